@@ -0,0 +1,101 @@
+package adapters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"sip_and_rip/ports"
+)
+
+// ControlServer - a json over http api for the calls in progress. It has no authentication of its own, so keep it on an address only
+// trusted clients can reach, ie localhost
+//
+//	GET  /conferences                          the rooms with someone in them, and who
+//	POST /conferences/{room}/{id}/mute         stops the rest of the room hearing the participant
+//	POST /conferences/{room}/{id}/unmute       lets them be heard again
+//	POST /conferences/{room}/{id}/kick         hangs up on them
+type ControlServer struct {
+	addr    string
+	server  *http.Server
+	control ports.Control
+}
+
+// NewControlServer - creates a control server that listens on the given address
+func NewControlServer(addr string, control ports.Control) *ControlServer {
+	return &ControlServer{
+		addr:    addr,
+		control: control,
+	}
+}
+
+// Serve - starts the control server
+func (s *ControlServer) Serve() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conferences", s.conferences)
+	mux.HandleFunc("/conferences/", s.participant)
+	s.server = &http.Server{Addr: s.addr, Handler: mux}
+
+	err := s.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// conferences - lists the rooms
+func (s *ControlServer) conferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, s.control.Conferences())
+}
+
+// participant - mutes, unmutes or kicks one of a room's participants
+func (s *ControlServer) participant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/conferences/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	room, id, action := parts[0], parts[1], parts[2]
+
+	var err error
+	switch action {
+	case "mute":
+		err = s.control.MuteParticipant(room, id, true)
+	case "unmute":
+		err = s.control.MuteParticipant(room, id, false)
+	case "kick":
+		err = s.control.KickParticipant(room, id)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case errors.Is(err, ports.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println("error writing the control api's response: ", err)
+	}
+}
@@ -0,0 +1,180 @@
+package adapters
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+
+	"sip_and_rip/ports"
+)
+
+// the label srtp's keys are exported from the handshake with (rfc 5764 4.2)
+const dtlsSrtpLabel = "EXTRACTOR-dtls_srtp"
+
+// the hash functions a fingerprint can use (rfc 8122 5)
+var fingerprintHashes = map[string]func() hash.Hash{
+	"sha-1":   sha1.New,
+	"sha-224": sha256.New224,
+	"sha-256": sha256.New,
+	"sha-384": sha512.New384,
+	"sha-512": sha512.New,
+}
+
+// the srtp profiles we offer in the handshake, in the order we prefer them, and the suites they key
+var dtlsSrtpProfiles = []dtls.SRTPProtectionProfile{dtls.SRTP_AEAD_AES_128_GCM, dtls.SRTP_AES128_CM_HMAC_SHA1_80}
+var dtlsSrtpSuites = map[dtls.SRTPProtectionProfile]string{
+	dtls.SRTP_AEAD_AES_128_GCM:       ports.SrtpAeadAes128Gcm,
+	dtls.SRTP_AES128_CM_HMAC_SHA1_80: ports.SrtpAesCm128HmacSha1_80,
+}
+
+// WebRtcCertificate - the certificate we shake hands with. Browsers only check it against the fingerprint in our sdp, so a self signed
+// one made when we start up is all it takes
+type WebRtcCertificate struct {
+	cert        tls.Certificate
+	hash        string
+	fingerprint string
+}
+
+// NewWebRtcCertificate - makes a self signed certificate and its sha-256 fingerprint
+func NewWebRtcCertificate() (*WebRtcCertificate, error) {
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		return nil, fmt.Errorf("error generating dtls certificate: %v", err)
+	}
+
+	fingerprint, err := certificateFingerprint("sha-256", cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebRtcCertificate{
+		cert:        cert,
+		hash:        "sha-256",
+		fingerprint: fingerprint,
+	}, nil
+}
+
+// certificateFingerprint - the hash of a der certificate as it goes in a=fingerprint, ie 4A:AD:B9:...
+func certificateFingerprint(hashName string, der []byte) (string, error) {
+	newHash, ok := fingerprintHashes[hashName]
+	if !ok {
+		return "", fmt.Errorf("unsupported fingerprint hash: %s", hashName)
+	}
+
+	h := newHash()
+	h.Write(der)
+
+	var parts []string
+	for _, b := range h.Sum(nil) {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+
+	return strings.Join(parts, ":"), nil
+}
+
+// handshake - runs the dtls handshake and keys srtp with it (rfc 5763). Both sides' certificates are self signed, so the browser's is
+// only trusted when it matches the fingerprint in their offer
+func (t *WebRtcTransport) handshake(ctx context.Context) {
+	defer close(t.handshakeDone)
+
+	config := &dtls.Config{
+		Certificates:           []tls.Certificate{t.cert.cert},
+		ExtendedMasterSecret:   dtls.RequireExtendedMasterSecret,
+		SRTPProtectionProfiles: dtlsSrtpProfiles,
+		ClientAuth:             dtls.RequireAnyClientCert,
+		// there is no chain to check a self signed certificate against, the fingerprint is what we trust
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: t.verifyFingerprint,
+	}
+
+	var conn *dtls.Conn
+	var err error
+	if t.local.Setup == "active" {
+		// we start the handshake, once the browser has found us and we know where to send it
+		select {
+		case <-t.found:
+		case <-ctx.Done():
+			fmt.Println("WebRtcTransport: browser never found us")
+			return
+		}
+		conn, err = dtls.ClientWithContext(ctx, dtlsConn{t.dtlsMux}, config)
+	} else {
+		conn, err = dtls.ServerWithContext(ctx, dtlsConn{t.dtlsMux}, config)
+	}
+	if err != nil {
+		fmt.Printf("WebRtcTransport: dtls handshake failed: %v\n", err)
+		return
+	}
+
+	session, suite, err := t.srtpSession(conn)
+	if err != nil {
+		fmt.Printf("WebRtcTransport: %v\n", err)
+		conn.Close()
+		return
+	}
+
+	t.Lock()
+	t.dtls = conn
+	t.srtp = session
+	t.Unlock()
+
+	fmt.Printf("WebRtcTransport: dtls handshake done, media is srtp with %s\n", suite)
+}
+
+// verifyFingerprint - checks the browser's certificate is the one their offer said it would be
+func (t *WebRtcTransport) verifyFingerprint(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("browser sent no certificate")
+	}
+
+	fingerprint, err := certificateFingerprint(t.remote.FingerprintHash, rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(fingerprint, t.remote.Fingerprint) {
+		return fmt.Errorf("browser's certificate doesn't match the fingerprint in its offer")
+	}
+
+	return nil
+}
+
+// srtpSession - the srtp keys the handshake agreed on (rfc 5764 4.2). The exported material is the client's key, the server's key,
+// the client's salt and then the server's salt, and each side sends with its own
+func (t *WebRtcTransport) srtpSession(conn *dtls.Conn) (*SrtpSession, string, error) {
+	profile, ok := conn.SelectedSRTPProtectionProfile()
+	if !ok {
+		return nil, "", fmt.Errorf("browser didn't agree to an srtp profile")
+	}
+	suite, ok := dtlsSrtpSuites[profile]
+	if !ok {
+		return nil, "", fmt.Errorf("browser picked srtp profile %d, which we didn't offer", profile)
+	}
+	s := srtpSuites[suite]
+
+	state := conn.ConnectionState()
+	material, err := state.ExportKeyingMaterial(dtlsSrtpLabel, nil, 2*(s.keyLen+s.saltLen))
+	if err != nil {
+		return nil, "", fmt.Errorf("error exporting srtp keys: %v", err)
+	}
+
+	keys, salts := material[:2*s.keyLen], material[2*s.keyLen:]
+	clientKey := append(append([]byte{}, keys[:s.keyLen]...), salts[:s.saltLen]...)
+	serverKey := append(append([]byte{}, keys[s.keyLen:]...), salts[s.saltLen:]...)
+
+	localKey, remoteKey := serverKey, clientKey
+	if t.local.Setup == "active" {
+		localKey, remoteKey = clientKey, serverKey
+	}
+
+	session, err := NewSrtpSession(suite, localKey, remoteKey)
+	return session, suite, err
+}
@@ -0,0 +1,200 @@
+package adapters
+
+import (
+	"fmt"
+
+	"sip_and_rip/ports"
+)
+
+// PCMU and PCMA have static payload types, see https://www.iana.org/assignments/rtp-parameters
+const (
+	PcmuPayloadType = ports.PcmuPayloadType
+	PcmaPayloadType = ports.PcmaPayloadType
+)
+
+const (
+	// added to the magnitude before finding the segment so the smallest segment is not empty
+	ulawBias = 0x84
+	// the largest magnitude that can be encoded once the bias is added
+	ulawClip = 32635
+)
+
+// the upper bound of each a-law segment, in 13 bit magnitudes
+var alawSegmentEnds = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+
+// G711Codec - a g.711 codec, either u-law (PCMU) or a-law (PCMA). each 8 bit sample decodes to one 16 bit pcm sample
+type G711Codec struct {
+	name        string
+	payloadType uint8
+	encode      func(int16) byte
+	decode      func(byte) int16
+}
+
+// NewUlawCodec - creates a g.711 u-law (PCMU) codec, used mostly in north america and japan
+func NewUlawCodec() *G711Codec {
+	return &G711Codec{
+		name:        "PCMU",
+		payloadType: PcmuPayloadType,
+		encode:      LinearToUlaw,
+		decode:      UlawToLinear,
+	}
+}
+
+// NewAlawCodec - creates a g.711 a-law (PCMA) codec, used mostly in europe
+func NewAlawCodec() *G711Codec {
+	return &G711Codec{
+		name:        "PCMA",
+		payloadType: PcmaPayloadType,
+		encode:      LinearToAlaw,
+		decode:      AlawToLinear,
+	}
+}
+
+// NewCodec - returns the codec for an rtp payload type
+func NewCodec(payloadType uint8) (ports.Codec, error) {
+	switch payloadType {
+	case PcmuPayloadType:
+		return NewUlawCodec(), nil
+	case PcmaPayloadType:
+		return NewAlawCodec(), nil
+	default:
+		return nil, fmt.Errorf("unsupported payload type: %d", payloadType)
+	}
+}
+
+// Name - the rtpmap encoding name
+func (c *G711Codec) Name() string {
+	return c.name
+}
+
+// PayloadType - the static rtp payload type
+func (c *G711Codec) PayloadType() uint8 {
+	return c.payloadType
+}
+
+// SampleRateHz - g711 is always 8000hz
+func (*G711Codec) SampleRateHz() int {
+	return 8000
+}
+
+// ClockRateHz - g711 timestamps count its samples, so 8000hz too
+func (*G711Codec) ClockRateHz() int {
+	return 8000
+}
+
+// Encode - encodes 16 bit pcm samples, one byte per sample
+func (c *G711Codec) Encode(pcm []int16) []byte {
+	payload := make([]byte, len(pcm))
+	for i, sample := range pcm {
+		payload[i] = c.encode(sample)
+	}
+
+	return payload
+}
+
+// Decode - decodes a payload into 16 bit pcm samples, one sample per byte
+func (c *G711Codec) Decode(payload []byte) []int16 {
+	pcm := make([]int16, len(payload))
+	for i, b := range payload {
+		pcm[i] = c.decode(b)
+	}
+
+	return pcm
+}
+
+// UlawToLinear - expands a u-law byte into a 16 bit pcm sample
+func UlawToLinear(u byte) int16 {
+	// u-law bytes are stored inverted
+	u = ^u
+
+	t := (int16(u&0x0f) << 3) + ulawBias
+	t <<= (u & 0x70) >> 4
+
+	if u&0x80 != 0 {
+		return ulawBias - t
+	}
+
+	return t - ulawBias
+}
+
+// LinearToUlaw - compresses a 16 bit pcm sample into a u-law byte
+func LinearToUlaw(sample int16) byte {
+	s := int(sample)
+
+	sign := 0
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > ulawClip {
+		s = ulawClip
+	}
+	s += ulawBias
+
+	// the exponent is the position of the highest set bit above the mantissa
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> (exponent + 3)) & 0x0f
+
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// AlawToLinear - expands an a-law byte into a 16 bit pcm sample
+func AlawToLinear(a byte) int16 {
+	// even bits are inverted on the wire
+	a ^= 0x55
+
+	t := int(a&0x0f) << 4
+	segment := int(a&0x70) >> 4
+	switch segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= segment - 1
+	}
+
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+
+	return int16(-t)
+}
+
+// LinearToAlaw - compresses a 16 bit pcm sample into an a-law byte
+func LinearToAlaw(sample int16) byte {
+	// a-law works on 13 bit samples
+	s := int(sample) >> 3
+
+	mask := 0xD5
+	if s < 0 {
+		mask = 0x55
+		s = -s - 1
+	}
+
+	segment := len(alawSegmentEnds)
+	for i, end := range alawSegmentEnds {
+		if s <= end {
+			segment = i
+			break
+		}
+	}
+
+	// out of range, clip to the largest value
+	if segment >= len(alawSegmentEnds) {
+		return byte(0x7F ^ mask)
+	}
+
+	a := segment << 4
+	if segment < 2 {
+		a |= (s >> 1) & 0x0f
+	} else {
+		a |= (s >> segment) & 0x0f
+	}
+
+	return byte(a ^ mask)
+}
@@ -0,0 +1,90 @@
+package adapters
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/stun"
+)
+
+// handleStun - answers a connectivity check (rfc 8445 7.3). The check has to be addressed to us and signed with our password, which
+// proves it comes from whoever got our answer. An address that passes can send us dtls and media, and a check with USE-CANDIDATE
+// nominates it as where ours goes
+func (t *WebRtcTransport) handleStun(pkt []byte, addr *net.UDPAddr) {
+	msg := &stun.Message{Raw: pkt}
+	if err := msg.Decode(); err != nil {
+		fmt.Printf("WebRtcTransport: bad stun message from %s: %v\n", addr, err)
+		return
+	}
+
+	// a lite agent never sends checks, so there are no responses to wait for, and indications are only keep alives
+	if msg.Type != stun.BindingRequest {
+		return
+	}
+
+	// the username is our ufrag and then theirs
+	var username stun.Username
+	if err := username.GetFrom(msg); err != nil || username.String() != t.local.IceUfrag+":"+t.remote.IceUfrag {
+		fmt.Printf("WebRtcTransport: ignoring connectivity check from %s for someone else\n", addr)
+		return
+	}
+	integrity := stun.NewShortTermIntegrity(t.local.IcePwd)
+	if err := integrity.Check(msg); err != nil {
+		fmt.Printf("WebRtcTransport: ignoring connectivity check from %s: %v\n", addr, err)
+		return
+	}
+	if err := stun.Fingerprint.Check(msg); err != nil {
+		fmt.Printf("WebRtcTransport: ignoring connectivity check from %s: %v\n", addr, err)
+		return
+	}
+
+	// the request sets the transaction id, and the mapped address tells the browser what its address looks like to us
+	response, err := stun.Build(msg, stun.BindingSuccess, &stun.XORMappedAddress{IP: addr.IP, Port: addr.Port}, integrity, stun.Fingerprint)
+	if err != nil {
+		fmt.Printf("WebRtcTransport: error building stun response: %v\n", err)
+		return
+	}
+	if _, err := t.conn.WriteToUDP(response.Raw, addr); err != nil {
+		fmt.Printf("WebRtcTransport: error sending stun response to %s: %v\n", addr, err)
+		return
+	}
+
+	t.validate(addr, msg.Contains(stun.AttrUseCandidate))
+}
+
+// validate - lets the address in, and picks it for our media when the browser nominates it. Until it nominates one, the first
+// address that works is as good as any
+func (t *WebRtcTransport) validate(addr *net.UDPAddr, nominate bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.validated[addr.String()] = true
+
+	switch {
+	case t.selected == nil:
+		close(t.found)
+	case !nominate || t.nominated && sameUDPAddr(t.selected, addr):
+		// only a nomination moves the media, and this one is where it already is
+		return
+	}
+	t.selected = addr
+	t.nominated = nominate
+
+	if nominate {
+		fmt.Printf("WebRtcTransport: browser nominated %s\n", addr)
+	} else {
+		fmt.Printf("WebRtcTransport: browser found us from %s\n", addr)
+	}
+}
+
+// isValidated - whether the address has passed a connectivity check
+func (t *WebRtcTransport) isValidated(addr *net.UDPAddr) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.validated[addr.String()]
+}
+
+func sameUDPAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,213 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+// mailbox names come from sip uris, so only allow characters that are safe in a path
+var validMailbox = regexp.MustCompile(`^[A-Za-z0-9_+-][A-Za-z0-9._+-]*$`)
+
+// the folders a mailbox keeps its messages in
+const (
+	newMessagesDir = "new"
+	oldMessagesDir = "old"
+)
+
+// FileMailboxStore - keeps each mailbox in its own directory, with a `new` and an `old` folder of recordings
+//
+//	<root>/<mailbox>/greeting.wav
+//	<root>/<mailbox>/new/<id>.wav + <id>.json
+//	<root>/<mailbox>/old/<id>.wav + <id>.json
+type FileMailboxStore struct {
+	root string
+}
+
+// NewFileMailboxStore - creates a mailbox store rooted at the directory
+func NewFileMailboxStore(root string) (*FileMailboxStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FileMailboxStore{
+		root: root,
+	}, nil
+}
+
+// RecordingDir - the directory new messages are recorded to
+func (s *FileMailboxStore) RecordingDir(mailbox string) (string, error) {
+	dir, err := s.dir(mailbox, newMessagesDir)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// List - new messages first, then heard ones. oldest first within each
+func (s *FileMailboxStore) List(mailbox string) ([]ports.VoicemailMessage, error) {
+	newMessages, err := s.list(mailbox, newMessagesDir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	oldMessages, err := s.list(mailbox, oldMessagesDir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(newMessages, oldMessages...), nil
+}
+
+// MarkHeard - moves the message to the old folder
+func (s *FileMailboxStore) MarkHeard(mailbox string, id string) error {
+	newDir, err := s.dir(mailbox, newMessagesDir)
+	if err != nil {
+		return err
+	}
+
+	oldDir, err := s.dir(mailbox, oldMessagesDir)
+	if err != nil {
+		return err
+	}
+
+	if err := validateMessageID(id); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(newDir, id+".wav")); os.IsNotExist(err) {
+		// already heard
+		return nil
+	}
+
+	if err := os.MkdirAll(oldDir, 0o755); err != nil {
+		return err
+	}
+
+	for _, ext := range []string{".wav", ".json"} {
+		if err := os.Rename(filepath.Join(newDir, id+ext), filepath.Join(oldDir, id+ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete - removes the message from whichever folder it is in
+func (s *FileMailboxStore) Delete(mailbox string, id string) error {
+	if err := validateMessageID(id); err != nil {
+		return err
+	}
+
+	for _, folder := range []string{newMessagesDir, oldMessagesDir} {
+		dir, err := s.dir(mailbox, folder)
+		if err != nil {
+			return err
+		}
+
+		for _, ext := range []string{".wav", ".json"} {
+			if err := os.Remove(filepath.Join(dir, id+ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Greeting - the mailbox's greeting.wav, if it has one
+func (s *FileMailboxStore) Greeting(mailbox string) string {
+	dir, err := s.dir(mailbox)
+	if err != nil {
+		return ""
+	}
+
+	greeting := filepath.Join(dir, "greeting.wav")
+	if _, err := os.Stat(greeting); err != nil {
+		return ""
+	}
+
+	return greeting
+}
+
+func (s *FileMailboxStore) list(mailbox string, folder string, heard bool) ([]ports.VoicemailMessage, error) {
+	dir, err := s.dir(mailbox, folder)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var messages []ports.VoicemailMessage
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".wav") {
+			continue
+		}
+
+		id := strings.TrimSuffix(e.Name(), ".wav")
+		msg := ports.VoicemailMessage{
+			ID:      id,
+			Heard:   heard,
+			WavFile: filepath.Join(dir, e.Name()),
+		}
+
+		// the recording's sidecar has who left the message and when
+		var sidecar struct {
+			Caller    string    `json:"caller"`
+			StartedAt time.Time `json:"startedAt"`
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, id+".json")); err == nil {
+			if err := json.Unmarshal(b, &sidecar); err != nil {
+				fmt.Printf("FileMailboxStore: bad sidecar for message %s: %v\n", id, err)
+			}
+		}
+		msg.Caller = sidecar.Caller
+		msg.ReceivedAt = sidecar.StartedAt
+		if msg.ReceivedAt.IsZero() {
+			if info, err := e.Info(); err == nil {
+				msg.ReceivedAt = info.ModTime()
+			}
+		}
+
+		messages = append(messages, msg)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ReceivedAt.Before(messages[j].ReceivedAt)
+	})
+
+	return messages, nil
+}
+
+func (s *FileMailboxStore) dir(mailbox string, elem ...string) (string, error) {
+	if !validMailbox.MatchString(mailbox) {
+		return "", fmt.Errorf("invalid mailbox name: %q", mailbox)
+	}
+
+	return filepath.Join(append([]string{s.root, mailbox}, elem...)...), nil
+}
+
+func validateMessageID(id string) error {
+	if !validMailbox.MatchString(id) {
+		return fmt.Errorf("invalid message id: %q", id)
+	}
+
+	return nil
+}
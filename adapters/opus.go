@@ -0,0 +1,106 @@
+//go:build cgo
+
+package adapters
+
+import (
+	"fmt"
+	"sync"
+
+	"layeh.com/gopus"
+
+	"sip_and_rip/ports"
+)
+
+const (
+	// we encode and decode opus at the rate everything else of ours runs at, and leave the resampling to libopus
+	opusSampleRateHz = 8000
+	// the longest an opus packet can play for, 120ms (rfc 6716 3.2.5)
+	opusMaxFrameSamples = opusSampleRateHz * 120 / 1000
+	// room for the largest packet we would make from one of our frames
+	opusMaxPacketBytes = 1275
+)
+
+// OpusSupported - whether we can offer and accept opus, which needs libopus through cgo
+const OpusSupported = true
+
+// OpusCodec - an opus codec (rfc 6716) in mono, for browsers that would rather not use g711. The rtpmap always says 48000hz and two
+// channels (rfc 7587 7), but libopus decodes to whatever rate and channels we ask for
+type OpusCodec struct {
+	sync.Mutex
+	payloadType uint8
+	encoder     *gopus.Encoder
+	decoder     *gopus.Decoder
+}
+
+// NewOpusCodec - creates an opus codec for the dynamic payload type the call negotiated
+func NewOpusCodec(payloadType uint8) (ports.Codec, error) {
+	encoder, err := gopus.NewEncoder(opusSampleRateHz, 1, gopus.Voip)
+	if err != nil {
+		return nil, fmt.Errorf("error creating opus encoder: %v", err)
+	}
+	decoder, err := gopus.NewDecoder(opusSampleRateHz, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error creating opus decoder: %v", err)
+	}
+
+	return &OpusCodec{
+		payloadType: payloadType,
+		encoder:     encoder,
+		decoder:     decoder,
+	}, nil
+}
+
+// Name - the rtpmap encoding name
+func (*OpusCodec) Name() string {
+	return "opus"
+}
+
+// PayloadType - the dynamic payload type from the sdp
+func (c *OpusCodec) PayloadType() uint8 {
+	return c.payloadType
+}
+
+// SampleRateHz - the rate we encode and decode at
+func (*OpusCodec) SampleRateHz() int {
+	return opusSampleRateHz
+}
+
+// ClockRateHz - opus timestamps count at 48000hz whatever the sample rate
+func (*OpusCodec) ClockRateHz() int {
+	return ports.OpusClockRateHz
+}
+
+// Encode - encodes a frame of pcm samples into one opus packet. Opus only takes frames of 2.5, 5, 10, 20, 40 or 60ms, so anything
+// else encodes to nothing
+func (c *OpusCodec) Encode(pcm []int16) []byte {
+	if len(pcm) == 0 {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	payload, err := c.encoder.Encode(pcm, len(pcm), opusMaxPacketBytes)
+	if err != nil {
+		return nil
+	}
+
+	return payload
+}
+
+// Decode - decodes an opus packet into pcm samples, nothing if it is corrupt
+func (c *OpusCodec) Decode(payload []byte) []int16 {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	pcm, err := c.decoder.Decode(payload, opusMaxFrameSamples, false)
+	if err != nil {
+		return nil
+	}
+
+	return pcm
+}
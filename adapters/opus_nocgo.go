@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package adapters
+
+import (
+	"fmt"
+
+	"sip_and_rip/ports"
+)
+
+// OpusSupported - whether we can offer and accept opus, which needs libopus through cgo
+const OpusSupported = false
+
+// NewOpusCodec - opus needs libopus, so without cgo there is none and calls stick to g711
+func NewOpusCodec(payloadType uint8) (ports.Codec, error) {
+	return nil, fmt.Errorf("unsupported payload type: %d, opus needs cgo", payloadType)
+}
@@ -0,0 +1,48 @@
+//go:build cgo
+
+package adapters
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOpusRoundTrip(t *testing.T) {
+	codec, err := NewOpusCodec(111)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second of a 400hz tone in 20ms frames. Opus takes a few frames to settle, so only the last one is checked
+	var frame, decoded []int16
+	for n := 0; n < 50; n++ {
+		frame = make([]int16, 160)
+		for i := range frame {
+			frame[i] = int16(8000 * math.Sin(2*math.Pi*400*float64(n*160+i)/8000))
+		}
+
+		payload := codec.Encode(frame)
+		if len(payload) == 0 || len(payload) > 160 {
+			t.Fatalf("frame %d encoded to %d bytes", n, len(payload))
+		}
+		if decoded = codec.Decode(payload); len(decoded) != len(frame) {
+			t.Fatalf("frame %d decoded to %d samples, want %d", n, len(decoded), len(frame))
+		}
+	}
+
+	if power := meanPower(decoded); power < meanPower(frame)/4 {
+		t.Errorf("decoded power %.0f, sent %.0f", power, meanPower(frame))
+	}
+	if codec.ClockRateHz() != 48000 || codec.SampleRateHz() != 8000 {
+		t.Errorf("got clock %d and rate %d, want 48000 and 8000", codec.ClockRateHz(), codec.SampleRateHz())
+	}
+}
+
+func meanPower(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+
+	return sum / float64(len(pcm))
+}
@@ -0,0 +1,94 @@
+package adapters
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PortAllocator - hands out rtp/rtcp socket pairs from a range of ports. RTP gets an even port and RTCP the odd port above it (rfc 3550)
+type PortAllocator struct {
+	sync.Mutex
+	ip net.IP
+	// even ports that are ready to be handed out. released ports go to the back so they rest before being reused, which keeps late packets from an old call out of a new one
+	free []int
+	// ports that are handed out
+	inUse map[int]bool
+}
+
+// NewPortAllocator - creates an allocator for the ports between min and max, bound to the ip
+func NewPortAllocator(ip net.IP, min int, max int) (*PortAllocator, error) {
+	if min <= 0 || max > 65535 || min >= max {
+		return nil, fmt.Errorf("invalid rtp port range %d-%d", min, max)
+	}
+
+	// rtp always starts on an even port
+	if min%2 != 0 {
+		min++
+	}
+
+	a := &PortAllocator{
+		ip:    ip,
+		inUse: make(map[int]bool),
+	}
+
+	// leave room for the rtcp port above the last rtp port
+	for port := min; port+1 <= max; port += 2 {
+		a.free = append(a.free, port)
+	}
+
+	if len(a.free) == 0 {
+		return nil, fmt.Errorf("rtp port range %d-%d has no room for an rtp/rtcp pair", min, max)
+	}
+
+	return a, nil
+}
+
+// Allocate - binds an rtp socket on the next free even port and an rtcp socket on the port above it
+func (a *PortAllocator) Allocate() (*net.UDPConn, *net.UDPConn, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	// ports can be taken by other programs, so try each free port at most once
+	for tries := len(a.free); tries > 0; tries-- {
+		port := a.free[0]
+		a.free = a.free[1:]
+
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: a.ip, Port: port})
+		if err != nil {
+			a.free = append(a.free, port)
+			continue
+		}
+
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: a.ip, Port: port + 1})
+		if err != nil {
+			rtpConn.Close()
+			a.free = append(a.free, port)
+			continue
+		}
+
+		a.inUse[port] = true
+
+		return rtpConn, rtcpConn, nil
+	}
+
+	return nil, nil, fmt.Errorf("no rtp ports available")
+}
+
+// Release - returns the pair to the pool. The sockets must already be closed
+func (a *PortAllocator) Release(port int) {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.inUse[port] {
+		return
+	}
+
+	delete(a.inUse, port)
+	a.free = append(a.free, port)
+}
+
+// IP - the address the sockets are bound to
+func (a *PortAllocator) IP() net.IP {
+	return a.ip
+}
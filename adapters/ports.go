@@ -0,0 +1,20 @@
+package adapters
+
+import "sip_and_rip/ports"
+
+// the adapters the domain is wired up with, checked against the ports they implement
+var (
+	_ ports.SipMessage      = (*SipMsg)(nil)
+	_ ports.SdpMessage      = (*SdpMsg)(nil)
+	_ ports.RtpClient       = (*RtpClient)(nil)
+	_ ports.RtpReceiver     = (*RtpReceiver)(nil)
+	_ ports.PortAllocator   = (*PortAllocator)(nil)
+	_ ports.MailboxStore    = (*FileMailboxStore)(nil)
+	_ ports.Codec           = (*G711Codec)(nil)
+	_ ports.MediaReadCloser = (*WavReader)(nil)
+	_ ports.MediaReadCloser = (*PromptReader)(nil)
+	_ ports.MediaReader     = (*ToneReader)(nil)
+	_ ports.MediaWriter     = (*WavWriter)(nil)
+	_ ports.PublicServer    = (*UDPServer)(nil)
+	_ ports.SipSender       = (*UDPServer)(nil)
+)
@@ -0,0 +1,257 @@
+package adapters
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"sip_and_rip/ports"
+)
+
+// the slice header each cached frame costs on top of its bytes
+const promptFrameOverhead = 24
+
+// hits, misses, evictions and the bytes cached, served with the rest of the metrics
+var promptCacheMetrics = expvar.NewMap("promptCache")
+
+// promptKey - a file as frames of one codec and size, since calls that negotiated differently need it cut differently
+type promptKey struct {
+	path      string
+	codec     string
+	frameSize int
+}
+
+// prompt - a file's frames, ready to send. They are shared by every call playing it, so nothing may write to them
+type prompt struct {
+	key    promptKey
+	frames [][]byte
+	size   int64
+}
+
+// promptLoad - a file being read in, which every call that wants it meanwhile waits for rather than opening it too
+type promptLoad struct {
+	done   chan struct{}
+	prompt *prompt
+	err    error
+	// set when the file changes while it is being read, so what was read isn't cached
+	stale bool
+}
+
+// PromptCache - wav files loaded and transcoded once into ready to send frames, and shared by every call that plays them, so a burst
+// of calls doesn't mean a file handle and a read per frame for each. The least recently played are evicted to stay under its size,
+// and a file is dropped as soon as it changes on disk
+type PromptCache struct {
+	sync.Mutex
+	maxBytes int64
+	size     int64
+	// the prompts by key, in an lru list with the most recently played at the front
+	entries map[promptKey]*list.Element
+	lru     *list.List
+	loading map[promptKey]*promptLoad
+	// nil when the directories can't be watched, in which case files are cached until they are evicted
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+}
+
+// NewPromptCache - creates a cache that holds up to maxBytes of frames
+func NewPromptCache(maxBytes int64) *PromptCache {
+	c := &PromptCache{
+		maxBytes: maxBytes,
+		entries:  make(map[promptKey]*list.Element),
+		lru:      list.New(),
+		loading:  make(map[promptKey]*promptLoad),
+		watched:  make(map[string]bool),
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Printf("PromptCache: not watching for changes, files stay cached until they are evicted: %v\n", err)
+	} else {
+		c.watcher = watcher
+		go c.watch()
+	}
+
+	return c
+}
+
+// Open - a reader of the file's frames in the codec, from the cache or loaded into it
+func (c *PromptCache) Open(filename string, codec ports.Codec, opts *ports.MediaOptions) (ports.MediaReadCloser, error) {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := promptKey{path: path, codec: codec.Name(), frameSize: opts.GetSampleSize()}
+
+	c.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.Unlock()
+		promptCacheMetrics.Add("hits", 1)
+		return &PromptReader{frames: elem.Value.(*prompt).frames}, nil
+	}
+
+	load, loading := c.loading[key]
+	if !loading {
+		load = &promptLoad{done: make(chan struct{})}
+		c.loading[key] = load
+		c.watchDir(path)
+	}
+	c.Unlock()
+
+	if loading {
+		<-load.done
+	} else {
+		promptCacheMetrics.Add("misses", 1)
+		load.prompt, load.err = loadPrompt(key, filename, codec, opts)
+		c.store(key, load)
+		close(load.done)
+	}
+	if load.err != nil {
+		return nil, load.err
+	}
+
+	return &PromptReader{frames: load.prompt.frames}, nil
+}
+
+// Close - stops watching for changes
+func (c *PromptCache) Close() error {
+	if c.watcher != nil {
+		return c.watcher.Close()
+	}
+
+	return nil
+}
+
+// loadPrompt - reads every frame of the file
+func loadPrompt(key promptKey, filename string, codec ports.Codec, opts *ports.MediaOptions) (*prompt, error) {
+	reader, err := NewWavReaderForCodec(filename, codec, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	p := &prompt{key: key}
+	for {
+		frame, err := reader.NextRtpFrame()
+		if err == io.EOF {
+			return p, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", filename, err)
+		}
+
+		p.frames = append(p.frames, frame)
+		p.size += int64(len(frame)) + promptFrameOverhead
+	}
+}
+
+// store - caches a load that worked, unless the file changed while it was being read or is too big to ever fit
+func (c *PromptCache) store(key promptKey, load *promptLoad) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.loading, key)
+	if load.err != nil || load.stale || load.prompt.size > c.maxBytes {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(load.prompt)
+	c.size += load.prompt.size
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+		promptCacheMetrics.Add("evictions", 1)
+	}
+	promptCacheMetrics.Set("bytes", expvarInt(c.size))
+}
+
+// remove - the lock must be held
+func (c *PromptCache) remove(elem *list.Element) {
+	p := c.lru.Remove(elem).(*prompt)
+	delete(c.entries, p.key)
+	c.size -= p.size
+}
+
+// watchDir - starts watching the file's directory for changes, if we aren't already. The lock must be held
+func (c *PromptCache) watchDir(path string) {
+	dir := filepath.Dir(path)
+	if c.watcher == nil || c.watched[dir] {
+		return
+	}
+
+	if err := c.watcher.Add(dir); err != nil {
+		fmt.Printf("PromptCache: not watching %s for changes: %v\n", dir, err)
+		return
+	}
+	c.watched[dir] = true
+}
+
+// watch - drops files from the cache as they change, until the watcher is closed
+func (c *PromptCache) watch() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				c.invalidate(event.Name)
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("PromptCache: error watching for changes: %v\n", err)
+		}
+	}
+}
+
+// invalidate - drops every cut of the file, so the next call to play it reads it again
+func (c *PromptCache) invalidate(path string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for key, load := range c.loading {
+		if key.path == path {
+			load.stale = true
+		}
+	}
+	for key, elem := range c.entries {
+		if key.path == path {
+			c.remove(elem)
+		}
+	}
+	promptCacheMetrics.Set("bytes", expvarInt(c.size))
+}
+
+// PromptReader - plays a cached file's frames. The frames are shared, so they must not be written to
+type PromptReader struct {
+	frames [][]byte
+	pos    int
+}
+
+// NextRtpFrame - the next frame of the file
+func (r *PromptReader) NextRtpFrame() ([]byte, error) {
+	if r.pos >= len(r.frames) {
+		return nil, io.EOF
+	}
+
+	frame := r.frames[r.pos]
+	r.pos++
+
+	return frame, nil
+}
+
+// Close - there is nothing to close, the frames stay in the cache
+func (r *PromptReader) Close() error {
+	return nil
+}
+
+func expvarInt(v int64) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(v)
+	return i
+}
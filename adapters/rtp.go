@@ -1,7 +1,10 @@
 package adapters
 
 import (
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/pion/rtp"
 
@@ -9,12 +12,14 @@ import (
 )
 
 // TODO this is hardcoded to PCMU (ulaw). You can go see what the different payload types are in `pion/rtp`
-var UlawPayloadType = uint8(0)
+var UlawPayloadType = ports.PcmuPayloadType
 
 // RtpClient - represents an rtp client
 type RtpClient struct {
+	// guards rtpAddr, which moves when we latch on to where the client's media really comes from, and the counters rtcp reads
+	sync.Mutex
 	rtpAddr *net.UDPAddr
-	conn    *net.UDPConn
+	conn    ports.MediaConn
 	// the sequence number is used to identify the order of packets
 	seq uint16
 	// used for ordering rtp packets
@@ -22,10 +27,26 @@ type RtpClient struct {
 	// helps identify the source of the RTP stream
 	ssrc uint32
 	opts *ports.MediaOptions
+	// encrypts the stream when the call negotiated srtp, nil for plain rtp
+	srtp ports.SrtpSession
+	// for rtcp sender reports
+	packetCount uint32
+	octetCount  uint32
+	// the timestamp of the latest frame and when it went out, or the first timestamp and when the stream started if none has yet
+	lastTimestamp   uint32
+	lastTimestampAt time.Time
+	// set while we are sending comfort noise in place of the audio
+	silent bool
+	// what Write sends the audio as
+	payloadType uint8
 }
 
-// NewRtpClient - creates a new rtp client. The `ssrc` is found in the sdp request. The `opts` lets us know what kind of media we have agreed to send (negotiated through sdp). The `rtpAddr` is also found in the sdp request.
-func NewRtpClient(rtpAddr *net.UDPAddr, ssrc uint32, opts *ports.MediaOptions) (*RtpClient, error) {
+// NewRtpClient - creates a new rtp client. The `conn` is our local rtp socket, the same one we receive the client's media on so symmetric rtp works. The `ssrc` identifies our stream, a random one is picked when it is 0. The `opts` lets us know what kind of media we have agreed to send (negotiated through sdp). The `rtpAddr` is also found in the sdp request.
+func NewRtpClient(conn ports.MediaConn, rtpAddr *net.UDPAddr, ssrc uint32, opts *ports.MediaOptions) (*RtpClient, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("rtp client needs a local socket")
+	}
+
 	// use a random timestamp offset to avoid collisions
 	timestampOffset := RandUint32()
 	seq := RandUint16()
@@ -33,34 +54,88 @@ func NewRtpClient(rtpAddr *net.UDPAddr, ssrc uint32, opts *ports.MediaOptions) (
 		ssrc = RandUint32()
 	}
 
-	// Create a UDP connection to the client
-	conn, err := net.DialUDP("udp", nil, rtpAddr)
-	if err != nil {
-		return nil, err
-	}
-
 	return &RtpClient{
-		rtpAddr:   rtpAddr,
-		seq:       seq,
-		timestamp: timestampOffset,
-		ssrc:      ssrc,
-		opts:      opts,
-		conn:      conn,
+		rtpAddr:         rtpAddr,
+		seq:             seq,
+		timestamp:       timestampOffset,
+		ssrc:            ssrc,
+		opts:            opts,
+		conn:            conn,
+		lastTimestamp:   timestampOffset,
+		lastTimestampAt: time.Now(),
+		payloadType:     UlawPayloadType,
 	}, nil
 }
 
-// Close - closes the rtp client
+// Close - closes the rtp client. The socket is shared with the receiver, so it is left for whoever allocated it to close
 func (r *RtpClient) Close() error {
-	if r.conn != nil {
-		return r.conn.Close()
-	}
-
 	return nil
 }
 
 // Write - writes the rtp payload to the rtp client
 func (r *RtpClient) Write(rtpPayload []byte) (int, error) {
-	packet := r.newPacket(rtpPayload)
+	r.Lock()
+	payloadType := r.payloadType
+	r.Unlock()
+
+	return r.write(payloadType, rtpPayload, false)
+}
+
+// SetPayloadType - the payload type of the audio Write sends, for when the far end picked something other than u-law
+func (r *RtpClient) SetPayloadType(payloadType uint8) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.payloadType = payloadType
+}
+
+// WriteComfortNoise - sends a comfort noise packet in the place of a frame. Its payload is just the noise level, we leave out the
+// spectral information, which the client is free to make up (rfc 3389 3)
+func (r *RtpClient) WriteComfortNoise(payloadType uint8, level uint8) (int, error) {
+	return r.write(payloadType, []byte{level & 0x7f}, true)
+}
+
+// WritePacket - sends the packet with its sequence number, timestamp and payload as they are. The ssrc is swapped for ours, since
+// clients drop packets that come back with their own as a loop (rfc 3550 8.2)
+func (r *RtpClient) WritePacket(pkt *rtp.Packet) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	packet := *pkt
+	packet.SSRC = r.ssrc
+
+	data, err := packet.Marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	if r.srtp != nil {
+		if data, err = r.srtp.EncryptRtp(data); err != nil {
+			return 0, fmt.Errorf("error encrypting rtp: %v", err)
+		}
+	}
+
+	n, err := r.conn.WriteToUDP(data, r.rtpAddr)
+	if err != nil {
+		return n, err
+	}
+
+	// our sender reports describe the stream that went out, which has their timestamps now
+	r.packetCount++
+	r.octetCount += uint32(len(pkt.Payload))
+	r.lastTimestamp = pkt.Timestamp
+	r.lastTimestampAt = time.Now()
+
+	return n, nil
+}
+
+func (r *RtpClient) write(payloadType uint8, rtpPayload []byte, silence bool) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	packet := r.newPacket(payloadType, rtpPayload)
+	// the first packet after a silence we didn't send starts a talkspurt (rfc 3551 4.1)
+	packet.Marker = r.silent && !silence
 
 	// Serialize the RTP packet into a byte slice
 	data, err := packet.Marshal()
@@ -68,29 +143,86 @@ func (r *RtpClient) Write(rtpPayload []byte) (int, error) {
 		return 0, err
 	}
 
+	if r.srtp != nil {
+		if data, err = r.srtp.EncryptRtp(data); err != nil {
+			return 0, fmt.Errorf("error encrypting rtp: %v", err)
+		}
+	}
+
 	// Send the RTP packet over UDP
-	n, err := r.conn.Write(data)
+	n, err := r.conn.WriteToUDP(data, r.rtpAddr)
 	if err != nil {
 		return n, err
 	}
 
+	r.packetCount++
+	r.octetCount += uint32(len(rtpPayload))
 	r.seq++
-	r.timestamp += uint32(r.opts.GetSampleSize())
+	r.silent = silence
+	r.advance()
 
 	return n, nil
 }
 
+// SetSrtp - encrypts the rest of the stream with the session
+func (r *RtpClient) SetSrtp(session ports.SrtpSession) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.srtp = session
+}
+
+// Skip - advances the timestamp by a frame without sending it. The sequence number stays put, so the client sees a gap in time rather than a lost packet
+func (r *RtpClient) Skip() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.advance()
+}
+
+// Stats - what has been sent so far, for rtcp sender reports
+func (r *RtpClient) Stats() ports.RtpSenderStats {
+	r.Lock()
+	defer r.Unlock()
+
+	return ports.RtpSenderStats{
+		SSRC:        r.ssrc,
+		PacketCount: r.packetCount,
+		OctetCount:  r.octetCount,
+		Timestamp:   r.lastTimestamp,
+		TimestampAt: r.lastTimestampAt,
+		ClockRateHz: r.opts.GetClockTicks() * r.opts.GetFramesPerSecond(),
+	}
+}
+
+// advance - moves the timestamp on to the next frame, remembering when the current one went out. The lock must be held
+func (r *RtpClient) advance() {
+	r.lastTimestamp = r.timestamp
+	r.lastTimestampAt = time.Now()
+	r.timestamp += uint32(r.opts.GetClockTicks())
+}
+
+// SetRemoteAddr - sends the rest of the stream to a new address. Clients behind NAT put addresses we can't reach in their sdp, so
+// we send back to wherever their media comes from instead (symmetric rtp, rfc 4961)
+func (r *RtpClient) SetRemoteAddr(addr *net.UDPAddr) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.rtpAddr = addr
+}
+
 // GetBuffer - returns a buffer of the proper size for an rtp packet
 func (r *RtpClient) GetBuffer() []byte {
 	return make([]byte, r.opts.GetBufferSize())
 }
 
-func (r *RtpClient) newPacket(payload []byte) *rtp.Packet {
+// newPacket - the lock must be held
+func (r *RtpClient) newPacket(payloadType uint8, payload []byte) *rtp.Packet {
 	return &rtp.Packet{
 		Header: rtp.Header{
 			Version:        2,
 			SequenceNumber: r.seq,
-			PayloadType:    UlawPayloadType,
+			PayloadType:    payloadType,
 			Timestamp:      r.timestamp,
 			SSRC:           r.ssrc,
 		},
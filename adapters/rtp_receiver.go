@@ -0,0 +1,236 @@
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"sip_and_rip/ports"
+)
+
+// how many out of order packets we hold on to while waiting for a missing one
+const defaultReorderWindow = 8
+
+// a jump in sequence numbers larger than this means the sender restarted its stream
+const maxSequenceJump = 3000
+
+// RtpReceiver - listens for an inbound rtp stream and hands packets out in sequence number order
+type RtpReceiver struct {
+	sync.Mutex
+	conn   ports.MediaConn
+	lost   uint32
+	closed uint32
+	done   chan struct{}
+	// where the stream comes from and the ssrc it had when we latched on to it
+	remoteAddr *net.UDPAddr
+	remoteSsrc uint32
+	onLatch    ports.RtpLatchHandler
+	onArrival  ports.RtpPacketHandler
+	// decrypts the stream when the call negotiated srtp, nil for plain rtp
+	srtp ports.SrtpSession
+}
+
+// NewRtpReceiver - reads rtp from the socket. The socket is shared with the RtpClient, so closing the receiver leaves it open
+func NewRtpReceiver(conn ports.MediaConn) *RtpReceiver {
+	return &RtpReceiver{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+// LocalAddr - the address the receiver is bound to
+func (r *RtpReceiver) LocalAddr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Start - reads packets in a goroutine until the receiver is closed
+func (r *RtpReceiver) Start(handler ports.RtpPacketHandler) {
+	go r.read(handler)
+}
+
+// OnLatch - calls the handler when the first packet arrives and whenever the stream moves. Must be called before Start
+func (r *RtpReceiver) OnLatch(handler ports.RtpLatchHandler) {
+	r.onLatch = handler
+}
+
+// OnArrival - calls the handler with every packet as it arrives, before reordering. Must be called before Start
+func (r *RtpReceiver) OnArrival(handler ports.RtpPacketHandler) {
+	r.onArrival = handler
+}
+
+// SetSrtp - only takes packets that decrypt with the session. Must be called before Start
+func (r *RtpReceiver) SetSrtp(session ports.SrtpSession) {
+	r.srtp = session
+}
+
+// RemoteAddr - where the stream is coming from, nil until the first packet arrives
+func (r *RtpReceiver) RemoteAddr() *net.UDPAddr {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.remoteAddr
+}
+
+// Lost - the number of packets that never showed up
+func (r *RtpReceiver) Lost() uint32 {
+	return atomic.LoadUint32(&r.lost)
+}
+
+// Close - stops reading. Must only be called after Start
+func (r *RtpReceiver) Close() error {
+	if !atomic.CompareAndSwapUint32(&r.closed, 0, 1) {
+		return nil
+	}
+
+	// wake the reader up so it sees it is closed
+	err := r.conn.SetReadDeadline(time.Now())
+	<-r.done
+
+	return err
+}
+
+func (r *RtpReceiver) read(handler ports.RtpPacketHandler) {
+	defer close(r.done)
+
+	reorder := newReorderBuffer(defaultReorderWindow)
+	buf := make([]byte, 1500) // rtp packets fit in a single mtu
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if atomic.LoadUint32(&r.closed) == 1 || errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			fmt.Println("RtpReceiver: error reading packet: ", err)
+			continue
+		}
+
+		// Unmarshal keeps a reference to the payload, so give every packet its own copy
+		data := append([]byte{}, buf[:n]...)
+		if r.srtp != nil {
+			// decrypting before we latch means nobody without the key can steal the stream
+			if data, err = r.srtp.DecryptRtp(data); err != nil {
+				fmt.Printf("RtpReceiver: dropping srtp packet from %s: %v\n", addr, err)
+				continue
+			}
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(data); err != nil {
+			fmt.Printf("RtpReceiver: bad rtp packet from %s: %v\n", addr, err)
+			continue
+		}
+
+		if !r.latch(addr, pkt.SSRC) {
+			continue
+		}
+		if r.onArrival != nil {
+			r.onArrival(pkt)
+		}
+
+		for _, p := range reorder.push(pkt) {
+			handler(p)
+		}
+		atomic.StoreUint32(&r.lost, reorder.lost)
+	}
+}
+
+// latch - locks on to the address of the first packet. Anyone could send packets to our port, so the stream only moves to a new
+// address (ie a NAT rebinding) when the packets from it carry the same ssrc. Returns false for packets that aren't from the stream
+func (r *RtpReceiver) latch(addr *net.UDPAddr, ssrc uint32) bool {
+	r.Lock()
+	if r.remoteAddr != nil && r.remoteAddr.IP.Equal(addr.IP) && r.remoteAddr.Port == addr.Port {
+		r.Unlock()
+		return true
+	}
+	if r.remoteAddr != nil && ssrc != r.remoteSsrc {
+		r.Unlock()
+		return false
+	}
+
+	r.remoteAddr = addr
+	r.remoteSsrc = ssrc
+	r.Unlock()
+
+	fmt.Printf("RtpReceiver: latched on to rtp from %s\n", addr)
+	if r.onLatch != nil {
+		r.onLatch(addr)
+	}
+
+	return true
+}
+
+// reorderBuffer - holds packets that arrive early until the ones before them show up
+type reorderBuffer struct {
+	started bool
+	// the sequence number of the next packet to hand out
+	next    uint16
+	pending map[uint16]*rtp.Packet
+	window  int
+	lost    uint32
+}
+
+func newReorderBuffer(window int) *reorderBuffer {
+	return &reorderBuffer{
+		pending: make(map[uint16]*rtp.Packet),
+		window:  window,
+	}
+}
+
+// push - adds a packet and returns every packet that is now ready, in order
+func (b *reorderBuffer) push(pkt *rtp.Packet) []*rtp.Packet {
+	if !b.started {
+		b.started = true
+		b.next = pkt.SequenceNumber
+	}
+
+	// sequence numbers wrap around, so compare using the signed distance
+	diff := int16(pkt.SequenceNumber - b.next)
+	if diff < 0 && diff > -maxSequenceJump {
+		// a duplicate, or it showed up after we gave up on it
+		return nil
+	}
+	if diff < 0 || diff > maxSequenceJump {
+		// the sender restarted its sequence numbers, start over from this packet
+		b.pending = make(map[uint16]*rtp.Packet)
+		b.next = pkt.SequenceNumber
+	}
+
+	b.pending[pkt.SequenceNumber] = pkt
+
+	ready := b.drain()
+
+	// stop waiting on missing packets once too many have piled up behind them
+	for len(b.pending) > b.window {
+		// everything still pending is ahead of next, find the closest one
+		oldest, found := uint16(0), false
+		for seq := range b.pending {
+			if !found || seq-b.next < oldest-b.next {
+				oldest, found = seq, true
+			}
+		}
+
+		b.lost += uint32(oldest - b.next)
+		b.next = oldest
+		ready = append(ready, b.drain()...)
+	}
+
+	return ready
+}
+
+func (b *reorderBuffer) drain() []*rtp.Packet {
+	var ready []*rtp.Packet
+	for {
+		p, ok := b.pending[b.next]
+		if !ok {
+			return ready
+		}
+
+		ready = append(ready, p)
+		delete(b.pending, b.next)
+		b.next++
+	}
+}
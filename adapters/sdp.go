@@ -1,89 +1,180 @@
 package adapters
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 
-	"github.com/jart/gosip/sdp"
+	"sip_and_rip/ports"
 )
 
-//
-func getAttributesFromSdp(sdpMsg *sdp.SDP) (ssrc uint32, cname string, rtcpAddr *net.UDPAddr, err error) {
-	for _, a := range sdpMsg.Attrs {
-		switch a[0] {
-		case "X-nat":
-			// TODO will have to learn how to deal with NAT eventually
-			// `a=X-nat:0` indicates that the sender of the SDP is not behind a NAT device
-			if a[1] != "0" {
-				return ssrc, cname, rtcpAddr, fmt.Errorf("client is behind a NAT device. Probably just need to make this not error and see what happens")
-			}
-		case "rtcp":
-			uri := ""
-			rtcpVals := strings.Split(a[1], " ")
-
-			// TODO checking for linphone's rtcp which looks like this: `a=rtcp:97535`. This will probably be different if it wasnt on localhost
-			if len(rtcpVals) == 1 {
-				uri = fmt.Sprintf("127.0.0.1:%s", rtcpVals[0])
-			} else if len(rtcpVals) == 4 {
-				uri = fmt.Sprintf("%s:%s", rtcpVals[3], rtcpVals[0])
-			} else {
-				return ssrc, cname, rtcpAddr, fmt.Errorf("invalid rtcp attribute: %s", a[1])
-			}
+// parseAttributes - reads a list of a= lines, the session's or a media's, into what they mean. Unknown attributes are kept as they are,
+// and ones we can't make sense of are logged and skipped rather than failing the whole sdp, since every client has its own extras. addr
+// is the connection address an a=rtcp without one of its own shares
+func parseAttributes(attrs []ports.SdpAttribute, addr string) ports.SdpAttributes {
+	var parsed ports.SdpAttributes
+	for _, a := range attrs {
+		if a.Name == "" {
+			fmt.Println("skipping sdp attribute with no name: ", a.Value)
+			continue
+		}
 
-			rtcpAddr, err = net.ResolveUDPAddr("udp", uri)
+		parsed.All = append(parsed.All, a)
+
+		switch a.Name {
+		case "rtcp":
+			rtcp, err := parseRtcpAttribute(a.Value, addr)
 			if err != nil {
-				return ssrc, cname, rtcpAddr, fmt.Errorf("error resolving rtcp addr: %v", err)
+				fmt.Println("skipping sdp attribute: ", err)
+				continue
 			}
+			parsed.Rtcp = rtcp
 		case "ssrc":
-			ssrcVals := strings.Split(a[1], " ")
-
-			// grab the ssrc, it helps identify the source of the RTP stream
-			ui64, pErr := strconv.ParseUint(ssrcVals[0], 10, 32)
-			if pErr != nil {
-				return ssrc, cname, rtcpAddr, fmt.Errorf("error parsing ssrc: %v", pErr)
+			if err := parseSsrcAttribute(&parsed, a.Value); err != nil {
+				fmt.Println("skipping sdp attribute: ", err)
 			}
-			ssrc = uint32(ui64)
-
-			// now check for cname
-			if len(ssrcVals) > 1 && len(ssrcVals) < 3 {
-				if strings.Contains(ssrcVals[1], "cname") {
-					// TODO cname is used identify the source of the RTP stream. it is used in the RTCP sender report (SR) or the receiver report (RR)
-					cname = strings.Split(ssrcVals[1], ":")[1]
-				} else {
-					return ssrc, cname, rtcpAddr, fmt.Errorf("encountered unknown ssrc attribute: %s", ssrcVals[1])
-				}
-			} else {
-				return ssrc, cname, rtcpAddr, fmt.Errorf("encountered unknown ssrc attribute: %s", ssrcVals[1])
+		case "rtcp-fb":
+			// used to specify the RTCP feedback messages that should be used for monitoring and controlling congestion in the session. An examle from linphone:
+			//	a=rtcp-fb:* trr-int 1000
+			//	a=rtcp-fb:* ccm tmmbr
+			//		* trr-int 1000: (Transport-wide Receiver Report Interval) indicates the time interval for sending RTCP receiver reports (1000ms). wildcard indicates that this applies to all media types in the session.
+			fb := strings.SplitN(a.Value, " ", 3)
+			if len(fb) < 2 {
+				fmt.Println("skipping invalid rtcp-fb attribute: ", a.Value)
+				continue
+			}
+			feedback := ports.SdpRtcpFeedback{PayloadType: fb[0], Type: fb[1]}
+			if len(fb) == 3 {
+				feedback.Param = fb[2]
 			}
+			parsed.RtcpFb = append(parsed.RtcpFb, feedback)
 		case "rtcp-xr":
-		// this attribute is used to convey extended RTP Control Protocol (RTCP) reports. An example from linphone:
-		//	`a=rtcp-xr:rcvr-rtt=all:10000 stat-summary=loss,dup,jitt,TTL voip-metrics`
-		//		rcvr-rtt=all:10000: This parameter enables round-trip time (RTT) measurement for all RTP receivers and sets the maximum interval between reports to 10,000 milliseconds. This information can be used to assess the quality of the media delivery and to detect any issues with the network.
-		// 		stat-summary=loss,dup,jitt,TTL,voip-metrics: This parameter requests that several types of statistics be included in the RTCP report. The statistics requested are:
-		//			loss: The fraction of lost RTP packets
-		// 			dup: The fraction of duplicated RTP packets
-		// 			jitt: The amount of jitter in the received RTP packets
-		// 			TTL: The time-to-live (TTL) value of the received RTP packets
-		// 			voip-metrics: Voice over IP (VoIP) quality metrics, such as the mean opinion score (MOS), delay, and packet loss rate.
+			// this attribute is used to convey extended RTP Control Protocol (RTCP) reports. An example from linphone:
+			//	`a=rtcp-xr:rcvr-rtt=all:10000 stat-summary=loss,dup,jitt,TTL voip-metrics`
+			//		rcvr-rtt=all:10000: This parameter enables round-trip time (RTT) measurement for all RTP receivers and sets the maximum interval between reports to 10,000 milliseconds. This information can be used to assess the quality of the media delivery and to detect any issues with the network.
+			// 		stat-summary=loss,dup,jitt,TTL: This parameter requests that several types of statistics be included in the RTCP report (loss, duplicates, jitter and time-to-live)
+			//		voip-metrics: Voice over IP (VoIP) quality metrics, such as the mean opinion score (MOS), delay, and packet loss rate.
+			for _, param := range strings.Fields(a.Value) {
+				xr := ports.SdpAttribute{Name: param}
+				if n := strings.Index(param, "="); n >= 0 {
+					xr.Name, xr.Value = param[:n], param[n+1:]
+				}
+				parsed.RtcpXr = append(parsed.RtcpXr, xr)
+			}
+		case "crypto":
+			crypto, err := parseCryptoAttribute(a.Value)
+			if err != nil {
+				fmt.Println("skipping sdp attribute: ", err)
+				continue
+			}
+			parsed.Crypto = append(parsed.Crypto, *crypto)
 		case "record":
-		// indicates if the media session is being recorded. Can be "off", "on", "sendonly", or "recvonly"
-		case "rtcp-fb":
-		// used to specify the RTCP feedback messages that should be used for monitoring and controlling congestion in the session. An examle from linphone:
-		//	a=rtcp-fb:* trr-int 1000
-		//	a=rtcp-fb:* ccm tmmbr
-		//		* trr-int 1000: (Transport-wide Receiver Report Interval) indicates the time interval for sending RTCP receiver reports (1000ms). wildcard indicates that this applies to all media types in the session.
-		default:
-			// TODO stop erroring on unknown attributes
-			// erroring on unknown attributes to make sure we are handling all of them for now
-			return ssrc, cname, rtcpAddr, fmt.Errorf("encountered unknown sdp attribute: %s", a[0])
+			// indicates if the media session is being recorded. Can be "on", "off" or "paused"
+			parsed.Record = a.Value
+		case "sendrecv", "sendonly", "recvonly", "inactive":
+			parsed.Direction = a.Name
+		}
+	}
+
+	return parsed
+}
+
+// parseRtcpAttribute - `a=rtcp:53020 IN IP4 126.16.64.4`. linphone sends just the port, ie `a=rtcp:97535`, in which case it shares the connection address with rtp (rfc 3605)
+func parseRtcpAttribute(value string, connAddr string) (*ports.SdpRtcp, error) {
+	rtcpVals := strings.Fields(value)
+	if len(rtcpVals) != 1 && len(rtcpVals) != 4 {
+		return nil, fmt.Errorf("invalid rtcp attribute: %s", value)
+	}
+
+	port, err := strconv.Atoi(rtcpVals[0])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid rtcp port: %s", value)
+	}
+
+	if len(rtcpVals) == 1 {
+		addrType := "IP4"
+		if ip := net.ParseIP(connAddr); ip != nil && ip.To4() == nil {
+			addrType = "IP6"
+		}
+
+		return &ports.SdpRtcp{Port: port, NetType: "IN", AddrType: addrType, Addr: connAddr}, nil
+	}
+
+	return &ports.SdpRtcp{Port: port, NetType: rtcpVals[1], AddrType: rtcpVals[2], Addr: rtcpVals[3]}, nil
+}
+
+// parseCryptoAttribute - `a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR|2^20|1:4`. A line can carry
+// more than one key when they have mkis, we only keep the first (rfc 4568 9.2)
+func parseCryptoAttribute(value string) (*ports.SdpCrypto, error) {
+	cryptoVals := strings.Fields(value)
+	if len(cryptoVals) < 3 {
+		return nil, fmt.Errorf("invalid crypto attribute: %s", value)
+	}
+
+	tag, err := strconv.Atoi(cryptoVals[0])
+	if err != nil || tag < 0 || tag > 999999999 {
+		return nil, fmt.Errorf("invalid crypto tag: %s", value)
+	}
+
+	keyParam := strings.SplitN(cryptoVals[2], ";", 2)[0]
+	if !strings.HasPrefix(keyParam, "inline:") {
+		return nil, fmt.Errorf("unsupported crypto key method: %s", value)
+	}
+
+	crypto := &ports.SdpCrypto{Tag: tag, Suite: cryptoVals[1], SessionParams: cryptoVals[3:]}
+
+	// the key and salt, then an optional lifetime and mki, which is told apart from the lifetime by its colon
+	keyVals := strings.Split(strings.TrimPrefix(keyParam, "inline:"), "|")
+	for _, v := range keyVals[1:] {
+		if strings.Contains(v, ":") {
+			crypto.Mki = v
+		} else {
+			crypto.Lifetime = v
 		}
 	}
 
-	if ssrc == 0 {
-		ssrc = RandUint32()
+	// the padding is often left off
+	if crypto.Key, err = base64.StdEncoding.DecodeString(keyVals[0]); err != nil {
+		if crypto.Key, err = base64.RawStdEncoding.DecodeString(keyVals[0]); err != nil {
+			return nil, fmt.Errorf("invalid crypto key: %s", value)
+		}
+	}
+
+	return crypto, nil
+}
+
+// parseSsrcAttribute - `a=ssrc:1234 cname:alice@host`. a source can have any number of lines, each adding an attribute to it
+func parseSsrcAttribute(attrs *ports.SdpAttributes, value string) error {
+	ssrcVals := strings.SplitN(value, " ", 2)
+
+	// grab the ssrc, it helps identify the source of the RTP stream
+	ui64, err := strconv.ParseUint(ssrcVals[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("error parsing ssrc %s: %v", value, err)
+	}
+	id := uint32(ui64)
+
+	var ssrc *ports.SdpSsrc
+	for i := range attrs.Ssrcs {
+		if attrs.Ssrcs[i].ID == id {
+			ssrc = &attrs.Ssrcs[i]
+		}
+	}
+	if ssrc == nil {
+		attrs.Ssrcs = append(attrs.Ssrcs, ports.SdpSsrc{ID: id})
+		ssrc = &attrs.Ssrcs[len(attrs.Ssrcs)-1]
+	}
+
+	if len(ssrcVals) == 2 {
+		// cname is used to identify the source of the RTP stream. it is used in the RTCP sender report (SR) or the receiver report (RR)
+		attr := ports.SdpAttribute{Name: ssrcVals[1]}
+		if n := strings.Index(attr.Name, ":"); n >= 0 {
+			attr.Name, attr.Value = attr.Name[:n], attr.Name[n+1:]
+		}
+		ssrc.Attributes = append(ssrc.Attributes, attr)
 	}
 
-	return ssrc, cname, rtcpAddr, err
+	return nil
 }
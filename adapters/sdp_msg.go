@@ -0,0 +1,839 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jart/gosip/sdp"
+	"github.com/jart/gosip/util"
+
+	"sip_and_rip/ports"
+)
+
+// SdpOrigin - the o= line. The session id stays the same for the life of a session, and the version goes up every time the description changes (rfc 3264)
+type SdpOrigin struct {
+	Username  string
+	SessionID string
+	Version   uint64
+	Addr      string
+}
+
+// SdpMedia - an m= line and everything under it
+type SdpMedia struct {
+	// audio, video, application, etc
+	Type string
+	// 0 means the stream was rejected or disabled
+	Port int
+	// RTP/AVP, RTP/SAVP, UDP/TLS/RTP/SAVPF, etc
+	Proto string
+	// the payload types for rtp, or whatever the proto uses instead of them
+	Formats []string
+	// the c= address for just this media, empty when it uses the session's
+	Addr string
+	// every a= line in order, rtpmap and fmtp included
+	Attrs []ports.SdpAttribute
+	// lines we don't model, like b= and i=, kept so they survive a round trip
+	Other []string
+	// what the a= lines say, read once the sdp is parsed or built
+	attributes *ports.SdpMediaAttributes
+}
+
+// SdpMsg - a session description. Unlike gosip's it keeps every m= line and every attribute where it found them, so what we parse we can write back out
+type SdpMsg struct {
+	Origin  SdpOrigin
+	Session string
+	// the session wide c= address
+	Addr  string
+	Time  string
+	Attrs []ports.SdpAttribute
+	Other []string
+	Media []*SdpMedia
+	// what the session's a= lines say, read once the sdp is parsed or built
+	attributes *ports.SdpAttributes
+	// true when it came from a client, false when we built it
+	request bool
+}
+
+// ParseSdp - parses an sdp body sent by a client
+func ParseSdp(body string) (*SdpMsg, error) {
+	s := &SdpMsg{request: true}
+
+	var media *SdpMedia
+	okVersion, okOrigin := false, false
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, fmt.Errorf("invalid sdp line: %s", line)
+		}
+		if !okVersion {
+			if line != "v=0" {
+				return nil, fmt.Errorf("sdp must start with v=0")
+			}
+			okVersion = true
+			continue
+		}
+
+		value := line[2:]
+		switch line[0] {
+		case 'o':
+			// o=<username> <sess-id> <sess-version> <nettype> <addrtype> <unicast-address>
+			o := strings.Fields(value)
+			if len(o) != 6 {
+				return nil, fmt.Errorf("invalid sdp origin: %s", value)
+			}
+			version, err := strconv.ParseUint(o[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sdp origin version: %s", value)
+			}
+			s.Origin = SdpOrigin{Username: o[0], SessionID: o[1], Version: version, Addr: o[5]}
+			okOrigin = true
+		case 's':
+			s.Session = value
+		case 't':
+			s.Time = value
+		case 'c':
+			// c=IN IP4 1.2.3.4
+			c := strings.Fields(value)
+			if len(c) != 3 {
+				return nil, fmt.Errorf("invalid sdp connection: %s", value)
+			}
+			// multicast addresses carry a ttl, ie 224.2.1.1/127
+			addr := strings.SplitN(c[2], "/", 2)[0]
+			if media != nil {
+				media.Addr = addr
+			} else {
+				s.Addr = addr
+			}
+		case 'm':
+			// m=<media> <port>[/<number of ports>] <proto> <fmt> ...
+			m := strings.Fields(value)
+			if len(m) < 3 {
+				return nil, fmt.Errorf("invalid sdp media: %s", value)
+			}
+			port, err := strconv.Atoi(strings.SplitN(m[1], "/", 2)[0])
+			if err != nil || port < 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid sdp media port: %s", value)
+			}
+			media = &SdpMedia{Type: m[0], Port: port, Proto: m[2], Formats: m[3:]}
+			s.Media = append(s.Media, media)
+		case 'a':
+			attr := ports.SdpAttribute{Name: value}
+			if n := strings.Index(value, ":"); n >= 0 {
+				attr.Name, attr.Value = value[:n], value[n+1:]
+			}
+			if media != nil {
+				media.Attrs = append(media.Attrs, attr)
+			} else {
+				s.Attrs = append(s.Attrs, attr)
+			}
+		default:
+			if media != nil {
+				media.Other = append(media.Other, line)
+			} else {
+				s.Other = append(s.Other, line)
+			}
+		}
+	}
+
+	if !okOrigin {
+		return nil, fmt.Errorf("sdp is missing its origin")
+	}
+
+	for _, m := range s.Media {
+		if m.Port != 0 && m.Addr == "" && s.Addr == "" {
+			return nil, fmt.Errorf("sdp has no connection address for its %s", m.Type)
+		}
+	}
+	s.readAttributes()
+
+	return s, nil
+}
+
+// readAttributes - reads what the session's and each media's a= lines say, so asking for them doesn't mean parsing them again
+func (s *SdpMsg) readAttributes() {
+	session := parseAttributes(s.Attrs, s.Addr)
+	s.attributes = &session
+
+	for _, m := range s.Media {
+		addr := m.Addr
+		if addr == "" {
+			addr = s.Addr
+		}
+		m.attributes = &ports.SdpMediaAttributes{Media: m.Type, Proto: m.Proto, Addr: addr, SdpAttributes: parseAttributes(m.Attrs, addr)}
+	}
+}
+
+// ContentType - lets the sdp be the payload of a sip message
+func (s *SdpMsg) ContentType() string {
+	return sdp.ContentType
+}
+
+// Data - the sdp as it goes on the wire
+func (s *SdpMsg) Data() []byte {
+	var b bytes.Buffer
+	s.Append(&b)
+	return b.Bytes()
+}
+
+// String - the sdp as it goes on the wire
+func (s *SdpMsg) String() string {
+	return string(s.Data())
+}
+
+// Append - writes the sdp out, with its lines in the order rfc 4566 wants them
+func (s *SdpMsg) Append(b *bytes.Buffer) {
+	b.WriteString("v=0\r\n")
+
+	username := s.Origin.Username
+	if username == "" {
+		username = "-"
+	}
+	fmt.Fprintf(b, "o=%s %s %d IN %s %s\r\n", username, s.Origin.SessionID, s.Origin.Version, addrType(s.Origin.Addr), s.Origin.Addr)
+
+	session := s.Session
+	if session == "" {
+		session = "-"
+	}
+	b.WriteString("s=" + session + "\r\n")
+	appendOtherLines(b, s.Other, "iuep")
+	if s.Addr != "" {
+		fmt.Fprintf(b, "c=IN %s %s\r\n", addrType(s.Addr), s.Addr)
+	}
+	appendOtherLines(b, s.Other, "b")
+
+	timing := s.Time
+	if timing == "" {
+		timing = "0 0"
+	}
+	b.WriteString("t=" + timing + "\r\n")
+	appendOtherLines(b, s.Other, "rzk")
+	appendAttributes(b, s.Attrs)
+
+	for _, m := range s.Media {
+		fmt.Fprintf(b, "m=%s %d %s %s\r\n", m.Type, m.Port, m.Proto, strings.Join(m.Formats, " "))
+		appendOtherLines(b, m.Other, "i")
+		if m.Addr != "" {
+			fmt.Fprintf(b, "c=IN %s %s\r\n", addrType(m.Addr), m.Addr)
+		}
+		appendOtherLines(b, m.Other, "bk")
+		appendAttributes(b, m.Attrs)
+	}
+}
+
+// Audio - the first audio stream that wasn't rejected, or nil if there isn't one
+func (s *SdpMsg) Audio() *SdpMedia {
+	for _, m := range s.Media {
+		if m.Type == "audio" && m.Port != 0 {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// MediaAddr - where to send the media's rtp
+func (s *SdpMsg) MediaAddr(m *SdpMedia) string {
+	addr := m.Addr
+	if addr == "" {
+		addr = s.Addr
+	}
+
+	return net.JoinHostPort(addr, strconv.Itoa(m.Port))
+}
+
+// Direction - sendrecv, sendonly, recvonly or inactive. A direction on the media wins over the session's, and sendrecv is the default
+func (s *SdpMsg) Direction(m *SdpMedia) string {
+	for _, attrs := range [][]ports.SdpAttribute{m.Attrs, s.Attrs} {
+		for _, a := range attrs {
+			switch a.Name {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				return a.Name
+			}
+		}
+	}
+
+	return "sendrecv"
+}
+
+// Codecs - the codecs of the media's payload types, filled in from its rtpmap and fmtp lines or from the static payload types iana assigned
+func (m *SdpMedia) Codecs() []sdp.Codec {
+	var codecs []sdp.Codec
+	for _, format := range m.Formats {
+		pt, err := strconv.ParseUint(format, 10, 7)
+		if err != nil {
+			continue
+		}
+
+		codec, ok := sdp.StandardCodecs[uint8(pt)]
+		codec.PT = uint8(pt)
+		prefix := format + " "
+		for _, a := range m.Attrs {
+			if a.Name == "rtpmap" && strings.HasPrefix(a.Value, prefix) {
+				// rtpmap:<pt> <name>/<rate>[/<channels>]
+				rtpmap := strings.Split(a.Value[len(prefix):], "/")
+				if len(rtpmap) < 2 {
+					continue
+				}
+				rate, err := strconv.Atoi(rtpmap[1])
+				if err != nil {
+					continue
+				}
+				codec.Name, codec.Rate, codec.Param, ok = rtpmap[0], rate, "", true
+				if len(rtpmap) > 2 {
+					codec.Param = rtpmap[2]
+				}
+			} else if a.Name == "fmtp" && strings.HasPrefix(a.Value, prefix) {
+				codec.Fmtp = a.Value[len(prefix):]
+			}
+		}
+
+		// a dynamic payload type without an rtpmap is meaningless
+		if ok {
+			codecs = append(codecs, codec)
+		}
+	}
+
+	return codecs
+}
+
+// Get - the value of the media's first attribute with the name
+func (m *SdpMedia) Get(name string) (string, bool) {
+	for _, a := range m.Attrs {
+		if a.Name == name {
+			return a.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// GetMediaAddress - where to send audio, as host:port
+func (s *SdpMsg) GetMediaAddress() string {
+	audio := s.Audio()
+	if audio == nil {
+		return ""
+	}
+
+	return s.MediaAddr(audio)
+}
+
+// IsCodecSupported - determines if the audio offers the codec, matched by name and rate since dynamic payload types differ between clients
+func (s *SdpMsg) IsCodecSupported(codec sdp.Codec) bool {
+	audio := s.Audio()
+	if audio == nil {
+		return false
+	}
+
+	return findCodec(audio.Codecs(), codec) != nil
+}
+
+// NewSdpResponse - answers the sdp with our media address and the codecs we accept from it
+func (s *SdpMsg) NewSdpResponse(localAddr *net.UDPAddr, acceptedCodecs ...sdp.Codec) (ports.SdpMessage, error) {
+	answer, err := NewSdpAnswer(s).WithAddr(localAddr).WithCodecs(acceptedCodecs...).WithRtcp().Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return answer, nil
+}
+
+// GetRtcpAddress - where to send rtcp, as host:port. Without an a=rtcp it is the port above rtp (rfc 3550)
+func (s *SdpMsg) GetRtcpAddress() string {
+	audio := s.GetMediaAttributes("audio")
+	if audio == nil {
+		return ""
+	}
+
+	if audio.Rtcp != nil {
+		return net.JoinHostPort(audio.Rtcp.Addr, strconv.Itoa(audio.Rtcp.Port))
+	}
+
+	m := s.Audio()
+	addr := m.Addr
+	if addr == "" {
+		addr = s.Addr
+	}
+
+	return net.JoinHostPort(addr, strconv.Itoa(m.Port+1))
+}
+
+// GetSsrc - the ssrc of the audio stream, 0 if the sdp doesn't say
+func (s *SdpMsg) GetSsrc() uint32 {
+	if ssrc := s.audioSsrc(); ssrc != nil {
+		return ssrc.ID
+	}
+
+	return 0
+}
+
+// GetCname - the cname of the audio stream's ssrc, empty if the sdp doesn't say
+func (s *SdpMsg) GetCname() string {
+	if ssrc := s.audioSsrc(); ssrc != nil {
+		return ssrc.Cname()
+	}
+
+	return ""
+}
+
+// IsRequest - true when the sdp came from a client, false when we built it
+func (s *SdpMsg) IsRequest() bool {
+	return s.request
+}
+
+// GetDirection - the direction of the audio, sendrecv when there is none
+func (s *SdpMsg) GetDirection() string {
+	audio := s.Audio()
+	if audio == nil {
+		return "inactive"
+	}
+
+	return s.Direction(audio)
+}
+
+// GetSessionAttributes - the attributes before the first m= line
+func (s *SdpMsg) GetSessionAttributes() *ports.SdpAttributes {
+	return s.attributes
+}
+
+// GetMediaAttributes - the attributes of the first m= line of the media type that wasn't rejected, or nil if there isn't one
+func (s *SdpMsg) GetMediaAttributes(media string) *ports.SdpMediaAttributes {
+	for _, m := range s.Media {
+		if m.Type == media && m.Port != 0 {
+			return m.attributes
+		}
+	}
+
+	return nil
+}
+
+func (s *SdpMsg) audioSsrc() *ports.SdpSsrc {
+	session := s.GetSessionAttributes()
+	ssrcs := session.Ssrcs
+	if audio := s.GetMediaAttributes("audio"); audio != nil && len(audio.Ssrcs) > 0 {
+		ssrcs = audio.Ssrcs
+	}
+	if len(ssrcs) == 0 {
+		return nil
+	}
+
+	return &ssrcs[0]
+}
+
+// SdpBuilder - builds our side of a session, either an offer or the answer to a client's offer
+type SdpBuilder struct {
+	offer     *SdpMsg
+	previous  *SdpMsg
+	addr      *net.UDPAddr
+	codecs    []sdp.Codec
+	ptime     int
+	direction string
+	rtcp      bool
+	rtcpXr    []ports.SdpAttribute
+	crypto    *ports.SdpCrypto
+	webRtc    *ports.WebRtcParams
+	ssrc      *ports.SdpSsrc
+	attrs     []ports.SdpAttribute
+}
+
+// NewSdpOffer - builds an sdp to start a session with
+func NewSdpOffer() *SdpBuilder {
+	return &SdpBuilder{}
+}
+
+// NewSdpAnswer - builds the answer to a client's offer. The answer has an m= line for each of theirs, with the ones we don't take rejected (rfc 3264)
+func NewSdpAnswer(offer *SdpMsg) *SdpBuilder {
+	return &SdpBuilder{offer: offer}
+}
+
+// WithAddr - where we send and receive the audio
+func (b *SdpBuilder) WithAddr(addr *net.UDPAddr) *SdpBuilder {
+	b.addr = addr
+	return b
+}
+
+// WithCodecs - the codecs we accept, in the order we prefer them. An answer only keeps the ones in the offer, using the offer's payload types
+func (b *SdpBuilder) WithCodecs(codecs ...sdp.Codec) *SdpBuilder {
+	b.codecs = append(b.codecs, codecs...)
+	return b
+}
+
+// WithPtime - the packetization time we want, in milliseconds
+func (b *SdpBuilder) WithPtime(ms int) *SdpBuilder {
+	b.ptime = ms
+	return b
+}
+
+// WithDirection - sendrecv, sendonly, recvonly or inactive. An answer otherwise mirrors the offer, ie we only receive from a client that only sends
+func (b *SdpBuilder) WithDirection(direction string) *SdpBuilder {
+	b.direction = direction
+	return b
+}
+
+// WithRtcp - advertises our rtcp on the port above rtp. Clients assume that anyway, but some only listen to an a=rtcp
+func (b *SdpBuilder) WithRtcp() *SdpBuilder {
+	b.rtcp = true
+	return b
+}
+
+// WithRtcpXr - the rtcp extended reports we can send (rfc 3611), ie {stat-summary loss,dup} {voip-metrics ""}. An answer only keeps the
+// ones the offer asked for, and leaves the attribute out when there are none
+func (b *SdpBuilder) WithRtcpXr(params ...ports.SdpAttribute) *SdpBuilder {
+	b.rtcpXr = append(b.rtcpXr, params...)
+	return b
+}
+
+// WithCrypto - our sdes key, which makes the audio srtp (rfc 4568). An answer keeps the offer's transport, so an offer of plain RTP/AVP
+// with keys in it gets srtp over RTP/AVP back, as the phones that do that expect
+func (b *SdpBuilder) WithCrypto(crypto *ports.SdpCrypto) *SdpBuilder {
+	b.crypto = crypto
+	return b
+}
+
+// WithSsrc - announces the ssrc and cname of the stream we send (rfc 5576), which browsers need to tell it apart from any other on the
+// port. An ssrc of 0 leaves it out
+func (b *SdpBuilder) WithSsrc(ssrc uint32, cname string) *SdpBuilder {
+	b.ssrc = nil
+	if ssrc != 0 {
+		b.ssrc = &ports.SdpSsrc{ID: ssrc, Attributes: []ports.SdpAttribute{{Name: "cname", Value: cname}}}
+	}
+	return b
+}
+
+// WithWebRtc - our ice and dtls parameters, which make the audio dtls-srtp for a browser (rfc 8829 5.3). We are ice-lite with a
+// single host candidate, the rtp address, and rtcp is multiplexed on it rather than advertised above it
+func (b *SdpBuilder) WithWebRtc(params *ports.WebRtcParams) *SdpBuilder {
+	b.webRtc = params
+	return b
+}
+
+// WithAttribute - adds an attribute to the audio
+func (b *SdpBuilder) WithAttribute(name string, value string) *SdpBuilder {
+	b.attrs = append(b.attrs, ports.SdpAttribute{Name: name, Value: value})
+	return b
+}
+
+// WithPrevious - the last sdp we sent in the session. The new one keeps its session id, and its version only goes up if something changed
+func (b *SdpBuilder) WithPrevious(previous *SdpMsg) *SdpBuilder {
+	b.previous = previous
+	return b
+}
+
+// Build - creates the sdp
+func (b *SdpBuilder) Build() (*SdpMsg, error) {
+	if b.addr == nil {
+		return nil, fmt.Errorf("sdp needs a media address")
+	}
+
+	ip := b.addr.IP.String()
+	s := &SdpMsg{
+		Origin:  SdpOrigin{Username: "-", SessionID: util.GenerateOriginID(), Version: 1, Addr: ip},
+		Session: "-",
+		Addr:    ip,
+		Time:    "0 0",
+	}
+	if b.offer != nil {
+		// echoing the session name back is what most clients do, and some look for it
+		s.Session = b.offer.Session
+	}
+
+	codecs := b.codecs
+	direction := b.direction
+	if b.offer != nil {
+		if b.offer.Audio() == nil {
+			return nil, fmt.Errorf("offer has no audio")
+		}
+
+		// take the offer's payload types, since the caller decides what its dynamic ones mean
+		codecs = nil
+		offered := b.offer.Audio().Codecs()
+		for _, c := range b.codecs {
+			if match := findCodec(offered, c); match != nil {
+				accepted := *match
+				if c.Fmtp != "" {
+					accepted.Fmtp = c.Fmtp
+				}
+				codecs = append(codecs, accepted)
+			}
+		}
+
+		if direction == "" {
+			direction = answerDirection(b.offer.Direction(b.offer.Audio()))
+		}
+	}
+	if len(codecs) == 0 {
+		return nil, fmt.Errorf("no codecs in common")
+	}
+	if direction == "" {
+		direction = "sendrecv"
+	}
+
+	proto := "RTP/AVP"
+	switch {
+	case b.webRtc != nil:
+		proto = "UDP/TLS/RTP/SAVPF"
+	case b.crypto != nil:
+		proto = "RTP/SAVP"
+	}
+	if proto != "RTP/AVP" && b.offer != nil {
+		proto = b.offer.Audio().Proto
+	}
+
+	audio := &SdpMedia{Type: "audio", Port: b.addr.Port, Proto: proto}
+	// an answer names each of its m= lines the same as the offer did (rfc 5888 9.1)
+	mid := ""
+	if b.offer != nil {
+		if mid, _ = b.offer.Audio().Get("mid"); mid != "" {
+			audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "mid", Value: mid})
+		}
+	}
+	for _, c := range codecs {
+		audio.Formats = append(audio.Formats, strconv.Itoa(int(c.PT)))
+		rtpmap := fmt.Sprintf("%d %s/%d", c.PT, c.Name, c.Rate)
+		if c.Param != "" {
+			rtpmap += "/" + c.Param
+		}
+		audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "rtpmap", Value: rtpmap})
+		if c.Fmtp != "" {
+			audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "fmtp", Value: fmt.Sprintf("%d %s", c.PT, c.Fmtp)})
+		}
+	}
+	if b.rtcp && b.webRtc == nil {
+		audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "rtcp", Value: fmt.Sprintf("%d IN %s %s", b.addr.Port+1, addrType(ip), ip)})
+	}
+	if b.crypto != nil {
+		audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "crypto", Value: formatCrypto(b.crypto)})
+	}
+	if b.webRtc != nil {
+		audio.Attrs = append(audio.Attrs, webRtcAttributes(b.webRtc, b.addr)...)
+		// we only ever answer as ice-lite
+		s.Attrs = append(s.Attrs, ports.SdpAttribute{Name: "ice-lite"})
+		if b.bundled(mid) {
+			s.Attrs = append(s.Attrs, ports.SdpAttribute{Name: "group", Value: "BUNDLE " + mid})
+		}
+	}
+	if b.ssrc != nil {
+		for _, a := range b.ssrc.Attributes {
+			audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "ssrc", Value: fmt.Sprintf("%d %s:%s", b.ssrc.ID, a.Name, a.Value)})
+		}
+	}
+	if xr := b.answerRtcpXr(); len(xr) > 0 {
+		audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "rtcp-xr", Value: formatRtcpXr(xr)})
+	}
+	if b.ptime > 0 {
+		audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: "ptime", Value: strconv.Itoa(b.ptime)})
+	}
+	audio.Attrs = append(audio.Attrs, b.attrs...)
+	audio.Attrs = append(audio.Attrs, ports.SdpAttribute{Name: direction})
+
+	if b.offer == nil {
+		s.Media = []*SdpMedia{audio}
+	} else {
+		// an answer has an m= line for every one in the offer, in the same order. we take the first audio and reject the rest with a 0 port
+		answered := false
+		for _, m := range b.offer.Media {
+			if !answered && m.Type == "audio" && m.Port != 0 {
+				s.Media = append(s.Media, audio)
+				answered = true
+				continue
+			}
+
+			rejected := &SdpMedia{Type: m.Type, Port: 0, Proto: m.Proto}
+			if mid, ok := m.Get("mid"); ok {
+				rejected.Attrs = append(rejected.Attrs, ports.SdpAttribute{Name: "mid", Value: mid})
+			}
+			if len(m.Formats) > 0 {
+				rejected.Formats = m.Formats[:1]
+				// a dynamic payload type means nothing without its rtpmap, and some clients won't take the answer without one
+				for _, a := range m.Attrs {
+					if a.Name == "rtpmap" && strings.HasPrefix(a.Value, m.Formats[0]+" ") {
+						rejected.Attrs = append(rejected.Attrs, a)
+						break
+					}
+				}
+			}
+			s.Media = append(s.Media, rejected)
+		}
+	}
+
+	if b.previous != nil {
+		s.Origin = b.previous.Origin
+		s.Session = b.previous.Session
+		if s.String() != b.previous.String() {
+			s.Origin.Version++
+		}
+	}
+	s.readAttributes()
+
+	return s, nil
+}
+
+// bundled - whether the offer bundled the media with the mid. We only answer one m= line, so it is bundled on its own, and the lines
+// we reject drop out of the group (rfc 8843 7.3.3)
+func (b *SdpBuilder) bundled(mid string) bool {
+	if b.offer == nil || mid == "" {
+		return false
+	}
+
+	for _, a := range b.offer.Attrs {
+		if a.Name != "group" {
+			continue
+		}
+
+		group := strings.Fields(a.Value)
+		if len(group) == 0 || group[0] != "BUNDLE" {
+			continue
+		}
+		for _, m := range group[1:] {
+			if m == mid {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webRtcAttributes - our ice credentials, our only candidate, the fingerprint of our certificate and our dtls role
+func webRtcAttributes(params *ports.WebRtcParams, addr *net.UDPAddr) []ports.SdpAttribute {
+	// a host candidate for rtp, with the priority rfc 8445 5.1.2.1 recommends for one
+	candidate := fmt.Sprintf("1 1 udp 2130706431 %s %d typ host", addr.IP.String(), addr.Port)
+
+	return []ports.SdpAttribute{
+		{Name: "ice-ufrag", Value: params.IceUfrag},
+		{Name: "ice-pwd", Value: params.IcePwd},
+		{Name: "fingerprint", Value: params.FingerprintHash + " " + params.Fingerprint},
+		{Name: "setup", Value: params.Setup},
+		{Name: "rtcp-mux"},
+		{Name: "candidate", Value: candidate},
+		{Name: "end-of-candidates"},
+	}
+}
+
+// answerRtcpXr - the extended reports we can send that the offer asked for. Report types with a list of metrics, like stat-summary,
+// only keep the metrics both sides know
+func (b *SdpBuilder) answerRtcpXr() []ports.SdpAttribute {
+	if b.offer == nil {
+		return b.rtcpXr
+	}
+
+	// the offer can ask for them for the whole session or just the audio
+	offered := b.offer.GetSessionAttributes().RtcpXr
+	if audio := b.offer.GetMediaAttributes("audio"); audio != nil {
+		offered = append(offered, audio.RtcpXr...)
+	}
+
+	var answer []ports.SdpAttribute
+	for _, ours := range b.rtcpXr {
+		for _, theirs := range offered {
+			if ours.Name != theirs.Name {
+				continue
+			}
+
+			if ours.Value == "" {
+				answer = append(answer, ours)
+				break
+			}
+
+			var metrics []string
+			for _, metric := range strings.Split(ours.Value, ",") {
+				for _, offeredMetric := range strings.Split(theirs.Value, ",") {
+					if metric == offeredMetric {
+						metrics = append(metrics, metric)
+					}
+				}
+			}
+			if len(metrics) > 0 {
+				answer = append(answer, ports.SdpAttribute{Name: ours.Name, Value: strings.Join(metrics, ",")})
+			}
+			break
+		}
+	}
+
+	return answer
+}
+
+// formatRtcpXr - the value of an a=rtcp-xr line, ie `stat-summary=loss,dup voip-metrics`
+func formatRtcpXr(params []ports.SdpAttribute) string {
+	var values []string
+	for _, param := range params {
+		if param.Value == "" {
+			values = append(values, param.Name)
+		} else {
+			values = append(values, param.Name+"="+param.Value)
+		}
+	}
+
+	return strings.Join(values, " ")
+}
+
+// formatCrypto - the value of an a=crypto line, ie `1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR`
+func formatCrypto(crypto *ports.SdpCrypto) string {
+	key := "inline:" + base64.StdEncoding.EncodeToString(crypto.Key)
+	if crypto.Lifetime != "" {
+		key += "|" + crypto.Lifetime
+	}
+	if crypto.Mki != "" {
+		key += "|" + crypto.Mki
+	}
+
+	return strings.Join(append([]string{strconv.Itoa(crypto.Tag), crypto.Suite, key}, crypto.SessionParams...), " ")
+}
+
+// findCodec - the codec in the list with the same name and rate
+func findCodec(codecs []sdp.Codec, codec sdp.Codec) *sdp.Codec {
+	for i := range codecs {
+		if strings.EqualFold(codecs[i].Name, codec.Name) && codecs[i].Rate == codec.Rate {
+			return &codecs[i]
+		}
+	}
+
+	return nil
+}
+
+// answerDirection - the direction that goes with the offer's, ie if they only send then we only receive
+func answerDirection(offered string) string {
+	switch offered {
+	case "sendonly":
+		return "recvonly"
+	case "recvonly":
+		return "sendonly"
+	case "inactive":
+		return "inactive"
+	}
+
+	return "sendrecv"
+}
+
+func addrType(addr string) string {
+	if util.IsIPv6(addr) {
+		return "IP6"
+	}
+
+	return "IP4"
+}
+
+// appendOtherLines - writes the lines we don't model whose type is one of the letters
+func appendOtherLines(b *bytes.Buffer, lines []string, letters string) {
+	for _, line := range lines {
+		if strings.IndexByte(letters, line[0]) >= 0 {
+			b.WriteString(line + "\r\n")
+		}
+	}
+}
+
+func appendAttributes(b *bytes.Buffer, attrs []ports.SdpAttribute) {
+	for _, a := range attrs {
+		if a.Value == "" {
+			b.WriteString("a=" + a.Name + "\r\n")
+		} else {
+			b.WriteString("a=" + a.Name + ":" + a.Value + "\r\n")
+		}
+	}
+}
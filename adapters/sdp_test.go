@@ -0,0 +1,173 @@
+package adapters
+
+import (
+	"reflect"
+	"testing"
+
+	"sip_and_rip/ports"
+)
+
+func TestParseSdpAttributes(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantSession *ports.SdpAttributes
+		wantMedias  []*ports.SdpMediaAttributes
+	}{
+		{
+			name: "session and media level",
+			body: "v=0\r\n" +
+				"o=alice 1 1 IN IP4 10.0.0.1\r\n" +
+				"s=-\r\n" +
+				"c=IN IP4 10.0.0.1\r\n" +
+				"t=0 0\r\n" +
+				"a=record:off\r\n" +
+				"a=rtcp-xr:rcvr-rtt=all:10000 voip-metrics\r\n" +
+				"m=audio 4000 RTP/AVP 0 101\r\n" +
+				"a=rtpmap:101 telephone-event/8000\r\n" +
+				"a=rtcp:4001\r\n" +
+				"a=ssrc:1234 cname:alice@host\r\n" +
+				"a=ssrc:1234 label:mic\r\n" +
+				"a=rtcp-fb:* trr-int 1000\r\n" +
+				"a=sendonly\r\n",
+			wantSession: &ports.SdpAttributes{
+				All: []ports.SdpAttribute{
+					{Name: "record", Value: "off"},
+					{Name: "rtcp-xr", Value: "rcvr-rtt=all:10000 voip-metrics"},
+				},
+				RtcpXr: []ports.SdpAttribute{{Name: "rcvr-rtt", Value: "all:10000"}, {Name: "voip-metrics"}},
+				Record: "off",
+			},
+			wantMedias: []*ports.SdpMediaAttributes{{
+				Media: "audio",
+				Proto: "RTP/AVP",
+				Addr:  "10.0.0.1",
+				SdpAttributes: ports.SdpAttributes{
+					All: []ports.SdpAttribute{
+						{Name: "rtpmap", Value: "101 telephone-event/8000"},
+						{Name: "rtcp", Value: "4001"},
+						{Name: "ssrc", Value: "1234 cname:alice@host"},
+						{Name: "ssrc", Value: "1234 label:mic"},
+						{Name: "rtcp-fb", Value: "* trr-int 1000"},
+						{Name: "sendonly"},
+					},
+					Rtcp: &ports.SdpRtcp{Port: 4001, NetType: "IN", AddrType: "IP4", Addr: "10.0.0.1"},
+					Ssrcs: []ports.SdpSsrc{{ID: 1234, Attributes: []ports.SdpAttribute{
+						{Name: "cname", Value: "alice@host"},
+						{Name: "label", Value: "mic"},
+					}}},
+					RtcpFb:    []ports.SdpRtcpFeedback{{PayloadType: "*", Type: "trr-int", Param: "1000"}},
+					Direction: "sendonly",
+				},
+			}},
+		},
+		{
+			name: "unknown and bad attributes",
+			body: "v=0\n" +
+				"o=- 1 1 IN IP4 10.0.0.1\n" +
+				"c=IN IP4 10.0.0.1\n" +
+				"a=x-vendor-thing:42\n" +
+				"a=ice-lite\n" +
+				"a=:no-name\n" +
+				"m=audio 4000 RTP/AVP 0\n" +
+				"a=rtcp:notaport\n" +
+				"a=ssrc:notanumber cname:x\n" +
+				"a=rtcp-fb:*\n" +
+				"a=x-other\n",
+			wantSession: &ports.SdpAttributes{
+				All: []ports.SdpAttribute{{Name: "x-vendor-thing", Value: "42"}, {Name: "ice-lite"}},
+			},
+			wantMedias: []*ports.SdpMediaAttributes{{
+				Media: "audio",
+				Proto: "RTP/AVP",
+				Addr:  "10.0.0.1",
+				SdpAttributes: ports.SdpAttributes{
+					All: []ports.SdpAttribute{
+						{Name: "rtcp", Value: "notaport"},
+						{Name: "ssrc", Value: "notanumber cname:x"},
+						{Name: "rtcp-fb", Value: "*"},
+						{Name: "x-other"},
+					},
+				},
+			}},
+		},
+		{
+			name: "each media its own",
+			body: "v=0\r\n" +
+				"o=- 1 1 IN IP4 10.0.0.1\r\n" +
+				"c=IN IP4 10.0.0.1\r\n" +
+				"m=audio 4000 RTP/SAVP 0\r\n" +
+				"c=IN IP6 ::1\r\n" +
+				"a=rtcp:4001 IN IP4 10.0.0.9\r\n" +
+				"a=recvonly\r\n" +
+				"m=video 5000 RTP/AVP 96\r\n" +
+				"a=rtcp:5001\r\n" +
+				"a=inactive\r\n",
+			wantSession: &ports.SdpAttributes{},
+			wantMedias: []*ports.SdpMediaAttributes{
+				{
+					Media: "audio",
+					Proto: "RTP/SAVP",
+					Addr:  "::1",
+					SdpAttributes: ports.SdpAttributes{
+						All:       []ports.SdpAttribute{{Name: "rtcp", Value: "4001 IN IP4 10.0.0.9"}, {Name: "recvonly"}},
+						Rtcp:      &ports.SdpRtcp{Port: 4001, NetType: "IN", AddrType: "IP4", Addr: "10.0.0.9"},
+						Direction: "recvonly",
+					},
+				},
+				{
+					Media: "video",
+					Proto: "RTP/AVP",
+					Addr:  "10.0.0.1",
+					SdpAttributes: ports.SdpAttributes{
+						All:       []ports.SdpAttribute{{Name: "rtcp", Value: "5001"}, {Name: "inactive"}},
+						Rtcp:      &ports.SdpRtcp{Port: 5001, NetType: "IN", AddrType: "IP4", Addr: "10.0.0.1"},
+						Direction: "inactive",
+					},
+				},
+			},
+		},
+		{
+			name: "rejected media with no connection address",
+			body: "v=0\r\n" +
+				"o=- 1 1 IN IP4 10.0.0.1\r\n" +
+				"m=audio 0 RTP/AVP 0\r\n" +
+				"a=rtcp:4001\r\n",
+			wantSession: &ports.SdpAttributes{},
+			wantMedias: []*ports.SdpMediaAttributes{{
+				Media: "audio",
+				Proto: "RTP/AVP",
+				SdpAttributes: ports.SdpAttributes{
+					All:  []ports.SdpAttribute{{Name: "rtcp", Value: "4001"}},
+					Rtcp: &ports.SdpRtcp{Port: 4001, NetType: "IN", AddrType: "IP4"},
+				},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseSdp(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := msg.GetSessionAttributes()
+			var medias []*ports.SdpMediaAttributes
+			for _, m := range msg.Media {
+				medias = append(medias, m.attributes)
+			}
+
+			if !reflect.DeepEqual(session, tt.wantSession) {
+				t.Errorf("session attributes\n got %+v\nwant %+v", session, tt.wantSession)
+			}
+			if len(medias) != len(tt.wantMedias) {
+				t.Fatalf("got %d medias, want %d", len(medias), len(tt.wantMedias))
+			}
+			for i := range medias {
+				if !reflect.DeepEqual(medias[i], tt.wantMedias[i]) {
+					t.Errorf("media %d\n got %+v\nwant %+v", i, medias[i], tt.wantMedias[i])
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	"sip_and_rip/ports"
@@ -11,22 +12,65 @@ import (
 	"github.com/jart/gosip/dialog"
 	"github.com/jart/gosip/sdp"
 	"github.com/jart/gosip/sip"
+	"github.com/jart/gosip/util"
 )
 
+// the rtcp extended reports we send when the caller asks for them (rfc 3611)
+var rtcpXrReports = []ports.SdpAttribute{
+	{Name: "stat-summary", Value: "loss,dup,jitt"},
+	{Name: "voip-metrics"},
+}
+
 // SipMsg - a wrapper around gosip's sip messages
 type SipMsg struct {
 	msg *sip.Msg
+	// where we listen for the caller's media, and the sdes key or the ice and dtls parameters that protect it, advertised in our sdp answer
+	localRtpAddr *net.UDPAddr
+	localCrypto  *ports.SdpCrypto
+	localWebRtc  *ports.WebRtcParams
+	// the stream we send, announced in our sdp answer
+	localSsrc  uint32
+	localCname string
+	// udp, tls, ws or wss, what the message came in on
+	transport string
+	// the last sdp we sent in the session, and the one we answered this message with
+	previousSdp *SdpMsg
+	localSdp    *SdpMsg
+	// set when the To tag is one we made up on parsing, which a proxy has to take back off before forwarding
+	ourTag bool
+	// set when the request's Max-Forwards really is 0, which gosip can't tell from it missing
+	noHopsLeft bool
 }
 
 // ParseSipMsg - parses a sip message from a byte array
 func ParseSipMsg(b []byte) (*SipMsg, error) {
-	m, err := sip.ParseMsg(b)
+	p, err := splitPacket(b)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := sip.ParseMsg(p.head)
 	if err != nil {
 		return nil, err
 	}
 
+	// gosip's sdp only knows one audio and one video stream, lumps their attributes together, and turns away sdp that clients send all
+	// the time, like LF line endings or a payload type it hasn't heard of, so the body is ours to parse
+	if len(p.body) > 0 {
+		if p.contentType == sdp.ContentType {
+			offer, err := ParseSdp(string(p.body))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing SDP message %v", err)
+			}
+			m.Payload = offer
+		} else {
+			m.Payload = &sip.MiscPayload{T: p.contentType, D: p.body}
+		}
+	}
+
 	sipMsg := &SipMsg{
-		msg: m,
+		msg:        m,
+		noHopsLeft: !m.IsResponse() && m.MaxForwards == 0 && p.hasMaxForwards,
 	}
 
 	if err = sipMsg.Validate(); err != nil {
@@ -55,15 +99,37 @@ func (s *SipMsg) String() string {
 }
 
 // Copy - creates a copy of the sip message
-func (s *SipMsg) Copy() *SipMsg {
+func (s *SipMsg) Copy() ports.SipMessage {
 	return &SipMsg{
-		msg: s.msg.Copy(),
+		msg:        s.msg.Copy(),
+		noHopsLeft: s.noHopsLeft,
 	}
 }
 
 // Append - turns a sip message back into a packet
 func (s *SipMsg) Append(buf *bytes.Buffer) {
-	s.msg.Append(buf)
+	if !s.noHopsLeft {
+		s.msg.Append(buf)
+		return
+	}
+
+	// gosip writes a Max-Forwards of 0 as 70, so the headers go out without its one and with ours after the request line
+	var msg bytes.Buffer
+	s.msg.Append(&msg)
+	head, body, _ := bytes.Cut(msg.Bytes(), []byte("\r\n\r\n"))
+	lines := bytes.Split(head, []byte("\r\n"))
+
+	buf.Write(lines[0])
+	buf.WriteString("\r\nMax-Forwards: 0\r\n")
+	for _, line := range lines[1:] {
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(bytes.TrimSpace(name)), "Max-Forwards") {
+			continue
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
 }
 
 // GetMethod - returns the method of the sip message
@@ -86,8 +152,106 @@ func (s *SipMsg) GetContact() *sip.Addr {
 	return s.msg.Contact
 }
 
+// GetFrom - the logical sender of the message, the caller for an INVITE
+func (s *SipMsg) GetFrom() *sip.Addr {
+	return s.msg.From
+}
+
+// GetTo - the logical destination of the message, the callee for an INVITE
+func (s *SipMsg) GetTo() *sip.Addr {
+	return s.msg.To
+}
+
+// SetLocalRtpAddr - sets the address we receive media on. It is advertised in the sdp answer to an INVITE
+func (s *SipMsg) SetLocalRtpAddr(addr *net.UDPAddr) {
+	s.localRtpAddr = addr
+}
+
+// SetLocalCrypto - our sdes key for the caller's media. The answer to an INVITE is srtp with it, or plain rtp when it is nil
+func (s *SipMsg) SetLocalCrypto(crypto *ports.SdpCrypto) {
+	s.localCrypto = crypto
+}
+
+// SetLocalSsrc - the ssrc and cname of the stream we send the caller
+func (s *SipMsg) SetLocalSsrc(ssrc uint32, cname string) {
+	s.localSsrc = ssrc
+	s.localCname = cname
+}
+
+// SetLocalWebRtc - our ice and dtls parameters, which make the sdp of our response webrtc
+func (s *SipMsg) SetLocalWebRtc(params *ports.WebRtcParams) {
+	s.localWebRtc = params
+}
+
+// SetTransport - records what the message came in on, udp, tls, ws or wss
+func (s *SipMsg) SetTransport(transport string) {
+	s.transport = transport
+}
+
+// GetTransport - what the message came in on, udp when we weren't told
+func (s *SipMsg) GetTransport() string {
+	if s.transport == "" {
+		return ports.TransportUDP
+	}
+
+	return s.transport
+}
+
+// GetRemoteSdp - the sdp in the body of the message
+func (s *SipMsg) GetRemoteSdp() (ports.SdpMessage, error) {
+	sdpMsg, err := s.sdp()
+	if err != nil {
+		return nil, err
+	}
+
+	return sdpMsg, nil
+}
+
+// sdp - the sdp in the body of the message. A client's was parsed along with the message, so only a body we were handed as bytes
+// needs parsing here
+func (s *SipMsg) sdp() (*SdpMsg, error) {
+	switch payload := s.msg.Payload.(type) {
+	case nil:
+		return nil, fmt.Errorf("no sdp in message")
+	case *SdpMsg:
+		return payload, nil
+	default:
+		return ParseSdp(string(payload.Data()))
+	}
+}
+
+// SetSource - records the address the message actually came from. Clients behind NAT don't know their public address, so the top
+// Via gets the received and rport params (rfc 3581), which makes our responses go back out through the hole their request came in
+func (s *SipMsg) SetSource(addr *net.UDPAddr) {
+	s.msg.SourceAddr = addr
+
+	via := s.msg.Via
+	if via == nil || addr == nil || s.IsResponse() {
+		return
+	}
+
+	rport := via.Param.Get("rport")
+	if rport != nil {
+		rport.Value = strconv.Itoa(addr.Port)
+	}
+
+	// received is required with rport, otherwise only when the Via's host isn't where the request came from
+	if rport != nil || via.Host != addr.IP.String() {
+		if received := via.Param.Get("received"); received != nil {
+			received.Value = addr.IP.String()
+		} else {
+			via.Param = &sip.Param{Name: "received", Value: addr.IP.String(), Next: via.Param}
+		}
+	}
+}
+
+// GetSource - the address the message came from, or nil if it didn't come off the network
+func (s *SipMsg) GetSource() *net.UDPAddr {
+	return s.msg.SourceAddr
+}
+
 // NewResponse - create a sip response based on the sip message
-func (s *SipMsg) NewResponse(code int) (*SipMsg, error) {
+func (s *SipMsg) NewResponse(code int) (ports.SipMessage, error) {
 	var sipMsg *sip.Msg
 	var err error
 
@@ -102,6 +266,11 @@ func (s *SipMsg) NewResponse(code int) (*SipMsg, error) {
 		sipMsg = s.newByeResponse(code)
 	case sip.MethodCancel:
 		sipMsg = s.newCancelResponse(code)
+	case ports.MethodSubscribe:
+		sipMsg = s.newSubscribeResponse(code)
+	case ports.MethodNotify, ports.MethodOptions, ports.MethodInfo, ports.MethodMessage, ports.MethodUpdate, ports.MethodPrack,
+		ports.MethodRefer, ports.MethodPublish:
+		sipMsg = s.newCancelResponse(code)
 	default:
 		return nil, fmt.Errorf("unsupported method: %s", s.msg.Method)
 	}
@@ -144,37 +313,540 @@ func (s *SipMsg) newCancelResponse(code int) *sip.Msg {
 	return response
 }
 
-func (s *SipMsg) newInviteResponse(code int) (*sip.Msg, error) {
-	rtpAddr, err := s.GetRtpAddress()
+func (s *SipMsg) newSubscribeResponse(code int) *sip.Msg {
+	response := dialog.NewResponse(s.msg, code)
+
+	response.Allow = ""
+	response.Expires = s.GetExpires()
+	response.Event = s.msg.Event
+	response.Contact = &sip.Addr{
+		Uri: s.msg.Request,
+	}
+
+	return response
+}
+
+// NewInDialogRequest - creates a request for us to send inside the dialog this message started, ie a BYE for an INVITE or a NOTIFY for a
+// SUBSCRIBE we answered. On the 2xx answering an INVITE of ours it is a request in the dialog we started, ie the BYE to the far end
+// of a bridged call
+func (s *SipMsg) NewInDialogRequest(method string, cseq int) (ports.SipMessage, error) {
+	if s.IsResponse() {
+		return s.newUacRequest(method, cseq)
+	}
+	if s.msg.Contact == nil {
+		return nil, fmt.Errorf("no contact header to send the %s to", method)
+	}
+
+	// TODO the request uri is what they dialed to reach us, which is the best guess we have for our own address
+	via := &sip.Via{
+		Host: s.msg.Request.Host,
+		Port: s.msg.Request.GetPort(),
+	}
+
+	// we are the other side of the dialog, so the from and to are swapped. The routes the request recorded are already in the order
+	// we go through them, it is only the caller that reverses them (rfc 3261 12.1.1)
+	req := &sip.Msg{
+		Method:     method,
+		Request:    s.msg.Contact.Uri.Copy(),
+		Via:        via.Branch(),
+		From:       s.msg.To.Copy(),
+		To:         s.msg.From.Copy(),
+		CallID:     s.msg.CallID,
+		CSeq:       cseq,
+		CSeqMethod: method,
+		Route:      s.msg.RecordRoute.Copy(),
+		UserAgent:  dialog.GosipUA,
+	}
+
+	return &SipMsg{
+		msg: req,
+	}, nil
+}
+
+// newUacRequest - a request in the dialog our INVITE started, from the 2xx that answered it. The from and to are as they were in the
+// INVITE, it goes to the far end's contact through the routes it recorded, in reverse (rfc 3261 12.2.1.1), and our Via comes back
+// with a branch of its own
+func (s *SipMsg) newUacRequest(method string, cseq int) (ports.SipMessage, error) {
+	if s.msg.CSeqMethod != sip.MethodInvite || s.msg.Status < 200 || s.msg.Status >= 300 {
+		return nil, fmt.Errorf("a dialog can only be started by a 2xx to an INVITE, not a %d to %s", s.msg.Status, s.msg.CSeqMethod)
+	}
+	if s.msg.Contact == nil || s.msg.Via == nil {
+		return nil, fmt.Errorf("no contact header to send the %s to", method)
+	}
+
+	req := &sip.Msg{
+		Method:     method,
+		Request:    s.msg.Contact.Uri.Copy(),
+		Via:        s.msg.Via.Detach().Copy(),
+		From:       s.msg.From.Copy(),
+		To:         s.msg.To.Copy(),
+		CallID:     s.msg.CallID,
+		CSeq:       cseq,
+		CSeqMethod: method,
+		Route:      s.msg.RecordRoute.Reversed(),
+		UserAgent:  dialog.GosipUA,
+	}
+	req.Via.Param = nil
+	req.Via.Branch()
+
+	return &SipMsg{
+		msg:       req,
+		transport: s.transport,
+	}, nil
+}
+
+// NewOutboundInvite - creates the INVITE for the other leg of a call we bridge. It is a new dialog of ours, with its own call id and
+// tags, from the caller to the target, and one hop closer to the loop limit than the INVITE it came from. Our Via and Contact are
+// the local address on the transport. The body is left for AddOffer, once the media has somewhere to go
+func (s *SipMsg) NewOutboundInvite(target *sip.URI, local *net.UDPAddr, transport string) (ports.SipMessage, error) {
+	if s.IsResponse() || s.msg.Method != sip.MethodInvite {
+		return nil, fmt.Errorf("only an INVITE can be bridged")
+	}
+	if target == nil || local == nil {
+		return nil, fmt.Errorf("INVITE needs a target and our address")
+	}
+
+	maxForwards := s.GetMaxForwards()
+	if maxForwards == 0 {
+		return nil, fmt.Errorf("too many hops")
+	}
+
+	from := &sip.Addr{Uri: s.msg.From.Uri.Copy()}
+	if s.msg.From.Display != "" {
+		from.Display = s.msg.From.Display
+	}
+	from.Tag()
+
+	via := &sip.Via{
+		Transport: strings.ToUpper(transport),
+		Host:      local.IP.String(),
+		Port:      uint16(local.Port),
+		Param:     &sip.Param{Name: "rport"},
+	}
+
+	req := &sip.Msg{
+		Method:      sip.MethodInvite,
+		Request:     target.Copy(),
+		Via:         via.Branch(),
+		From:        from,
+		To:          &sip.Addr{Uri: target.Copy()},
+		Contact:     &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: s.msg.From.Uri.User, Host: local.IP.String(), Port: uint16(local.Port)}},
+		CallID:      util.GenerateCallID(),
+		CSeq:        1,
+		CSeqMethod:  sip.MethodInvite,
+		MaxForwards: maxForwards - 1,
+		UserAgent:   dialog.GosipUA,
+	}
+	req.To.Uri.Param = nil
+
+	return &SipMsg{
+		msg:        req,
+		transport:  transport,
+		noHopsLeft: req.MaxForwards == 0,
+	}, nil
+}
+
+// AddOffer - puts our sdp offer in the body of an INVITE we are sending, with the address and ssrc set on it. We offer the codecs we
+// can transcode, and dtmf and comfort noise at the payload types most clients use
+func (s *SipMsg) AddOffer() error {
+	if s.localRtpAddr == nil {
+		return fmt.Errorf("offer needs the address we receive media on")
+	}
+
+	offer, err := NewSdpOffer().
+		WithAddr(s.localRtpAddr).
+		WithCodecs(sdp.ULAWCodec, sdp.Codec{PT: 8, Name: "PCMA", Rate: 8000},
+			sdp.Codec{PT: 101, Name: "telephone-event", Rate: 8000, Fmtp: "0-16"},
+			sdp.Codec{PT: 13, Name: "CN", Rate: 8000}).
+		WithPtime(s.GetMediaOptions().PacketizationTimeMs).
+		WithRtcp().
+		WithSsrc(s.localSsrc, s.localCname).
+		Build()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error building SDP offer: %v", err)
 	}
 
-	rtcpAddr, err := s.GetRtcpAddress()
+	s.localSdp = offer
+	s.msg.Payload = offer
+
+	return nil
+}
+
+// NewAck - acknowledges a final response to an INVITE of ours. A 2xx is acknowledged in its dialog, as a request of its own, and
+// anything else in the INVITE's transaction, on its branch (rfc 3261 17.1.1.3)
+func (s *SipMsg) NewAck(response ports.SipMessage) (ports.SipMessage, error) {
+	if s.IsResponse() || s.msg.Method != sip.MethodInvite {
+		return nil, fmt.Errorf("only an INVITE is acknowledged")
+	}
+
+	if status := response.GetStatus(); status >= 200 && status < 300 {
+		return response.NewInDialogRequest(ports.MethodAck, s.msg.CSeq)
+	}
+
+	ack := &sip.Msg{
+		Method:     sip.MethodAck,
+		Request:    s.msg.Request,
+		Via:        s.msg.Via.Detach(),
+		From:       s.msg.From,
+		To:         response.GetTo(),
+		CallID:     s.msg.CallID,
+		CSeq:       s.msg.CSeq,
+		CSeqMethod: sip.MethodAck,
+		Route:      s.msg.Route,
+		UserAgent:  dialog.GosipUA,
+	}
+
+	return &SipMsg{
+		msg:       ack,
+		transport: s.transport,
+	}, nil
+}
+
+// NewCancel - cancels an INVITE of ours that hasn't been answered yet. It goes on the INVITE's branch, so it hits the same
+// transaction (rfc 3261 9.1)
+func (s *SipMsg) NewCancel() (ports.SipMessage, error) {
+	if s.IsResponse() || s.msg.Method != sip.MethodInvite {
+		return nil, fmt.Errorf("only an INVITE can be cancelled")
+	}
+
+	cancel := dialog.NewCancel(s.msg)
+	cancel.Via = s.msg.Via.Detach()
+	cancel.UserAgent = dialog.GosipUA
+
+	return &SipMsg{
+		msg:       cancel,
+		transport: s.transport,
+	}, nil
+}
+
+// GetMaxForwards - how many more hops the request can take, 70 when it doesn't say
+func (s *SipMsg) GetMaxForwards() int {
+	if s.noHopsLeft {
+		return 0
+	}
+	// gosip can't tell a missing Max-Forwards from a 0, and sends 0 as 70 too
+	if s.msg.MaxForwards == 0 {
+		return 70
+	}
+
+	return s.msg.MaxForwards
+}
+
+// IsInDialog - whether the request is in a dialog, by the To tag the far end gave it rather than one we made up on parsing
+func (s *SipMsg) IsInDialog() bool {
+	return !s.ourTag && s.msg.To != nil && s.msg.To.Param.Get("tag") != nil
+}
+
+// GetBranch - the branch of the top Via, which names the transaction the message is in (rfc 3261 17.2.3)
+func (s *SipMsg) GetBranch() string {
+	if s.msg.Via == nil {
+		return ""
+	}
+	if branch := s.msg.Via.Param.Get("branch"); branch != nil {
+		return branch.Value
+	}
+
+	return ""
+}
+
+// GetRoutes - the uris of the Route headers, the next hop first
+func (s *SipMsg) GetRoutes() []*sip.URI {
+	var routes []*sip.URI
+	for route := s.msg.Route; route != nil; route = route.Next {
+		routes = append(routes, route.Uri)
+	}
+
+	return routes
+}
+
+// GetViaAddr - where the top Via says responses go, with the received and rport params of a sender behind NAT (rfc 3581), and the
+// transport they go over
+func (s *SipMsg) GetViaAddr() (*net.UDPAddr, string, error) {
+	via := s.msg.Via
+	if via == nil {
+		return nil, "", fmt.Errorf("no Via to send the response to")
+	}
+
+	host, port := via.Host, int(via.Port)
+	if received := via.Param.Get("received"); received != nil && received.Value != "" {
+		host = received.Value
+	}
+	if rport := via.Param.Get("rport"); rport != nil && rport.Value != "" {
+		p, err := strconv.Atoi(rport.Value)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid rport %q: %v", rport.Value, err)
+		}
+		port = p
+	}
+	if port == 0 {
+		port = 5060
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	sdpMsg, err := sdp.Parse(string(s.msg.Payload.Data()))
+	return addr, strings.ToLower(via.Transport), nil
+}
+
+// NewForwardedRequest - the request as a proxy passes it on (rfc 3261 16.6): to the hop's target, one hop closer to the loop limit,
+// with our Via on top and our Record-Route when the request starts a dialog we want to stay in. The To tag we made up on parsing
+// comes back off, since it is for the far end to pick
+func (s *SipMsg) NewForwardedRequest(hop ports.ForwardHop) (ports.SipMessage, error) {
+	if s.IsResponse() {
+		return nil, fmt.Errorf("only a request can be forwarded")
+	}
+	if hop.Local == nil {
+		return nil, fmt.Errorf("forwarding needs our address")
+	}
+
+	maxForwards := s.GetMaxForwards()
+	if maxForwards == 0 {
+		return nil, fmt.Errorf("too many hops")
+	}
+
+	req := s.msg.Copy()
+	req.MaxForwards = maxForwards - 1
+	if hop.Target != nil {
+		req.Request = hop.Target.Copy()
+	}
+	if hop.PopRoute && req.Route != nil {
+		req.Route = req.Route.Next
+	}
+	if s.ourTag && req.To != nil {
+		req.To = req.To.Copy()
+		req.To.Param = withoutParam(req.To.Param, "tag")
+	}
+
+	req.Via = &sip.Via{
+		Transport: strings.ToUpper(hop.Transport),
+		Host:      hop.Local.IP.String(),
+		Port:      uint16(hop.Local.Port),
+		Param:     &sip.Param{Name: "branch", Value: hop.Branch, Next: &sip.Param{Name: "rport"}},
+		Next:      req.Via,
+	}
+
+	if hop.RecordRoute {
+		uri := &sip.URI{
+			Scheme: "sip",
+			Host:   hop.Local.IP.String(),
+			Port:   uint16(hop.Local.Port),
+			Param:  &sip.URIParam{Name: "lr"},
+		}
+		req.RecordRoute = &sip.Addr{Uri: uri, Next: req.RecordRoute}
+	}
+
+	return &SipMsg{
+		msg:        req,
+		transport:  hop.Transport,
+		noHopsLeft: req.MaxForwards == 0,
+	}, nil
+}
+
+// NewForwardedResponse - the response as a proxy passes it back, with our Via taken off the top (rfc 3261 16.7)
+func (s *SipMsg) NewForwardedResponse() (ports.SipMessage, error) {
+	if !s.IsResponse() {
+		return nil, fmt.Errorf("only a response can be passed back")
+	}
+	if s.msg.Via == nil || s.msg.Via.Next == nil {
+		return nil, fmt.Errorf("no Via to pass the response back to")
+	}
+
+	res := s.msg.Copy()
+	res.Via = res.Via.Next
+
+	return &SipMsg{
+		msg: res,
+	}, nil
+}
+
+// withoutParam - the params without the named one, leaving the list it came from as it was
+func withoutParam(param *sip.Param, name string) *sip.Param {
+	if param == nil {
+		return nil
+	}
+	if param.Name == name {
+		return withoutParam(param.Next, name)
+	}
+
+	return &sip.Param{Name: param.Name, Value: param.Value, Next: withoutParam(param.Next, name)}
+}
+
+// packet - a sip packet split at the blank line after its headers, into what gosip parses and what we read ourselves
+type packet struct {
+	// the start line and headers, less Content-Length and Content-Type, which without the body would mean nothing to gosip
+	head        []byte
+	contentType string
+	body        []byte
+	// whether the headers have a Max-Forwards, since gosip reads a 0 the same as it missing
+	hasMaxForwards bool
+}
+
+// splitPacket - splits the packet into its headers and body. The headers are handed on with CRLF line endings, whichever the client used
+func splitPacket(b []byte) (*packet, error) {
+	end, blank := bytes.Index(b, []byte("\r\n\r\n")), 4
+	if n := bytes.Index(b, []byte("\n\n")); n >= 0 && (end < 0 || n < end) {
+		end, blank = n, 2
+	}
+	if end < 0 {
+		// no end to the headers, which gosip will tell the caller about
+		return &packet{head: b}, nil
+	}
+
+	p := &packet{body: b[end+blank:]}
+	var head bytes.Buffer
+	contentLength := -1
+	dropping := false
+	for i, line := range bytes.Split(b[:end], []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		// a line starting with white space carries on the header before it (rfc 3261 7.3.1)
+		folded := i > 0 && len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		if !folded {
+			dropping = false
+		}
+		if n := bytes.IndexByte(line, ':'); i > 0 && !folded && n >= 0 {
+			value := strings.TrimSpace(string(line[n+1:]))
+			switch strings.ToLower(strings.TrimSpace(string(line[:n]))) {
+			case "content-length", "l":
+				length, err := strconv.Atoi(value)
+				if err != nil || length < 0 {
+					return nil, fmt.Errorf("invalid Content-Length: %s", value)
+				}
+				contentLength, dropping = length, true
+			case "content-type", "c":
+				// the media type without its parameters, which are all charset and the like
+				p.contentType, dropping = strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0])), true
+			case "max-forwards":
+				p.hasMaxForwards = true
+			}
+		}
+		if !dropping {
+			head.Write(line)
+			head.WriteString("\r\n")
+		}
+	}
+	head.WriteString("\r\n")
+	p.head = head.Bytes()
+
+	if contentLength >= 0 && contentLength != len(p.body) {
+		return nil, fmt.Errorf("Content-Length incorrect: %d != %d", contentLength, len(p.body))
+	}
+
+	return p, nil
+}
+
+// GetHeader - returns the value of a header, or empty if it isn't set
+func (s *SipMsg) GetHeader(name string) string {
+	switch strings.ToLower(name) {
+	case "event":
+		return s.msg.Event
+	case "refer-to":
+		return s.msg.ReferTo
+	case "referred-by":
+		return s.msg.ReferredBy
+	case "supported":
+		return s.msg.Supported
+	}
+
+	if h := s.msg.XHeader.Get(name); h != nil {
+		return string(h.Value)
+	}
+
+	return ""
+}
+
+// SetHeader - sets a header on the message, replacing it if it already exists
+func (s *SipMsg) SetHeader(name string, value string) {
+	switch strings.ToLower(name) {
+	case "event":
+		s.msg.Event = value
+		return
+	case "refer-to":
+		s.msg.ReferTo = value
+		return
+	case "referred-by":
+		s.msg.ReferredBy = value
+		return
+	}
+
+	if h := s.msg.XHeader.Get(name); h != nil {
+		h.Value = []byte(value)
+		return
+	}
+
+	s.msg.XHeader = &sip.XHeader{
+		Name:  name,
+		Value: []byte(value),
+		Next:  s.msg.XHeader,
+	}
+}
+
+// SetPayload - sets the body of the message
+func (s *SipMsg) SetPayload(contentType string, body []byte) {
+	s.msg.Payload = &sip.MiscPayload{
+		T: contentType,
+		D: body,
+	}
+}
+
+func (s *SipMsg) newInviteResponse(code int) (*sip.Msg, error) {
+	if code >= 300 || code == 100 || code == 180 {
+		// turning the call down, or not answering it yet, so there is nothing to answer the offer with
+		response := dialog.NewResponse(s.msg, code)
+		response.Allow = ""
+		return response, nil
+	}
+
+	offer, err := s.sdp()
 	if err != nil {
 		return nil, fmt.Errorf("error parsing SDP message %v", err)
 	}
 
-	sdpRes := sdp.New(rtpAddr, sdp.ULAWCodec)
-	sdpRes.SendOnly = true
-	sdpRes.RecvOnly = false
-
-	// TODO we need a better way to determine if we should set the ssrc. the method auto generates a random one if it doesnt exist in the request
-	// sdpRes.Attrs = append(sdpRes.Attrs, [2]string{"ssrc", fmt.Sprintf("%d cname:%s", si.ssrc, si.cname)})
+	// opus or g711, u-law or a-law, whichever the caller put first
+	audio, ok := s.audioCodec()
+	if !ok {
+		return nil, fmt.Errorf("offer has no opus or g711 audio")
+	}
+	codecs := []sdp.Codec{audio}
+	if isOpus(audio) {
+		// we send mono, and ask for it back, at the rate we play out at (rfc 7587 7)
+		rate := s.GetMediaOptions().SampleRateHz
+		codecs[0].Fmtp = fmt.Sprintf("maxplaybackrate=%d;sprop-maxcapturerate=%d;stereo=0;sprop-stereo=0", rate, rate)
+	}
+	// accept rfc 2833 dtmf using whatever payload type the caller picked
+	if _, ok := s.GetDtmfPayloadType(); ok {
+		codecs = append(codecs, sdp.Codec{Name: "telephone-event", Rate: audio.Rate, Fmtp: "0-16"})
+	}
+	// and rfc 3389 comfort noise, which we send in place of the silences in what we play
+	if _, ok := s.GetComfortNoisePayloadType(); ok {
+		codecs = append(codecs, sdp.Codec{Name: "CN", Rate: audio.Rate})
+	}
 
-	if rtcpAddr != nil {
-		sdpRes.Attrs = append(sdpRes.Attrs, [2]string{"rtcp", fmt.Sprintf("%d IN IP4 %s", rtcpAddr.Port, rtcpAddr.IP)})
+	builder := NewSdpAnswer(offer).
+		WithCodecs(codecs...).
+		WithPtime(s.GetMediaOptions().PacketizationTimeMs).
+		WithPrevious(s.previousSdp)
+
+	if s.localRtpAddr != nil {
+		// point the caller at the socket we both send and receive on
+		builder.WithAddr(s.localRtpAddr).WithRtcp().WithRtcpXr(rtcpXrReports...).WithSsrc(s.localSsrc, s.localCname).
+			WithCrypto(s.localCrypto).WithWebRtc(s.localWebRtc)
+	} else {
+		// without a socket of our own we can only send, so the caller's address is all we have to put in the sdp
+		rtpAddr, err := s.GetRtpAddress()
+		if err != nil {
+			return nil, err
+		}
+		builder.WithAddr(rtpAddr).WithDirection("sendonly")
 	}
 
-	sdpRes.Origin.ID = sdpMsg.Origin.ID
-	sdpRes.Origin.Version = sdpMsg.Origin.ID
-	sdpRes.Session = sdpMsg.Session
-	sdpRes.Ptime = s.GetMediaOptions().PacketizationTimeMs
+	answer, err := builder.Build()
+	if err != nil {
+		return nil, fmt.Errorf("error building SDP answer: %v", err)
+	}
+	s.localSdp = answer
 
 	response := dialog.NewResponse(s.msg, code)
 
@@ -184,11 +856,26 @@ func (s *SipMsg) newInviteResponse(code int) (*sip.Msg, error) {
 		Uri: s.msg.Request,
 	}
 	response.Allow = ""
-	response.Payload = sdpRes
+	response.Payload = answer
 
 	return response, nil
 }
 
+// SetPreviousSdp - the last sdp we sent in this session, so the answer to a re-INVITE keeps its session id and version
+func (s *SipMsg) SetPreviousSdp(previous ports.SdpMessage) {
+	// only our own sdp carries the origin we need to keep
+	s.previousSdp, _ = previous.(*SdpMsg)
+}
+
+// GetLocalSdp - the sdp we put in our answer, nil until the response to an INVITE has been made
+func (s *SipMsg) GetLocalSdp() ports.SdpMessage {
+	if s.localSdp == nil {
+		return nil
+	}
+
+	return s.localSdp
+}
+
 func (s *SipMsg) newRegisterResponse(code int) (*sip.Msg, error) {
 	response := dialog.NewResponse(s.msg, code)
 
@@ -246,7 +933,7 @@ func (s *SipMsg) GetExpires() int {
 // Validate - validates the sip message
 func (s *SipMsg) Validate() error {
 	// we dont worry about validating responses because they are made by us
-	if s.isResponse() {
+	if s.IsResponse() {
 		fmt.Println("skipping validation for response")
 		return nil
 	}
@@ -262,9 +949,44 @@ func (s *SipMsg) Validate() error {
 		return nil
 	case sip.MethodCancel:
 		return nil
+	case ports.MethodSubscribe:
+		return s.validateSubscribe()
+	case ports.MethodNotify:
+		return nil
+	case ports.MethodOptions, ports.MethodInfo, ports.MethodMessage, ports.MethodUpdate, ports.MethodPrack, ports.MethodRefer,
+		ports.MethodPublish:
+		// nothing we answer ourselves, but a proxy passes them on
+		return nil
 	default:
 		return fmt.Errorf("unsupported method: %s", s.msg.Method)
 	}
+}
+
+func (s *SipMsg) validateSubscribe() error {
+	if s.msg.From.Param.Get("tag") == nil {
+		return fmt.Errorf("tag is empty in the `from` attribute")
+	}
+
+	if s.msg.To == nil {
+		s.msg.To = &sip.Addr{
+			Uri: s.msg.Request,
+		}
+	}
+
+	// a refresh already has our tag from when we accepted the subscription
+	if s.msg.To.Param.Get("tag") == nil {
+		s.msg.To.Tag()
+		s.ourTag = true
+	}
+
+	if s.msg.CSeq == 0 || s.msg.CSeqMethod == "" { // check that cseq is valid
+		return fmt.Errorf("invalid cseq")
+	}
+
+	if s.msg.CallID == "" { // check that call id is valid
+		return fmt.Errorf("invalid call id")
+	}
+
 	return nil
 }
 
@@ -300,9 +1022,9 @@ func (s *SipMsg) validateRegister() error {
 }
 
 func (s *SipMsg) validateInvite() error {
-	sdpMsg, err := sdp.Parse(string(s.msg.Payload.Data()))
-	if err != nil {
-		return fmt.Errorf("error parsing SDP message %v", err)
+	offer, ok := s.msg.Payload.(*SdpMsg)
+	if !ok {
+		return fmt.Errorf("no sdp in INVITE")
 	}
 
 	tag := s.msg.From.Param.Get("tag")
@@ -316,27 +1038,20 @@ func (s *SipMsg) validateInvite() error {
 		}
 	}
 
-	// make sure we generate a tag now
-	s.msg.To.Tag()
+	// make sure we generate a tag now. a re-INVITE already has ours
+	if s.msg.To.Param.Get("tag") == nil {
+		s.msg.To.Tag()
+		s.ourTag = true
+	}
 
 	// TODO the Session-Expires header is set by some sip clients to negotiate how long the session will be
 
 	// only do audio
-	if sdpMsg.Audio == nil {
+	if offer.Audio() == nil {
 		return fmt.Errorf("no audio in sdp")
 	}
 
-	// make sure the client supports our codec (g.711/u-law/PCMU)
-	isSupportedCodec := false
-	for _, c := range sdpMsg.Audio.Codecs {
-		if c.Name == "PCMU" {
-			isSupportedCodec = true
-		}
-	}
-	if !isSupportedCodec {
-		// TODO we need to send a 488 Not Acceptable Here response or something similar instead of continue
-		return fmt.Errorf("client does not support our codec")
-	}
+	// whether it offers a codec we have is left to the call, which turns it down with a 488 when it doesn't
 
 	if s.msg.CSeq == 0 || s.msg.CSeqMethod == "" { // check that cseq is valid
 		return fmt.Errorf("invalid cseq")
@@ -352,12 +1067,15 @@ func (s *SipMsg) validateInvite() error {
 
 // GetRtpAddress - returns the rtp address from the sdp message
 func (s *SipMsg) GetRtpAddress() (*net.UDPAddr, error) {
-	sdpMsg, err := sdp.Parse(string(s.msg.Payload.Data()))
+	sdpMsg, err := s.sdp()
 	if err != nil {
 		return nil, fmt.Errorf("error parsing SDP message %v", err)
 	}
 
-	addr := fmt.Sprintf("%s:%d", sdpMsg.Addr, sdpMsg.Audio.Port)
+	addr := sdpMsg.GetMediaAddress()
+	if addr == "" {
+		return nil, fmt.Errorf("no audio in sdp")
+	}
 
 	// TODO maybe just do this once and save the info to our object
 	rtpAddr, err := net.ResolveUDPAddr("udp", addr)
@@ -368,45 +1086,55 @@ func (s *SipMsg) GetRtpAddress() (*net.UDPAddr, error) {
 	return rtpAddr, nil
 }
 
-// GetRtcpAddress - returns the rtcp address from the sdp message
+// GetRtcpAddress - returns the rtcp address from the sdp message. Without an a=rtcp it is the port above rtp (rfc 3550)
 func (s *SipMsg) GetRtcpAddress() (*net.UDPAddr, error) {
-	sdpMsg, err := sdp.Parse(string(s.msg.Payload.Data()))
+	sdpMsg, err := s.sdp()
 	if err != nil {
 		return nil, fmt.Errorf("error parsing SDP message %v", err)
 	}
 
-	_, _, rtcpAddr, err := getAttributesFromSdp(sdpMsg)
+	addr := sdpMsg.GetRtcpAddress()
+	if addr == "" {
+		return nil, fmt.Errorf("no audio in sdp")
+	}
+
+	rtcpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return nil, fmt.Errorf("error getting attributes from sdp: %v", err)
+		return nil, fmt.Errorf("error resolving rtcp addr: %v", err)
 	}
 
 	return rtcpAddr, nil
 }
 
-// GetSsrc - returns the ssrc from the sdp message, includes the cname if available. used to identify the stream
+// GetSsrc - returns the ssrc from the sdp message, includes the cname if available. used to identify the stream. A random ssrc is made up when the sdp doesn't have one
 func (s *SipMsg) GetSsrc() (uint32, string, error) {
-	sdpMsg, err := sdp.Parse(string(s.msg.Payload.Data()))
+	sdpMsg, err := s.sdp()
 	if err != nil {
 		return 0, "", fmt.Errorf("error parsing SDP message %v", err)
 	}
 
-	ssrc, cname, _, err := getAttributesFromSdp(sdpMsg)
-	if err != nil {
-		return 0, "", fmt.Errorf("error getting attributes from sdp: %v", err)
+	ssrc := sdpMsg.GetSsrc()
+	if ssrc == 0 {
+		ssrc = RandUint32()
 	}
 
-	return ssrc, cname, nil
+	return ssrc, sdpMsg.GetCname(), nil
 }
 
-// GetMediaOptions - returns the media options from the sdp message
-func (*SipMsg) GetMediaOptions() *ports.MediaOptions {
-	// TODO we should grab this dynamically when we implement more than just ulaw
-	return &ports.MediaOptions{
+// GetMediaOptions - returns the media options from the sdp message. Everything we play and hear is 8000hz, only opus puts another
+// clock on the rtp timestamps
+func (s *SipMsg) GetMediaOptions() *ports.MediaOptions {
+	opts := &ports.MediaOptions{
 		PacketizationTimeMs:  20,
 		SampleRateHz:         8000,
 		SampleFormatPcmBytes: 1,
 		ChannelSize:          1,
 	}
+	if audio, ok := s.audioCodec(); ok && audio.Rate != opts.SampleRateHz {
+		opts.ClockRateHz = audio.Rate
+	}
+
+	return opts
 }
 
 // IsUnregister - returns true if the message is a sip unregister request
@@ -422,11 +1150,88 @@ func (s *SipMsg) IsUnregister() bool {
 	return false
 }
 
+// GetDtmfPayloadType - returns the payload type the caller uses for rfc 2833 dtmf events, if they offered it at the clock rate of the audio
+func (s *SipMsg) GetDtmfPayloadType() (uint8, bool) {
+	return s.offeredPayloadType("telephone-event")
+}
+
+// GetAudioPayloadType - the payload type of the first audio codec in the sdp we can send, opus or g711. In an answer that is the one
+// the far end picked for us to send
+func (s *SipMsg) GetAudioPayloadType() (uint8, bool) {
+	audio, ok := s.audioCodec()
+
+	return audio.PT, ok
+}
+
+// GetOpusPayloadType - the dynamic payload type of opus, when it is the audio codec of the sdp
+func (s *SipMsg) GetOpusPayloadType() (uint8, bool) {
+	audio, ok := s.audioCodec()
+	if !ok || !isOpus(audio) {
+		return 0, false
+	}
+
+	return audio.PT, true
+}
+
+// GetComfortNoisePayloadType - returns the payload type the caller uses for rfc 3389 comfort noise, if they offered it at the clock
+// rate of the audio. It is 13 unless they gave it a dynamic one
+func (s *SipMsg) GetComfortNoisePayloadType() (uint8, bool) {
+	return s.offeredPayloadType("CN")
+}
+
+// audioCodec - the first audio codec in the sdp we can send, in the caller's order of preference
+func (s *SipMsg) audioCodec() (sdp.Codec, bool) {
+	sdpMsg, err := s.sdp()
+	if err != nil || sdpMsg.Audio() == nil {
+		return sdp.Codec{}, false
+	}
+
+	for _, c := range sdpMsg.Audio().Codecs() {
+		if c.PT == ports.PcmuPayloadType || c.PT == ports.PcmaPayloadType || (OpusSupported && isOpus(c)) {
+			return c, true
+		}
+	}
+
+	return sdp.Codec{}, false
+}
+
+// isOpus - whether the codec is opus, whose rtpmap always has the 48000hz clock (rfc 7587 7)
+func isOpus(c sdp.Codec) bool {
+	return strings.EqualFold(c.Name, "opus") && c.Rate == ports.OpusClockRateHz
+}
+
+// offeredPayloadType - the payload type of the first audio codec in the sdp with the encoding name, at the same clock rate as the
+// audio it goes with
+func (s *SipMsg) offeredPayloadType(name string) (uint8, bool) {
+	sdpMsg, err := s.sdp()
+	if err != nil || sdpMsg.Audio() == nil {
+		return 0, false
+	}
+
+	rate := 8000
+	if audio, ok := s.audioCodec(); ok {
+		rate = audio.Rate
+	}
+	for _, c := range sdpMsg.Audio().Codecs() {
+		if strings.EqualFold(c.Name, name) && c.Rate == rate {
+			return c.PT, true
+		}
+	}
+
+	return 0, false
+}
+
 // GetCSeq - returns the cseq number and method from the sip message
 func (s *SipMsg) GetCSeq() (int, string) {
 	return s.msg.CSeq, s.msg.CSeqMethod
 }
 
-func (s *SipMsg) isResponse() bool {
+// IsResponse - returns true if the message is a response rather than a request
+func (s *SipMsg) IsResponse() bool {
 	return s.msg.IsResponse()
 }
+
+// GetStatus - the status code of a response, 0 for requests
+func (s *SipMsg) GetStatus() int {
+	return s.msg.Status
+}
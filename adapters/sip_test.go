@@ -0,0 +1,295 @@
+package adapters
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jart/gosip/sip"
+
+	"sip_and_rip/ports"
+)
+
+const testSdp = "v=0\r\no=alice 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n"
+
+func testInvite(headers string, body string) string {
+	return "INVITE sip:bob@127.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 127.0.0.1:5070;branch=z9hG4bKabc\r\n" +
+		"From: <sip:alice@127.0.0.1>;tag=a1\r\n" +
+		"To: <sip:bob@127.0.0.1>\r\n" +
+		"Call-ID: c1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Contact: <sip:alice@127.0.0.1:5070>\r\n" +
+		headers +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+}
+
+// routes - the Route headers of the packet, in order
+func routes(t *testing.T, msg interface{ Append(*bytes.Buffer) }) []string {
+	t.Helper()
+
+	var b bytes.Buffer
+	msg.Append(&b)
+	var found []string
+	for _, line := range strings.Split(b.String(), "\r\n") {
+		if strings.HasPrefix(line, "Route: ") {
+			for _, r := range strings.Split(strings.TrimPrefix(line, "Route: "), ",") {
+				found = append(found, strings.TrimSpace(r))
+			}
+		}
+	}
+
+	return found
+}
+
+func TestInDialogRouteSet(t *testing.T) {
+	invite, err := ParseSipMsg([]byte(testInvite("Record-Route: <sip:p1.example.com;lr>, <sip:p2.example.com;lr>\r\n", testSdp)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// we answered the INVITE, so our BYE goes through the proxies in the order they recorded themselves
+	bye, err := invite.NewInDialogRequest("BYE", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := routes(t, bye)
+	if len(got) != 2 || !strings.Contains(got[0], "p1") || !strings.Contains(got[1], "p2") {
+		t.Errorf("got routes %v, want p1 then p2", got)
+	}
+}
+
+func TestParseInviteSdp(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantPt  uint8
+		wantErr bool
+	}{
+		{name: "crlf", body: testSdp, wantPt: 0},
+		{name: "lf line endings", body: strings.ReplaceAll(testSdp, "\r\n", "\n"), wantPt: 0},
+		{
+			name:   "connection only on the media",
+			body:   "v=0\r\no=alice 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=audio 4000 RTP/AVP 8\r\nc=IN IP4 127.0.0.1\r\n",
+			wantPt: 8,
+		},
+		{
+			name:   "dynamic payload type without an rtpmap",
+			body:   testSdp[:len(testSdp)-2] + " 96\r\n",
+			wantPt: 0,
+		},
+		{
+			name:   "payload type nobody assigned",
+			body:   "v=0\r\no=alice 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 35 8\r\n",
+			wantPt: 8,
+		},
+		{name: "no audio", body: strings.Replace(testSdp, "m=audio", "m=video", 1), wantErr: true},
+		{name: "no connection address", body: strings.Replace(testSdp, "c=IN IP4 127.0.0.1\r\n", "", 1), wantErr: true},
+		{name: "no body", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invite, err := ParseSipMsg([]byte(testInvite("", tt.body)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("parsed an INVITE we can't answer")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pt, ok := invite.GetAudioPayloadType(); !ok || pt != tt.wantPt {
+				t.Errorf("got audio payload type %d %v, want %d", pt, ok, tt.wantPt)
+			}
+		})
+	}
+}
+
+func testOptions(headers string) string {
+	return "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 127.0.0.1:5070;branch=z9hG4bKopt\r\n" +
+		"From: <sip:alice@127.0.0.1>;tag=a1\r\n" +
+		"To: <sip:bob@127.0.0.1>\r\n" +
+		"Call-ID: o1\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		headers +
+		"Content-Length: 0\r\n\r\n"
+}
+
+// maxForwards - the Max-Forwards headers of the packet
+func maxForwards(msg interface{ Append(*bytes.Buffer) }) []string {
+	var b bytes.Buffer
+	msg.Append(&b)
+	var found []string
+	for _, line := range strings.Split(b.String(), "\r\n") {
+		if strings.HasPrefix(line, "Max-Forwards:") {
+			found = append(found, line)
+		}
+	}
+
+	return found
+}
+
+func TestMaxForwards(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		want   int
+	}{
+		{name: "missing", packet: testOptions(""), want: 70},
+		{name: "some left", packet: testOptions("Max-Forwards: 5\r\n"), want: 5},
+		{name: "none left", packet: testOptions("Max-Forwards: 0\r\n"), want: 0},
+		{name: "none left, lf line endings", packet: strings.ReplaceAll(testOptions("max-forwards: 0\r\n"), "\r\n", "\n"), want: 0},
+		{name: "missing, lf line endings", packet: strings.ReplaceAll(testOptions(""), "\r\n", "\n"), want: 70},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseSipMsg([]byte(tt.packet))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := msg.GetMaxForwards(); got != tt.want {
+				t.Errorf("got Max-Forwards %d, want %d", got, tt.want)
+			}
+			if got, want := maxForwards(msg), "Max-Forwards: "+strconv.Itoa(tt.want); len(got) != 1 || got[0] != want {
+				t.Errorf("wrote %v, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestForwardLastHop(t *testing.T) {
+	msg, err := ParseSipMsg([]byte(testOptions("Max-Forwards: 1\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hop := ports.ForwardHop{Local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5061}, Transport: ports.TransportUDP, Branch: "z9hG4bKfwd"}
+	forwarded, err := msg.NewForwardedRequest(hop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := maxForwards(forwarded); len(got) != 1 || got[0] != "Max-Forwards: 0" {
+		t.Errorf("forwarded with %v, want just Max-Forwards: 0", got)
+	}
+
+	// and it goes no further
+	var b bytes.Buffer
+	forwarded.Append(&b)
+	reparsed, err := ParseSipMsg(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reparsed.NewForwardedRequest(hop); err == nil {
+		t.Error("forwarded a request with no hops left")
+	}
+}
+
+func TestOutboundInviteMaxForwards(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		want    string
+	}{
+		{name: "missing", want: "Max-Forwards: 69"},
+		{name: "some left", headers: "Max-Forwards: 5\r\n", want: "Max-Forwards: 4"},
+		{name: "last hop", headers: "Max-Forwards: 1\r\n", want: "Max-Forwards: 0"},
+		{name: "none left", headers: "Max-Forwards: 0\r\n"},
+	}
+
+	target := &sip.URI{Scheme: "sip", User: "carol", Host: "10.0.0.2"}
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5061}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invite, err := ParseSipMsg([]byte(testInvite(tt.headers, testSdp)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := invite.NewOutboundInvite(target, local, ports.TransportUDP)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatal("bridged a call with no hops left")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := maxForwards(out); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("got %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnswerAudioCodec(t *testing.T) {
+	const browserSdp = "v=0\r\no=alice 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n"
+	tests := []struct {
+		name      string
+		media     string
+		opus      bool
+		wantCodec string
+		wantDtmf  uint8
+		wantClock int
+	}{
+		{
+			name: "opus first",
+			media: "m=audio 4000 RTP/AVP 111 0 110 126\r\na=rtpmap:111 opus/48000/2\r\na=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+				"a=rtpmap:110 telephone-event/48000\r\na=rtpmap:126 telephone-event/8000\r\n",
+			opus: true, wantCodec: "111 opus/48000/2", wantDtmf: 110, wantClock: 48000,
+		},
+		{
+			name: "g711 first",
+			media: "m=audio 4000 RTP/AVP 0 111 110 126\r\na=rtpmap:111 opus/48000/2\r\n" +
+				"a=rtpmap:110 telephone-event/48000\r\na=rtpmap:126 telephone-event/8000\r\n",
+			wantCodec: "0 PCMU/8000", wantDtmf: 126,
+		},
+		{
+			name:      "opus at the wrong clock rate",
+			media:     "m=audio 4000 RTP/AVP 111 8\r\na=rtpmap:111 opus/16000\r\n",
+			wantCodec: "8 PCMA/8000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.opus && !OpusSupported {
+				t.Skip("opus needs cgo")
+			}
+			invite, err := ParseSipMsg([]byte(testInvite("", browserSdp+tt.media)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pt, ok := invite.GetOpusPayloadType(); ok != tt.opus || (ok && pt != 111) {
+				t.Errorf("got opus payload type %d %v, want it %v", pt, ok, tt.opus)
+			}
+			if dtmf, ok := invite.GetDtmfPayloadType(); ok != (tt.wantDtmf != 0) || dtmf != tt.wantDtmf {
+				t.Errorf("got dtmf payload type %d %v, want %d", dtmf, ok, tt.wantDtmf)
+			}
+			if clock := invite.GetMediaOptions().ClockRateHz; clock != tt.wantClock {
+				t.Errorf("got clock rate %d, want %d", clock, tt.wantClock)
+			}
+
+			if _, err := invite.NewResponse(200); err != nil {
+				t.Fatal(err)
+			}
+			answer := invite.GetLocalSdp().(*SdpMsg).Audio()
+			if len(answer.Formats) == 0 || !strings.HasPrefix(tt.wantCodec, answer.Formats[0]+" ") {
+				t.Fatalf("answered with %v, want %s first", answer.Formats, tt.wantCodec)
+			}
+			if rtpmap, _ := answer.Get("rtpmap"); rtpmap != tt.wantCodec {
+				t.Errorf("answered with rtpmap %q, want %q", rtpmap, tt.wantCodec)
+			}
+		})
+	}
+}
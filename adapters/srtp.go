@@ -0,0 +1,112 @@
+package adapters
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/pion/srtp/v2"
+
+	"sip_and_rip/ports"
+)
+
+// how far back an srtp packet can be and still be let in, as long as it hasn't been seen before (rfc 3711 3.3.2)
+const srtpReplayWindow = 128
+
+// srtpSuite - how an sdes crypto suite maps on to an srtp protection profile
+type srtpSuite struct {
+	profile srtp.ProtectionProfile
+	keyLen  int
+	saltLen int
+}
+
+// the crypto suites we support
+var srtpSuites = map[string]srtpSuite{
+	ports.SrtpAesCm128HmacSha1_80: {profile: srtp.ProtectionProfileAes128CmHmacSha1_80, keyLen: 16, saltLen: 14},
+	ports.SrtpAesCm128HmacSha1_32: {profile: srtp.ProtectionProfileAes128CmHmacSha1_32, keyLen: 16, saltLen: 14},
+	ports.SrtpAeadAes128Gcm:       {profile: srtp.ProtectionProfileAeadAes128Gcm, keyLen: 16, saltLen: 12},
+}
+
+// NewSrtpKey - a random master key and salt for the crypto suite, for our side of an sdes exchange
+func NewSrtpKey(suite string) ([]byte, error) {
+	s, ok := srtpSuites[suite]
+	if !ok {
+		return nil, fmt.Errorf("unsupported srtp crypto suite: %s", suite)
+	}
+
+	key := make([]byte, s.keyLen+s.saltLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating srtp key: %v", err)
+	}
+
+	return key, nil
+}
+
+// SrtpSession - encrypts what we send with our key and decrypts what the caller sends with theirs. pion's contexts aren't safe to
+// share between goroutines, so each direction has its own lock
+type SrtpSession struct {
+	localMu  sync.Mutex
+	local    *srtp.Context
+	remoteMu sync.Mutex
+	remote   *srtp.Context
+}
+
+// NewSrtpSession - creates the session from the two sides' master keys and salts, as they are exchanged in a=crypto
+func NewSrtpSession(suite string, localKey []byte, remoteKey []byte) (*SrtpSession, error) {
+	s, ok := srtpSuites[suite]
+	if !ok {
+		return nil, fmt.Errorf("unsupported srtp crypto suite: %s", suite)
+	}
+	if len(localKey) != s.keyLen+s.saltLen || len(remoteKey) != s.keyLen+s.saltLen {
+		return nil, fmt.Errorf("%s keys must be %d bytes", suite, s.keyLen+s.saltLen)
+	}
+
+	local, err := srtp.CreateContext(localKey[:s.keyLen], localKey[s.keyLen:], s.profile)
+	if err != nil {
+		return nil, fmt.Errorf("error creating srtp context: %v", err)
+	}
+
+	// only what comes in can be replayed at us
+	remote, err := srtp.CreateContext(remoteKey[:s.keyLen], remoteKey[s.keyLen:], s.profile,
+		srtp.SRTPReplayProtection(srtpReplayWindow), srtp.SRTCPReplayProtection(srtpReplayWindow))
+	if err != nil {
+		return nil, fmt.Errorf("error creating srtp context: %v", err)
+	}
+
+	return &SrtpSession{
+		local:  local,
+		remote: remote,
+	}, nil
+}
+
+// EncryptRtp - turns an rtp packet into an srtp one
+func (s *SrtpSession) EncryptRtp(pkt []byte) ([]byte, error) {
+	s.localMu.Lock()
+	defer s.localMu.Unlock()
+
+	return s.local.EncryptRTP(nil, pkt, nil)
+}
+
+// DecryptRtp - turns an srtp packet back into rtp
+func (s *SrtpSession) DecryptRtp(pkt []byte) ([]byte, error) {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+
+	return s.remote.DecryptRTP(nil, pkt, nil)
+}
+
+// EncryptRtcp - turns a compound rtcp packet into an srtcp one
+func (s *SrtpSession) EncryptRtcp(pkt []byte) ([]byte, error) {
+	s.localMu.Lock()
+	defer s.localMu.Unlock()
+
+	return s.local.EncryptRTCP(nil, pkt, nil)
+}
+
+// DecryptRtcp - turns an srtcp packet back into rtcp
+func (s *SrtpSession) DecryptRtcp(pkt []byte) ([]byte, error) {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+
+	return s.remote.DecryptRTCP(nil, pkt, nil)
+}
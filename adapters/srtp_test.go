@@ -0,0 +1,145 @@
+package adapters
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"sip_and_rip/ports"
+)
+
+func TestParseCryptoAttribute(t *testing.T) {
+	key := []byte("0123456789abcdefghijklmnopqr")
+
+	tests := []struct {
+		name    string
+		value   string
+		want    *ports.SdpCrypto
+		wantErr bool
+	}{
+		{
+			name:  "lifetime and mki",
+			value: "1 AES_CM_128_HMAC_SHA1_80 inline:MDEyMzQ1Njc4OWFiY2RlZmdoaWprbG1ub3Bxcg==|2^20|1:4",
+			want:  &ports.SdpCrypto{Tag: 1, Suite: "AES_CM_128_HMAC_SHA1_80", Key: key, Lifetime: "2^20", Mki: "1:4", SessionParams: []string{}},
+		},
+		{
+			name:  "no padding and a session param",
+			value: "2 AES_CM_128_HMAC_SHA1_32 inline:MDEyMzQ1Njc4OWFiY2RlZmdoaWprbG1ub3Bxcg UNENCRYPTED_SRTCP",
+			want:  &ports.SdpCrypto{Tag: 2, Suite: "AES_CM_128_HMAC_SHA1_32", Key: key, SessionParams: []string{"UNENCRYPTED_SRTCP"}},
+		},
+		{name: "too short", value: "1 AES_CM_128_HMAC_SHA1_80", wantErr: true},
+		{name: "bad tag", value: "x AES_CM_128_HMAC_SHA1_80 inline:MDEy", wantErr: true},
+		{name: "not inline", value: "1 AES_CM_128_HMAC_SHA1_80 uri:https://example.com/key", wantErr: true},
+		{name: "bad key", value: "1 AES_CM_128_HMAC_SHA1_80 inline:!!!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCryptoAttribute(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// sdesKey - a new key for the suite, as the far end reads it out of our a=crypto line
+func sdesKey(t *testing.T, suite string) (local []byte, remote []byte) {
+	t.Helper()
+
+	key, err := NewSrtpKey(suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crypto, err := parseCryptoAttribute(formatCrypto(&ports.SdpCrypto{Tag: 1, Suite: suite, Key: key}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, crypto.Key
+}
+
+func TestSrtpRoundTrip(t *testing.T) {
+	suites := []string{ports.SrtpAesCm128HmacSha1_80, ports.SrtpAesCm128HmacSha1_32, ports.SrtpAeadAes128Gcm}
+
+	for _, suite := range suites {
+		t.Run(suite, func(t *testing.T) {
+			aliceKey, aliceKeyAtBob := sdesKey(t, suite)
+			bobKey, bobKeyAtAlice := sdesKey(t, suite)
+
+			alice, err := NewSrtpSession(suite, aliceKey, bobKeyAtAlice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewSrtpSession(suite, bobKey, aliceKeyAtBob)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pkt, err := (&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: 65535, Timestamp: 160, SSRC: 1234},
+				Payload: bytes.Repeat([]byte{0xff}, 160),
+			}).Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			protected, err := alice.EncryptRtp(pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(protected, pkt[12:]) {
+				t.Fatal("srtp payload went out in the clear")
+			}
+			got, err := bob.DecryptRtp(protected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, pkt) {
+				t.Fatalf("got rtp %x, want %x", got, pkt)
+			}
+
+			if _, err := bob.DecryptRtp(protected); err == nil {
+				t.Error("a replayed packet was let in")
+			}
+			tampered := append([]byte{}, protected...)
+			tampered[20] ^= 1
+			if _, err := bob.DecryptRtp(tampered); err == nil {
+				t.Error("a tampered packet was let in")
+			}
+			// alice's own key doesn't decrypt what she sends, bob's does
+			if _, err := alice.DecryptRtp(protected); err == nil {
+				t.Error("a packet decrypted with the wrong key")
+			}
+
+			report, err := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverReport{SSRC: 1234}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			protected, err = bob.EncryptRtcp(report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = alice.DecryptRtcp(protected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, report) {
+				t.Fatalf("got rtcp %x, want %x", got, report)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package adapters
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"sip_and_rip/ports"
+)
+
+// the largest sip message we read off a connection, anything bigger is someone trying to run us out of memory
+const maxSipMessageSize = 1024 * 1024
+
+// TLSServer - a TLS server that listens for SIP messages (rfc 3261 26.2). Unlike udp, messages come in over a stream, so they are split
+// up by their Content-Length, and everything we send for a connection's messages goes back over it
+type TLSServer struct {
+	addr     string
+	config   *tls.Config
+	listener net.Listener
+
+	api ports.Api
+}
+
+// NewTLSServer - creates a new TLS server that listens on the given address with the certificate and its key
+func NewTLSServer(addr string, certFile string, keyFile string, api ports.Api) (*TLSServer, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls certificate: %v", err)
+	}
+
+	return &TLSServer{
+		addr: addr,
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		api: api,
+	}, nil
+}
+
+// Serve - starts the TLS server
+func (s *TLSServer) Serve() error {
+	listener, err := tls.Listen("tcp", s.addr, s.config)
+	if err != nil {
+		return err
+	}
+
+	s.listener = listener
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			fmt.Println("Error accepting TLS connection:", err)
+			continue
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn - reads messages off a connection until the client closes it
+func (s *TLSServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	// the domain keys everything by ip and port, which a tcp address has just the same
+	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
+	remoteAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+
+	// responses and our own requests can be sent from other goroutines, ie a BYE at the end of a voicemail
+	var writeMu sync.Mutex
+	send := func(b []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		if _, err := conn.Write(b); err != nil {
+			fmt.Printf("Error writing TLS message to %s: %v\n", remoteAddr.String(), err)
+			return err
+		}
+		return nil
+	}
+
+	reader := bufio.NewReader(conn)
+	crlfs := 0
+	for {
+		msg, err := readSipMessage(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			fmt.Printf("Error reading TLS message from %s: %v\n", remoteAddr.String(), err)
+			return
+		}
+
+		if msg == nil {
+			// a double CRLF is a keep alive, which gets a single CRLF back (rfc 5626 3.5.1)
+			if crlfs++; crlfs == 2 {
+				send([]byte("\r\n"))
+				crlfs = 0
+			}
+			continue
+		}
+		crlfs = 0
+
+		if err := s.api.HandleSipMessage(remoteAddr, ports.TransportTLS, msg, send); err != nil {
+			fmt.Println("Error handling SIP message:", err)
+		}
+	}
+}
+
+// readSipMessage - reads the next message off the stream, its headers up to the blank line and then a body of its Content-Length.
+// Returns nil for each CRLF between messages
+func readSipMessage(reader *bufio.Reader) ([]byte, error) {
+	var msg bytes.Buffer
+	contentLength := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.TrimRight(line, "\r\n") == "" {
+			if msg.Len() == 0 {
+				return nil, nil
+			}
+
+			msg.WriteString(line)
+			break
+		}
+
+		msg.WriteString(line)
+		if msg.Len() > maxSipMessageSize {
+			return nil, fmt.Errorf("sip message headers are too long")
+		}
+
+		// Content-Length, or l in its compact form
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "content-length" || name == "l" {
+			if contentLength, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || contentLength < 0 {
+				return nil, fmt.Errorf("invalid Content-Length: %s", strings.TrimSpace(value))
+			}
+		}
+	}
+
+	if msg.Len()+contentLength > maxSipMessageSize {
+		return nil, fmt.Errorf("sip message is too long")
+	}
+
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	msg.Write(body)
+
+	return msg.Bytes(), nil
+}
+
+// Close - closes the TLS server
+func (s *TLSServer) Close() error {
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package adapters
+
+import (
+	"io"
+	"math"
+
+	"sip_and_rip/ports"
+)
+
+// about -10dBFS, loud enough to hear without clipping. The frequencies of a dual tone share it
+const defaultToneAmplitude = 10000
+
+// ToneReader - synthesizes a tone, ie ringback or the beep before leaving a voicemail. Each segment of its cadence is a sine wave, the
+// sum of two for dual frequency tones, or silence
+type ToneReader struct {
+	opts      *ports.MediaOptions
+	codec     ports.Codec
+	tone      ports.Tone
+	amplitude float64
+	// samples left to generate, -1 for a tone that repeats until it is stopped
+	remaining int
+	// the segment of the cadence we are in, and the sample index within it, which keeps the phase continuous between frames
+	segment  int
+	position int
+}
+
+// NewToneReader - creates a tone encoded with the codec. It lasts for durationMs, or when that is 0 for one go through its cadence, or
+// forever if the cadence repeats
+func NewToneReader(tone ports.Tone, durationMs int, codec ports.Codec, opts *ports.MediaOptions) *ToneReader {
+	t := &ToneReader{
+		opts:      opts,
+		codec:     codec,
+		tone:      tone,
+		amplitude: defaultToneAmplitude,
+	}
+	if tone.Amplitude > 0 {
+		t.amplitude = float64(tone.Amplitude)
+	}
+
+	var cadence int
+	for _, seg := range tone.Segments {
+		cadence += t.samples(seg.DurationMs)
+	}
+
+	switch {
+	case cadence == 0:
+		// nothing to play, and nothing to repeat
+	case durationMs > 0:
+		t.remaining = t.samples(durationMs)
+	case tone.Repeat:
+		t.remaining = -1
+	default:
+		t.remaining = cadence
+	}
+
+	return t
+}
+
+// NextRtpFrame - generates the next frame of the tone
+func (t *ToneReader) NextRtpFrame() ([]byte, error) {
+	if t.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	size := t.opts.GetSampleSize()
+	if t.remaining > 0 && size > t.remaining {
+		size = t.remaining
+	}
+
+	pcm := make([]int16, size)
+	for i := range pcm {
+		seg := t.current()
+		if seg == nil {
+			// the cadence ran out part way through the frame
+			pcm = pcm[:i]
+			t.remaining = 0
+			break
+		}
+
+		var v float64
+		for _, freqHz := range seg.FreqsHz {
+			phase := 2 * math.Pi * float64(freqHz) * float64(t.position) / float64(t.codec.SampleRateHz())
+			v += math.Sin(phase)
+		}
+		if len(seg.FreqsHz) > 0 {
+			pcm[i] = int16(t.amplitude * v / float64(len(seg.FreqsHz)))
+		}
+		t.position++
+	}
+	if len(pcm) == 0 {
+		return nil, io.EOF
+	}
+	if t.remaining > 0 {
+		t.remaining -= len(pcm)
+	}
+
+	return t.codec.Encode(pcm), nil
+}
+
+// current - the segment the next sample is in, moving on to the next one as each finishes. nil once a cadence that doesn't repeat is over
+func (t *ToneReader) current() *ports.ToneSegment {
+	for t.segment < len(t.tone.Segments) {
+		seg := &t.tone.Segments[t.segment]
+		if t.position < t.samples(seg.DurationMs) {
+			return seg
+		}
+
+		t.segment++
+		t.position = 0
+		if t.segment == len(t.tone.Segments) && t.tone.Repeat {
+			t.segment = 0
+		}
+	}
+
+	return nil
+}
+
+// samples - the number of samples in the milliseconds at the codec's rate
+func (t *ToneReader) samples(ms int) int {
+	return t.codec.SampleRateHz() * ms / 1000
+}
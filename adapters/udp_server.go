@@ -45,7 +45,7 @@ func (s *UDPServer) Serve() error {
 			continue
 		}
 
-		if err := s.api.HandleSipMessage(remoteAddr, buf[:n], func(b []byte) error {
+		if err := s.api.HandleSipMessage(remoteAddr, ports.TransportUDP, buf[:n], func(b []byte) error {
 			if _, err := conn.WriteToUDP(b, remoteAddr); err != nil {
 				fmt.Printf("Error writing UDP packet to %s: %v\n:", remoteAddr.String(), err)
 			}
@@ -55,8 +55,21 @@ func (s *UDPServer) Serve() error {
 			// TODO we can have the domain return formalized error types and map those to http codes
 		}
 	}
+}
 
-	return nil
+// SendTo - sends a message from our sip socket, so the replies come back to it
+func (s *UDPServer) SendTo(addr *net.UDPAddr, b []byte) error {
+	if s.conn == nil {
+		return fmt.Errorf("UDP server isn't serving yet")
+	}
+
+	_, err := s.conn.WriteToUDP(b, addr)
+	return err
+}
+
+// LocalAddr - the address we listen on, unspecified when it is every interface
+func (s *UDPServer) LocalAddr() *net.UDPAddr {
+	return s.addr
 }
 
 // Close - closes the UDP server
@@ -1,49 +1,184 @@
 package adapters
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 
 	"sip_and_rip/ports"
 )
 
+// the wav format codes we know how to read
+const (
+	wavFormatPcm  = 1
+	wavFormatAlaw = 6
+	wavFormatUlaw = 7
+)
+
 // WavReader - a .wav file reader
 type WavReader struct {
 	opts *ports.MediaOptions
 	file *os.File
+	// the codec frames are encoded with before they are returned
+	codec ports.Codec
+	// the codec the file is stored in, nil for 16 bit linear pcm
+	fileCodec ports.Codec
+	// bytes of audio left in the data chunk, -1 when the file has no header
+	remaining int64
 }
 
-// NewWavReader - creates a new wav file reader
+// NewWavReader - creates a new wav file reader that returns u-law frames
 func NewWavReader(filename string, opts *ports.MediaOptions) (*WavReader, error) {
+	return NewWavReaderForCodec(filename, NewUlawCodec(), opts)
+}
+
+// NewWavReaderForCodec - creates a new wav file reader that returns frames encoded with the codec. 16 bit pcm, u-law and a-law files are transcoded as needed. Files without a RIFF header are read as raw u-law
+func NewWavReaderForCodec(filename string, codec ports.Codec, opts *ports.MediaOptions) (*WavReader, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	return &WavReader{
-		opts: opts,
-		file: file,
-	}, nil
+	w := &WavReader{
+		opts:      opts,
+		file:      file,
+		codec:     codec,
+		fileCodec: NewUlawCodec(),
+		remaining: -1,
+	}
+
+	if err := w.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading wav header of %s: %v", filename, err)
+	}
+
+	return w, nil
 }
 
 // NextRtpFrame - reads the next rtp frame from the .wav file and returns it in a buffer
 func (w *WavReader) NextRtpFrame() ([]byte, error) {
+	// 16 bit pcm takes two bytes per sample
+	size := w.opts.GetSampleSize()
+	if w.fileCodec == nil {
+		size *= 2
+	}
+	if w.remaining >= 0 && int64(size) > w.remaining {
+		size = int(w.remaining)
+	}
+
 	// Create a new buffer to read the frame into
-	buf := make([]byte, w.opts.GetBufferSize())
+	buf := make([]byte, size)
 
 	// Read one audio frame from the file
-	n, err := w.file.Read(buf)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(w.file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return nil, err
 	}
 	if n == 0 {
 		return nil, io.EOF
 	}
+	if w.remaining >= 0 {
+		w.remaining -= int64(n)
+	}
 
-	return buf[:n], nil
+	return w.encode(buf[:n]), nil
 }
 
 // Close -
 func (w *WavReader) Close() error {
 	return w.file.Close()
 }
+
+func (w *WavReader) encode(data []byte) []byte {
+	if w.fileCodec == nil {
+		pcm := make([]int16, len(data)/2)
+		for i := range pcm {
+			pcm[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+		}
+
+		return w.codec.Encode(pcm)
+	}
+
+	// no need to transcode when the file is already in the codec we send
+	if w.fileCodec.PayloadType() == w.codec.PayloadType() {
+		return data
+	}
+
+	return w.codec.Encode(w.fileCodec.Decode(data))
+}
+
+// readHeader - walks the RIFF chunks up to the start of the audio data
+func (w *WavReader) readHeader() error {
+	riff := make([]byte, 12)
+	n, err := io.ReadFull(w.file, riff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	if n < 12 || string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		// no header, treat the whole file as raw u-law like we always have
+		_, err := w.file.Seek(0, io.SeekStart)
+		return err
+	}
+
+	chunkHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(w.file, chunkHeader); err != nil {
+			return fmt.Errorf("no data chunk found: %v", err)
+		}
+
+		id := string(chunkHeader[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+
+		switch id {
+		case "fmt ":
+			format := make([]byte, size+size%2)
+			if _, err := io.ReadFull(w.file, format); err != nil {
+				return err
+			}
+			if err := w.parseFormat(format); err != nil {
+				return err
+			}
+		case "data":
+			w.remaining = size
+			return nil
+		default:
+			// chunks are padded to an even number of bytes
+			if _, err := w.file.Seek(size+size%2, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *WavReader) parseFormat(format []byte) error {
+	if len(format) < 16 {
+		return fmt.Errorf("fmt chunk is too short")
+	}
+
+	audioFormat := binary.LittleEndian.Uint16(format[0:2])
+	channels := binary.LittleEndian.Uint16(format[2:4])
+	sampleRateHz := binary.LittleEndian.Uint32(format[4:8])
+	bitsPerSample := binary.LittleEndian.Uint16(format[14:16])
+
+	if channels != 1 {
+		return fmt.Errorf("only mono files are supported, found %d channels", channels)
+	}
+	if int(sampleRateHz) != w.codec.SampleRateHz() {
+		return fmt.Errorf("file is %dhz but the codec is %dhz", sampleRateHz, w.codec.SampleRateHz())
+	}
+
+	switch {
+	case audioFormat == wavFormatPcm && bitsPerSample == 16:
+		w.fileCodec = nil
+	case audioFormat == wavFormatUlaw:
+		w.fileCodec = NewUlawCodec()
+	case audioFormat == wavFormatAlaw:
+		w.fileCodec = NewAlawCodec()
+	default:
+		return fmt.Errorf("unsupported wav format %d with %d bits per sample", audioFormat, bitsPerSample)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package adapters
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// the canonical RIFF/WAVE header for pcm audio is 44 bytes
+const wavHeaderSize = 44
+
+// WavWriter - writes 16 bit pcm samples to a .wav file
+type WavWriter struct {
+	file         *os.File
+	sampleRateHz int
+	channelSize  int
+	// number of bytes of audio written after the header
+	dataSize uint32
+}
+
+// NewWavWriter - creates a .wav file. The header is rewritten with the real sizes when the writer is closed
+func NewWavWriter(filename string, sampleRateHz int, channelSize int) (*WavWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WavWriter{
+		file:         file,
+		sampleRateHz: sampleRateHz,
+		channelSize:  channelSize,
+	}
+
+	// reserve space for the header, we dont know the sizes yet
+	if err := w.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// WriteAt doesnt move the offset, so skip past the header ourselves
+	if _, err := file.Seek(wavHeaderSize, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// WriteSamples - appends pcm samples to the file
+func (w *WavWriter) WriteSamples(pcm []int16) error {
+	buf := make([]byte, len(pcm)*2)
+	for i, sample := range pcm {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(sample))
+	}
+
+	n, err := w.file.Write(buf)
+	w.dataSize += uint32(n)
+
+	return err
+}
+
+// Close - fills in the header sizes and closes the file
+func (w *WavWriter) Close() error {
+	if err := w.writeHeader(); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	return w.file.Close()
+}
+
+func (w *WavWriter) writeHeader() error {
+	bitsPerSample := 16
+	blockAlign := w.channelSize * bitsPerSample / 8
+	byteRate := w.sampleRateHz * blockAlign
+
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:4], "RIFF")
+	// the size of the file minus the "RIFF" id and this size field
+	binary.LittleEndian.PutUint32(header[4:8], wavHeaderSize-8+w.dataSize)
+	copy(header[8:12], "WAVE")
+
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16) // size of the fmt chunk
+	binary.LittleEndian.PutUint16(header[20:22], 1)  // 1 is linear pcm
+	binary.LittleEndian.PutUint16(header[22:24], uint16(w.channelSize))
+	binary.LittleEndian.PutUint32(header[24:28], uint32(w.sampleRateHz))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(byteRate))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:36], uint16(bitsPerSample))
+
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], w.dataSize)
+
+	_, err := w.file.WriteAt(header, 0)
+
+	return err
+}
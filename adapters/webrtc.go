@@ -0,0 +1,432 @@
+package adapters
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+
+	"sip_and_rip/ports"
+)
+
+// how long the browser has to find us and finish the dtls handshake once it has our answer
+const webRtcHandshakeTimeout = 30 * time.Second
+
+// how many packets of each kind can wait for their reader before we drop them, like a socket's buffer would
+const muxQueueSize = 256
+
+// what a packet on a webrtc media port is, told apart by its first byte (rfc 7983 7)
+const (
+	muxStun = iota
+	muxDtls
+	muxRtp
+	muxRtcp
+	muxUnknown
+)
+
+// WebRtcTransport - the ice, dtls and srtp a browser's media needs, multiplexed on the call's rtp socket. We are an ice-lite agent
+// (rfc 8445 2.5): we never check connectivity ourselves, we answer the browser's checks and send to the address it nominates, and
+// only packets from addresses that passed a check get any further than that
+type WebRtcTransport struct {
+	sync.Mutex
+	conn   *net.UDPConn
+	cert   *WebRtcCertificate
+	local  ports.WebRtcParams
+	remote ports.WebRtcParams
+	// the addresses that passed a connectivity check, and the one media goes to
+	validated map[string]bool
+	selected  *net.UDPAddr
+	nominated bool
+	// closed once there is an address to shake hands with
+	found chan struct{}
+	// the handshake and the srtp it keyed, nil until it is done
+	dtls *dtls.Conn
+	srtp *SrtpSession
+	// the packets off the socket, by kind
+	dtlsMux *muxConn
+	rtp     *muxConn
+	rtcp    *muxConn
+	cancel  context.CancelFunc
+	started bool
+	closed  bool
+	// closed when the handshake and the reader have stopped
+	handshakeDone chan struct{}
+	readDone      chan struct{}
+}
+
+// NewWebRtcTransport - creates the transport for a call's rtp socket, with the caller's ice and dtls parameters from their offer and
+// the certificate we shake hands with
+func NewWebRtcTransport(conn *net.UDPConn, remote *ports.WebRtcParams, cert *WebRtcCertificate) (*WebRtcTransport, error) {
+	if remote.IceUfrag == "" || remote.IcePwd == "" {
+		return nil, fmt.Errorf("webrtc needs the caller's ice-ufrag and ice-pwd")
+	}
+	if _, ok := fingerprintHashes[remote.FingerprintHash]; !ok || remote.Fingerprint == "" {
+		return nil, fmt.Errorf("webrtc needs the caller's fingerprint, and %q isn't a hash we support", remote.FingerprintHash)
+	}
+
+	ufrag, err := randIceString(6)
+	if err != nil {
+		return nil, err
+	}
+	pwd, err := randIceString(18)
+	if err != nil {
+		return nil, err
+	}
+
+	// rfc 8842 5.3: the offer has to be actpass, but an active or passive one only leaves us one choice
+	setup := "passive"
+	if remote.Setup == "passive" {
+		setup = "active"
+	}
+
+	t := &WebRtcTransport{
+		conn: conn,
+		cert: cert,
+		local: ports.WebRtcParams{
+			IceUfrag:        ufrag,
+			IcePwd:          pwd,
+			FingerprintHash: cert.hash,
+			Fingerprint:     cert.fingerprint,
+			Setup:           setup,
+		},
+		remote:        *remote,
+		validated:     make(map[string]bool),
+		found:         make(chan struct{}),
+		handshakeDone: make(chan struct{}),
+		readDone:      make(chan struct{}),
+	}
+	t.dtlsMux = newMuxConn(t, muxDtls)
+	t.rtp = newMuxConn(t, muxRtp)
+	t.rtcp = newMuxConn(t, muxRtcp)
+
+	return t, nil
+}
+
+// LocalParams - our ice credentials, certificate fingerprint and dtls role, for the answer
+func (t *WebRtcTransport) LocalParams() *ports.WebRtcParams {
+	local := t.local
+	return &local
+}
+
+// Start - reads the socket and waits for the browser's handshake, or starts it once the browser has found us when we are the client
+func (t *WebRtcTransport) Start() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.started || t.closed {
+		return fmt.Errorf("webrtc transport already started")
+	}
+	t.started = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), webRtcHandshakeTimeout)
+	t.cancel = cancel
+
+	go t.read()
+	go t.handshake(ctx)
+
+	return nil
+}
+
+// RtpConn - the rtp half of the socket
+func (t *WebRtcTransport) RtpConn() ports.MediaConn {
+	return t.rtp
+}
+
+// RtcpConn - the rtcp half of the socket (rfc 5761)
+func (t *WebRtcTransport) RtcpConn() ports.MediaConn {
+	return t.rtcp
+}
+
+// Close - tells the browser we are done with a dtls close_notify and stops reading. The socket is left open for whoever allocated it
+func (t *WebRtcTransport) Close() error {
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return nil
+	}
+	t.closed = true
+	started := t.started
+	t.Unlock()
+
+	if started {
+		// a handshake that hasn't finished never will
+		t.cancel()
+		<-t.handshakeDone
+	}
+
+	var err error
+	if t.dtls != nil {
+		err = t.dtls.Close()
+	}
+	t.dtlsMux.close()
+	t.rtp.close()
+	t.rtcp.close()
+
+	if started {
+		// wake the reader up so it sees it is closed
+		t.conn.SetReadDeadline(time.Now())
+		<-t.readDone
+	}
+
+	return err
+}
+
+func (t *WebRtcTransport) isClosed() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.closed
+}
+
+func (t *WebRtcTransport) read() {
+	defer close(t.readDone)
+
+	buf := make([]byte, 1500) // nothing on a media port is bigger than an mtu
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if t.isClosed() || errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			fmt.Println("WebRtcTransport: error reading packet: ", err)
+			continue
+		}
+
+		pkt := append([]byte{}, buf[:n]...)
+		switch kind := classifyPacket(pkt); kind {
+		case muxStun:
+			t.handleStun(pkt, addr)
+		case muxDtls:
+			if t.isValidated(addr) {
+				t.dtlsMux.push(pkt, addr)
+			}
+		case muxRtp, muxRtcp:
+			t.handleSrtp(kind, pkt, addr)
+		}
+	}
+}
+
+// handleSrtp - decrypts the caller's media and hands it to the rtp or rtcp half. Anything before the handshake is done, or that isn't
+// from an address that passed a check, is dropped
+func (t *WebRtcTransport) handleSrtp(kind int, pkt []byte, addr *net.UDPAddr) {
+	t.Lock()
+	session := t.srtp
+	validated := t.validated[addr.String()]
+	t.Unlock()
+
+	if session == nil || !validated {
+		return
+	}
+
+	var err error
+	if kind == muxRtcp {
+		if pkt, err = session.DecryptRtcp(pkt); err != nil {
+			fmt.Printf("WebRtcTransport: dropping srtcp packet from %s: %v\n", addr, err)
+			return
+		}
+		t.rtcp.push(pkt, addr)
+		return
+	}
+
+	if pkt, err = session.DecryptRtp(pkt); err != nil {
+		fmt.Printf("WebRtcTransport: dropping srtp packet from %s: %v\n", addr, err)
+		return
+	}
+	t.rtp.push(pkt, addr)
+}
+
+// send - encrypts a packet of the kind and sends it to the browser. Until there is somewhere to send it and srtp to encrypt it with,
+// media goes nowhere, just as it would if the network dropped it
+func (t *WebRtcTransport) send(kind int, pkt []byte) (int, error) {
+	t.Lock()
+	addr, session := t.selected, t.srtp
+	t.Unlock()
+
+	if addr == nil || (kind != muxDtls && session == nil) {
+		return len(pkt), nil
+	}
+
+	data := pkt
+	var err error
+	switch kind {
+	case muxRtp:
+		data, err = session.EncryptRtp(pkt)
+	case muxRtcp:
+		data, err = session.EncryptRtcp(pkt)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := t.conn.WriteToUDP(data, addr); err != nil {
+		return 0, err
+	}
+
+	return len(pkt), nil
+}
+
+// classifyPacket - what a packet is from its first byte: 0-3 is stun, 20-63 dtls and 128-191 rtp or rtcp (rfc 7983 7). rtcp is told
+// apart from rtp by its packet type, which lands where rtp's marker bit and payload type would be 192-223 (rfc 5761 4)
+func classifyPacket(pkt []byte) int {
+	if len(pkt) == 0 {
+		return muxUnknown
+	}
+
+	switch b := pkt[0]; {
+	case b <= 3:
+		return muxStun
+	case b >= 20 && b <= 63:
+		return muxDtls
+	case b >= 128 && b <= 191:
+		if len(pkt) > 1 && pkt[1] >= 192 && pkt[1] <= 223 {
+			return muxRtcp
+		}
+		return muxRtp
+	}
+
+	return muxUnknown
+}
+
+// randIceString - a random ice-ufrag or ice-pwd. Base64 only uses characters ice allows (rfc 8839 5.4), and every 3 bytes make 4 of them
+func randIceString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating ice credentials: %v", err)
+	}
+
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// muxPacket - a packet off the socket and where it came from
+type muxPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// muxConn - one kind of packet off a multiplexed socket, which reads and writes like a socket of its own
+type muxConn struct {
+	transport *WebRtcTransport
+	kind      int
+	packets   chan muxPacket
+	closeOnce sync.Once
+	closed    chan struct{}
+	// closed when the read deadline passes, each deadline gets its own, and changed wakes reads up to wait on the new one
+	deadlineMu sync.Mutex
+	expired    chan struct{}
+	changed    chan struct{}
+	timer      *time.Timer
+}
+
+func newMuxConn(t *WebRtcTransport, kind int) *muxConn {
+	return &muxConn{
+		transport: t,
+		kind:      kind,
+		packets:   make(chan muxPacket, muxQueueSize),
+		closed:    make(chan struct{}),
+		expired:   make(chan struct{}),
+		changed:   make(chan struct{}),
+	}
+}
+
+// push - queues a packet for the reader, dropping it when the reader isn't keeping up
+func (c *muxConn) push(data []byte, addr *net.UDPAddr) {
+	select {
+	case c.packets <- muxPacket{data: data, addr: addr}:
+	default:
+	}
+}
+
+// ReadFromUDP - the next packet of the kind and where it came from
+func (c *muxConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		c.deadlineMu.Lock()
+		expired, changed := c.expired, c.changed
+		c.deadlineMu.Unlock()
+
+		select {
+		case p := <-c.packets:
+			return copy(b, p.data), p.addr, nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+		}
+	}
+}
+
+// WriteToUDP - sends the packet to the browser. The address is ignored, it goes wherever the browser nominated
+func (c *muxConn) WriteToUDP(b []byte, _ *net.UDPAddr) (int, error) {
+	return c.transport.send(c.kind, b)
+}
+
+// SetReadDeadline - wakes up reads once the time has passed. The zero time means no deadline
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	expired := make(chan struct{})
+	c.expired = expired
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { close(expired) })
+	}
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	return nil
+}
+
+// LocalAddr - the socket's address
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.transport.conn.LocalAddr()
+}
+
+func (c *muxConn) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// dtlsConn - the dtls packets as the net.Conn pion's dtls reads and writes
+type dtlsConn struct {
+	*muxConn
+}
+
+func (c dtlsConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFromUDP(b)
+	return n, err
+}
+
+func (c dtlsConn) Write(b []byte) (int, error) {
+	return c.WriteToUDP(b, nil)
+}
+
+func (c dtlsConn) Close() error {
+	c.close()
+	return nil
+}
+
+func (c dtlsConn) RemoteAddr() net.Addr {
+	c.transport.Lock()
+	defer c.transport.Unlock()
+
+	return c.transport.selected
+}
+
+func (c dtlsConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c dtlsConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,135 @@
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"sip_and_rip/ports"
+)
+
+// the websocket subprotocol for sip (rfc 7118 4.1)
+const wsSipProtocol = "sip"
+
+// WSServer - a websocket server for SIP (rfc 7118), which is how browsers talk SIP. Every websocket message is a whole sip message, so
+// unlike tls there is nothing to frame, and everything we send for a connection's messages goes back over it. It is wss when it has a
+// certificate
+type WSServer struct {
+	addr     string
+	certFile string
+	keyFile  string
+	server   *http.Server
+
+	api ports.Api
+}
+
+// NewWSServer - creates a new websocket server that listens on the given address. With a certificate and its key it serves wss
+func NewWSServer(addr string, certFile string, keyFile string, api ports.Api) *WSServer {
+	return &WSServer{
+		addr:     addr,
+		certFile: certFile,
+		keyFile:  keyFile,
+		api:      api,
+	}
+}
+
+// Serve - starts the websocket server
+func (s *WSServer) Serve() error {
+	s.server = &http.Server{
+		Addr:    s.addr,
+		Handler: websocket.Server{Handshake: s.handshake, Handler: s.serveConn},
+	}
+
+	var err error
+	if s.certFile != "" {
+		err = s.server.ListenAndServeTLS(s.certFile, s.keyFile)
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// handshake - only lets in clients that asked for sip, which is all we speak over the websocket (rfc 7118 4.1). Browsers can connect
+// from any page, so the origin isn't checked, whoever connects still has to register like everyone else
+func (s *WSServer) handshake(config *websocket.Config, req *http.Request) error {
+	for _, protocol := range config.Protocol {
+		if strings.EqualFold(strings.TrimSpace(protocol), wsSipProtocol) {
+			config.Protocol = []string{wsSipProtocol}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("websocket client didn't ask for the sip subprotocol")
+}
+
+// serveConn - reads messages off a connection until the client closes it
+func (s *WSServer) serveConn(ws *websocket.Conn) {
+	defer ws.Close()
+	ws.MaxPayloadBytes = maxSipMessageSize
+
+	transport := ports.TransportWS
+	if s.certFile != "" {
+		transport = ports.TransportWSS
+	}
+
+	// the domain keys everything by ip and port, which the http request has just the same
+	tcpAddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		fmt.Printf("Error reading websocket client address %s: %v\n", ws.Request().RemoteAddr, err)
+		return
+	}
+	remoteAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+
+	// responses and our own requests can be sent from other goroutines, ie a BYE at the end of a voicemail
+	var writeMu sync.Mutex
+	send := func(b []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		// sip is text, and text frames are what browser sip stacks expect
+		if err := websocket.Message.Send(ws, string(b)); err != nil {
+			fmt.Printf("Error writing websocket message to %s: %v\n", remoteAddr.String(), err)
+			return err
+		}
+		return nil
+	}
+
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Error reading websocket message from %s: %v\n", remoteAddr.String(), err)
+			}
+			return
+		}
+
+		// some sip stacks keep the connection alive with a double CRLF, like they would over tcp, which gets a CRLF back (rfc 5626 3.5.1)
+		if strings.TrimSpace(string(msg)) == "" {
+			send([]byte("\r\n"))
+			continue
+		}
+
+		if err := s.api.HandleSipMessage(remoteAddr, transport, msg, send); err != nil {
+			fmt.Println("Error handling SIP message:", err)
+		}
+	}
+}
+
+// Close - closes the websocket server
+func (s *WSServer) Close() error {
+	if s.server != nil {
+		return s.server.Close()
+	}
+
+	return nil
+}
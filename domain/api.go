@@ -6,39 +6,95 @@ import (
 	"fmt"
 	"net"
 
-	"sip_and_rip/adapters"
 	"sip_and_rip/ports"
 )
 
 // Api - the api for this sip/rtp server
 type Api struct {
-	fsmCache *FsmCache
+	cfg       *Config
+	factories *ports.Factories
+	fsmCache  *FsmCache
+	registrar *Registrar
+	media     *MediaSelector
+	// nil when voicemail is disabled
+	voicemail   *Voicemail
+	b2bua       *B2bua
+	conferences *Conferences
+	queues      *Queues
+	// nil unless we are a proxy
+	proxy *Proxy
 }
 
-// NewApi - create a new api instance
-func NewApi() *Api {
-	return &Api{
-		fsmCache: NewFsmCache(),
+// NewApi - create a new api instance. The allocator hands out the calls' rtp ports, and voicemail is disabled when the store is nil
+func NewApi(cfg *Config, factories *ports.Factories, allocator ports.PortAllocator, store ports.MailboxStore) *Api {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	// bridged calls have a leg of each kind, so both are paced by the same scheduler, which mixes the conference rooms too
+	scheduler := NewMediaScheduler()
+	a := &Api{
+		cfg:         cfg,
+		factories:   factories,
+		fsmCache:    NewFsmCache(cfg, allocator, factories, scheduler),
+		registrar:   NewRegistrar(),
+		media:       NewMediaSelector(cfg, factories),
+		conferences: NewConferences(cfg, factories, scheduler),
+	}
+
+	if store != nil {
+		a.voicemail = NewVoicemail(cfg, store, a.registrar)
+	}
+	a.b2bua = NewB2bua(cfg, factories, allocator, scheduler, a.registrar, a.voicemail)
+	a.queues = NewQueues(cfg, a.registrar, a.b2bua, a.voicemail)
+	if cfg.ProxyMode == ProxyStateless || cfg.ProxyMode == ProxyStateful {
+		a.proxy = NewProxy(cfg, a.registrar)
+	}
+
+	return a
+}
+
+// SetSipSender - what requests to the bridge routes, and the requests we proxy in dialogs, are sent with, once the server is up
+func (a *Api) SetSipSender(sender ports.SipSender) {
+	a.b2bua.SetSender(sender)
+	if a.proxy != nil {
+		a.proxy.SetSender(sender)
 	}
 }
 
 // HandleSipMessage - a sip message has been received, advance its dialog
-func (a *Api) HandleSipMessage(remoteAddr *net.UDPAddr, msg []byte, sendResponseCallback ports.SendResponseCallback) error {
+func (a *Api) HandleSipMessage(remoteAddr *net.UDPAddr, transport string, msg []byte, sendResponseCallback ports.SendResponseCallback) error {
 	if a.isKeepAlive(msg) {
 		return nil
 	}
 
-	sipMsg, err := adapters.ParseSipMsg(msg)
+	sipMsg, err := a.factories.ParseSipMessage(msg)
 	if err != nil {
 		fmt.Println("bad sip message: ", string(msg))
 
 		return err
 	}
 
+	// responses go back to where the request came from, which isn't always where it says it came from when there is NAT in the way
+	sipMsg.SetSource(remoteAddr)
+	sipMsg.SetTransport(transport)
+
+	// the legs of bridged calls that are ours to handle, rather than the caller's dialog's
+	if a.b2bua.Handle(sipMsg, sendResponseCallback) {
+		return nil
+	}
+	if a.proxy != nil && !a.forUs(sipMsg) && a.proxy.Handle(sipMsg, sendResponseCallback) {
+		return nil
+	}
+
 	fmt.Printf("sip method %s, message length: %d; fsmCache length: %d\n", sipMsg.GetMethod(), len(msg), a.fsmCache.Len())
 
 	fmt.Printf("sipMsg from addr %s: %v ", remoteAddr.String(), sipMsg)
 
+	if sipMsg.IsResponse() {
+		return a.handleResponse(sipMsg)
+	}
+
 	fsm, err := a.fsmCache.Get(sipMsg)
 	if err == errFsmNotFound {
 		fsm, err = a.fsmCache.NewSipFsm(context.Background(), sipMsg, remoteAddr.String())
@@ -84,6 +140,12 @@ func (a *Api) HandleSipMessage(remoteAddr *net.UDPAddr, msg []byte, sendResponse
 	case ports.MethodAck:
 		// TODO i think ACK can sometimes contain updated sdp info for the call
 		// TODO also might need to respond to the ACK
+		if fsm == nil {
+			// the ACK for a call we turned down before there was a dialog for it, nothing to do
+			fmt.Println("fsm not found for ACK request, dropping it")
+			return nil
+		}
+
 		if err := fsm.RecvAck(); err != nil {
 			fmt.Printf("Error sending 200 OK in response to ACK %s: %v\n", remoteAddr.String(), err)
 			return err
@@ -136,7 +198,50 @@ func (a *Api) HandleSipMessage(remoteAddr *net.UDPAddr, msg []byte, sendResponse
 		// 	continue
 		// }
 
-		if err := fsm.SendOk(sipMsg, sendResponseCallback); err != nil {
+		if fsm.HasCall(sipMsg.GetCallID()) {
+			if err := fsm.SendReinviteOk(sipMsg, sendResponseCallback); err != nil {
+				fmt.Printf("Error answering re-INVITE from %s: %v\n", remoteAddr.String(), err)
+			}
+			break
+		}
+
+		handler := testLine(a.cfg, sipMsg)
+		if handler == nil && a.voicemail != nil {
+			var err error
+			if handler, err = a.voicemail.Route(sipMsg); err != nil {
+				fmt.Printf("Turning down call %s with 403: %v\n", sipMsg.GetCallID(), err)
+				// 403 Forbidden
+				return sendResponse(sipMsg, 403, sendResponseCallback)
+			}
+		}
+		if handler == nil {
+			handler = a.conferences.Route(sipMsg)
+		}
+		if handler == nil {
+			var err error
+			if handler, err = a.queues.Route(fsm, sipMsg, sendResponseCallback); err != nil {
+				fmt.Printf("Turning down call %s with 403: %v\n", sipMsg.GetCallID(), err)
+				// 403 Forbidden
+				return sendResponse(sipMsg, 403, sendResponseCallback)
+			}
+		}
+		if handler == nil {
+			if target, ok := a.b2bua.Route(sipMsg); ok {
+				if err := a.b2bua.Connect(fsm, sipMsg, target, sendResponseCallback); err != nil {
+					fmt.Printf("Error bridging call %s: %v\n", sipMsg.GetCallID(), err)
+				}
+				break
+			}
+
+			filename, code, err := a.media.Select(sipMsg)
+			if err != nil {
+				fmt.Printf("Turning down call %s with %d: %v\n", sipMsg.GetCallID(), code, err)
+				return sendResponse(sipMsg, code, sendResponseCallback)
+			}
+			handler = playFile(filename)
+		}
+
+		if err := fsm.SendOk(sipMsg, sendResponseCallback, handler); err != nil {
 			fmt.Printf("Error sending 200 OK to %s: %v\n", remoteAddr.String(), err)
 		}
 
@@ -144,6 +249,8 @@ func (a *Api) HandleSipMessage(remoteAddr *net.UDPAddr, msg []byte, sendResponse
 	case ports.MethodRegister:
 		// check for when client is unregistering
 		if sipMsg.IsUnregister() {
+			a.registrar.Unregister(sipMsg)
+
 			if err := a.fsmCache.CloseFsm(sipMsg); err != nil {
 				fmt.Printf("Error closing FSM for key %s from %s: %v\n", fsm.key, remoteAddr.String(), err)
 			}
@@ -154,6 +261,28 @@ func (a *Api) HandleSipMessage(remoteAddr *net.UDPAddr, msg []byte, sendResponse
 			fmt.Printf("Error sending 200 OK for fsm %s from %s: %v\n", fsm.key, remoteAddr.String(), err)
 			return err
 		}
+
+		if err := a.registrar.Register(sipMsg, remoteAddr, sendResponseCallback); err != nil {
+			fmt.Printf("Error registering %s: %v\n", remoteAddr.String(), err)
+		}
+
+	case ports.MethodSubscribe:
+		if a.voicemail == nil {
+			// 489 Bad Event, message-summary is the only event we know
+			return sendResponse(sipMsg, 489, sendResponseCallback)
+		}
+
+		if err := a.voicemail.Subscribe(sipMsg, sendResponseCallback); err != nil {
+			fmt.Printf("Error handling SUBSCRIBE from %s: %v\n", remoteAddr.String(), err)
+			return err
+		}
+	case ports.MethodNotify:
+		// we dont subscribe to anything, but let the sender know we got it
+		return sendResponse(sipMsg, 200, sendResponseCallback)
+	case ports.MethodRefer:
+		// the calls we bridge take REFERs before they get here, and there is nobody to transfer anything else to. 603 Decline
+		return sendResponse(sipMsg, 603, sendResponseCallback)
+
 	default:
 		fmt.Printf("received unknown message method type: %s\n", sipMsg.GetMethod())
 	}
@@ -162,6 +291,64 @@ func (a *Api) HandleSipMessage(remoteAddr *net.UDPAddr, msg []byte, sendResponse
 	return nil
 }
 
+// forUs - whether a request is one we answer ourselves even as a proxy: calls to the test lines, voicemail, the conference rooms, the
+// queues and the agents' feature codes, and subscriptions to voicemail, which are to the user's own AoR
+func (a *Api) forUs(sipMsg ports.SipMessage) bool {
+	if sipMsg.IsResponse() {
+		return false
+	}
+
+	switch sipMsg.GetMethod() {
+	case ports.MethodInvite:
+		if testLine(a.cfg, sipMsg) != nil || a.conferences.Route(sipMsg) != nil {
+			return true
+		}
+		if handler, err := a.queues.Route(nil, sipMsg, nil); handler != nil || err != nil {
+			return true
+		}
+		return a.voicemail != nil && sipMsg.GetRequest().User == a.cfg.VoicemailNumber
+	case ports.MethodSubscribe:
+		return a.voicemail != nil && sipMsg.GetHeader("Event") == "message-summary"
+	}
+
+	return false
+}
+
+// Conferences - the conference rooms with someone in them, for the control api
+func (a *Api) Conferences() []ports.Conference {
+	return a.conferences.List()
+}
+
+// MuteParticipant - stops or starts the rest of a conference room hearing one of its participants
+func (a *Api) MuteParticipant(room string, id string, muted bool) error {
+	return a.conferences.Mute(room, id, muted)
+}
+
+// KickParticipant - hangs up on one of a conference room's participants
+func (a *Api) KickParticipant(room string, id string) error {
+	return a.conferences.Kick(room, id)
+}
+
+// handleResponse - a response to a request we sent
+func (a *Api) handleResponse(sipMsg ports.SipMessage) error {
+	_, method := sipMsg.GetCSeq()
+	if method != ports.MethodBye {
+		// nothing to do for the responses to our NOTIFYs
+		return nil
+	}
+
+	fsm, err := a.fsmCache.Get(sipMsg)
+	if err != nil {
+		return fmt.Errorf("no fsm found for the response to our BYE: %v", err)
+	}
+
+	if sipMsg.GetStatus() >= 200 {
+		return fsm.RecvByeOk()
+	}
+
+	return nil
+}
+
 func (*Api) isKeepAlive(msg []byte) bool {
 	// linphone's keep alive is 4 bytes
 	// telephone's keep alive is 2 bytes
@@ -170,3 +357,16 @@ func (*Api) isKeepAlive(msg []byte) bool {
 	}
 	return false
 }
+
+// sendResponse - sends a response with no special handling
+func sendResponse(sipMsg ports.SipMessage, code int, send ports.SendResponseCallback) error {
+	res, err := sipMsg.NewResponse(code)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	res.Append(&b)
+
+	return send(b.Bytes())
+}
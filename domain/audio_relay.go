@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"sync"
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+// how far a relay can fall behind its delay, when the sender's clock runs faster than ours, before we catch up by dropping audio
+const relayMaxBacklogMs = 200
+
+// audioRelay - audio out of one call's jitter buffer, played into a call once it is delay old, ie the caller's own for an echo or the
+// far end's for a bridged call. It is decoded on the way in and encoded with the codec on the way out, so the two ends needn't agree
+// on one. We send on our clock and the jitter buffer plays out on its own, so the delay is kept as the samples we hold rather than by
+// timing them
+type audioRelay struct {
+	sync.Mutex
+	codec ports.Codec
+	opts  *ports.MediaOptions
+	// samples waiting to go out, oldest first
+	samples    []int16
+	delay      int
+	maxBacklog int
+}
+
+func newAudioRelay(codec ports.Codec, opts *ports.MediaOptions, delay time.Duration) *audioRelay {
+	rate := codec.SampleRateHz()
+
+	return &audioRelay{
+		codec:      codec,
+		opts:       opts,
+		delay:      int(int64(rate) * int64(delay) / int64(time.Second)),
+		maxBacklog: rate * relayMaxBacklogMs / 1000,
+	}
+}
+
+// push - takes a frame of audio to relay
+func (r *audioRelay) push(frame *AudioFrame) {
+	r.Lock()
+	defer r.Unlock()
+
+	// the sender went quiet, ie on hold, and the backlog ran dry. Starting again with the delay in silence keeps it delay late
+	if len(r.samples) == 0 {
+		r.samples = make([]int16, r.delay, r.delay+len(frame.Samples))
+	}
+	r.samples = append(r.samples, frame.Samples...)
+
+	if over := len(r.samples) - r.delay - r.maxBacklog; over > 0 {
+		r.samples = r.samples[over:]
+	}
+}
+
+// NextRtpFrame - the next frame to send, silence while there is nothing to relay. It never runs out, the call ending stops it
+func (r *audioRelay) NextRtpFrame() ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.codec.Encode(r.next(r.opts.GetSampleSize())), nil
+}
+
+// take - the next n samples, padded with silence while there is nothing to relay, for mixing rather than sending
+func (r *audioRelay) take(n int) []int16 {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.next(n)
+}
+
+func (r *audioRelay) next(n int) []int16 {
+	pcm := make([]int16, n)
+	copied := copy(pcm, r.samples)
+	r.samples = r.samples[copied:]
+
+	return pcm
+}
@@ -0,0 +1,992 @@
+package domain
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"sip_and_rip/ports"
+)
+
+const (
+	// how long we ring the far end before giving up, when the config doesn't say
+	defaultRingSeconds = 30
+	// the first wait before sending our INVITE again over udp, which doubles each time up to the cap (rfc 3261 17.1.1.2, timers a and t2)
+	inviteRetransmitInterval    = 500 * time.Millisecond
+	inviteRetransmitMaxInterval = 4 * time.Second
+	// how long a bridge that is over hangs around to soak up late responses and retransmissions (rfc 3261 17.1.1.2, timer d)
+	bridgeLingerTime = 32 * time.Second
+)
+
+// the states of a bridge: we have sent our INVITE, the far end is ringing, it answered and we are answering the caller, the media is
+// flowing, we gave up on the far end and are waiting for it to finish, and it is all over. A caller we answered ourselves waits in a
+// queue until someone takes the call, when it goes straight to answered
+const (
+	bridgeQueued     = "queued"
+	bridgeCalling    = "calling"
+	bridgeRinging    = "ringing"
+	bridgeAnswered   = "answered"
+	bridgeConnected  = "connected"
+	bridgeCancelling = "cancelling"
+	bridgeEnded      = "ended"
+)
+
+// BridgeRoute - sends calls to a number on to a sip uri, ie a phone that doesn't register or another pbx
+type BridgeRoute struct {
+	// the user part of the request uri, ie 100 in sip:100@host
+	Number string `json:"number,omitempty"`
+	// or the start of it, ie 9 for an outside line. It is stripped off the number that goes on
+	Prefix string `json:"prefix,omitempty"`
+	// where the calls go, ie sip:100@10.0.0.5:5060. A uri without a user gets the number that was dialed
+	Uri string `json:"uri"`
+}
+
+// Validate - checks the route matches something and goes somewhere we can send to
+func (r BridgeRoute) Validate() error {
+	if r.Number == "" && r.Prefix == "" {
+		return fmt.Errorf("bridge route needs a number or a prefix")
+	}
+
+	uri, err := sip.ParseURI([]byte(r.Uri))
+	if err != nil {
+		return fmt.Errorf("invalid bridge route uri %q: %v", r.Uri, err)
+	}
+	if uri.Scheme != "sip" {
+		return fmt.Errorf("bridge route uri %q isn't a sip uri, which is all we can reach", r.Uri)
+	}
+
+	return nil
+}
+
+// target - where a call to the dialed number goes, or nil if the route isn't for it
+func (r BridgeRoute) target(dialed string) *sip.URI {
+	number := dialed
+	switch {
+	case r.Number != "" && r.Number == dialed:
+	case r.Prefix != "" && strings.HasPrefix(dialed, r.Prefix) && len(dialed) > len(r.Prefix):
+		number = strings.TrimPrefix(dialed, r.Prefix)
+	default:
+		return nil
+	}
+
+	uri, err := sip.ParseURI([]byte(r.Uri))
+	if err != nil {
+		return nil
+	}
+	if uri.User == "" {
+		uri.User = number
+	}
+
+	return uri
+}
+
+// bridgeTarget - who a bridged call rings and how to reach them
+type bridgeTarget struct {
+	uri       *sip.URI
+	transport string
+	send      ports.SendResponseCallback
+	// the registered user we are ringing, whose voicemail takes the call when they don't answer. Empty for a bridge route
+	user string
+}
+
+// B2bua - connects callers to registered users, and to the sip uris of the bridge routes, as a back to back user agent. Each call is
+// two dialogs, the caller's with us and ours with the far end, each with its own sdp, and we relay the media between them,
+// transcoding when the two ends picked different codecs
+type B2bua struct {
+	sync.Mutex
+	cfg       *Config
+	factories *ports.Factories
+	allocator ports.PortAllocator
+	scheduler *MediaScheduler
+	registrar *Registrar
+	// nil when voicemail is disabled
+	voicemail *Voicemail
+	// nil until the server is up, in which case only registered users can be rung
+	sender ports.SipSender
+	// the bridges by the call id of each of their legs
+	bridges map[string]*bridge
+}
+
+// NewB2bua - creates the b2bua. Calls to users who don't answer go to their voicemail, unless it is nil
+func NewB2bua(cfg *Config, factories *ports.Factories, allocator ports.PortAllocator, scheduler *MediaScheduler, registrar *Registrar, voicemail *Voicemail) *B2bua {
+	return &B2bua{
+		cfg:       cfg,
+		factories: factories,
+		allocator: allocator,
+		scheduler: scheduler,
+		registrar: registrar,
+		voicemail: voicemail,
+		bridges:   make(map[string]*bridge),
+	}
+}
+
+// SetSender - what we send our requests to the bridge routes with
+func (b *B2bua) SetSender(sender ports.SipSender) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.sender = sender
+}
+
+// Route - who an INVITE should ring, a registered user or a bridge route. false when it isn't for either
+func (b *B2bua) Route(sipMsg ports.SipMessage) (*bridgeTarget, bool) {
+	return b.route(sipMsg.GetRequest().User)
+}
+
+// route - who a number rings, a registered user or a bridge route
+func (b *B2bua) route(dialed string) (*bridgeTarget, bool) {
+	if dialed == "" {
+		return nil, false
+	}
+
+	if binding, ok := b.registrar.Lookup(dialed); ok && binding.Contact != nil && binding.Send != nil {
+		return &bridgeTarget{uri: binding.Contact.Uri, transport: binding.Transport, send: binding.Send, user: dialed}, true
+	}
+
+	b.Lock()
+	sender := b.sender
+	b.Unlock()
+	if sender == nil {
+		return nil, false
+	}
+
+	for _, route := range b.cfg.BridgeRoutes {
+		uri := route.target(dialed)
+		if uri == nil {
+			continue
+		}
+
+		send, err := sendToUri(sender, uri)
+		if err != nil {
+			fmt.Printf("b2bua: can't reach %s for %s: %v\n", uri, dialed, err)
+			return nil, false
+		}
+		return &bridgeTarget{uri: uri, transport: ports.TransportUDP, send: send}, true
+	}
+
+	return nil, false
+}
+
+// sendToUri - sends to the host and port of the uri over udp, 5060 when it has no port
+func sendToUri(sender ports.SipSender, uri *sip.URI) (ports.SendResponseCallback, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(uri.Host, strconv.Itoa(int(uri.GetPort()))))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(b []byte) error {
+		return sender.SendTo(addr, b)
+	}, nil
+}
+
+// Connect - rings the target for the caller's INVITE. The caller hears nothing but ringing until the far end answers, when we answer
+// them in turn, and gets the far end's answer when it doesn't
+func (b *B2bua) Connect(fsm *SipFsm, invite ports.SipMessage, target *bridgeTarget, send ports.SendResponseCallback) error {
+	// the call has been through too many hops already to take another one through us (rfc 3261 16.3)
+	if invite.GetMaxForwards() == 0 {
+		fmt.Printf("b2bua: call %s has too many hops to bridge to %s\n", invite.GetCallID(), target.uri)
+		// 483 Too Many Hops
+		return sendResponse(invite, 483, send)
+	}
+
+	callee, err := b.call(invite, target)
+	if err != nil {
+		sendResponse(invite, 500, send)
+		return err
+	}
+
+	br := &bridge{
+		b2bua:      b,
+		fsm:        fsm,
+		invite:     invite,
+		sendCaller: send,
+		callee:     callee,
+		legs:       map[string]*bridgeLeg{callee.out.GetCallID(): callee},
+		state:      bridgeCalling,
+	}
+
+	b.Lock()
+	b.bridges[invite.GetCallID()] = br
+	b.bridges[callee.out.GetCallID()] = br
+	b.Unlock()
+
+	fmt.Printf("b2bua: bridging call %s to %s as %s\n", invite.GetCallID(), target.uri, callee.out.GetCallID())
+
+	if err := sendResponse(invite, 100, send); err != nil {
+		fmt.Printf("b2bua: error sending 100 Trying for call %s: %v\n", invite.GetCallID(), err)
+	}
+
+	if err := callee.sendMsg(callee.out); err != nil {
+		// 503 Service Unavailable
+		br.giveUp(503, false)
+		return err
+	}
+
+	go callee.ring(target.transport == ports.TransportUDP, b.ringTime(), br.pending, func() {
+		fmt.Printf("b2bua: %s didn't answer call %s\n", target.uri, invite.GetCallID())
+		// 480 Temporarily Unavailable, or their voicemail
+		br.giveUp(480, true)
+	})
+
+	return nil
+}
+
+// queue - a bridge for a caller we have already answered, ie one waiting in a queue. It has nobody at the far end until someone we
+// offer the call to answers, and their legs are added to it as they are offered it
+func (b *B2bua) queue(fsm *SipFsm, invite ports.SipMessage, send ports.SendResponseCallback, caller *Call, queued *queuedCall) *bridge {
+	br := &bridge{
+		b2bua:      b,
+		fsm:        fsm,
+		invite:     invite,
+		sendCaller: send,
+		caller:     caller,
+		legs:       map[string]*bridgeLeg{},
+		queued:     queued,
+		state:      bridgeQueued,
+	}
+
+	b.Lock()
+	b.bridges[invite.GetCallID()] = br
+	b.Unlock()
+
+	return br
+}
+
+// call - starts a leg of ours to the target: an INVITE made from the caller's, offering media of its own. It isn't sent yet
+func (b *B2bua) call(invite ports.SipMessage, target *bridgeTarget) (*bridgeLeg, error) {
+	out, err := invite.NewOutboundInvite(target.uri, b.localAddr(invite), target.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	call := NewCall(out.GetCallID(), b.allocator, b.factories, b.scheduler)
+	call.silenceMode = b.cfg.SilenceMode
+	call.tonePlan = b.cfg.TonePlan
+	if err := call.Offer(out, invite); err != nil {
+		return nil, err
+	}
+
+	cseq, _ := out.GetCSeq()
+	return &bridgeLeg{
+		out:       out,
+		send:      target.send,
+		target:    target,
+		call:      call,
+		cseq:      cseq,
+		responded: make(chan struct{}),
+	}, nil
+}
+
+// ringTime - how long we ring someone before giving up on them
+func (b *B2bua) ringTime() time.Duration {
+	ringSeconds := b.cfg.RingSeconds
+	if ringSeconds <= 0 {
+		ringSeconds = defaultRingSeconds
+	}
+
+	return time.Duration(ringSeconds) * time.Second
+}
+
+// Handle - takes the messages of the bridges' dialogs: everything on our legs to the far ends, the caller's CANCEL and retransmitted
+// INVITE while the far end rings, their ACK when we turned them down, and their REFER. Returns false for everything else, which is
+// handled like any other message
+func (b *B2bua) Handle(sipMsg ports.SipMessage, send ports.SendResponseCallback) bool {
+	b.Lock()
+	br, ok := b.bridges[sipMsg.GetCallID()]
+	b.Unlock()
+	if !ok {
+		return false
+	}
+
+	if leg := br.leg(sipMsg.GetCallID()); leg != nil {
+		if sipMsg.IsResponse() {
+			br.handleResponse(leg, sipMsg)
+		} else {
+			br.handleRequest(leg, sipMsg, send)
+		}
+		return true
+	}
+
+	switch sipMsg.GetMethod() {
+	case ports.MethodAck:
+		// for the failure we passed on, which the caller's dialog never saw
+		return br.wasDeclined()
+	case ports.MethodCancel:
+		return br.cancel(sipMsg, send)
+	case ports.MethodInvite:
+		// the caller didn't hear our 100 Trying and sent it again, the first one is still ringing
+		return br.pending()
+	case ports.MethodRefer:
+		br.refer(nil, sipMsg, send)
+		return true
+	}
+
+	return false
+}
+
+// localAddr - our address for the Via and Contact of our requests
+func (b *B2bua) localAddr(invite ports.SipMessage) *net.UDPAddr {
+	b.Lock()
+	sender := b.sender
+	b.Unlock()
+
+	return localSipAddr(sender, invite.GetRequest().Host)
+}
+
+// localSipAddr - the address we send sip from. When we listen on every interface, the host that was dialed to reach us is the best
+// guess we have at which of them is ours
+func localSipAddr(sender ports.SipSender, dialed string) *net.UDPAddr {
+	local := &net.UDPAddr{Port: 5060}
+	if sender != nil {
+		addr := *sender.LocalAddr()
+		local = &addr
+	}
+	if local.IP != nil && !local.IP.IsUnspecified() {
+		return local
+	}
+
+	local.IP = net.IPv4(127, 0, 0, 1)
+	if ip := net.ParseIP(dialed); ip != nil {
+		local.IP = ip
+	} else if ipAddr, err := net.ResolveIPAddr("ip", dialed); err == nil {
+		local.IP = ipAddr.IP
+	}
+
+	return local
+}
+
+// addLeg - files a new leg of the bridge's, so its messages find it
+func (b *B2bua) addLeg(br *bridge, leg *bridgeLeg) {
+	br.Lock()
+	br.legs[leg.out.GetCallID()] = leg
+	br.Unlock()
+
+	b.Lock()
+	b.bridges[leg.out.GetCallID()] = br
+	b.Unlock()
+}
+
+// forget - drops the bridge once it has had time to soak up anything late
+func (b *B2bua) forget(br *bridge) {
+	time.AfterFunc(bridgeLingerTime, func() {
+		br.Lock()
+		var callIDs []string
+		for callID := range br.legs {
+			callIDs = append(callIDs, callID)
+		}
+		br.Unlock()
+
+		b.Lock()
+		defer b.Unlock()
+
+		// a caller who moved on to another queue has a new bridge under the same call id
+		callIDs = append(callIDs, br.invite.GetCallID())
+		for _, callID := range callIDs {
+			if b.bridges[callID] == br {
+				delete(b.bridges, callID)
+			}
+		}
+	})
+}
+
+// bridge - a caller connected, or being connected, to the far end
+type bridge struct {
+	sync.Mutex
+	b2bua *B2bua
+	// the caller's dialog, their INVITE and how to send to them
+	fsm        *SipFsm
+	invite     ports.SipMessage
+	sendCaller ports.SendResponseCallback
+	// the caller's media, nil until we have answered them. Once a transfer has put someone we called in the caller's place, callerLeg
+	// is our dialog with them
+	caller    *Call
+	callerLeg *bridgeLeg
+	// our dialog with the far end, who a transfer can replace too, and every leg the bridge has had by its call id
+	callee *bridgeLeg
+	legs   map[string]*bridgeLeg
+	// what each side hears, the other side's audio. nil until the call is connected
+	toCaller *audioRelay
+	toCallee *audioRelay
+	// the transfer under way, if there is one
+	transfer *transfer
+	// the queue the caller waited in, nil when they were bridged straight away
+	queued *queuedCall
+	state  string
+	// set once the caller has heard ringing, and once we have turned the caller down
+	rang     bool
+	declined bool
+}
+
+// leg - the leg of ours with the call id, nil for the caller's dialog
+func (br *bridge) leg(callID string) *bridgeLeg {
+	br.Lock()
+	defer br.Unlock()
+
+	return br.legs[callID]
+}
+
+// pending - whether the far end hasn't answered yet
+func (br *bridge) pending() bool {
+	br.Lock()
+	defer br.Unlock()
+
+	return br.state == bridgeCalling || br.state == bridgeRinging || br.state == bridgeAnswered
+}
+
+// wasDeclined - whether the caller got a failure from us rather than an answer
+func (br *bridge) wasDeclined() bool {
+	br.Lock()
+	defer br.Unlock()
+
+	return br.declined
+}
+
+// decline - turns the caller down
+func (br *bridge) decline(status int) {
+	br.Lock()
+	br.declined = true
+	br.Unlock()
+
+	if err := sendResponse(br.invite, status, br.sendCaller); err != nil {
+		fmt.Printf("b2bua: error sending %d for call %s: %v\n", status, br.invite.GetCallID(), err)
+	}
+}
+
+// handleResponse - a response from one of our legs to our INVITE
+func (br *bridge) handleResponse(leg *bridgeLeg, response ports.SipMessage) {
+	if _, method := response.GetCSeq(); method != ports.MethodInvite {
+		// the far end took our CANCEL, BYE or NOTIFY, there is nothing more to do
+		return
+	}
+	leg.gotResponse()
+
+	br.Lock()
+	t := br.transfer
+	callee := br.callee
+	queued := br.queued
+	br.Unlock()
+
+	if t != nil && t.leg == leg {
+		t.handleResponse(response)
+		return
+	}
+	if queued != nil && queued.offered(leg) {
+		queued.handleResponse(leg, response)
+		return
+	}
+	if leg != callee {
+		// a retransmitted answer from someone a transfer put in the caller's place, or a late one for a leg that is over
+		if response.GetStatus() >= 200 {
+			leg.acknowledge(response)
+		}
+		return
+	}
+
+	br.Lock()
+	status := response.GetStatus()
+	state := br.state
+	switch {
+	case status < 200:
+		if state == bridgeCalling {
+			br.state = bridgeRinging
+		}
+		ring := !br.rang && (state == bridgeCalling || state == bridgeRinging)
+		br.rang = true
+		br.Unlock()
+
+		if ring {
+			if err := sendResponse(br.invite, 180, br.sendCaller); err != nil {
+				fmt.Printf("b2bua: error sending 180 Ringing for call %s: %v\n", br.invite.GetCallID(), err)
+			}
+		}
+		return
+
+	case status < 300:
+		answered := state == bridgeCalling || state == bridgeRinging
+		if answered {
+			br.state = bridgeAnswered
+		}
+		br.Unlock()
+
+		// every 2xx is acknowledged, the far end sends it again until it is
+		leg.acknowledge(response)
+
+		if answered {
+			leg.setAnswer(response)
+			go br.connect(response)
+		} else if state == bridgeCancelling {
+			// they answered just as we gave up on them
+			leg.hangupWith(response)
+			br.finish()
+		}
+		return
+	}
+
+	// turned down. It is only for the caller to hear about if we were still waiting
+	waiting := state == bridgeCalling || state == bridgeRinging
+	if waiting || state == bridgeCancelling {
+		br.state = bridgeEnded
+	}
+	br.Unlock()
+
+	leg.acknowledge(response)
+	if !waiting {
+		br.finish()
+		return
+	}
+
+	fmt.Printf("b2bua: %s turned down call %s with %d\n", leg.target.uri, br.invite.GetCallID(), status)
+	br.giveUp(status, false)
+}
+
+// handleRequest - a request from the far end of one of our legs
+func (br *bridge) handleRequest(leg *bridgeLeg, req ports.SipMessage, send ports.SendResponseCallback) {
+	switch req.GetMethod() {
+	case ports.MethodBye:
+		if err := sendResponse(req, 200, send); err != nil {
+			fmt.Printf("b2bua: error answering BYE for call %s: %v\n", leg.out.GetCallID(), err)
+		}
+		leg.hungUp()
+
+		br.Lock()
+		t := br.transfer
+		callee, callerLeg, caller := br.callee, br.callerLeg, br.caller
+		wasUp := br.state == bridgeAnswered || br.state == bridgeConnected
+		transferor := t != nil && t.transferor == leg
+		if transferor {
+			// they are done with the call once it is in our hands, the transfer goes on without them
+			t.transferorGone = true
+		} else if leg == callee || leg == callerLeg {
+			br.state = bridgeEnded
+		}
+		br.Unlock()
+
+		if transferor || (leg != callee && leg != callerLeg) {
+			return
+		}
+		fmt.Printf("b2bua: %s hung up call %s\n", leg.target.uri, br.invite.GetCallID())
+
+		// the other side goes too
+		if leg == callerLeg {
+			callee.hangup()
+		} else if wasUp && callerLeg != nil {
+			callerLeg.hangup()
+		} else if wasUp && caller != nil {
+			if err := caller.Hangup(); err != nil {
+				fmt.Printf("b2bua: error hanging up call %s: %v\n", br.invite.GetCallID(), err)
+			}
+		}
+		br.finish()
+
+	case ports.MethodInvite:
+		// a re-INVITE, ie the far end putting us on hold. Each leg negotiates its own media, so it goes no further than us
+		leg.call.PrepareAnswer(req)
+		if err := sendResponse(req, 200, send); err != nil {
+			fmt.Printf("b2bua: error answering re-INVITE for call %s: %v\n", leg.out.GetCallID(), err)
+			return
+		}
+		if err := leg.call.Renegotiate(req); err != nil {
+			fmt.Printf("b2bua: error renegotiating call %s: %v\n", leg.out.GetCallID(), err)
+		}
+
+	case ports.MethodAck:
+		// for our answer to their re-INVITE
+
+	case ports.MethodRefer:
+		br.refer(leg, req, send)
+
+	default:
+		fmt.Printf("b2bua: ignoring %s from %s\n", req.GetMethod(), leg.target.uri)
+	}
+}
+
+// cancel - the caller hung up before the far end answered, so we stop ringing them. Returns false once it is too late, when the
+// caller's dialog handles it like any other
+func (br *bridge) cancel(cancel ports.SipMessage, send ports.SendResponseCallback) bool {
+	br.Lock()
+	if br.state != bridgeCalling && br.state != bridgeRinging {
+		br.Unlock()
+		return false
+	}
+	br.state = bridgeCancelling
+	br.Unlock()
+
+	if err := sendResponse(cancel, 200, send); err != nil {
+		fmt.Printf("b2bua: error answering CANCEL for call %s: %v\n", br.invite.GetCallID(), err)
+	}
+	// 487 Request Terminated
+	br.decline(487)
+	fmt.Printf("b2bua: caller cancelled call %s\n", br.invite.GetCallID())
+
+	br.cancelCallee()
+
+	return true
+}
+
+// connect - the far end answered, so we answer the caller and start relaying the media between them
+func (br *bridge) connect(response ports.SipMessage) {
+	if err := br.callee.call.Connect(response); err != nil {
+		fmt.Printf("b2bua: error connecting call %s: %v\n", br.callee.out.GetCallID(), err)
+		br.hangupCallee()
+		// 500 Server Internal Error
+		br.decline(500)
+		return
+	}
+
+	if err := br.fsm.SendOk(br.invite, br.sendCaller, br.relay); err != nil {
+		fmt.Printf("b2bua: error answering call %s: %v\n", br.invite.GetCallID(), err)
+	}
+
+	// we couldn't take the call after all, ie the caller's media security is one we can't agree to
+	if !br.fsm.HasCall(br.invite.GetCallID()) {
+		br.hangupCallee()
+	}
+}
+
+// relay - the caller's handler, which passes the audio of each side to the other until one of them hangs up
+func (br *bridge) relay(caller *Call, sipMsg ports.SipMessage) error {
+	br.Lock()
+	br.caller = caller
+	callee := br.callee
+	up := br.state == bridgeAnswered
+	if up {
+		br.state = bridgeConnected
+	}
+	br.Unlock()
+
+	// the far end hung up while we were answering the caller
+	if !up {
+		return caller.Hangup()
+	}
+
+	callerCodec, err := caller.sendCodec()
+	if err != nil {
+		br.hangupCallee()
+		return err
+	}
+	calleeCodec, err := callee.call.sendCodec()
+	if err != nil {
+		br.hangupCallee()
+		return err
+	}
+
+	fmt.Printf("b2bua: connected call %s (%s) to %s (%s)\n", br.invite.GetCallID(), callerCodec.Name(), callee.target.uri, calleeCodec.Name())
+
+	toCaller := newAudioRelay(callerCodec, caller.mediaOpts, 0)
+	toCallee := newAudioRelay(calleeCodec, callee.call.mediaOpts, 0)
+	br.Lock()
+	br.toCaller, br.toCallee = toCaller, toCallee
+	br.Unlock()
+	callee.call.OnAudio(br.fromCallee)
+	caller.OnAudio(br.fromCaller)
+
+	go br.play(callee, toCallee)
+	err = caller.Play(toCaller)
+
+	// the caller hung up, which ends the call unless they are transferring it, or have been transferred out of it
+	br.Lock()
+	stays := br.callerLeg != nil
+	if t := br.transfer; t != nil && t.transferor == nil {
+		t.transferorGone = true
+		stays = true
+	}
+	br.Unlock()
+	if !stays {
+		br.hangupCallee()
+	}
+
+	return err
+}
+
+// play - relays to one of our legs until it ends
+func (br *bridge) play(leg *bridgeLeg, relay *audioRelay) {
+	if err := leg.call.Play(relay); err != nil && err != errCallEnded {
+		fmt.Printf("b2bua: error relaying to %s: %v\n", leg.target.uri, err)
+	}
+}
+
+// fromCaller - audio from whoever is on the caller's side, for the far end
+func (br *bridge) fromCaller(frame *AudioFrame) {
+	br.Lock()
+	relay := br.toCallee
+	br.Unlock()
+
+	if relay != nil {
+		relay.push(frame)
+	}
+}
+
+// fromCallee - audio from whoever is on the far end, for the caller's side
+func (br *bridge) fromCallee(frame *AudioFrame) {
+	br.Lock()
+	relay := br.toCaller
+	br.Unlock()
+
+	if relay != nil {
+		relay.push(frame)
+	}
+}
+
+// giveUp - the far end isn't taking the call. A registered user's voicemail takes it when they are busy or don't answer, otherwise the
+// caller gets the far end's answer. When we are the ones giving up on them, they need cancelling
+func (br *bridge) giveUp(status int, cancelCallee bool) {
+	br.Lock()
+	if cancelCallee {
+		br.state = bridgeCancelling
+	} else {
+		br.state = bridgeEnded
+	}
+	br.Unlock()
+
+	if cancelCallee {
+		br.cancelCallee()
+	} else {
+		br.finish()
+	}
+
+	voicemail := br.b2bua.voicemail
+	if user := br.callee.target.user; voicemail != nil && user != "" && unanswered(status) {
+		fmt.Printf("b2bua: sending call %s to %s's voicemail\n", br.invite.GetCallID(), user)
+		if err := br.fsm.SendOk(br.invite, br.sendCaller, voicemail.leaveMessage(user)); err != nil {
+			fmt.Printf("b2bua: error answering call %s: %v\n", br.invite.GetCallID(), err)
+		}
+		return
+	}
+
+	// the far end's challenges are for us, the caller can't answer them. 403 Forbidden
+	if status == 401 || status == 407 {
+		status = 403
+	}
+	br.decline(status)
+}
+
+// unanswered - whether the far end didn't answer in time or was busy, the two things voicemail is for. A decline or something being
+// wrong goes back to the caller
+func unanswered(status int) bool {
+	switch status {
+	// 408 Request Timeout, 480 Temporarily Unavailable, 486 Busy Here, 600 Busy Everywhere
+	case 408, 480, 486, 600:
+		return true
+	}
+
+	return false
+}
+
+// cancelCallee - stops the far end ringing. Their 487 ends the leg
+func (br *bridge) cancelCallee() {
+	if err := br.callee.cancel(); err != nil {
+		fmt.Printf("b2bua: error cancelling call %s: %v\n", br.callee.out.GetCallID(), err)
+		br.finish()
+	}
+}
+
+// hangupCallee - ends the far end's leg, if it is up, and with it the bridge
+func (br *bridge) hangupCallee() {
+	br.Lock()
+	callee := br.callee
+	if br.state == bridgeAnswered || br.state == bridgeConnected {
+		br.state = bridgeEnded
+	}
+	br.Unlock()
+
+	callee.hangup()
+	br.finish()
+}
+
+// finish - closes the media of every leg, gives up on a transfer that is under way, and lets the bridge go
+func (br *bridge) finish() {
+	br.Lock()
+	t := br.transfer
+	br.transfer = nil
+	legs := make([]*bridgeLeg, 0, len(br.legs))
+	for _, leg := range br.legs {
+		legs = append(legs, leg)
+	}
+	br.Unlock()
+
+	if t != nil {
+		t.abandon()
+	}
+	for _, leg := range legs {
+		leg.close()
+	}
+	br.b2bua.forget(br)
+}
+
+// bridgeLeg - a dialog of ours with someone we called: our INVITE, how to send to them, their answer and the media
+type bridgeLeg struct {
+	sync.Mutex
+	out    ports.SipMessage
+	send   ports.SendResponseCallback
+	target *bridgeTarget
+	call   *Call
+	// the 2xx they answered our INVITE with, and the cseq of our last request in the dialog
+	answer ports.SipMessage
+	cseq   int
+	// set once the dialog is over, by their BYE or ours
+	byeSent bool
+	// closed on the first response to our INVITE, which stops it being sent again
+	responded chan struct{}
+}
+
+// ring - sends our INVITE again until the far end responds when it went over udp, and calls timedOut if it is still pending once they
+// have rung for too long
+func (l *bridgeLeg) ring(retransmit bool, ringTime time.Duration, pending func() bool, timedOut func()) {
+	timeout := time.NewTimer(ringTime)
+	defer timeout.Stop()
+
+	interval := inviteRetransmitInterval
+	retry := time.NewTimer(interval)
+	defer retry.Stop()
+	if !retransmit {
+		retry.Stop()
+	}
+
+	// once there is a response it stays closed, so stop selecting on it and leave the loop to the timers
+	responded := l.responded
+	for {
+		select {
+		case <-responded:
+			retransmit = false
+			responded = nil
+		case <-retry.C:
+			if !retransmit {
+				continue
+			}
+			if err := l.sendMsg(l.out); err != nil {
+				fmt.Printf("b2bua: error resending INVITE for call %s: %v\n", l.out.GetCallID(), err)
+			}
+			if interval *= 2; interval > inviteRetransmitMaxInterval {
+				interval = inviteRetransmitMaxInterval
+			}
+			retry.Reset(interval)
+			continue
+		case <-timeout.C:
+			if pending() {
+				timedOut()
+			}
+			return
+		}
+
+		if !pending() {
+			return
+		}
+	}
+}
+
+// gotResponse - stops our INVITE being sent again
+func (l *bridgeLeg) gotResponse() {
+	l.Lock()
+	defer l.Unlock()
+
+	select {
+	case <-l.responded:
+	default:
+		close(l.responded)
+	}
+}
+
+// setAnswer - the 2xx that started our dialog with them
+func (l *bridgeLeg) setAnswer(answer ports.SipMessage) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.answer = answer
+}
+
+// request - a request of ours in the dialog, ie a BYE or a NOTIFY
+func (l *bridgeLeg) request(method string) (ports.SipMessage, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.answer == nil {
+		return nil, fmt.Errorf("call %s hasn't been answered", l.out.GetCallID())
+	}
+	l.cseq++
+
+	return l.answer.NewInDialogRequest(method, l.cseq)
+}
+
+// acknowledge - sends the ACK for a final response to our INVITE
+func (l *bridgeLeg) acknowledge(response ports.SipMessage) {
+	ack, err := l.out.NewAck(response)
+	if err == nil {
+		err = l.sendMsg(ack)
+	}
+	if err != nil {
+		fmt.Printf("b2bua: error acknowledging %d for call %s: %v\n", response.GetStatus(), l.out.GetCallID(), err)
+	}
+}
+
+// cancel - stops them ringing. Their 487 ends the leg
+func (l *bridgeLeg) cancel() error {
+	cancel, err := l.out.NewCancel()
+	if err != nil {
+		return err
+	}
+
+	return l.sendMsg(cancel)
+}
+
+// hangup - ends the dialog, if they answered, and closes the media
+func (l *bridgeLeg) hangup() {
+	l.Lock()
+	answer := l.answer
+	l.Unlock()
+
+	if answer != nil {
+		l.hangupWith(answer)
+	}
+	l.close()
+}
+
+// hangupWith - sends them a BYE in the dialog their 2xx started, once
+func (l *bridgeLeg) hangupWith(answer ports.SipMessage) {
+	l.Lock()
+	sent := l.byeSent
+	l.byeSent = true
+	if l.answer == nil {
+		l.answer = answer
+	}
+	l.Unlock()
+	if sent {
+		return
+	}
+
+	bye, err := l.request(ports.MethodBye)
+	if err == nil {
+		err = l.sendMsg(bye)
+	}
+	if err != nil {
+		fmt.Printf("b2bua: error hanging up call %s: %v\n", l.out.GetCallID(), err)
+	}
+}
+
+// hungUp - they ended the dialog with a BYE of their own
+func (l *bridgeLeg) hungUp() {
+	l.Lock()
+	l.byeSent = true
+	l.Unlock()
+
+	l.close()
+}
+
+// close - stops the leg's media
+func (l *bridgeLeg) close() {
+	if err := l.call.Close(); err != nil {
+		fmt.Printf("b2bua: error closing call %s: %v\n", l.out.GetCallID(), err)
+	}
+}
+
+func (l *bridgeLeg) sendMsg(msg ports.SipMessage) error {
+	var b bytes.Buffer
+	msg.Append(&b)
+
+	return l.send(b.Bytes())
+}
@@ -0,0 +1,810 @@
+package domain
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"sip_and_rip/ports"
+)
+
+var errCallEnded = fmt.Errorf("call ended")
+
+// CallHandler - the application that runs once a call is answered, ie playing a prompt or taking a voicemail
+type CallHandler func(call *Call, sipMsg ports.SipMessage) error
+
+// Call - the media state of a single dialog, identified by its call id
+type Call struct {
+	sync.Mutex
+	callID    string
+	allocator ports.PortAllocator
+	factories *ports.Factories
+	scheduler *MediaScheduler
+	rtpConn   *net.UDPConn
+	rtcpConn  *net.UDPConn
+	// what the media is read from and written to: the sockets themselves, or the halves of the webrtc transport on the rtp one
+	rtpMedia  ports.MediaConn
+	rtcpMedia ports.MediaConn
+	webRtc    ports.WebRtcTransport
+	receiver  ports.RtpReceiver
+	rtpClient ports.RtpClient
+	rtcp      *RtcpSession
+	mediaOpts *ports.MediaOptions
+	// our stream, announced in the answer and used for our rtp and rtcp
+	ssrc  uint32
+	cname string
+	// protects the media when the call negotiated srtp, nil for plain rtp
+	srtp ports.SrtpSession
+	// where we receive media, our sdes key or ice and dtls parameters for it, and the last sdp we answered with
+	localRtpAddr *net.UDPAddr
+	localCrypto  *ports.SdpCrypto
+	localWebRtc  *ports.WebRtcParams
+	localSdp     ports.SdpMessage
+	// false while the caller has us on hold
+	sending bool
+	// what goes out in place of silence, and the stream that keeps media going between prompts
+	silenceMode  string
+	comfortNoise *comfortNoise
+	idle         *ScheduledStream
+	playing      int
+	// what is playing, so it can be swapped for something else
+	stream *callStream
+	// the country whose tones we play, ie ringback
+	tonePlan string
+	// the payload type of what we send, the opus or g711 the caller offered first or the far end of a call we placed answered with
+	sendPayloadType uint8
+	// the dynamic payload type of opus when the call is using it, 0 when it isn't
+	opusPayloadType uint8
+	// everything interested in the caller's rtp as it arrives and once it is in order, and in their audio out of the jitter buffer
+	arrivalHandlers []ports.RtpPacketHandler
+	handlers        []ports.RtpPacketHandler
+	audioHandlers   []AudioFrameHandler
+	jitterBuffer    *JitterBuffer
+	recorders       []*CallRecorder
+	digits          chan byte
+	hangupFunc      func() error
+	done            chan struct{}
+	closed          bool
+}
+
+// NewCall - creates the media state for a dialog. Its rtp ports come from the allocator, and the scheduler paces the media we play
+func NewCall(callID string, allocator ports.PortAllocator, factories *ports.Factories, scheduler *MediaScheduler) *Call {
+	return &Call{
+		callID:    callID,
+		allocator: allocator,
+		factories: factories,
+		scheduler: scheduler,
+		digits:    make(chan byte, 32),
+		done:      make(chan struct{}),
+	}
+}
+
+// Listen - allocates the sockets for the call's media and advertises them in the answer to the INVITE. The media is srtp with the
+// caller's sdes key or keyed by a dtls handshake with their browser when the security says so
+func (c *Call) Listen(sipMsg ports.SipMessage, security mediaSecurity) error {
+	pt, ok := sipMsg.GetAudioPayloadType()
+	if !ok {
+		return fmt.Errorf("offer for call %s has no audio we can send", c.callID)
+	}
+	c.sendPayloadType = pt
+	c.opusPayloadType, _ = sipMsg.GetOpusPayloadType()
+
+	if err := c.allocate(sipMsg); err != nil {
+		return err
+	}
+	sipMsg.SetLocalRtpAddr(c.localRtpAddr)
+	sipMsg.SetLocalSsrc(c.ssrc, c.cname)
+
+	var err error
+	switch {
+	case security.crypto != nil:
+		err = c.secure(sipMsg, security.crypto)
+	case security.webRtc != nil:
+		err = c.startWebRtc(sipMsg, security.webRtc)
+	}
+	if err != nil {
+		c.releasePorts()
+		return err
+	}
+
+	if pt, ok := sipMsg.GetDtmfPayloadType(); ok {
+		c.OnRtp(NewDtmfDetector(pt, c.pushDigit).HandlePacket)
+	}
+
+	c.receive()
+
+	return nil
+}
+
+// Offer - allocates the sockets for the media of a call we are placing and offers them in our INVITE. The origin is the request that
+// led to the call, whose address we advertise when the sockets are bound to every interface. Our media is always plain rtp
+func (c *Call) Offer(invite ports.SipMessage, origin ports.SipMessage) error {
+	if err := c.allocate(origin); err != nil {
+		return err
+	}
+	invite.SetLocalRtpAddr(c.localRtpAddr)
+	invite.SetLocalSsrc(c.ssrc, c.cname)
+
+	if err := invite.AddOffer(); err != nil {
+		c.releasePorts()
+		return err
+	}
+	c.localSdp = invite.GetLocalSdp()
+
+	c.receive()
+
+	return nil
+}
+
+// Connect - starts the media of a call we placed, once the far end has answered our offer, sending in the codec they picked
+func (c *Call) Connect(response ports.SipMessage) error {
+	pt, ok := response.GetAudioPayloadType()
+	if !ok {
+		return fmt.Errorf("answer for call %s has no audio we can send", c.callID)
+	}
+	c.sendPayloadType = pt
+
+	if dtmf, ok := response.GetDtmfPayloadType(); ok {
+		c.OnRtp(NewDtmfDetector(dtmf, c.pushDigit).HandlePacket)
+	}
+
+	return c.Answer(response)
+}
+
+// allocate - binds the call's rtp and rtcp sockets, and picks the address and the ssrc we advertise for them
+func (c *Call) allocate(sipMsg ports.SipMessage) error {
+	rtpConn, rtcpConn, err := c.allocator.Allocate()
+	if err != nil {
+		return fmt.Errorf("error allocating rtp ports: %v", err)
+	}
+	c.rtpConn, c.rtpMedia = rtpConn, rtpConn
+	c.rtcpConn, c.rtcpMedia = rtcpConn, rtcpConn
+
+	ip := c.allocator.IP()
+	if ip == nil || ip.IsUnspecified() {
+		// bound to every interface, so the address the caller dialed to reach us is the best guess we have
+		if ip, err = resolveRequestHost(sipMsg); err != nil {
+			c.releasePorts()
+			return err
+		}
+	}
+
+	c.localRtpAddr = &net.UDPAddr{
+		IP:   ip,
+		Port: rtpConn.LocalAddr().(*net.UDPAddr).Port,
+	}
+	c.ssrc, c.cname = newSsrc(), newCname()
+
+	return nil
+}
+
+// receive - starts taking the caller's rtp and rtcp off the sockets
+func (c *Call) receive() {
+	c.jitterBuffer = NewJitterBuffer(c.scheduler, c.newCodec, c.handleAudio)
+
+	c.rtcp = NewRtcpSession(c.rtcpMedia, c.cname)
+	c.rtcp.SetJitterBuffer(c.jitterBuffer)
+	c.rtcp.SetSrtp(c.srtp)
+	c.rtcp.Listen()
+
+	c.receiver = c.factories.NewRtpReceiver(c.rtpMedia)
+	c.receiver.SetSrtp(c.srtp)
+	c.receiver.OnLatch(c.latch)
+	c.receiver.OnArrival(c.handleArrival)
+	c.receiver.Start(c.handleRtp)
+}
+
+// Answer - starts the rtp stream to the caller once they have our answer
+func (c *Call) Answer(sipMsg ports.SipMessage) error {
+	rtpAddr, err := sipMsg.GetRtpAddress()
+	if err != nil {
+		return fmt.Errorf("error getting rtp addr: %v", err)
+	}
+
+	c.mediaOpts = sipMsg.GetMediaOptions()
+
+	c.Lock()
+	defer c.Unlock()
+
+	// their media may have beaten our answer, in which case we already know where it really comes from
+	if latched := c.receiver.RemoteAddr(); latched != nil {
+		rtpAddr = latched
+	}
+
+	// our ssrc is our own, picking the caller's would make the two streams collide
+	rtpClient, err := c.factories.NewRtpClient(c.rtpMedia, rtpAddr, c.ssrc, c.mediaOpts)
+	if err != nil {
+		return fmt.Errorf("error creating rtp client: %v", err)
+	}
+	if c.srtp != nil {
+		rtpClient.SetSrtp(c.srtp)
+	}
+	rtpClient.SetPayloadType(c.sendPayloadType)
+	c.rtpClient = rtpClient
+	c.updateLocalSdp(sipMsg.GetLocalSdp())
+
+	codec, err := c.sendCodec()
+	if err != nil {
+		return err
+	}
+	c.comfortNoise = newComfortNoise(c.silenceMode, sipMsg, codec, c.mediaOpts)
+	if c.comfortNoise.idles() {
+		interval := time.Second / time.Duration(c.mediaOpts.GetFramesPerSecond())
+		c.idle = c.scheduler.Schedule(idleStream{call: c}, interval)
+	}
+
+	if rtcpAddr, err := sipMsg.GetRtcpAddress(); err != nil {
+		fmt.Printf("call %s: not sending rtcp: %v\n", c.callID, err)
+	} else {
+		c.rtcp.Start(rtcpAddr, rtpClient, c.mediaOpts)
+	}
+
+	return nil
+}
+
+// secure - makes the call's media srtp, with the caller's key for what they send and a new one of ours for what we send, which goes
+// in the answer under the tag of the line we picked
+func (c *Call) secure(sipMsg ports.SipMessage, remote *ports.SdpCrypto) error {
+	key, err := c.factories.NewSrtpKey(remote.Suite)
+	if err != nil {
+		return err
+	}
+
+	session, err := c.factories.NewSrtpSession(remote.Suite, key, remote.Key)
+	if err != nil {
+		return fmt.Errorf("error creating srtp session: %v", err)
+	}
+
+	c.srtp = session
+	c.localCrypto = &ports.SdpCrypto{Tag: remote.Tag, Suite: remote.Suite, Key: key}
+	sipMsg.SetLocalCrypto(c.localCrypto)
+
+	fmt.Printf("call %s: media is srtp with %s\n", c.callID, remote.Suite)
+
+	return nil
+}
+
+// startWebRtc - carries the media over a webrtc transport on the rtp socket, which answers the browser's connectivity checks and keys
+// srtp with a dtls handshake. rtcp comes and goes on the rtp port, so the rtcp socket sits unused
+func (c *Call) startWebRtc(sipMsg ports.SipMessage, remote *ports.WebRtcParams) error {
+	transport, err := c.factories.NewWebRtcTransport(c.rtpConn, remote)
+	if err != nil {
+		return fmt.Errorf("error creating webrtc transport: %v", err)
+	}
+	if err := transport.Start(); err != nil {
+		return fmt.Errorf("error starting webrtc transport: %v", err)
+	}
+
+	c.webRtc = transport
+	c.rtpMedia, c.rtcpMedia = transport.RtpConn(), transport.RtcpConn()
+	c.localWebRtc = transport.LocalParams()
+	sipMsg.SetLocalWebRtc(c.localWebRtc)
+
+	fmt.Printf("call %s: media is webrtc, waiting for the browser's dtls handshake\n", c.callID)
+
+	return nil
+}
+
+// PrepareAnswer - sets up a re-INVITE so our answer comes from the same socket and session as the first one. The srtp keys, and the
+// ice and dtls parameters, stay the same for the life of the call
+func (c *Call) PrepareAnswer(sipMsg ports.SipMessage) {
+	c.Lock()
+	defer c.Unlock()
+
+	sipMsg.SetLocalRtpAddr(c.localRtpAddr)
+	sipMsg.SetLocalSsrc(c.ssrc, c.cname)
+	sipMsg.SetLocalCrypto(c.localCrypto)
+	sipMsg.SetLocalWebRtc(c.localWebRtc)
+	sipMsg.SetPreviousSdp(c.localSdp)
+}
+
+// Renegotiate - applies our answer to a re-INVITE, ie going on hold or sending media somewhere new
+func (c *Call) Renegotiate(sipMsg ports.SipMessage) error {
+	rtpAddr, err := sipMsg.GetRtpAddress()
+	if err != nil {
+		return fmt.Errorf("error getting rtp addr: %v", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// once we have latched on to where their media really comes from, that wins over an sdp address which may not be reachable
+	if c.rtpClient != nil && c.receiver.RemoteAddr() == nil {
+		c.rtpClient.SetRemoteAddr(rtpAddr)
+	}
+	if rtcpAddr, err := sipMsg.GetRtcpAddress(); err == nil {
+		c.rtcp.SetRemoteAddr(rtcpAddr)
+	}
+	c.updateLocalSdp(sipMsg.GetLocalSdp())
+
+	return nil
+}
+
+// updateLocalSdp - remembers our answer, and stops sending while it says we shouldn't. The lock must be held
+func (c *Call) updateLocalSdp(localSdp ports.SdpMessage) {
+	if localSdp == nil {
+		c.sending = true
+		return
+	}
+
+	c.localSdp = localSdp
+	c.rtcp.SetLocalSdp(localSdp)
+	direction := localSdp.GetDirection()
+	c.sending = direction == "sendrecv" || direction == "sendonly"
+}
+
+// latch - sends our media back to wherever the caller's comes from, which gets through their NAT when their sdp address doesn't
+func (c *Call) latch(addr *net.UDPAddr) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.rtpClient != nil {
+		c.rtpClient.SetRemoteAddr(addr)
+	}
+}
+
+// OnRtp - adds a handler for the caller's rtp packets
+func (c *Call) OnRtp(handler ports.RtpPacketHandler) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.handlers = append(c.handlers, handler)
+}
+
+// OnArrival - adds a handler for the caller's rtp packets as they arrive, before they are put in order
+func (c *Call) OnArrival(handler ports.RtpPacketHandler) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.arrivalHandlers = append(c.arrivalHandlers, handler)
+}
+
+// OnAudio - adds a handler for the caller's audio, in order and with the gaps concealed
+func (c *Call) OnAudio(handler AudioFrameHandler) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.audioHandlers = append(c.audioHandlers, handler)
+}
+
+// Record - starts recording the caller's audio into the directory
+func (c *Call) Record(dir string, sipMsg ports.SipMessage) (*CallRecorder, error) {
+	recorder, err := NewCallRecorder(dir, sipMsg, c.receiver, c.factories)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.recorders = append(c.recorders, recorder)
+	c.Unlock()
+
+	c.OnAudio(recorder.HandleFrame)
+
+	return recorder, nil
+}
+
+// OpenWav - opens a wav file to play to the caller, in the codec we send. Close it when done
+func (c *Call) OpenWav(filename string) (ports.MediaReadCloser, error) {
+	codec, err := c.sendCodec()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.factories.NewWavReader(filename, codec, c.mediaOpts)
+}
+
+// Tone - a sine wave to play to the caller, or silence for 0hz
+func (c *Call) Tone(freqHz int, durationMs int) (ports.MediaReader, error) {
+	seg := ports.ToneSegment{DurationMs: durationMs}
+	if freqHz > 0 {
+		seg.FreqsHz = []int{freqHz}
+	}
+
+	return c.newTone(ports.Tone{Segments: []ports.ToneSegment{seg}}, 0)
+}
+
+// PlanTone - one of the tones of the call's tone plan, ie ToneRingback. It lasts for durationMs, or without one for its cadence, or
+// until it is stopped if its cadence repeats
+func (c *Call) PlanTone(name string, durationMs int) (ports.MediaReader, error) {
+	tone, err := LookupTone(c.tonePlan, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.newTone(tone, durationMs)
+}
+
+func (c *Call) newTone(tone ports.Tone, durationMs int) (ports.MediaReader, error) {
+	codec, err := c.sendCodec()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.factories.NewToneReader(tone, durationMs, codec, c.mediaOpts), nil
+}
+
+// sendCodec - the codec of the media we send, opus, u-law or a-law
+func (c *Call) sendCodec() (ports.Codec, error) {
+	return c.newCodec(c.sendPayloadType)
+}
+
+// newCodec - the codec for one of the call's payload types. Opus has whatever dynamic one the caller gave it, g711 its static ones
+func (c *Call) newCodec(payloadType uint8) (ports.Codec, error) {
+	if c.opusPayloadType != 0 && payloadType == c.opusPayloadType {
+		return c.factories.NewOpusCodec(payloadType)
+	}
+
+	return c.factories.NewCodec(payloadType)
+}
+
+// FileSource - a wav file, for playlists
+func (c *Call) FileSource(filename string) MediaSource {
+	return func() (ports.MediaReader, error) {
+		return c.OpenWav(filename)
+	}
+}
+
+// SilenceSource - a gap of silence, for playlists
+func (c *Call) SilenceSource(durationMs int) MediaSource {
+	return func() (ports.MediaReader, error) {
+		return c.Tone(0, durationMs)
+	}
+}
+
+// ToneSource - one of the tones of the call's tone plan, for playlists
+func (c *Call) ToneSource(name string, durationMs int) MediaSource {
+	return func() (ports.MediaReader, error) {
+		return c.PlanTone(name, durationMs)
+	}
+}
+
+// NewPlaylist - a playlist of the sources with frames the size of the call's, going through them the number of times it loops or
+// LoopForever. Close it when done
+func (c *Call) NewPlaylist(loops int, sources ...MediaSource) *Playlist {
+	return NewPlaylist(time.Second/time.Duration(c.mediaOpts.GetFramesPerSecond()), loops, sources...)
+}
+
+// Replace - swaps what is playing for the reader, which carries on where it left off without restarting the stream, ie moving from
+// ringback to hold music. The Play that was playing returns once the reader runs out. The old reader is left for whoever opened it to close
+func (c *Call) Replace(reader ports.MediaReader) error {
+	c.Lock()
+	stream := c.stream
+	c.Unlock()
+
+	if stream == nil {
+		return fmt.Errorf("call %s isn't playing anything", c.callID)
+	}
+
+	stream.Lock()
+	stream.reader = reader
+	stream.Unlock()
+
+	return nil
+}
+
+// Play - sends the media to the caller until it runs out or the call ends
+func (c *Call) Play(reader ports.MediaReader) error {
+	_, err := c.play(reader, false)
+	return err
+}
+
+// Reflect - sends the caller's packets back to them as they arrive, sequence numbers and all, until the call ends. Nothing else is
+// sent meanwhile, so theirs is the only stream they get
+func (c *Call) Reflect() error {
+	if c.rtpClient == nil {
+		return fmt.Errorf("call %s has not been answered", c.callID)
+	}
+
+	// the idle stream holds off while we reflect, as it would while we play
+	c.Lock()
+	c.playing++
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.playing--
+		c.Unlock()
+	}()
+
+	c.OnArrival(c.reflect)
+
+	<-c.done
+	return errCallEnded
+}
+
+// PlayUntilDigit - sends the media to the caller, stopping early if they press a key. Returns the key, or 0 if the media finished
+func (c *Call) PlayUntilDigit(reader ports.MediaReader) (byte, error) {
+	return c.play(reader, true)
+}
+
+// WaitForDigit - waits for the caller to press a key. Returns 0 if they don't press one in time
+func (c *Call) WaitForDigit(timeout time.Duration) (byte, error) {
+	select {
+	case digit := <-c.digits:
+		return digit, nil
+	case <-c.done:
+		return 0, errCallEnded
+	case <-time.After(timeout):
+		return 0, nil
+	}
+}
+
+// Quality - how the call's audio has held up so far
+func (c *Call) Quality() CallQuality {
+	if c.rtcp == nil {
+		return CallQuality{}
+	}
+
+	return c.rtcp.Quality()
+}
+
+// Hangup - ends the call from our side
+func (c *Call) Hangup() error {
+	if c.hangupFunc == nil {
+		return fmt.Errorf("call %s can't be hung up", c.callID)
+	}
+
+	return c.hangupFunc()
+}
+
+// Done - closed once the call has ended
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close - stops everything the call has running
+func (c *Call) Close() error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	recorders := c.recorders
+	idle := c.idle
+	c.Unlock()
+
+	// stopping waits for a frame being sent, which needs the lock
+	if idle != nil {
+		idle.Stop()
+	}
+
+	// nothing more goes to the recorders once they are stopped
+	if c.jitterBuffer != nil {
+		c.jitterBuffer.Close()
+	}
+
+	// say goodbye while the rtcp socket is still open
+	var quality *CallQuality
+	if c.rtcp != nil {
+		if rErr := c.rtcp.Close(); rErr != nil {
+			fmt.Printf("call %s: error sending rtcp bye: %v\n", c.callID, rErr)
+		}
+
+		q := c.rtcp.Quality()
+		quality = &q
+		fmt.Printf("call %s quality: %s\n", c.callID, q)
+		rtcpMetrics.Add("packetsLost", int64(q.CumulativeLost))
+	}
+
+	var err error
+	for _, recorder := range recorders {
+		if rErr := recorder.Stop(quality); rErr != nil {
+			err = fmt.Errorf("error stopping recording for call %s: %v", c.callID, rErr)
+		}
+	}
+
+	if c.receiver != nil {
+		c.receiver.Close()
+	}
+	if c.rtpClient != nil {
+		c.rtpClient.Close()
+	}
+	c.releasePorts()
+
+	return err
+}
+
+// releasePorts - closes the call's sockets and gives the ports back to the allocator
+func (c *Call) releasePorts() {
+	if c.rtpConn == nil {
+		return
+	}
+
+	// the transport says goodbye to the browser over the socket, so it goes first
+	if c.webRtc != nil {
+		if err := c.webRtc.Close(); err != nil {
+			fmt.Printf("call %s: error closing webrtc transport: %v\n", c.callID, err)
+		}
+	}
+
+	port := c.rtpConn.LocalAddr().(*net.UDPAddr).Port
+	c.rtpConn.Close()
+	c.rtcpConn.Close()
+	c.allocator.Release(port)
+}
+
+// resolveRequestHost - the ip of the host in the request uri, which is what the caller dialed to reach us
+func resolveRequestHost(sipMsg ports.SipMessage) (net.IP, error) {
+	host := sipMsg.GetRequest().Host
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	ipAddr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving our own address %s: %v", host, err)
+	}
+
+	return ipAddr.IP, nil
+}
+
+func (c *Call) play(reader ports.MediaReader, stopOnDigit bool) (byte, error) {
+	if c.rtpClient == nil {
+		return 0, fmt.Errorf("call %s has not been answered", c.callID)
+	}
+
+	stream := &callStream{call: c, reader: reader}
+
+	// the idle stream holds off while we play
+	c.Lock()
+	c.playing++
+	c.stream = stream
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.playing--
+		if c.stream == stream {
+			c.stream = nil
+		}
+		c.Unlock()
+	}()
+	interval := time.Second / time.Duration(c.mediaOpts.GetFramesPerSecond())
+	job := c.scheduler.Schedule(stream, interval)
+	defer job.Stop()
+
+	// a nil channel never receives, so digits are left for someone else unless we are stopping on them
+	var digits chan byte
+	if stopOnDigit {
+		digits = c.digits
+	}
+
+	select {
+	case <-job.Done():
+		return 0, stream.err
+	case <-c.done:
+		return 0, errCallEnded
+	case digit := <-digits:
+		return digit, nil
+	}
+}
+
+// callStream - plays a reader out to the caller, a frame each time the scheduler says one is due
+type callStream struct {
+	// guards the reader, which can be replaced while it plays
+	sync.Mutex
+	call   *Call
+	reader ports.MediaReader
+	err    error
+}
+
+// SendFrame - sends the next frame of the reader to the caller
+func (s *callStream) SendFrame() bool {
+	frame, done := s.next()
+	if done {
+		return true
+	}
+
+	s.call.Lock()
+	sending := s.call.sending
+	s.call.Unlock()
+
+	// on hold the media keeps playing out, it just goes nowhere
+	if !sending {
+		s.call.rtpClient.Skip()
+		return false
+	}
+
+	// send the buffer to the sip client using rtp, or comfort noise if it is silence
+	if err := s.call.comfortNoise.sendFrame(s.call.rtpClient, frame); err != nil {
+		s.err = fmt.Errorf("failed to send RTP packet: %v", err)
+		return true
+	}
+
+	return false
+}
+
+// SkipFrame - drops the next frame of the reader because we are too late to send it
+func (s *callStream) SkipFrame() bool {
+	if _, done := s.next(); done {
+		return true
+	}
+	s.call.rtpClient.Skip()
+
+	return false
+}
+
+func (s *callStream) next() ([]byte, bool) {
+	s.Lock()
+	reader := s.reader
+	s.Unlock()
+
+	frame, err := reader.NextRtpFrame()
+	if err == io.EOF {
+		// it may have run out just as it was replaced, in which case the new one carries on
+		s.Lock()
+		replaced := s.reader != reader
+		s.Unlock()
+		if replaced {
+			return s.next()
+		}
+		return nil, true
+	} else if err != nil {
+		s.err = err
+		return nil, true
+	}
+
+	return frame, false
+}
+
+// handleArrival - takes the caller's packets as they arrive, before the receiver puts them in order
+func (c *Call) handleArrival(pkt *rtp.Packet) {
+	c.rtcp.HandleRtp(pkt)
+	c.jitterBuffer.Push(pkt)
+
+	c.Lock()
+	handlers := c.arrivalHandlers
+	c.Unlock()
+
+	for _, handler := range handlers {
+		handler(pkt)
+	}
+}
+
+// reflect - sends a packet of the caller's back to them, unless they have us on hold
+func (c *Call) reflect(pkt *rtp.Packet) {
+	c.Lock()
+	sending := c.sending
+	c.Unlock()
+
+	if !sending {
+		return
+	}
+	if _, err := c.rtpClient.WritePacket(pkt); err != nil {
+		fmt.Printf("call %s: error reflecting rtp: %v\n", c.callID, err)
+	}
+}
+
+func (c *Call) handleAudio(frame *AudioFrame) {
+	c.Lock()
+	handlers := c.audioHandlers
+	c.Unlock()
+
+	for _, handler := range handlers {
+		handler(frame)
+	}
+}
+
+func (c *Call) handleRtp(pkt *rtp.Packet) {
+	c.Lock()
+	handlers := c.handlers
+	c.Unlock()
+
+	for _, handler := range handlers {
+		handler(pkt)
+	}
+}
+
+func (c *Call) pushDigit(digit byte) {
+	fmt.Printf("call %s: caller pressed %c\n", c.callID, digit)
+
+	select {
+	case c.digits <- digit:
+	default:
+		// nobody is listening for digits, drop it
+	}
+}
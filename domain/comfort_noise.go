@@ -0,0 +1,229 @@
+package domain
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"sip_and_rip/ports"
+)
+
+// what we send the caller when we have nothing to say. Some phones take a stream that stops for a dead call and hang up on it, so
+// unless it is off they always get something
+const (
+	// the silences in what we play, and the gaps between prompts, are sent as comfort noise (rfc 3389) to callers that negotiated it.
+	// The rest get silence frames between prompts
+	SilenceComfortNoise = "cn"
+	// the gaps between prompts are filled with silence frames, for callers that can't do comfort noise or do it badly
+	SilenceFrames = "silence"
+	// nothing is sent between prompts
+	SilenceOff = "off"
+)
+
+const (
+	// frames quieter than this many -dBov are silence to the vad, well under speech and above the hiss of most recordings
+	vadSilenceLevel = 50
+	// how long a silence has to last before we stop sending it, so the quiet ends of words and short pauses aren't clipped
+	vadHangoverMs = 200
+	// how often the comfort noise is refreshed while the silence lasts. The level rarely changes, this is so the caller keeps hearing from us
+	comfortNoiseRefreshMs = 1000
+	// the level of the comfort noise between prompts until we have heard what the silences in them sound like, a quiet room
+	defaultComfortNoiseLevel = 70
+	// the power of a square wave at u-law's loudest, decoded to 16 bits, which is 0 dBov (rfc 3389 3)
+	dbovReference = 32124.0 * 32124.0
+)
+
+// comfortNoise - decides what goes out in place of the silences, both in what we play and between prompts. The vad is a simple energy
+// one: prompts are recorded, so their silences are far quieter than the speech in them
+type comfortNoise struct {
+	sync.Mutex
+	mode string
+	// the caller's payload type for comfort noise, when they negotiated it
+	payloadType uint8
+	negotiated  bool
+	codec       ports.Codec
+	// a frame of silence, for callers that get silence frames
+	silence        []byte
+	hangoverFrames int
+	refreshFrames  int
+	// quiet frames in a row, and whether we have stopped sending them
+	quietFrames int
+	suppressing bool
+	// frames skipped since our last comfort noise packet
+	sinceUpdate int
+	// the power of the silence since our last comfort noise packet, to tell the caller how loud it is
+	power       float64
+	powerFrames int
+	level       uint8
+}
+
+// newComfortNoise - what the call sends in place of silence, in the mode from the config and as negotiated in the INVITE
+func newComfortNoise(mode string, sipMsg ports.SipMessage, codec ports.Codec, opts *ports.MediaOptions) *comfortNoise {
+	if mode == "" {
+		mode = SilenceComfortNoise
+	}
+
+	n := &comfortNoise{
+		mode:           mode,
+		codec:          codec,
+		silence:        codec.Encode(make([]int16, opts.GetSampleSize())),
+		hangoverFrames: vadHangoverMs * opts.GetFramesPerSecond() / 1000,
+		refreshFrames:  comfortNoiseRefreshMs * opts.GetFramesPerSecond() / 1000,
+		level:          defaultComfortNoiseLevel,
+	}
+	n.payloadType, n.negotiated = sipMsg.GetComfortNoisePayloadType()
+
+	return n
+}
+
+// idles - whether anything goes out between prompts
+func (n *comfortNoise) idles() bool {
+	return n.mode != SilenceOff
+}
+
+// suppresses - whether the silences go out as comfort noise
+func (n *comfortNoise) suppresses() bool {
+	return n.mode == SilenceComfortNoise && n.negotiated
+}
+
+// sendFrame - sends a frame of what we are playing, or comfort noise in its place once the vad has heard enough silence
+func (n *comfortNoise) sendFrame(client ports.RtpClient, frame []byte) error {
+	if !n.suppresses() {
+		_, err := client.Write(frame)
+		return err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	power := meanPower(n.codec.Decode(frame))
+	if dbovLevel(power) < vadSilenceLevel {
+		n.quietFrames = 0
+		n.suppressing = false
+		_, err := client.Write(frame)
+		return err
+	}
+
+	n.quietFrames++
+	n.power += power
+	n.powerFrames++
+	if !n.suppressing && n.quietFrames <= n.hangoverFrames {
+		_, err := client.Write(frame)
+		return err
+	}
+
+	return n.sendSilence(client)
+}
+
+// sendIdle - sends a frame's worth of nothing, while nothing is playing
+func (n *comfortNoise) sendIdle(client ports.RtpClient) error {
+	if !n.suppresses() {
+		_, err := client.Write(n.silence)
+		return err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	return n.sendSilence(client)
+}
+
+// sendSilence - sends comfort noise when the silence starts and every so often while it lasts, and nothing in between. The rtp
+// clock keeps moving either way. The lock must be held
+func (n *comfortNoise) sendSilence(client ports.RtpClient) error {
+	if n.suppressing && n.sinceUpdate < n.refreshFrames {
+		n.sinceUpdate++
+		client.Skip()
+		return nil
+	}
+
+	if n.powerFrames > 0 {
+		n.level = dbovLevel(n.power / float64(n.powerFrames))
+		n.power, n.powerFrames = 0, 0
+	}
+	n.suppressing = true
+	n.sinceUpdate = 0
+
+	if _, err := client.WriteComfortNoise(n.payloadType, n.level); err != nil {
+		return fmt.Errorf("error sending comfort noise: %v", err)
+	}
+
+	return nil
+}
+
+// meanPower - the mean of the squares of the samples
+func meanPower(samples []int16) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+
+	return sum / float64(len(samples))
+}
+
+// dbovLevel - the power as a comfort noise level, how many dB it is below the loudest the codec goes. Digital silence is as quiet
+// as a level can say
+func dbovLevel(power float64) uint8 {
+	if power <= 0 {
+		return 127
+	}
+
+	level := -10 * math.Log10(power/dbovReference)
+	switch {
+	case level < 0:
+		return 0
+	case level > 127:
+		return 127
+	}
+
+	return uint8(level)
+}
+
+// idleStream - keeps media going to the caller while nothing is playing, so the quiet between prompts doesn't look like a dead call
+type idleStream struct {
+	call *Call
+}
+
+// SendFrame - sends silence or comfort noise, unless a prompt is playing
+func (s idleStream) SendFrame() bool {
+	c := s.call
+
+	c.Lock()
+	playing, sending := c.playing > 0, c.sending
+	c.Unlock()
+
+	switch {
+	case playing:
+		// the prompt keeps the clock moving
+		return false
+	case !sending:
+		c.rtpClient.Skip()
+		return false
+	}
+
+	if err := c.comfortNoise.sendIdle(c.rtpClient); err != nil {
+		fmt.Printf("call %s: stopped sending silence: %v\n", c.callID, err)
+		return true
+	}
+
+	return false
+}
+
+// SkipFrame - keeps the clock moving when we are too late to send the frame
+func (s idleStream) SkipFrame() bool {
+	c := s.call
+
+	c.Lock()
+	playing := c.playing > 0
+	c.Unlock()
+
+	if !playing {
+		c.rtpClient.Skip()
+	}
+
+	return false
+}
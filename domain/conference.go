@@ -0,0 +1,429 @@
+package domain
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+const (
+	// the room is mixed a frame at a time on our clock, at the g711 rate every codec we have shares
+	conferenceFrameMs   = 20
+	conferenceRateHz    = 8000
+	conferenceFrameSize = conferenceRateHz * conferenceFrameMs / 1000
+	// how much of each participant's audio we hold before mixing it, so their jitter buffer playing out on their clock and the mixer
+	// on ours don't leave gaps whenever the two drift past each other
+	conferenceInputDelay = 40 * time.Millisecond
+	// and of the mix before it is sent, for the same reason between the mixer and the participant's own stream
+	conferenceOutputDelay = conferenceFrameMs * time.Millisecond
+	// the goes callers get at the pin, and how long they have for each digit
+	conferencePinTries   = 3
+	conferenceDigitTimer = 10 * time.Second
+)
+
+// a rising pair of notes when someone joins, and a falling pair when they leave
+var (
+	conferenceJoinTone = ports.Tone{Segments: []ports.ToneSegment{
+		{FreqsHz: []int{600}, DurationMs: 120},
+		{FreqsHz: []int{900}, DurationMs: 180},
+	}}
+	conferenceLeaveTone = ports.Tone{Segments: []ports.ToneSegment{
+		{FreqsHz: []int{900}, DurationMs: 120},
+		{FreqsHz: []int{600}, DurationMs: 180},
+	}}
+)
+
+// ConferenceRoom - a number callers dial to talk to everyone else who dialed it
+type ConferenceRoom struct {
+	// the user part of the request uri, ie 800 in sip:800@host
+	Number string `json:"number,omitempty"`
+	// or the start of it, ie 7 for each of 7000 to 7999 being a room of its own
+	Prefix string `json:"prefix,omitempty"`
+	// the digits callers enter, then #, before they are let in. Anyone can join when empty
+	Pin string `json:"pin,omitempty"`
+}
+
+// Validate - checks the room matches something and its pin can be dialed
+func (r ConferenceRoom) Validate() error {
+	if r.Number == "" && r.Prefix == "" {
+		return fmt.Errorf("conference room needs a number or a prefix")
+	}
+
+	for _, digit := range r.Pin {
+		if digit < '0' || digit > '9' {
+			return fmt.Errorf("conference room pin %q can only have the digits 0 to 9", r.Pin)
+		}
+	}
+
+	return nil
+}
+
+// matches - whether the dialed number is this room, or one of its rooms for a prefix
+func (r ConferenceRoom) matches(dialed string) bool {
+	if r.Number != "" {
+		return r.Number == dialed
+	}
+
+	return strings.HasPrefix(dialed, r.Prefix) && len(dialed) > len(r.Prefix)
+}
+
+// Conferences - the conference rooms, addressed by the number dialed. Everyone's audio comes out of their jitter buffer and is mixed
+// together, and each participant hears the mix without themselves in it, encoded with their own codec. A room exists while there is
+// someone in it
+type Conferences struct {
+	sync.Mutex
+	cfg       *Config
+	scheduler *MediaScheduler
+	rooms     map[string]*conference
+	// the join and leave tones in linear pcm, ready to mix in
+	joinTone  []int16
+	leaveTone []int16
+}
+
+// NewConferences - creates the conference rooms of the config, which mix on the scheduler
+func NewConferences(cfg *Config, factories *ports.Factories, scheduler *MediaScheduler) *Conferences {
+	return &Conferences{
+		cfg:       cfg,
+		scheduler: scheduler,
+		rooms:     map[string]*conference{},
+		joinTone:  renderTone(factories, conferenceJoinTone),
+		leaveTone: renderTone(factories, conferenceLeaveTone),
+	}
+}
+
+// renderTone - the samples of a tone that doesn't repeat, made by the tone reader and decoded back again. The odd bit lost to u-law
+// doesn't matter for a beep
+func renderTone(factories *ports.Factories, tone ports.Tone) []int16 {
+	codec, err := factories.NewCodec(ports.PcmuPayloadType)
+	if err != nil {
+		fmt.Println("conference: can't make the join and leave tones: ", err)
+		return nil
+	}
+
+	reader := factories.NewToneReader(tone, 0, codec, &ports.MediaOptions{SampleRateHz: conferenceRateHz})
+
+	var pcm []int16
+	for {
+		payload, err := reader.NextRtpFrame()
+		if err == io.EOF {
+			return pcm
+		}
+		if err != nil {
+			fmt.Println("conference: error making a tone: ", err)
+			return pcm
+		}
+		pcm = append(pcm, codec.Decode(payload)...)
+	}
+}
+
+// Route - the handler that puts the caller in the room they dialed, nil when they didn't dial one
+func (c *Conferences) Route(sipMsg ports.SipMessage) CallHandler {
+	dialed := sipMsg.GetRequest().User
+	if dialed == "" {
+		return nil
+	}
+
+	for _, room := range c.cfg.ConferenceRooms {
+		if room.matches(dialed) {
+			return c.join(dialed, room.Pin)
+		}
+	}
+
+	return nil
+}
+
+// join - asks for the pin if the room has one, then mixes the caller into the room until they hang up or are kicked
+func (c *Conferences) join(room string, pin string) CallHandler {
+	return func(call *Call, sipMsg ports.SipMessage) error {
+		caller := addrString(sipMsg.GetFrom())
+
+		if pin != "" {
+			ok, err := c.checkPin(call, pin)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Printf("conference %s: %s got the pin wrong, hanging up\n", room, caller)
+				return call.Hangup()
+			}
+		}
+
+		codec, err := call.sendCodec()
+		if err != nil {
+			return err
+		}
+
+		p := &participant{
+			call:     call,
+			caller:   caller,
+			joinedAt: time.Now(),
+			in:       newAudioRelay(codec, call.mediaOpts, conferenceInputDelay),
+			out:      newAudioRelay(codec, call.mediaOpts, conferenceOutputDelay),
+		}
+		call.OnAudio(p.in.push)
+
+		conf := c.enter(room, p)
+		defer c.leave(conf, p)
+
+		return call.Play(p.out)
+	}
+}
+
+// checkPin - gives the caller a few goes at the room's pin, each after a double beep and ended by # or by them stopping. Without
+// prompts, a wrong pin gets a burst of congestion tone
+func (c *Conferences) checkPin(call *Call, pin string) (bool, error) {
+	for try := 0; try < conferencePinTries; try++ {
+		for i := 0; i < 2; i++ {
+			if err := c.playTone(call, beepHz, 150); err != nil {
+				return false, err
+			}
+			if err := c.playTone(call, 0, 100); err != nil {
+				return false, err
+			}
+		}
+
+		var entered strings.Builder
+		for {
+			digit, err := call.WaitForDigit(conferenceDigitTimer)
+			if err != nil {
+				return false, err
+			}
+			if digit == 0 || digit == '#' {
+				break
+			}
+			entered.WriteByte(digit)
+		}
+
+		if entered.String() == pin {
+			return true, nil
+		}
+
+		reorder, err := call.PlanTone(ToneCongestion, 1000)
+		if err != nil {
+			return false, err
+		}
+		if err := call.Play(reorder); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+func (c *Conferences) playTone(call *Call, freqHz int, durationMs int) error {
+	tone, err := call.Tone(freqHz, durationMs)
+	if err != nil {
+		return err
+	}
+
+	return call.Play(tone)
+}
+
+// enter - puts the participant in the room, opening it if they are the first, and lets everyone know with the join tone
+func (c *Conferences) enter(room string, p *participant) *conference {
+	c.Lock()
+	defer c.Unlock()
+
+	conf, ok := c.rooms[room]
+	if !ok {
+		conf = &conference{room: room}
+		c.rooms[room] = conf
+		conf.job = c.scheduler.Schedule(conf, conferenceFrameMs*time.Millisecond)
+	}
+
+	conf.Lock()
+	conf.nextID++
+	p.id = strconv.Itoa(conf.nextID)
+	conf.participants = append(conf.participants, p)
+	conf.announce(c.joinTone)
+	count := len(conf.participants)
+	conf.Unlock()
+
+	fmt.Printf("conference %s: %s joined as %s, %d in the room\n", room, p.caller, p.id, count)
+
+	return conf
+}
+
+// leave - takes the participant out of the room, closing it if they were the last, and lets everyone left know with the leave tone
+func (c *Conferences) leave(conf *conference, p *participant) {
+	c.Lock()
+	defer c.Unlock()
+
+	conf.Lock()
+	for i, other := range conf.participants {
+		if other == p {
+			conf.participants = append(conf.participants[:i], conf.participants[i+1:]...)
+			break
+		}
+	}
+	conf.announce(c.leaveTone)
+	count := len(conf.participants)
+	conf.Unlock()
+
+	fmt.Printf("conference %s: %s (%s) left, %d in the room\n", conf.room, p.caller, p.id, count)
+
+	if count == 0 {
+		conf.job.Stop()
+		delete(c.rooms, conf.room)
+	}
+}
+
+// List - the rooms with someone in them, and who
+func (c *Conferences) List() []ports.Conference {
+	c.Lock()
+	defer c.Unlock()
+
+	list := []ports.Conference{}
+	for _, conf := range c.rooms {
+		conf.Lock()
+		info := ports.Conference{Room: conf.room, Participants: []ports.ConferenceParticipant{}}
+		for _, p := range conf.participants {
+			info.Participants = append(info.Participants, ports.ConferenceParticipant{
+				ID:       p.id,
+				Caller:   p.caller,
+				JoinedAt: p.joinedAt,
+				Muted:    p.muted,
+			})
+		}
+		conf.Unlock()
+		list = append(list, info)
+	}
+
+	return list
+}
+
+// Mute - stops or starts the rest of the room hearing the participant. They still hear the room
+func (c *Conferences) Mute(room string, id string, muted bool) error {
+	return c.withParticipant(room, id, func(conf *conference, p *participant) {
+		conf.Lock()
+		p.muted = muted
+		conf.Unlock()
+	})
+}
+
+// Kick - hangs up on the participant, who leaves the room like they hung up themselves
+func (c *Conferences) Kick(room string, id string) error {
+	var call *Call
+	if err := c.withParticipant(room, id, func(conf *conference, p *participant) {
+		call = p.call
+	}); err != nil {
+		return err
+	}
+
+	return call.Hangup()
+}
+
+func (c *Conferences) withParticipant(room string, id string, fn func(conf *conference, p *participant)) error {
+	c.Lock()
+	conf, ok := c.rooms[room]
+	c.Unlock()
+	if !ok {
+		return fmt.Errorf("conference room %s is empty: %w", room, ports.ErrNotFound)
+	}
+
+	conf.Lock()
+	var found *participant
+	for _, p := range conf.participants {
+		if p.id == id {
+			found = p
+		}
+	}
+	conf.Unlock()
+	if found == nil {
+		return fmt.Errorf("conference room %s has no participant %s: %w", room, id, ports.ErrNotFound)
+	}
+
+	fn(conf, found)
+
+	return nil
+}
+
+// participant - a call in a conference room
+type participant struct {
+	id       string
+	call     *Call
+	caller   string
+	joinedAt time.Time
+	// what they said, waiting to be mixed, and the mix waiting to be sent to them
+	in  *audioRelay
+	out *audioRelay
+	// guarded by the room's lock
+	muted bool
+}
+
+// conference - a room with people in it, mixed a frame at a time by the scheduler
+type conference struct {
+	sync.Mutex
+	room         string
+	participants []*participant
+	nextID       int
+	job          *ScheduledStream
+	// join and leave tones still to be mixed in, which everyone hears
+	tones []int32
+}
+
+// announce - mixes the tone in for everyone, on top of any still playing
+func (conf *conference) announce(tone []int16) {
+	for i, sample := range tone {
+		if i < len(conf.tones) {
+			conf.tones[i] += int32(sample)
+		} else {
+			conf.tones = append(conf.tones, int32(sample))
+		}
+	}
+}
+
+// SendFrame - mixes the next frame. Everyone's audio is summed once, and each participant gets the sum less their own, so nobody
+// hears themselves. It never runs out, the last one leaving stops it
+func (conf *conference) SendFrame() bool {
+	conf.Lock()
+	defer conf.Unlock()
+
+	sum := make([]int32, conferenceFrameSize)
+	heard := make([][]int16, len(conf.participants))
+	for i, p := range conf.participants {
+		// a muted participant's audio is still taken, so it doesn't back up for when they are unmuted
+		samples := p.in.take(conferenceFrameSize)
+		if p.muted {
+			continue
+		}
+		heard[i] = samples
+		for j, sample := range samples {
+			sum[j] += int32(sample)
+		}
+	}
+
+	n := len(sum)
+	if len(conf.tones) < n {
+		n = len(conf.tones)
+	}
+	for j := 0; j < n; j++ {
+		sum[j] += conf.tones[j]
+	}
+	conf.tones = conf.tones[n:]
+
+	for i, p := range conf.participants {
+		mix := make([]int16, conferenceFrameSize)
+		for j := range mix {
+			v := sum[j]
+			if heard[i] != nil {
+				v -= int32(heard[i][j])
+			}
+			mix[j] = clamp16(float64(v))
+		}
+		p.out.push(&AudioFrame{Samples: mix, SampleRateHz: conferenceRateHz})
+	}
+
+	return false
+}
+
+// SkipFrame - mixes the frame anyway. The mix is sent on each participant's own stream, so being late here only eats into their
+// output delay, where dropping the frame would be a gap for everyone
+func (conf *conference) SkipFrame() bool {
+	return conf.SendFrame()
+}
@@ -0,0 +1,51 @@
+package domain
+
+// Config - settings for the sip/rtp server
+type Config struct {
+	// the directory the files calls hear are in. The working directory when empty
+	MediaDir string
+	// what calls hear when none of the rules match, relative to MediaDir
+	DefaultPlayFile string
+	// pick what each call hears, the first that matches wins
+	PlayRules []PlayRule
+	// lets callers pick what they hear from MediaDir with an X-Play-File header
+	PlayFileHeader bool
+	// the directory call recordings are written to. Recording is disabled when empty
+	RecordingDir string
+	// the number owners dial to listen to their messages
+	VoicemailNumber string
+	// played before the beep for mailboxes without their own greeting.wav
+	VoicemailGreeting string
+	// the longest message a caller can leave
+	VoicemailMaxSeconds int
+	// the numbers of the test lines: one that echoes the caller back to them EchoDelayMs late, one that plays a 1004hz tone at 0dBm0,
+	// and one that sends their packets straight back. Each is disabled when empty
+	EchoNumber      string
+	EchoDelayMs     int
+	MilliwattNumber string
+	ReflectorNumber string
+	// send calls to numbers on to sip uris, the first that matches wins. Calls to registered users go to them before any route
+	BridgeRoutes []BridgeRoute
+	// the numbers callers dial to talk to each other, the first that matches wins. They come before the bridge routes
+	ConferenceRooms []ConferenceRoom
+	// the numbers callers dial to wait for the next free agent
+	Queues []CallQueue
+	// the feature codes agents dial to log in to a queue and out of it, followed by its number or on their own for every queue, and to
+	// pause and unpause. Each is disabled when empty
+	AgentLoginCode   string
+	AgentLogoutCode  string
+	AgentPauseCode   string
+	AgentUnpauseCode string
+	// ProxyOff, ProxyStateless or ProxyStateful, whether calls to registered users and the bridge routes are proxied rather than
+	// bridged. Off when empty
+	ProxyMode string
+	// how long a bridged call rings before the caller is sent to voicemail, or turned away, and how long each group of a proxied
+	// call's phones ring. 30 when 0
+	RingSeconds int
+	// SrtpRequire, SrtpPrefer or SrtpDisable. Prefer when empty
+	SrtpPolicy string
+	// SilenceComfortNoise, SilenceFrames or SilenceOff, what we send the caller in place of silence. Comfort noise when empty
+	SilenceMode string
+	// TonePlanUS, TonePlanUK or TonePlanEU, whose ringback, busy and beeps we play. The us plan when empty
+	TonePlan string
+}
@@ -0,0 +1,50 @@
+package domain
+
+import (
+	"github.com/jart/gosip/rtp"
+	pionrtp "github.com/pion/rtp"
+)
+
+// DtmfDetector - turns rfc 2833 telephone-event packets into digits
+type DtmfDetector struct {
+	payloadType uint8
+	onDigit     func(digit byte)
+	// the end of an event is sent three times, the rtp timestamp identifies which event it belongs to
+	lastTimestamp uint32
+	seen          bool
+}
+
+// NewDtmfDetector - calls onDigit once for every key the caller presses
+func NewDtmfDetector(payloadType uint8, onDigit func(digit byte)) *DtmfDetector {
+	return &DtmfDetector{
+		payloadType: payloadType,
+		onDigit:     onDigit,
+	}
+}
+
+// HandlePacket - looks for the end of a telephone event
+func (d *DtmfDetector) HandlePacket(pkt *pionrtp.Packet) {
+	// the event payload is 4 bytes: event, end bit + volume, and a 16 bit duration
+	if pkt.PayloadType != d.payloadType || len(pkt.Payload) < 4 {
+		return
+	}
+
+	isEnd := pkt.Payload[1]&0x80 != 0
+	if !isEnd {
+		return
+	}
+
+	// ignore the retransmitted end packets
+	if d.seen && pkt.Timestamp == d.lastTimestamp {
+		return
+	}
+	d.seen = true
+	d.lastTimestamp = pkt.Timestamp
+
+	digit, err := rtp.DtmfToChar(pkt.Payload[0])
+	if err != nil {
+		return
+	}
+
+	d.onDigit(digit)
+}
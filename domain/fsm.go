@@ -3,9 +3,10 @@ package domain
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 
-	"sip_and_rip/adapters"
 	"sip_and_rip/ports"
 
 	"github.com/looplab/fsm"
@@ -23,18 +24,32 @@ type SipFsm struct {
 	callIds        []string
 	registerCallId string
 	addr           string
+	cfg            *Config
+	allocator      ports.PortAllocator
+	factories      *ports.Factories
+	scheduler      *MediaScheduler
+	// the media state of each dialog, by call id
+	calls   map[string]*Call
+	callsMu sync.Mutex
+	// the cseq of the requests we send, ie BYE. Guarded by callsMu, since a bridge sends them from its own goroutines too
+	localCSeq int
 }
 
 // NewSipFsm - creates a new sip finite state machine for handling sip's dialogs
-func NewSipFsm(ctx context.Context, key string, addr string) (*SipFsm, error) {
+func NewSipFsm(ctx context.Context, key string, addr string, cfg *Config, allocator ports.PortAllocator, factories *ports.Factories, scheduler *MediaScheduler) (*SipFsm, error) {
 	if key == "" {
 		return nil, fmt.Errorf("key is required")
 	}
 
 	f := &SipFsm{
-		ctx:  ctx,
-		key:  key,
-		addr: addr,
+		ctx:       ctx,
+		key:       key,
+		addr:      addr,
+		cfg:       cfg,
+		allocator: allocator,
+		factories: factories,
+		scheduler: scheduler,
+		calls:     make(map[string]*Call),
 	}
 
 	f.FSM = fsm.NewFSM(
@@ -61,8 +76,8 @@ func NewSipFsm(ctx context.Context, key string, addr string) (*SipFsm, error) {
 			{Name: "invite_send_200", Src: []string{"init", "invite_sent_183", "call_terminated", "call_cancelled", "register_sent_200"}, Dst: "invite_sent_200"},
 			{Name: "invite_recv_ack", Src: []string{"invite_sent_200"}, Dst: "call_established"},
 			{Name: "recv_cancel", Src: []string{"invite_sent_100", "invite_sent_180", "invite_sent_183", "invite_sent_200", "call_established", "call_terminated"}, Dst: "call_cancelled"},
-			{Name: "send_bye", Src: []string{"call_established"}, Dst: "sent_bye"},
-			{Name: "recv_bye", Src: []string{"call_established", "invite_sent_200", "call_cancelled"}, Dst: "call_terminated"},
+			{Name: "send_bye", Src: []string{"call_established", "invite_sent_200"}, Dst: "sent_bye"},
+			{Name: "recv_bye", Src: []string{"call_established", "invite_sent_200", "call_cancelled", "sent_bye"}, Dst: "call_terminated"},
 			{Name: "recv_200", Src: []string{"sent_bye"}, Dst: "call_terminated"},
 		},
 		fsm.Callbacks{
@@ -74,10 +89,69 @@ func NewSipFsm(ctx context.Context, key string, addr string) (*SipFsm, error) {
 }
 
 func (f *SipFsm) Close() error {
+	f.callsMu.Lock()
+	var callIDs []string
+	for callID := range f.calls {
+		callIDs = append(callIDs, callID)
+	}
+	f.callsMu.Unlock()
+
+	for _, callID := range callIDs {
+		if err := f.endCall(callID); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (f *SipFsm) BeforeHook(sipMsg *adapters.SipMsg) error {
+// startCall - sets up the media state for a dialog before we answer it, protecting the media the way we agreed to
+func (f *SipFsm) startCall(sipMsg ports.SipMessage, send ports.SendResponseCallback, security mediaSecurity) (*Call, error) {
+	f.callsMu.Lock()
+	defer f.callsMu.Unlock()
+
+	if call, ok := f.calls[sipMsg.GetCallID()]; ok {
+		return call, nil
+	}
+
+	call := NewCall(sipMsg.GetCallID(), f.allocator, f.factories, f.scheduler)
+	call.silenceMode = f.cfg.SilenceMode
+	call.tonePlan = f.cfg.TonePlan
+	if err := call.Listen(sipMsg, security); err != nil {
+		return nil, err
+	}
+
+	if f.cfg.RecordingDir != "" {
+		if _, err := call.Record(f.cfg.RecordingDir, sipMsg); err != nil {
+			call.Close()
+			return nil, err
+		}
+	}
+
+	call.hangupFunc = func() error {
+		return f.SendBye(sipMsg, send)
+	}
+
+	f.calls[sipMsg.GetCallID()] = call
+
+	return call, nil
+}
+
+// endCall - tears down the media state for a dialog
+func (f *SipFsm) endCall(callID string) error {
+	f.callsMu.Lock()
+	call, ok := f.calls[callID]
+	delete(f.calls, callID)
+	f.callsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return call.Close()
+}
+
+func (f *SipFsm) BeforeHook(sipMsg ports.SipMessage) error {
 	f.AddCallId(sipMsg.GetCallID())
 
 	cseq, method := sipMsg.GetCSeq()
@@ -94,7 +168,7 @@ func (f *SipFsm) BeforeHook(sipMsg *adapters.SipMsg) error {
 	return nil
 }
 
-func (f *SipFsm) RecvCancel(sipMsg *adapters.SipMsg, send ports.SendResponseCallback) error {
+func (f *SipFsm) RecvCancel(sipMsg ports.SipMessage, send ports.SendResponseCallback) error {
 	// send fsm a recv_cancel
 	err := f.FSM.Event(f.ctx, "recv_cancel")
 	if err != nil {
@@ -102,6 +176,10 @@ func (f *SipFsm) RecvCancel(sipMsg *adapters.SipMsg, send ports.SendResponseCall
 		return err
 	}
 
+	if err := f.endCall(sipMsg.GetCallID()); err != nil {
+		fmt.Println("FSM: error ending call: ", err.Error())
+	}
+
 	response, err := sipMsg.NewResponse(200)
 	if err != nil {
 		fmt.Println("FSM: error sending 200 OK to CANCEL: ", err.Error())
@@ -124,7 +202,7 @@ func (f *SipFsm) RecvCancel(sipMsg *adapters.SipMsg, send ports.SendResponseCall
 	return nil
 }
 
-func (f *SipFsm) RegisterSendOk(sipMsg *adapters.SipMsg, send ports.SendResponseCallback) error {
+func (f *SipFsm) RegisterSendOk(sipMsg ports.SipMessage, send ports.SendResponseCallback) error {
 	// check for states that should loop back (not change to "invite_sent_200")
 	if f.FSM.Current() != "call_established" && f.FSM.Current() != "invite_sent_200" && f.FSM.Current() != "register_sent_200" {
 		// first update fsm to make sure our state is valid
@@ -166,7 +244,7 @@ func (f *SipFsm) RegisterSendOk(sipMsg *adapters.SipMsg, send ports.SendResponse
 	return nil
 }
 
-func (f *SipFsm) SendTrying(sipMsg *adapters.SipMsg, send ports.SendResponseCallback) error {
+func (f *SipFsm) SendTrying(sipMsg ports.SipMessage, send ports.SendResponseCallback, handler CallHandler) error {
 	// first update fsm to make sure our state is valid
 	err := f.FSM.Event(f.ctx, "invite_send_100")
 	if err != nil {
@@ -200,10 +278,10 @@ func (f *SipFsm) SendTrying(sipMsg *adapters.SipMsg, send ports.SendResponseCall
 
 	fmt.Println("sent trying response: ", b.String())
 
-	return f.SendRinging(sipMsg, send)
+	return f.SendRinging(sipMsg, send, handler)
 }
 
-func (f *SipFsm) SendRinging(sipMsg *adapters.SipMsg, send ports.SendResponseCallback) error {
+func (f *SipFsm) SendRinging(sipMsg ports.SipMessage, send ports.SendResponseCallback, handler CallHandler) error {
 	err := f.FSM.Event(f.ctx, "invite_send_180")
 	if err != nil {
 		fmt.Println("FSM: error sending ringing: ", err.Error())
@@ -227,11 +305,11 @@ func (f *SipFsm) SendRinging(sipMsg *adapters.SipMsg, send ports.SendResponseCal
 
 	fmt.Println("sent ringing response: ", b.String())
 
-	return f.SendSessionProgress(sipMsg, send)
+	return f.SendSessionProgress(sipMsg, send, handler)
 }
 
 // TODO we will need to fix the SDP body for this to actually get a ringing tone
-func (f *SipFsm) SendSessionProgress(sipMsg *adapters.SipMsg, send ports.SendResponseCallback) error {
+func (f *SipFsm) SendSessionProgress(sipMsg ports.SipMessage, send ports.SendResponseCallback, handler CallHandler) error {
 	err := f.FSM.Event(f.ctx, "invite_send_183")
 	if err != nil {
 		fmt.Println("FSM: error sending session progress: ", err.Error())
@@ -254,11 +332,29 @@ func (f *SipFsm) SendSessionProgress(sipMsg *adapters.SipMsg, send ports.SendRes
 
 	fmt.Println("sent session progress response: ", b.String())
 
-	return f.SendOk(sipMsg, send)
+	return f.SendOk(sipMsg, send, handler)
 }
 
-func (f *SipFsm) SendOk(sipMsg *adapters.SipMsg, send ports.SendResponseCallback) error {
-	err := f.FSM.Event(f.ctx, "invite_send_200")
+// SendOk - answers the INVITE, then runs the handler for the call
+func (f *SipFsm) SendOk(sipMsg ports.SipMessage, send ports.SendResponseCallback, handler CallHandler) error {
+	// opus and g711 are all the audio we have, so offers with neither are turned down
+	if _, ok := sipMsg.GetAudioPayloadType(); !ok {
+		fmt.Printf("FSM: turning down call %s: no opus or g711 in the offer\n", sipMsg.GetCallID())
+		// 488 Not Acceptable Here
+		return sendResponse(sipMsg, 488, send)
+	}
+
+	// turn the call down before the dialog goes anywhere when we can't agree on how to protect its media
+	security, err := selectMediaSecurity(f.cfg.SrtpPolicy, sipMsg, f.factories.NewSrtpKey)
+	if errors.Is(err, errSrtpNotAcceptable) {
+		fmt.Printf("FSM: turning down call %s: %v\n", sipMsg.GetCallID(), err)
+		// 488 Not Acceptable Here
+		return sendResponse(sipMsg, 488, send)
+	} else if err != nil {
+		return err
+	}
+
+	err = f.FSM.Event(f.ctx, "invite_send_200")
 	if err != nil {
 		// TODO should make sure we send an error response to the client
 		fmt.Println("FSM: error sending ok: ", err.Error())
@@ -273,6 +369,12 @@ func (f *SipFsm) SendOk(sipMsg *adapters.SipMsg, send ports.SendResponseCallback
 		return err
 	}
 
+	call, err := f.startCall(sipMsg, send, security)
+	if err != nil {
+		fmt.Println("FSM: error starting call: ", err.Error())
+		return err
+	}
+
 	response, err := sipMsg.NewResponse(200)
 	if err != nil {
 		fmt.Println("error getting response: ", err.Error())
@@ -289,20 +391,131 @@ func (f *SipFsm) SendOk(sipMsg *adapters.SipMsg, send ports.SendResponseCallback
 
 	fmt.Println("sent ok response: ", b.String())
 
+	if err := call.Answer(sipMsg); err != nil {
+		fmt.Println("FSM: error answering call: ", err.Error())
+		return err
+	}
+
 	go func() {
-		if err := sendWav(sipMsg); err != nil {
-			fmt.Println("error sending wav: ", err.Error())
+		if err := handler(call, sipMsg); err == errCallEnded {
+			fmt.Println("caller hung up")
+			return
+		} else if err != nil {
+			fmt.Println("error handling call: ", err.Error())
 			// TODO need to set the fsm state to call ended or something similar
 			return
 		}
 
-		fmt.Println("done sending audio")
+		fmt.Println("done handling call")
 	}()
 
 	return nil
 }
 
+// HasCall - determines if the dialog's call is already up, which makes an INVITE for it a re-INVITE
+func (f *SipFsm) HasCall(callID string) bool {
+	f.callsMu.Lock()
+	defer f.callsMu.Unlock()
+
+	_, ok := f.calls[callID]
+	return ok
+}
+
+// SendReinviteOk - answers a re-INVITE for a call that is already up, ie the caller putting us on hold or moving its media. The call's handler keeps running
+func (f *SipFsm) SendReinviteOk(sipMsg ports.SipMessage, send ports.SendResponseCallback) error {
+	f.callsMu.Lock()
+	call, ok := f.calls[sipMsg.GetCallID()]
+	f.callsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no call %s to re-INVITE", sipMsg.GetCallID())
+	}
+
+	if err := f.BeforeHook(sipMsg); err == errCSeqRetry {
+		fmt.Println("duplicate cseq header found for fsm: ", f.String())
+	} else if err != nil {
+		return err
+	}
+
+	// answer from the same socket and session as before
+	call.PrepareAnswer(sipMsg)
+
+	response, err := sipMsg.NewResponse(200)
+	if err != nil {
+		fmt.Println("error getting response: ", err.Error())
+		return err
+	}
+
+	var b bytes.Buffer
+	response.Append(&b)
+
+	if err = send(b.Bytes()); err != nil {
+		fmt.Println("FSM: error sending re-INVITE ok: ", err.Error())
+		return err
+	}
+
+	fmt.Println("sent re-INVITE ok response: ", b.String())
+
+	return call.Renegotiate(sipMsg)
+}
+
+// SendBye - hangs up a call from our side. sipMsg is the INVITE that started the call
+func (f *SipFsm) SendBye(sipMsg ports.SipMessage, send ports.SendResponseCallback) error {
+	err := f.FSM.Event(f.ctx, "send_bye")
+	if err != nil {
+		fmt.Println("FSM: error sending bye: ", err.Error())
+		return err
+	}
+
+	if err := f.endCall(sipMsg.GetCallID()); err != nil {
+		fmt.Println("FSM: error ending call: ", err.Error())
+	}
+
+	bye, err := f.NewRequest(sipMsg, ports.MethodBye)
+	if err != nil {
+		fmt.Println("error getting bye request: ", err.Error())
+		return err
+	}
+
+	var b bytes.Buffer
+	bye.Append(&b)
+
+	if err := send(b.Bytes()); err != nil {
+		return err
+	}
+
+	fmt.Println("sent BYE for call ", sipMsg.GetCallID())
+
+	return nil
+}
+
+// NewRequest - a request of ours in the dialog the INVITE started, ie a BYE or the NOTIFYs of a transfer, numbered after the ones we
+// sent before it
+func (f *SipFsm) NewRequest(sipMsg ports.SipMessage, method string) (ports.SipMessage, error) {
+	f.callsMu.Lock()
+	f.localCSeq++
+	cseq := f.localCSeq
+	f.callsMu.Unlock()
+
+	return sipMsg.NewInDialogRequest(method, cseq)
+}
+
+// RecvByeOk - the other side accepted our BYE
+func (f *SipFsm) RecvByeOk() error {
+	err := f.FSM.Event(f.ctx, "recv_200")
+	if err != nil {
+		fmt.Println("FSM: error recieving 200 OK for BYE: ", err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func (f *SipFsm) RecvAck() error {
+	// the ACK for our answer to a re-INVITE, the call is already up
+	if f.FSM.Current() == "call_established" {
+		return nil
+	}
+
 	// TODO  weird things happening from sip client when it does not like sdp response, so it immediately sends a BYE request, but also sends an ACK ? Yes, after testing, it is sending the ACK unrelated to the BYE, so probably a race condition on the clients side
 	// TODO should check the current state, if we recieve an ACK from a BYE or from a 200 response
 	err := f.FSM.Event(f.ctx, "invite_recv_ack")
@@ -314,7 +527,7 @@ func (f *SipFsm) RecvAck() error {
 	return nil
 }
 
-func (f *SipFsm) RecvBye(sipMsg *adapters.SipMsg, send ports.SendResponseCallback) error {
+func (f *SipFsm) RecvBye(sipMsg ports.SipMessage, send ports.SendResponseCallback) error {
 	err := f.FSM.Event(f.ctx, "recv_bye")
 	if err != nil {
 		fmt.Println("FSM: error recieving bye. Sending 481: ", err.Error())
@@ -332,6 +545,10 @@ func (f *SipFsm) RecvBye(sipMsg *adapters.SipMsg, send ports.SendResponseCallbac
 		return err
 	}
 
+	if err := f.endCall(sipMsg.GetCallID()); err != nil {
+		fmt.Println("FSM: error ending call: ", err.Error())
+	}
+
 	response, err := sipMsg.NewResponse(200)
 	if err != nil {
 		fmt.Println("error getting response: ", err.Error())
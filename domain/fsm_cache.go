@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"sync"
 
-	"sip_and_rip/adapters"
+	"sip_and_rip/ports"
 )
 
 var errMissingKey = fmt.Errorf("key is empty")
@@ -15,27 +15,34 @@ var errFsmNotFound = fmt.Errorf("fsm not found")
 // FsmCache - a cache that stores fsm's by their unique key
 type FsmCache struct {
 	sync.RWMutex
-	m map[string]*SipFsm
+	m         map[string]*SipFsm
+	cfg       *Config
+	allocator ports.PortAllocator
+	factories *ports.Factories
+	scheduler *MediaScheduler
 }
 
-// NewFsmCache - creates a new cache that stores fsm's by their key
-func NewFsmCache() *FsmCache {
+// NewFsmCache - creates a new cache that stores fsm's by their key. Every call's media is paced by the one scheduler
+func NewFsmCache(cfg *Config, allocator ports.PortAllocator, factories *ports.Factories, scheduler *MediaScheduler) *FsmCache {
 	m := make(map[string]*SipFsm)
 
 	return &FsmCache{
-		m: m,
+		m:         m,
+		cfg:       cfg,
+		allocator: allocator,
+		factories: factories,
+		scheduler: scheduler,
 	}
 }
 
-// TODO use ports not adapters when defining the input
 // NewSipFsm - creates a new sipFsm and stores it in the cache
-func (f *FsmCache) NewSipFsm(ctx context.Context, sipMsg *adapters.SipMsg, addr string) (*SipFsm, error) {
+func (f *FsmCache) NewSipFsm(ctx context.Context, sipMsg ports.SipMessage, addr string) (*SipFsm, error) {
 	key, err := f.GetKey(sipMsg)
 	if err != nil {
 		return nil, err
 	}
 
-	fsm, err := NewSipFsm(ctx, key, addr)
+	fsm, err := NewSipFsm(ctx, key, addr, f.cfg, f.allocator, f.factories, f.scheduler)
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +52,7 @@ func (f *FsmCache) NewSipFsm(ctx context.Context, sipMsg *adapters.SipMsg, addr
 	return fsm, nil
 }
 
-func (f *FsmCache) Delete(sipMsg *adapters.SipMsg) (string, error) {
+func (f *FsmCache) Delete(sipMsg ports.SipMessage) (string, error) {
 	key, err := f.GetKey(sipMsg)
 	if err != nil {
 		return key, err
@@ -80,7 +87,7 @@ func (f *FsmCache) DeleteWithUrn(urn string) error {
 	return nil
 }
 
-func (f *FsmCache) Get(sipMsg *adapters.SipMsg) (*SipFsm, error) {
+func (f *FsmCache) Get(sipMsg ports.SipMessage) (*SipFsm, error) {
 	key, err := f.GetKey(sipMsg)
 	if err == errMissingKey || err == errMissingContact {
 		// lets check by the callId instead of the key
@@ -116,7 +123,7 @@ func (f *FsmCache) GetWithKey(key string) (*SipFsm, error) {
 	return fsm, nil
 }
 
-func (f *FsmCache) Set(sipMsg *adapters.SipMsg, value *SipFsm) error {
+func (f *FsmCache) Set(sipMsg ports.SipMessage, value *SipFsm) error {
 	key, err := f.GetKey(sipMsg)
 	if err != nil {
 		return err
@@ -133,7 +140,7 @@ func (f *FsmCache) SetWithKey(key string, value *SipFsm) error {
 	return nil
 }
 
-func (*FsmCache) GetKey(sipMsg *adapters.SipMsg) (string, error) {
+func (*FsmCache) GetKey(sipMsg ports.SipMessage) (string, error) {
 	if sipMsg.GetContact() == nil {
 		return "", errMissingContact
 	}
@@ -159,7 +166,7 @@ func (f *FsmCache) Len() int {
 	return len(f.m)
 }
 
-func (f *FsmCache) CloseFsm(sipMsg *adapters.SipMsg) error {
+func (f *FsmCache) CloseFsm(sipMsg ports.SipMessage) error {
 	fsm, err := f.Get(sipMsg)
 	if err != nil {
 		return err
@@ -0,0 +1,462 @@
+package domain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"sip_and_rip/ports"
+)
+
+const (
+	// the size of the frames we play out
+	jitterFrameMs = 20
+	// the delay we start with, and the range it adapts within
+	jitterInitialDelayMs = 60
+	jitterMinDelayMs     = 40
+	jitterMaxDelayMs     = 300
+	// a timestamp this far from where we are playing means the sender restarted its clock, not that the packet is early or late
+	jitterMaxJumpMs = 2000
+	// stop playing out after this long without a packet, ie the caller put us on hold. We pick up again with their next packet
+	jitterIdleMs = 5000
+)
+
+// AudioFrame - a frame of the caller's audio, played out of the jitter buffer in order and on time
+type AudioFrame struct {
+	// the rtp timestamp of the first sample
+	Timestamp uint32
+	Samples   []int16
+	// the codec the caller used, ie PCMU
+	Codec        string
+	SampleRateHz int
+	// some or all of the samples were made up to cover for packets that were lost or late
+	Concealed bool
+	// the first frame of a talkspurt, or of the stream starting over
+	Marker bool
+}
+
+// AudioFrameHandler - is called with every frame of the caller's audio
+type AudioFrameHandler func(frame *AudioFrame)
+
+// JitterBufferStats - how the jitter buffer is doing, for rtcp-xr
+type JitterBufferStats struct {
+	// packets thrown away for being late or duplicates
+	Discarded uint32
+	// frames that were all or partly made up
+	Concealed uint32
+	// the delay we are aiming for, and the most it is allowed to grow to
+	NominalDelayMs int
+	MaxDelayMs     int
+}
+
+// bufferedPacket - a decoded packet waiting to be played out
+type bufferedPacket struct {
+	timestamp uint32
+	samples   []int16
+	marker    bool
+}
+
+// JitterBuffer - sits between the caller's rtp and whoever wants their audio. Packets go in as they arrive, in whatever order, and frames come
+// out at a steady pace once they have been put back in order, with duplicates and late packets thrown away and gaps concealed. The delay it holds
+// packets for adapts to how much their arrival jitters
+type JitterBuffer struct {
+	sync.Mutex
+	scheduler *MediaScheduler
+	newCodec  func(payloadType uint8) (ports.Codec, error)
+	codecs    map[uint8]ports.Codec
+	handler   AudioFrameHandler
+	codec     ports.Codec
+	// decoded packets by rtp timestamp
+	packets map[uint32]*bufferedPacket
+	// the playout clock. We are playing once we have a job, and have started once the first real frame has gone out
+	job       *ScheduledStream
+	started   bool
+	playoutTs uint32
+	// the timestamp just past the newest packet, to tell how much is buffered
+	newestTs uint32
+	// the last packet's rtp timestamp and where it landed in samples, for codecs whose rtp clock runs faster than their samples
+	clockTs    uint32
+	sampleTs   uint32
+	hasClockTs bool
+	// the delay we are aiming for, in samples, and the arrival jitter it is based on
+	targetDelay uint32
+	jitter      float64
+	lastTransit int64
+	hasTransit  bool
+	startedAt   time.Time
+	// set when the next frame starts a talkspurt
+	marker bool
+	// set when a packet showed up too late, so the next frame is made up to push the playout back
+	stretch bool
+	// frames in a row with nothing real in them
+	emptyFrames int
+	plc         *g711Plc
+	stats       JitterBufferStats
+	closed      bool
+}
+
+// NewJitterBuffer - creates a jitter buffer that plays out on the scheduler's clock. Packets it can't decode, ie telephone-event, are ignored
+func NewJitterBuffer(scheduler *MediaScheduler, newCodec func(payloadType uint8) (ports.Codec, error), handler AudioFrameHandler) *JitterBuffer {
+	return &JitterBuffer{
+		scheduler: scheduler,
+		newCodec:  newCodec,
+		codecs:    make(map[uint8]ports.Codec),
+		handler:   handler,
+		packets:   make(map[uint32]*bufferedPacket),
+		plc:       newG711Plc(),
+		startedAt: time.Now(),
+	}
+}
+
+// Push - takes in a packet as it arrives
+func (b *JitterBuffer) Push(pkt *rtp.Packet) {
+	codec, err := b.getCodec(pkt.PayloadType)
+	if err != nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	first := b.codec == nil || b.codec.SampleRateHz() != codec.SampleRateHz()
+	b.codec = codec
+	if first {
+		b.targetDelay = b.samples(jitterInitialDelayMs)
+		b.stats.MaxDelayMs = jitterMaxDelayMs
+	}
+	pkt = b.toSamples(codec, pkt)
+	b.updateJitter(pkt)
+
+	samples := codec.Decode(pkt.Payload)
+	if len(samples) == 0 {
+		return
+	}
+
+	if b.job != nil {
+		ahead := int32(pkt.Timestamp - b.playoutTs)
+		switch {
+		case ahead > int32(b.samples(jitterMaxJumpMs)) || ahead < -int32(b.samples(jitterMaxJumpMs)):
+			// the sender jumped its clock, start over from this packet
+			b.resync(pkt.Timestamp)
+		case pkt.Marker && len(b.packets) == 0 && ahead > 0:
+			// the start of a talkspurt after a silence is the one place we can change the delay without it being heard
+			b.resync(pkt.Timestamp)
+		case ahead+int32(len(samples)) <= 0:
+			// it missed its turn, or we already played it
+			b.stats.Discarded++
+			b.grow()
+			return
+		}
+	}
+
+	if _, ok := b.packets[pkt.Timestamp]; ok {
+		b.stats.Discarded++
+		return
+	}
+	b.packets[pkt.Timestamp] = &bufferedPacket{timestamp: pkt.Timestamp, samples: samples, marker: pkt.Marker}
+
+	end := pkt.Timestamp + uint32(len(samples))
+	if len(b.packets) == 1 || int32(end-b.newestTs) > 0 {
+		b.newestTs = end
+	}
+
+	if b.job == nil {
+		// hold the first packet for the target delay before playing it, so the ones behind it have time to show up
+		b.playoutTs = pkt.Timestamp - b.delayFrames()
+		b.started = false
+		b.marker = true
+		b.emptyFrames = 0
+		b.job = b.scheduler.Schedule(jitterBufferStream{b}, jitterFrameMs*time.Millisecond)
+	}
+}
+
+// Stats - how the buffer is doing
+func (b *JitterBuffer) Stats() JitterBufferStats {
+	b.Lock()
+	defer b.Unlock()
+
+	stats := b.stats
+	stats.NominalDelayMs = b.ms(b.targetDelay)
+
+	return stats
+}
+
+// Close - stops playing out. Whatever is still buffered is dropped
+func (b *JitterBuffer) Close() {
+	b.Lock()
+	b.closed = true
+	job := b.job
+	b.job = nil
+	b.Unlock()
+
+	// stopping waits for a frame that is going out, which needs the lock
+	if job != nil {
+		job.Stop()
+	}
+}
+
+// next - plays out the next frame. Returns nil when there is nothing to play yet, and done once the caller has gone quiet for too long
+func (b *JitterBuffer) next() (frame *AudioFrame, done bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed || b.codec == nil {
+		return nil, true
+	}
+
+	n := b.samples(jitterFrameMs)
+	buffered := int32(b.newestTs - b.playoutTs)
+
+	// too much piled up, ie the sender's clock runs faster than ours, so skip a frame to catch up
+	if b.started && buffered > int32(b.targetDelay+3*n) {
+		b.drop(b.playoutTs + n)
+		b.playoutTs += n
+	}
+
+	// packets are arriving later than we thought, so stretch the audio by a frame to give them more time
+	stretch := b.started && b.stretch
+	b.stretch = false
+	frameTs := b.playoutTs
+
+	samples := make([]int16, 0, n)
+	concealed, real := false, false
+	for pos := uint32(0); pos < n && !stretch; {
+		ts := b.playoutTs + pos
+		if pkt := b.covering(ts); pkt != nil {
+			start := ts - pkt.timestamp
+			count := minUint32(uint32(len(pkt.samples))-start, n-pos)
+			samples = append(samples, b.plc.good(pkt.samples[start:start+count])...)
+			if pkt.marker && start == 0 {
+				b.marker = true
+			}
+			pos += count
+			real = true
+			continue
+		}
+
+		if !b.started {
+			// nothing to play until the first packet comes up
+			pos = n
+			continue
+		}
+
+		// conceal up to the next packet, or the end of the frame
+		count := n - pos
+		if next, ok := b.nextAfter(ts); ok && next-ts < count {
+			count = next - ts
+		}
+		samples = append(samples, b.plc.conceal(int(count))...)
+		pos += count
+		concealed = true
+	}
+
+	if stretch {
+		samples = b.plc.conceal(int(n))
+		concealed = true
+	} else {
+		b.drop(b.playoutTs + n)
+		b.playoutTs += n
+	}
+
+	if !real && !b.started {
+		return nil, false
+	}
+	b.started = true
+
+	if real {
+		b.emptyFrames = 0
+	} else if b.emptyFrames++; b.emptyFrames*jitterFrameMs >= jitterIdleMs {
+		fmt.Println("JitterBuffer: no audio for a while, pausing")
+		b.job = nil
+		return nil, true
+	}
+	if concealed {
+		b.stats.Concealed++
+	}
+
+	frame = &AudioFrame{
+		Timestamp:    frameTs,
+		Samples:      samples,
+		Codec:        b.codec.Name(),
+		SampleRateHz: b.codec.SampleRateHz(),
+		Concealed:    concealed,
+		Marker:       b.marker,
+	}
+	b.marker = false
+
+	return frame, false
+}
+
+// covering - the packet with a sample at the timestamp. The lock must be held
+func (b *JitterBuffer) covering(ts uint32) *bufferedPacket {
+	if pkt, ok := b.packets[ts]; ok {
+		return pkt
+	}
+
+	for _, pkt := range b.packets {
+		if offset := ts - pkt.timestamp; int32(offset) >= 0 && offset < uint32(len(pkt.samples)) {
+			return pkt
+		}
+	}
+
+	return nil
+}
+
+// nextAfter - the timestamp of the first packet after ts. The lock must be held
+func (b *JitterBuffer) nextAfter(ts uint32) (uint32, bool) {
+	var next uint32
+	found := false
+	for _, pkt := range b.packets {
+		if ahead := int32(pkt.timestamp - ts); ahead > 0 && (!found || pkt.timestamp-ts < next-ts) {
+			next, found = pkt.timestamp, true
+		}
+	}
+
+	return next, found
+}
+
+// drop - throws away every packet that ends before the timestamp. The lock must be held
+func (b *JitterBuffer) drop(ts uint32) {
+	for key, pkt := range b.packets {
+		if int32(pkt.timestamp+uint32(len(pkt.samples))-ts) <= 0 {
+			delete(b.packets, key)
+		}
+	}
+}
+
+// resync - starts the playout clock over so the packet plays after the target delay. The lock must be held
+func (b *JitterBuffer) resync(ts uint32) {
+	b.packets = make(map[uint32]*bufferedPacket)
+	b.playoutTs = ts - b.delayFrames()
+	b.marker = true
+}
+
+// delayFrames - the target delay in whole frames, so the first packet starts on a frame of its own. The lock must be held
+func (b *JitterBuffer) delayFrames() uint32 {
+	n := b.samples(jitterFrameMs)
+	return (b.targetDelay + n/2) / n * n
+}
+
+// grow - a packet showed up too late to play, so hold on to packets a frame longer from now on. The lock must be held
+func (b *JitterBuffer) grow() {
+	if max := b.samples(jitterMaxDelayMs); b.targetDelay+b.samples(jitterFrameMs) <= max {
+		b.targetDelay += b.samples(jitterFrameMs)
+		b.stretch = true
+	}
+}
+
+// updateJitter - tracks the arrival jitter like rtcp does (rfc 3550 A.8), and eases the target delay towards 3 times it plus a frame. It only
+// shrinks the delay slowly, since growing it back costs a stretched frame. The lock must be held
+func (b *JitterBuffer) updateJitter(pkt *rtp.Packet) {
+	arrival := int64(time.Since(b.startedAt)) * int64(b.codec.SampleRateHz()) / int64(time.Second)
+	transit := arrival - int64(pkt.Timestamp)
+	if b.hasTransit {
+		d := transit - b.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		// a jump this big is the sender restarting its clock, not jitter
+		if d < int64(b.samples(jitterMaxJumpMs)) {
+			b.jitter += (float64(d) - b.jitter) / 16
+		}
+	}
+	b.lastTransit = transit
+	b.hasTransit = true
+
+	ideal := uint32(3*b.jitter) + b.samples(jitterFrameMs)
+	if min := b.samples(jitterMinDelayMs); ideal < min {
+		ideal = min
+	}
+	if max := b.samples(jitterMaxDelayMs); ideal > max {
+		ideal = max
+	}
+	if ideal < b.targetDelay {
+		b.targetDelay -= (b.targetDelay - ideal + 63) / 64
+	}
+}
+
+func (b *JitterBuffer) getCodec(payloadType uint8) (ports.Codec, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if codec, ok := b.codecs[payloadType]; ok {
+		return codec, nil
+	}
+
+	codec, err := b.newCodec(payloadType)
+	if err != nil {
+		return nil, err
+	}
+	b.codecs[payloadType] = codec
+
+	return codec, nil
+}
+
+// toSamples - the packet with its timestamp counting samples at the codec's rate rather than ticks of its rtp clock, ie for opus,
+// whose clock is 48000hz and whose samples we take at 8000hz. Only the distance from the last packet's matters, so that is all that
+// is kept. The lock must be held
+func (b *JitterBuffer) toSamples(codec ports.Codec, pkt *rtp.Packet) *rtp.Packet {
+	ratio := codec.ClockRateHz() / codec.SampleRateHz()
+	if ratio <= 1 {
+		b.hasClockTs = false
+		return pkt
+	}
+
+	ts := pkt.Timestamp
+	if b.hasClockTs {
+		ts = b.sampleTs + uint32(int32(pkt.Timestamp-b.clockTs)/int32(ratio))
+	}
+	b.clockTs, b.sampleTs, b.hasClockTs = pkt.Timestamp, ts, true
+
+	scaled := *pkt
+	scaled.Timestamp = ts
+
+	return &scaled
+}
+
+// samples - the number of samples in the milliseconds at the codec's rate
+func (b *JitterBuffer) samples(ms int) uint32 {
+	return uint32(ms * b.codec.SampleRateHz() / 1000)
+}
+
+func (b *JitterBuffer) ms(samples uint32) int {
+	if b.codec == nil {
+		return 0
+	}
+
+	return int(samples) * 1000 / b.codec.SampleRateHz()
+}
+
+// jitterBufferStream - plays the jitter buffer out on the scheduler
+type jitterBufferStream struct {
+	buffer *JitterBuffer
+}
+
+// SendFrame - hands the next frame to the buffer's handler
+func (s jitterBufferStream) SendFrame() bool {
+	frame, done := s.buffer.next()
+	if frame != nil {
+		s.buffer.handler(frame)
+	}
+
+	return done
+}
+
+// SkipFrame - nothing consuming the caller's audio is live, so a late frame is still better handed over than dropped
+func (s jitterBufferStream) SkipFrame() bool {
+	return s.SendFrame()
+}
+
+func minUint32(a uint32, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
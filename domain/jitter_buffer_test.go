@@ -0,0 +1,128 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+
+	"sip_and_rip/ports"
+)
+
+// testCodec - a byte per sample, so a frame's samples say which packet they came from. Its rtp clock is its sample rate unless it says
+// otherwise, like opus
+type testCodec struct {
+	clockRateHz int
+}
+
+func (testCodec) Name() string          { return "TEST" }
+func (testCodec) PayloadType() uint8    { return 0 }
+func (testCodec) SampleRateHz() int     { return 8000 }
+func (testCodec) Encode([]int16) []byte { return nil }
+func (c testCodec) ClockRateHz() int {
+	if c.clockRateHz == 0 {
+		return 8000
+	}
+	return c.clockRateHz
+}
+func (testCodec) Decode(payload []byte) []int16 {
+	samples := make([]int16, len(payload))
+	for i, b := range payload {
+		samples[i] = int16(b)
+	}
+	return samples
+}
+
+// newTestJitterBuffer - a buffer whose scheduler never runs, so the test plays it out a frame at a time itself
+func newTestJitterBuffer(codec testCodec) *JitterBuffer {
+	scheduler := &MediaScheduler{shards: []*schedulerShard{{wake: make(chan struct{}, 1)}}}
+	newCodec := func(uint8) (ports.Codec, error) { return codec, nil }
+
+	return NewJitterBuffer(scheduler, newCodec, func(*AudioFrame) {})
+}
+
+// testPacket - the nth 20ms packet of a stream, its samples all n+1 and its timestamps ticks apart
+func testPacket(seq uint16, ts uint32, ticks uint32, n int) *rtp.Packet {
+	payload := make([]byte, 160)
+	for i := range payload {
+		payload[i] = byte(n + 1)
+	}
+
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq + uint16(n), Timestamp: ts + uint32(n)*ticks},
+		Payload: payload,
+	}
+}
+
+func TestJitterBufferPlaysOutInOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// where the stream starts, to cross the sequence number and timestamp wraps
+		seq uint16
+		ts  uint32
+		// the codec's rtp clock, when it isn't its 8000hz sample rate
+		clockRateHz int
+		// the packets in the order they arrive, before anything plays, and the ones that turn up once it all has
+		pushed []int
+		late   []int
+		// the packets each frame came from, by its last sample since the first few are blended after a gap, 0 for a concealed one
+		want          []int
+		wantDiscarded uint32
+	}{
+		{name: "in order", seq: 1000, ts: 80000, pushed: []int{0, 1, 2, 3}, want: []int{1, 2, 3, 4}},
+		{name: "reordered", seq: 1000, ts: 80000, pushed: []int{1, 0, 3, 2}, want: []int{1, 2, 3, 4}},
+		{name: "duplicate", seq: 1000, ts: 80000, pushed: []int{0, 1, 1, 2}, want: []int{1, 2, 3}, wantDiscarded: 1},
+		{name: "gap", seq: 1000, ts: 80000, pushed: []int{0, 1, 3}, want: []int{1, 2, 0, 4}},
+		{name: "late", seq: 1000, ts: 80000, pushed: []int{0, 1, 2}, late: []int{1}, want: []int{1, 2, 3}, wantDiscarded: 1},
+		{name: "sequence wrap", seq: 65534, ts: 80000, pushed: []int{0, 2, 1, 3}, want: []int{1, 2, 3, 4}},
+		{name: "timestamp wrap", seq: 65534, ts: 0xffffffff - 239, pushed: []int{0, 1, 3, 2}, want: []int{1, 2, 3, 4}},
+		{name: "48khz clock", seq: 1000, ts: 80000, clockRateHz: 48000, pushed: []int{1, 0, 3, 2}, want: []int{1, 2, 3, 4}},
+		{name: "48khz clock gap", seq: 1000, ts: 80000, clockRateHz: 48000, pushed: []int{0, 1, 3}, want: []int{1, 2, 0, 4}},
+		{
+			name: "48khz clock wrap", seq: 1000, ts: 0xffffffff - 1439, clockRateHz: 48000,
+			pushed: []int{0, 1, 3, 2}, want: []int{1, 2, 3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec := testCodec{clockRateHz: tt.clockRateHz}
+			ticks := uint32(160 * codec.ClockRateHz() / codec.SampleRateHz())
+			b := newTestJitterBuffer(codec)
+			for _, n := range tt.pushed {
+				b.Push(testPacket(tt.seq, tt.ts, ticks, n))
+			}
+
+			var got []int
+			for i := 0; len(got) < len(tt.want) && i < 20; i++ {
+				frame, done := b.next()
+				if done {
+					t.Fatalf("buffer finished after %v", got)
+				}
+				if frame == nil {
+					continue
+				}
+				if frame.Concealed {
+					got = append(got, 0)
+				} else {
+					got = append(got, int(frame.Samples[len(frame.Samples)-1]))
+				}
+			}
+
+			for _, n := range tt.late {
+				b.Push(testPacket(tt.seq, tt.ts, ticks, n))
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got frames %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got frames %v, want %v", got, tt.want)
+				}
+			}
+			if stats := b.Stats(); stats.Discarded != tt.wantDiscarded {
+				t.Errorf("discarded %d packets, want %d", stats.Discarded, tt.wantDiscarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package domain
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+// PlayFileHeader - the header callers can pick what they hear with, when it is allowed
+const PlayFileHeader = "X-Play-File"
+
+// PlayRule - picks the file a call hears. Every field that is set has to match, and the first rule that matches wins
+type PlayRule struct {
+	// the user part of the request uri, ie 100 in sip:100@host
+	Number string `json:"number,omitempty"`
+	// the user part of the caller's From
+	Caller string `json:"caller,omitempty"`
+	// when in the day the rule applies, as HH:MM in the server's time zone. A window that ends before it starts goes over midnight
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// the wav file, relative to the media directory
+	File string `json:"file"`
+}
+
+// Validate - checks the rule has a file and its times make sense
+func (r PlayRule) Validate() error {
+	if r.File == "" {
+		return fmt.Errorf("play rule has no file")
+	}
+	for _, t := range []string{r.From, r.To} {
+		if t == "" {
+			continue
+		}
+		if _, err := parseTimeOfDay(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matches - whether the call is one the rule is for, at the time
+func (r PlayRule) matches(dialed string, caller string, now time.Time) bool {
+	if r.Number != "" && r.Number != dialed {
+		return false
+	}
+	if r.Caller != "" && r.Caller != caller {
+		return false
+	}
+	if r.From == "" && r.To == "" {
+		return true
+	}
+
+	// a window with no start starts at midnight, and one with no end goes until midnight
+	minute := now.Hour()*60 + now.Minute()
+	from, to := 0, 24*60
+	if r.From != "" {
+		from, _ = parseTimeOfDay(r.From)
+	}
+	if r.To != "" {
+		to, _ = parseTimeOfDay(r.To)
+	}
+
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// parseTimeOfDay - HH:MM as minutes past midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, it should be HH:MM", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// MediaSelector - picks the wav file each call hears, from the caller's X-Play-File header when that is allowed, then the rules, and
+// then the default. Files are always inside the media directory
+type MediaSelector struct {
+	dir         string
+	defaultFile string
+	rules       []PlayRule
+	allowHeader bool
+	factories   *ports.Factories
+}
+
+// NewMediaSelector - creates a selector with the media directory, rules and default from the config
+func NewMediaSelector(cfg *Config, factories *ports.Factories) *MediaSelector {
+	dir := cfg.MediaDir
+	if dir == "" {
+		dir = "."
+	}
+
+	return &MediaSelector{
+		dir:         dir,
+		defaultFile: cfg.DefaultPlayFile,
+		rules:       cfg.PlayRules,
+		allowHeader: cfg.PlayFileHeader,
+		factories:   factories,
+	}
+}
+
+// Select - the path of the file the call should hear. When there is no such file the error comes with the response to turn the call
+// down with: 404 Not Found when the caller asked for it, and 480 Temporarily Unavailable when we did, since that is ours to fix
+func (m *MediaSelector) Select(sipMsg ports.SipMessage) (string, int, error) {
+	name, code := m.pick(sipMsg), 480
+	if header := sipMsg.GetHeader(PlayFileHeader); m.allowHeader && header != "" {
+		name, code = header, 404
+	}
+	if name == "" {
+		return "", 480, fmt.Errorf("no file to play")
+	}
+
+	path, err := m.resolve(name)
+	if err != nil {
+		return "", code, err
+	}
+
+	// opening it checks it is a wav we can play, which is better found out now than once the call is answered
+	codec, err := m.factories.NewCodec(ports.PcmuPayloadType)
+	if err != nil {
+		return "", code, err
+	}
+	reader, err := m.factories.NewWavReader(path, codec, nil)
+	if err != nil {
+		return "", code, err
+	}
+	reader.Close()
+
+	return path, 0, nil
+}
+
+// pick - the file of the first rule the call matches, or the default
+func (m *MediaSelector) pick(sipMsg ports.SipMessage) string {
+	dialed, caller, now := sipMsg.GetRequest().User, aorUser(sipMsg.GetFrom()), time.Now()
+	for _, rule := range m.rules {
+		if rule.matches(dialed, caller, now) {
+			return rule.File
+		}
+	}
+
+	return m.defaultFile
+}
+
+// resolve - the path of the file in the media directory. The name is cleaned as if the directory were the root, so ../ can't climb
+// out of it, and symlinks can't lead out of it either
+func (m *MediaSelector) resolve(name string) (string, error) {
+	path := filepath.Join(m.dir, filepath.Clean("/"+name))
+
+	realDir, err := filepath.EvalSymlinks(m.dir)
+	if err != nil {
+		return "", fmt.Errorf("error reading media directory: %v", err)
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("no media file %q: %v", name, err)
+	}
+
+	rel, err := filepath.Rel(realDir, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("media file %q is outside the media directory", name)
+	}
+
+	return path, nil
+}
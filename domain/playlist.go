@@ -0,0 +1,184 @@
+package domain
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+// LoopForever - loops a playlist until it is stopped, ie hold music
+const LoopForever = -1
+
+// MediaSource - opens something to play. A playlist opens its sources again each time round, so they can loop
+type MediaSource func() (ports.MediaReader, error)
+
+// Playlist - plays its sources one after the other, as many times through as it loops. To the caller it is all one stream: the frames
+// go out back to back on the same rtp clock, whatever they came from
+type Playlist struct {
+	sync.Mutex
+	sources []MediaSource
+	// the times to go through the sources, or LoopForever
+	loops int
+	// the times we have been through them, and the source we are on
+	played int
+	index  int
+	// the open source, nil until the first frame and after moving on from it
+	current ports.MediaReader
+	// frames read from the open source
+	position int
+	frameDur time.Duration
+	closed   bool
+}
+
+// NewPlaylist - creates a playlist that goes through the sources the number of times it loops, each of its frames lasting frameDur
+func NewPlaylist(frameDur time.Duration, loops int, sources ...MediaSource) *Playlist {
+	return &Playlist{
+		sources:  sources,
+		loops:    loops,
+		frameDur: frameDur,
+	}
+}
+
+// NextRtpFrame - the next frame of the open source, or of the next one once it runs out
+func (p *Playlist) NextRtpFrame() ([]byte, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	// a whole time round without a frame means there is nothing to play, which would otherwise loop forever
+	empty := 0
+	for !p.closed && empty <= len(p.sources) {
+		if p.current == nil {
+			if !p.open() {
+				return nil, io.EOF
+			}
+		}
+
+		frame, err := p.current.NextRtpFrame()
+		if err == nil {
+			p.position++
+			return frame, nil
+		}
+		if err != io.EOF {
+			fmt.Printf("Playlist: skipping source %d: %v\n", p.index, err)
+		}
+		if p.position == 0 {
+			empty++
+		}
+		p.advance()
+	}
+
+	return nil, io.EOF
+}
+
+// Next - skips the rest of the source that is playing
+func (p *Playlist) Next() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current != nil {
+		p.advance()
+	}
+}
+
+// Jump - starts playing the source at the index from its beginning
+func (p *Playlist) Jump(index int) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if index < 0 || index >= len(p.sources) {
+		return fmt.Errorf("playlist has no source %d", index)
+	}
+
+	p.closeCurrent()
+	p.index = index
+
+	return nil
+}
+
+// Seek - moves to the offset into the source that is playing, counted from its beginning. Sources are only read forwards, so going
+// back opens it again
+func (p *Playlist) Seek(offset time.Duration) error {
+	p.Lock()
+	defer p.Unlock()
+
+	frames := int(offset / p.frameDur)
+	if p.current == nil || frames < p.position {
+		p.closeCurrent()
+		if !p.open() {
+			return io.EOF
+		}
+	}
+
+	for p.position < frames {
+		if _, err := p.current.NextRtpFrame(); err != nil {
+			// past the end, so it carries on with the next source
+			p.advance()
+			return nil
+		}
+		p.position++
+	}
+
+	return nil
+}
+
+// Close - stops the playlist, closing the source that is playing
+func (p *Playlist) Close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closed = true
+	return p.closeCurrent()
+}
+
+// open - opens the source we are on, or the next that opens when it doesn't. Returns false once the playlist is done. The lock must be held
+func (p *Playlist) open() bool {
+	for tries := 0; tries < len(p.sources); tries++ {
+		if p.loops != LoopForever && p.played >= p.loops {
+			return false
+		}
+
+		reader, err := p.sources[p.index]()
+		if err == nil {
+			p.current, p.position = reader, 0
+			return true
+		}
+
+		fmt.Printf("Playlist: skipping source %d: %v\n", p.index, err)
+		p.next()
+	}
+
+	return false
+}
+
+// advance - closes the open source and moves on to the next. The lock must be held
+func (p *Playlist) advance() {
+	p.closeCurrent()
+	p.next()
+}
+
+// next - moves on to the next source, going round again after the last. The lock must be held
+func (p *Playlist) next() {
+	p.index++
+	if p.index == len(p.sources) {
+		p.index = 0
+		p.played++
+	}
+}
+
+// closeCurrent - the lock must be held
+func (p *Playlist) closeCurrent() error {
+	if p.current == nil {
+		return nil
+	}
+
+	var err error
+	if closer, ok := p.current.(ports.MediaReadCloser); ok {
+		err = closer.Close()
+	}
+	p.current, p.position = nil, 0
+
+	return err
+}
@@ -0,0 +1,161 @@
+package domain
+
+// packet loss concealment for g711, after itu-t g.711 appendix I: lost audio is covered by repeating the last pitch period of the caller's
+// voice, fading out the longer the loss goes on, and blended back into the real audio when it returns. All the lengths are at 8000hz
+
+const (
+	// the audio we keep to find the pitch in, 48.75ms
+	plcHistoryLen = 390
+	// the pitch we look for is between 66hz and 200hz
+	plcMinPitch = 40
+	plcMaxPitch = 120
+	// the window the pitch is correlated over, 20ms
+	plcCorrelationLen = 160
+	// concealment is at full volume for the first 10ms, then fades to silence by 60ms
+	plcFadeStart = 80
+	plcFadeEnd   = 480
+)
+
+// g711Plc - conceals the gaps in a stream of decoded g711
+type g711Plc struct {
+	history []int16
+	// the pitch period being repeated, and where we are in it
+	period []int16
+	offset int
+	// the samples concealed since the last real ones
+	lost int
+}
+
+func newG711Plc() *g711Plc {
+	return &g711Plc{history: make([]int16, 0, plcHistoryLen)}
+}
+
+// good - takes in real audio. Right after a gap, the start of it is blended with the concealment so there is no click
+func (p *g711Plc) good(samples []int16) []int16 {
+	if p.lost > 0 && len(p.period) > 0 {
+		// blend over a quarter of the pitch period, and a bit longer the longer the gap was
+		overlap := len(p.period) / 4
+		if p.lost > plcFadeStart {
+			overlap += 32
+		}
+		if overlap > len(samples) {
+			overlap = len(samples)
+		}
+
+		blended := append([]int16{}, samples...)
+		synthetic := p.synthesize(overlap)
+		for i := 0; i < overlap; i++ {
+			w := float64(i+1) / float64(overlap+1)
+			blended[i] = clamp16(float64(samples[i])*w + float64(synthetic[i])*(1-w))
+		}
+		samples = blended
+	}
+
+	p.lost = 0
+	p.period = nil
+	p.remember(samples)
+
+	return samples
+}
+
+// conceal - makes up n samples to cover a gap
+func (p *g711Plc) conceal(n int) []int16 {
+	if p.lost == 0 {
+		pitch := findPitch(p.history)
+		if pitch == 0 {
+			// not enough audio to go on, so there is nothing better than silence
+			p.lost += n
+			return make([]int16, n)
+		}
+		p.period = append([]int16{}, p.history[len(p.history)-pitch:]...)
+		p.offset = 0
+	}
+
+	out := p.synthesize(n)
+	for i := range out {
+		out[i] = clamp16(float64(out[i]) * plcGain(p.lost+i))
+	}
+	p.lost += n
+	p.remember(out)
+
+	return out
+}
+
+// synthesize - the next n samples of the repeated pitch period
+func (p *g711Plc) synthesize(n int) []int16 {
+	out := make([]int16, n)
+	if len(p.period) == 0 {
+		return out
+	}
+
+	for i := range out {
+		out[i] = p.period[p.offset]
+		p.offset = (p.offset + 1) % len(p.period)
+	}
+
+	return out
+}
+
+func (p *g711Plc) remember(samples []int16) {
+	p.history = append(p.history, samples...)
+	if over := len(p.history) - plcHistoryLen; over > 0 {
+		p.history = append(p.history[:0], p.history[over:]...)
+	}
+}
+
+// plcGain - how loud the concealment is, this many samples into the gap
+func plcGain(lost int) float64 {
+	switch {
+	case lost < plcFadeStart:
+		return 1
+	case lost >= plcFadeEnd:
+		return 0
+	default:
+		return 1 - float64(lost-plcFadeStart)/float64(plcFadeEnd-plcFadeStart)
+	}
+}
+
+// findPitch - the period of the voice at the end of the history, from the lag the end best correlates with. 0 when it is too short or silent
+func findPitch(history []int16) int {
+	if len(history) < plcCorrelationLen+plcMaxPitch {
+		return 0
+	}
+
+	end := len(history) - plcCorrelationLen
+	best, bestScore := 0, 0.0
+	for lag := plcMinPitch; lag <= plcMaxPitch; lag++ {
+		var corr, energy float64
+		for i := 0; i < plcCorrelationLen; i++ {
+			a := float64(history[end+i])
+			b := float64(history[end+i-lag])
+			corr += a * b
+			energy += b * b
+		}
+		if energy == 0 {
+			continue
+		}
+
+		// normalized so loud stretches of the history don't win just for being loud
+		if score := corr / energy; corr > 0 && score > bestScore {
+			best, bestScore = lag, score
+		}
+	}
+
+	if best == 0 {
+		// silence or noise, any period will do
+		return plcMinPitch
+	}
+
+	return best
+}
+
+func clamp16(v float64) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+
+	return int16(v)
+}
@@ -0,0 +1,839 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"sip_and_rip/ports"
+)
+
+// how calls to registered users and the bridge routes are handled: by the b2bua, which is a party to both legs, or by passing the
+// requests on as a proxy. A stateless proxy forwards each message as it comes and forgets it, and a stateful one keeps each request's
+// transaction, which lets it fork to every phone a user has and pick the best answer
+const (
+	ProxyOff       = "off"
+	ProxyStateless = "stateless"
+	ProxyStateful  = "stateful"
+)
+
+const (
+	// the start of the branches of the requests we forward, which tells the responses to them from those to our own requests
+	proxyBranchPrefix = "z9hG4bKpx"
+	// how long a transaction waits for a final response before it is a 408 (rfc 3261 17.1.1.2 and 17.1.2.2, timers b and f)
+	proxyTransactionTimeout = 32 * time.Second
+)
+
+// Proxy - forwards requests to the registered users' phones and the bridge routes, and their responses back the way they came by
+// their Vias (rfc 3261 16). It stays in the dialogs it forwards with a Record-Route, and passes on the requests in them that come
+// back through it
+type Proxy struct {
+	sync.Mutex
+	cfg       *Config
+	registrar *Registrar
+	// nil until the server is up, in which case only registered users can be reached
+	sender ports.SipSender
+	// the transactions of the requests we forward, by the branch they came in on, and by the branches we forwarded them on. Stateful only
+	transactions map[string]*proxyTransaction
+	branches     map[string]*proxyBranch
+	// our own addresses, which tell our Record-Route in a Route from anyone else's
+	localIPs map[string]bool
+}
+
+// NewProxy - creates the proxy for the mode in the config
+func NewProxy(cfg *Config, registrar *Registrar) *Proxy {
+	p := &Proxy{
+		cfg:          cfg,
+		registrar:    registrar,
+		transactions: make(map[string]*proxyTransaction),
+		branches:     make(map[string]*proxyBranch),
+		localIPs:     make(map[string]bool),
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				p.localIPs[ipNet.IP.String()] = true
+			}
+		}
+	}
+
+	return p
+}
+
+// SetSender - what we send requests to the bridge routes, and the requests in dialogs, with
+func (p *Proxy) SetSender(sender ports.SipSender) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.sender = sender
+}
+
+// Handle - forwards the message if it is one for the proxy: a response to a request we forwarded, a request routed through us by our
+// Record-Route, or a new request for a registered user or a bridge route. Returns false for everything else, which is for us
+func (p *Proxy) Handle(sipMsg ports.SipMessage, send ports.SendResponseCallback) bool {
+	if sipMsg.IsResponse() {
+		if !strings.HasPrefix(sipMsg.GetBranch(), proxyBranchPrefix) {
+			return false
+		}
+
+		p.handleResponse(sipMsg)
+		return true
+	}
+
+	if p.stateful() && p.inTransaction(sipMsg, send) {
+		return true
+	}
+
+	// a request in a dialog we recorded the route of. It goes on to the next Route, or to the far end
+	if routes := sipMsg.GetRoutes(); len(routes) > 0 {
+		if !p.isLocal(routes[0]) {
+			return false
+		}
+
+		p.forwardInDialog(sipMsg, send, routes)
+		return true
+	}
+
+	if !p.routable(sipMsg) {
+		return false
+	}
+
+	groups := p.targets(sipMsg)
+	if len(groups) == 0 {
+		return false
+	}
+
+	// the rest of the dialog comes through us too, so we can keep passing it on
+	local := localSipAddr(p.getSender(), sipMsg.GetRequest().Host)
+	p.forward(sipMsg, send, groups, local, false, startsDialog(sipMsg.GetMethod()))
+
+	return true
+}
+
+// proxyTarget - somewhere we forward a request to
+type proxyTarget struct {
+	// the request uri it goes with, nil to leave it as it was
+	uri       *sip.URI
+	send      ports.SendResponseCallback
+	transport string
+}
+
+// targets - where a new request goes: each of the user's phones, in groups that are tried one after the other with the phones in
+// each rung at once, or the next hop of a bridge route. A stateless proxy can only try one, so it is the phone they prefer
+func (p *Proxy) targets(sipMsg ports.SipMessage) [][]*proxyTarget {
+	dialed := sipMsg.GetRequest().User
+	if dialed == "" {
+		return nil
+	}
+
+	if bindings := p.registrar.LookupAll(dialed); len(bindings) > 0 {
+		if !p.stateful() {
+			bindings = bindings[:1]
+		}
+
+		// the bindings are in order of preference, so each group is a run of the same q (rfc 3261 16.6)
+		var groups [][]*proxyTarget
+		for i, binding := range bindings {
+			if binding.Contact == nil || binding.Send == nil {
+				continue
+			}
+
+			target := &proxyTarget{uri: binding.Contact.Uri, send: binding.Send, transport: binding.Transport}
+			if i == 0 || binding.Q != bindings[i-1].Q || len(groups) == 0 {
+				groups = append(groups, nil)
+			}
+			groups[len(groups)-1] = append(groups[len(groups)-1], target)
+		}
+
+		return groups
+	}
+
+	sender := p.getSender()
+	if sender == nil {
+		return nil
+	}
+
+	for _, route := range p.cfg.BridgeRoutes {
+		uri := route.target(dialed)
+		if uri == nil {
+			continue
+		}
+
+		send, err := sendToUri(sender, uri)
+		if err != nil {
+			fmt.Printf("proxy: can't reach %s for %s: %v\n", uri, dialed, err)
+			return nil
+		}
+		return [][]*proxyTarget{{{uri: uri, send: send, transport: ports.TransportUDP}}}
+	}
+
+	return nil
+}
+
+// forwardInDialog - passes on a request that our Record-Route brought back through us. It goes to the next Route when there is one,
+// and to its request uri when there isn't
+func (p *Proxy) forwardInDialog(sipMsg ports.SipMessage, send ports.SendResponseCallback, routes []*sip.URI) {
+	next := sipMsg.GetRequest()
+	if len(routes) > 1 {
+		next = routes[1]
+	}
+
+	target := &proxyTarget{transport: ports.TransportUDP}
+	if binding, ok := p.boundAt(next); ok {
+		// a registered phone, which we have to reach the way it reached us
+		target.send, target.transport = binding.Send, binding.Transport
+	} else if sender := p.getSender(); sender != nil {
+		var err error
+		if target.send, err = sendToUri(sender, next); err != nil {
+			fmt.Printf("proxy: can't reach %s: %v\n", next, err)
+		}
+	}
+	if target.send == nil {
+		if sipMsg.GetMethod() != ports.MethodAck {
+			// 503 Service Unavailable
+			sendResponse(sipMsg, 503, send)
+		}
+		return
+	}
+
+	local := localSipAddr(p.getSender(), routes[0].Host)
+	local.Port = int(routes[0].GetPort())
+	p.forward(sipMsg, send, [][]*proxyTarget{{target}}, local, true, false)
+}
+
+// forward - passes the request on to the targets. A stateful proxy does it in a transaction of its own, a stateless one just sends it
+func (p *Proxy) forward(sipMsg ports.SipMessage, send ports.SendResponseCallback, groups [][]*proxyTarget, local *net.UDPAddr, popRoute bool, recordRoute bool) {
+	// the request has been around too many proxies, or round the same ones, already (rfc 3261 16.3)
+	if sipMsg.GetMaxForwards() == 0 {
+		fmt.Printf("proxy: %s for %s has too many hops\n", sipMsg.GetMethod(), sipMsg.GetCallID())
+		if sipMsg.GetMethod() != ports.MethodAck {
+			// 483 Too Many Hops
+			sendResponse(sipMsg, 483, send)
+		}
+		return
+	}
+
+	// the ACK for a 2xx is a transaction of its own with no response, so it is always forwarded statelessly
+	if !p.stateful() || sipMsg.GetMethod() == ports.MethodAck {
+		target := groups[0][0]
+		hop := ports.ForwardHop{
+			Target:      target.uri,
+			Local:       local,
+			Transport:   target.transport,
+			Branch:      statelessBranch(sipMsg, target),
+			PopRoute:    popRoute,
+			RecordRoute: recordRoute,
+		}
+		fwd, err := sipMsg.NewForwardedRequest(hop)
+		if err == nil {
+			err = sendSipMessage(fwd, target.send)
+		}
+		if err != nil {
+			fmt.Printf("proxy: error forwarding %s for %s: %v\n", sipMsg.GetMethod(), sipMsg.GetCallID(), err)
+		}
+		return
+	}
+
+	tx := &proxyTransaction{
+		proxy:       p,
+		request:     sipMsg,
+		send:        send,
+		key:         transactionKey(sipMsg),
+		groups:      groups,
+		local:       local,
+		popRoute:    popRoute,
+		recordRoute: recordRoute,
+		group:       -1,
+	}
+
+	p.Lock()
+	p.transactions[tx.key] = tx
+	p.Unlock()
+
+	fmt.Printf("proxy: forwarding %s for %s to %d groups of targets\n", sipMsg.GetMethod(), sipMsg.GetCallID(), len(groups))
+
+	tx.Lock()
+	defer tx.Unlock()
+
+	if sipMsg.GetMethod() == ports.MethodInvite {
+		// ringing can take a while, so the caller stops sending the INVITE again (rfc 3261 16.2)
+		tx.respondWith(100)
+	}
+	tx.nextGroup()
+}
+
+// inTransaction - hands the request to the transaction it belongs to: an INVITE or other request sent again, the ACK for a failure we
+// passed back, or a CANCEL. Returns false when it isn't in one of ours
+func (p *Proxy) inTransaction(sipMsg ports.SipMessage, send ports.SendResponseCallback) bool {
+	p.Lock()
+	tx, ok := p.transactions[transactionKey(sipMsg)]
+	p.Unlock()
+	if !ok {
+		return false
+	}
+
+	switch sipMsg.GetMethod() {
+	case ports.MethodAck:
+		// ours to absorb, each branch was acknowledged as its failure came in (rfc 3261 16.7)
+	case ports.MethodCancel:
+		// 200 OK for the CANCEL, and the INVITE ends with a 487 from each of the branches
+		if err := sendResponse(sipMsg, 200, send); err != nil {
+			fmt.Printf("proxy: error answering CANCEL for %s: %v\n", sipMsg.GetCallID(), err)
+		}
+		tx.cancel()
+	default:
+		tx.retransmitted()
+	}
+
+	return true
+}
+
+// handleResponse - a response to a request we forwarded. One to a transaction goes to it, and anything else, ie a 2xx sent again
+// after the transaction is over, goes back by its Vias
+func (p *Proxy) handleResponse(response ports.SipMessage) {
+	p.Lock()
+	branch, ok := p.branches[response.GetBranch()]
+	p.Unlock()
+	if ok {
+		branch.tx.handleResponse(branch, response)
+		return
+	}
+
+	fwd, err := response.NewForwardedResponse()
+	if err != nil {
+		fmt.Printf("proxy: error passing back %d for %s: %v\n", response.GetStatus(), response.GetCallID(), err)
+		return
+	}
+
+	addr, transport, err := fwd.GetViaAddr()
+	if err != nil {
+		fmt.Printf("proxy: nowhere to pass back %d for %s: %v\n", response.GetStatus(), response.GetCallID(), err)
+		return
+	}
+	sender := p.getSender()
+	if sender == nil || (transport != "" && transport != ports.TransportUDP) {
+		// the connection it would go back on is the transaction's, and that is gone
+		fmt.Printf("proxy: can't pass back %d for %s over %s\n", response.GetStatus(), response.GetCallID(), transport)
+		return
+	}
+
+	var b bytes.Buffer
+	fwd.Append(&b)
+	if err := sender.SendTo(addr, b.Bytes()); err != nil {
+		fmt.Printf("proxy: error passing back %d for %s: %v\n", response.GetStatus(), response.GetCallID(), err)
+	}
+}
+
+// routable - whether the request is one routed by its request uri: a new one, rather than one in a dialog, and never a REGISTER,
+// which is for our registrar. A stateless proxy has no transactions to match the ACKs and CANCELs of the INVITEs it forwarded to, so
+// they are routed the same way, which takes them where the INVITE went
+func (p *Proxy) routable(sipMsg ports.SipMessage) bool {
+	switch sipMsg.GetMethod() {
+	case ports.MethodRegister:
+		return false
+	case ports.MethodAck, ports.MethodCancel:
+		return !p.stateful()
+	}
+
+	return !sipMsg.IsInDialog()
+}
+
+// boundAt - the registered phone at the uri's address, if there is one
+func (p *Proxy) boundAt(uri *sip.URI) (*Binding, bool) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(uri.Host, strconv.Itoa(int(uri.GetPort()))))
+	if err != nil {
+		return nil, false
+	}
+
+	return p.registrar.LookupSource(addr)
+}
+
+// isLocal - whether the uri is us, ie our Record-Route coming back as a Route
+func (p *Proxy) isLocal(uri *sip.URI) bool {
+	local := localSipAddr(p.getSender(), uri.Host)
+	if int(uri.GetPort()) != local.Port {
+		return false
+	}
+
+	return p.localIPs[uri.Host] || local.IP.String() == uri.Host
+}
+
+func (p *Proxy) stateful() bool {
+	return p.cfg.ProxyMode == ProxyStateful
+}
+
+func (p *Proxy) getSender() ports.SipSender {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.sender
+}
+
+// forget - drops the transaction once it has had time to soak up anything late
+func (p *Proxy) forget(tx *proxyTransaction) {
+	time.AfterFunc(proxyTransactionTimeout, func() {
+		p.Lock()
+		defer p.Unlock()
+
+		delete(p.transactions, tx.key)
+		for _, branch := range tx.branches {
+			delete(p.branches, branch.branch)
+		}
+	})
+}
+
+// proxyTransaction - a request we are forwarding statefully, and the branches we forwarded it on (rfc 3261 16.7)
+type proxyTransaction struct {
+	sync.Mutex
+	proxy   *Proxy
+	request ports.SipMessage
+	// how to send back to where the request came from
+	send ports.SendResponseCallback
+	key  string
+	// the targets, a group at a time, and the group being tried
+	groups [][]*proxyTarget
+	group  int
+	// how the request is forwarded
+	local       *net.UDPAddr
+	popRoute    bool
+	recordRoute bool
+	branches    []*proxyBranch
+	// the best final response yet, nil when it is one of our own. It is sent back once every branch is over, unless a 2xx beats it
+	best       ports.SipMessage
+	bestStatus int
+	// the last response we sent back, which is sent again when the request is
+	last []byte
+	// set once the final response has gone back, once the caller has cancelled, and once a 6xx means no more branches
+	final     bool
+	cancelled bool
+	declined  bool
+	// how long the group rings before it is cancelled, INVITEs only
+	ringTimer *time.Timer
+}
+
+// proxyBranch - the request forwarded to one of the targets
+type proxyBranch struct {
+	tx      *proxyTransaction
+	request ports.SipMessage
+	send    ports.SendResponseCallback
+	branch  string
+	// the highest status it has responded with, 0 before it has
+	status int
+	// closed on its first response, which stops it being sent again
+	responded chan struct{}
+	// set once it has a final response, and when it is to be cancelled as soon as it has responded at all (rfc 3261 9.1)
+	done          bool
+	cancelPending bool
+}
+
+// nextGroup - forwards the request to the next group of targets, or sends back the best response when there are none left. The lock
+// must be held
+func (tx *proxyTransaction) nextGroup() {
+	for tx.group+1 < len(tx.groups) && !tx.cancelled && !tx.declined {
+		tx.group++
+
+		started := 0
+		for _, target := range tx.groups[tx.group] {
+			if tx.startBranch(target) {
+				started++
+			}
+		}
+		if started == 0 {
+			continue
+		}
+
+		if tx.request.GetMethod() == ports.MethodInvite {
+			ringSeconds := tx.proxy.cfg.RingSeconds
+			if ringSeconds <= 0 {
+				ringSeconds = defaultRingSeconds
+			}
+			tx.ringTimer = time.AfterFunc(time.Duration(ringSeconds)*time.Second, tx.ringTimeout)
+		}
+		return
+	}
+
+	tx.finish()
+}
+
+// startBranch - forwards the request to one target. The lock must be held
+func (tx *proxyTransaction) startBranch(target *proxyTarget) bool {
+	branch := &proxyBranch{
+		tx:        tx,
+		send:      target.send,
+		branch:    newProxyBranch(),
+		responded: make(chan struct{}),
+	}
+
+	hop := ports.ForwardHop{
+		Target:      target.uri,
+		Local:       tx.local,
+		Transport:   target.transport,
+		Branch:      branch.branch,
+		PopRoute:    tx.popRoute,
+		RecordRoute: tx.recordRoute,
+	}
+	fwd, err := tx.request.NewForwardedRequest(hop)
+	if err == nil {
+		branch.request = fwd
+		err = sendSipMessage(fwd, target.send)
+	}
+	if err != nil {
+		fmt.Printf("proxy: error forwarding %s for %s to %v: %v\n", tx.request.GetMethod(), tx.request.GetCallID(), target.uri, err)
+		tx.consider(nil, 503)
+		return false
+	}
+
+	tx.branches = append(tx.branches, branch)
+	tx.proxy.Lock()
+	tx.proxy.branches[branch.branch] = branch
+	tx.proxy.Unlock()
+
+	go branch.watch(target.transport == ports.TransportUDP)
+
+	return true
+}
+
+// handleResponse - a response on one of the branches
+func (tx *proxyTransaction) handleResponse(branch *proxyBranch, response ports.SipMessage) {
+	if _, method := response.GetCSeq(); method == ports.MethodCancel {
+		// the far end took our CANCEL, the INVITE's 487 is still to come
+		return
+	}
+
+	tx.Lock()
+	defer tx.Unlock()
+
+	select {
+	case <-branch.responded:
+	default:
+		close(branch.responded)
+	}
+
+	status := response.GetStatus()
+	invite := tx.request.GetMethod() == ports.MethodInvite
+	switch {
+	case status < 200:
+		if branch.status < status {
+			branch.status = status
+		}
+		if branch.cancelPending {
+			branch.cancelPending = false
+			branch.cancel()
+		}
+		// 100 Trying is hop by hop, we sent our own. The rest tell the caller how it is going
+		if status > 100 && !tx.final {
+			tx.respond(response)
+		}
+
+	case status < 300:
+		// every 2xx goes back, even after another branch answered, since each is a dialog of its own (rfc 3261 16.7)
+		branch.status = status
+		branch.done = true
+		tx.respond(response)
+		if !tx.final {
+			tx.final = true
+			tx.cancelBranches()
+			tx.stopRinging()
+			tx.proxy.forget(tx)
+		}
+
+	default:
+		if invite {
+			// the ACK for a failure is hop by hop, so it is ours to send (rfc 3261 17.1.1.3)
+			if ack, err := branch.request.NewAck(response); err != nil {
+				fmt.Printf("proxy: error acknowledging %d for %s: %v\n", status, tx.request.GetCallID(), err)
+			} else if err := sendSipMessage(ack, branch.send); err != nil {
+				fmt.Printf("proxy: error acknowledging %d for %s: %v\n", status, tx.request.GetCallID(), err)
+			}
+		}
+		if branch.done {
+			// sent again, since our ACK got lost
+			return
+		}
+
+		branch.status = status
+		branch.done = true
+		tx.consider(response, status)
+		if status >= 600 {
+			// turned down everywhere, so there is no point in the rest of the branches (rfc 3261 16.7)
+			tx.declined = true
+			tx.cancelBranches()
+		}
+		tx.checkGroup()
+	}
+}
+
+// consider - keeps the response if it is the best so far: a 6xx beats anything, then the lowest class wins (rfc 3261 16.7). The
+// lock must be held
+func (tx *proxyTransaction) consider(response ports.SipMessage, status int) {
+	switch {
+	case tx.bestStatus == 0:
+	case tx.bestStatus >= 600:
+		return
+	case status >= 600:
+	case status/100 < tx.bestStatus/100:
+	default:
+		return
+	}
+
+	tx.best, tx.bestStatus = response, status
+}
+
+// checkGroup - moves on to the next group once every branch of this one is over. The lock must be held
+func (tx *proxyTransaction) checkGroup() {
+	for _, branch := range tx.branches {
+		if !branch.done {
+			return
+		}
+	}
+
+	tx.stopRinging()
+	if !tx.final {
+		tx.nextGroup()
+	}
+}
+
+// finish - sends back the best response, once no branch answered. The lock must be held
+func (tx *proxyTransaction) finish() {
+	if tx.final {
+		return
+	}
+	tx.final = true
+	tx.proxy.forget(tx)
+
+	switch {
+	case tx.bestStatus == 0:
+		// nowhere took the request. 480 Temporarily Unavailable
+		tx.respondWith(480)
+	case tx.bestStatus == 503:
+		// it is the far end that is unavailable, not us, so the caller shouldn't take it as a reason to stop using us (rfc 3261 16.7)
+		tx.respondWith(500)
+	case tx.best == nil:
+		tx.respondWith(tx.bestStatus)
+	default:
+		tx.respond(tx.best)
+	}
+}
+
+// respond - passes a response from one of the branches back. The lock must be held
+func (tx *proxyTransaction) respond(response ports.SipMessage) {
+	fwd, err := response.NewForwardedResponse()
+	if err != nil {
+		fmt.Printf("proxy: error passing back %d for %s: %v\n", response.GetStatus(), tx.request.GetCallID(), err)
+		return
+	}
+
+	var b bytes.Buffer
+	fwd.Append(&b)
+	tx.sendBack(b.Bytes())
+}
+
+// respondWith - sends back a response of our own. The lock must be held
+func (tx *proxyTransaction) respondWith(status int) {
+	res, err := tx.request.NewResponse(status)
+	if err != nil {
+		fmt.Printf("proxy: error creating %d for %s: %v\n", status, tx.request.GetCallID(), err)
+		return
+	}
+
+	var b bytes.Buffer
+	res.Append(&b)
+	tx.sendBack(b.Bytes())
+}
+
+// sendBack - the lock must be held
+func (tx *proxyTransaction) sendBack(b []byte) {
+	tx.last = b
+	if err := tx.send(b); err != nil {
+		fmt.Printf("proxy: error sending response for %s: %v\n", tx.request.GetCallID(), err)
+	}
+}
+
+// retransmitted - the request came again, since our response to it got lost
+func (tx *proxyTransaction) retransmitted() {
+	tx.Lock()
+	defer tx.Unlock()
+
+	if tx.last == nil {
+		return
+	}
+	if err := tx.send(tx.last); err != nil {
+		fmt.Printf("proxy: error sending response for %s again: %v\n", tx.request.GetCallID(), err)
+	}
+}
+
+// cancel - the caller gave up, so every branch is cancelled and no more are started
+func (tx *proxyTransaction) cancel() {
+	tx.Lock()
+	defer tx.Unlock()
+
+	if tx.final {
+		return
+	}
+	tx.cancelled = true
+	tx.cancelBranches()
+}
+
+// ringTimeout - the group has rung for too long. Its branches are cancelled, and the next group gets a go once their 487s are in
+func (tx *proxyTransaction) ringTimeout() {
+	tx.Lock()
+	defer tx.Unlock()
+
+	if tx.final {
+		return
+	}
+	fmt.Printf("proxy: nobody answered %s\n", tx.request.GetCallID())
+	tx.cancelBranches()
+}
+
+// cancelBranches - the lock must be held
+func (tx *proxyTransaction) cancelBranches() {
+	for _, branch := range tx.branches {
+		if branch.done {
+			continue
+		}
+
+		if branch.status == 0 {
+			// a CANCEL can't go before the request has been responded to, so it waits for the first response
+			branch.cancelPending = true
+			continue
+		}
+		branch.cancel()
+	}
+}
+
+func (tx *proxyTransaction) stopRinging() {
+	if tx.ringTimer != nil {
+		tx.ringTimer.Stop()
+	}
+}
+
+// cancel - stops the branch's INVITE, whose 487 ends it, or a 408 if that doesn't come in time. Other requests can't be cancelled,
+// they just run their course
+func (b *proxyBranch) cancel() {
+	if b.request.GetMethod() != ports.MethodInvite {
+		return
+	}
+	time.AfterFunc(proxyTransactionTimeout, b.expire)
+
+	cancel, err := b.request.NewCancel()
+	if err == nil {
+		err = sendSipMessage(cancel, b.send)
+	}
+	if err != nil {
+		fmt.Printf("proxy: error cancelling %s: %v\n", b.request.GetCallID(), err)
+	}
+}
+
+// watch - sends the request again until it is responded to when it went over udp, and gives up on the branch with a 408 when it isn't
+// responded to in time. An INVITE that is ringing is left to the ring timeout, anything else has to be over in time too
+func (b *proxyBranch) watch(retransmit bool) {
+	interval := inviteRetransmitInterval
+	retry := time.NewTimer(interval)
+	defer retry.Stop()
+	if !retransmit {
+		retry.Stop()
+	}
+
+	timeout := time.NewTimer(proxyTransactionTimeout)
+	defer timeout.Stop()
+
+	responded := b.responded
+	for {
+		select {
+		case <-responded:
+			if b.request.GetMethod() == ports.MethodInvite {
+				return
+			}
+			retransmit = false
+			responded = nil
+		case <-retry.C:
+			if !retransmit {
+				continue
+			}
+			if err := sendSipMessage(b.request, b.send); err != nil {
+				fmt.Printf("proxy: error forwarding %s again: %v\n", b.request.GetCallID(), err)
+			}
+			if interval *= 2; interval > inviteRetransmitMaxInterval {
+				interval = inviteRetransmitMaxInterval
+			}
+			retry.Reset(interval)
+		case <-timeout.C:
+			b.expire()
+			return
+		}
+	}
+}
+
+// expire - the branch got no final response in time, which counts as a 408 Request Timeout
+func (b *proxyBranch) expire() {
+	b.tx.Lock()
+	defer b.tx.Unlock()
+
+	if b.done {
+		return
+	}
+	fmt.Printf("proxy: no final response for %s on %s\n", b.request.GetCallID(), b.branch)
+	b.done = true
+	b.tx.consider(nil, 408)
+	b.tx.checkGroup()
+}
+
+// transactionKey - the server transaction a request is in: the branch it came in on, which its CANCEL and the ACK for a failure share,
+// and its method, with theirs counting as the INVITE's (rfc 3261 17.2.3)
+func transactionKey(sipMsg ports.SipMessage) string {
+	method := sipMsg.GetMethod()
+	if method == ports.MethodAck || method == ports.MethodCancel {
+		method = ports.MethodInvite
+	}
+
+	return sipMsg.GetBranch() + " " + method
+}
+
+// statelessBranch - the branch a stateless proxy forwards a request on. It is the same each time the request comes, and for its
+// CANCEL and the ACK for a failure, so they go on the INVITE's transaction downstream as they did upstream (rfc 3261 16.11)
+func statelessBranch(sipMsg ports.SipMessage, target *proxyTarget) string {
+	cseq, _ := sipMsg.GetCSeq()
+	key := fmt.Sprintf("%s %s %d", sipMsg.GetBranch(), sipMsg.GetCallID(), cseq)
+	if target.uri != nil {
+		key += " " + target.uri.String()
+	}
+	sum := sha256.Sum256([]byte(key))
+
+	return proxyBranchPrefix + hex.EncodeToString(sum[:8])
+}
+
+// newProxyBranch - a branch for a stateful proxy's request
+func newProxyBranch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return proxyBranchPrefix + hex.EncodeToString(b)
+}
+
+// startsDialog - whether a request starts a dialog, which a proxy stays in with its Record-Route
+func startsDialog(method string) bool {
+	switch method {
+	case ports.MethodInvite, ports.MethodSubscribe, ports.MethodRefer:
+		return true
+	}
+
+	return false
+}
+
+func sendSipMessage(msg ports.SipMessage, send ports.SendResponseCallback) error {
+	var b bytes.Buffer
+	msg.Append(&b)
+
+	return send(b.Bytes())
+}
@@ -0,0 +1,992 @@
+package domain
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+// the ways a queue's agents are offered its calls: every free agent at once, the next free one after whoever was offered the last
+// call, or the one who has been free the longest
+const (
+	QueueRingAll     = "ring-all"
+	QueueRoundRobin  = "round-robin"
+	QueueLongestIdle = "longest-idle"
+)
+
+const (
+	// how long an agent who turned a call down, or didn't answer it, is left alone before they are offered another
+	agentRestTime = 5 * time.Second
+	// the most beeps a position announcement plays, for the 10th caller and everyone behind them
+	queueMaxAnnouncedPosition = 10
+)
+
+var errNotAgentsPhone = fmt.Errorf("not one of the agent's phones")
+
+// how a caller's wait in a queue ended
+const (
+	queueAnswered = "answered"
+	queueHungUp   = "hung up"
+	queueTimedOut = "timed out"
+	// the number they overflowed to didn't answer either
+	queueFailed = "failed"
+)
+
+// CallQueue - a number callers dial to wait on hold for the next free agent
+type CallQueue struct {
+	// the user part of the request uri, ie 600 in sip:600@host
+	Number string `json:"number"`
+	// QueueRingAll, QueueRoundRobin or QueueLongestIdle. Ring all when empty
+	Strategy string `json:"strategy,omitempty"`
+	// the users who can log in to the queue as agents. Any registered user when empty
+	Agents []string `json:"agents,omitempty"`
+	// the wav file callers hear while they wait, looped, relative to MediaDir. Ringback when empty
+	Music string `json:"music,omitempty"`
+	// how often callers hear their place in the queue, a beep for each. Never when 0
+	AnnounceSeconds int `json:"announce_seconds,omitempty"`
+	// how long each offer of a call rings an agent. RingSeconds when 0
+	RingSeconds int `json:"ring_seconds,omitempty"`
+	// how long callers wait before they overflow. Forever when 0
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// where callers overflow to: a mailbox, or a number, ie another queue, a registered user or a bridge route. Without either they
+	// are hung up on
+	OverflowMailbox string `json:"overflow_mailbox,omitempty"`
+	OverflowNumber  string `json:"overflow_number,omitempty"`
+}
+
+// Validate - checks the queue has a number, a strategy we know and one place to overflow to at most
+func (q CallQueue) Validate() error {
+	if q.Number == "" {
+		return fmt.Errorf("queue needs a number")
+	}
+
+	switch q.Strategy {
+	case "", QueueRingAll, QueueRoundRobin, QueueLongestIdle:
+	default:
+		return fmt.Errorf("queue %s has an unknown strategy: %s", q.Number, q.Strategy)
+	}
+
+	if q.AnnounceSeconds < 0 || q.RingSeconds < 0 || q.TimeoutSeconds < 0 {
+		return fmt.Errorf("queue %s can't wait a negative number of seconds", q.Number)
+	}
+	if q.OverflowMailbox != "" && q.OverflowNumber != "" {
+		return fmt.Errorf("queue %s can overflow to a mailbox or a number, not both", q.Number)
+	}
+	if q.OverflowNumber == q.Number {
+		return fmt.Errorf("queue %s can't overflow to itself", q.Number)
+	}
+
+	return nil
+}
+
+// allows - whether the user can log in to the queue
+func (q CallQueue) allows(user string) bool {
+	if len(q.Agents) == 0 {
+		return true
+	}
+
+	for _, agent := range q.Agents {
+		if agent == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Queues - the call queues. Callers wait on hold, hearing their place in the queue now and then, while the agents logged in to it are
+// offered their calls, in turn, as they come free. Offers are bridged calls, so once an agent answers the call is like any other
+// bridged one, transfers and all. Agents log in and out, and pause and unpause, with feature codes
+type Queues struct {
+	sync.Mutex
+	cfg       *Config
+	registrar *Registrar
+	b2bua     *B2bua
+	// nil when voicemail is disabled
+	voicemail *Voicemail
+	// by number, and the agents by user
+	queues map[string]*queue
+	agents map[string]*agent
+}
+
+// NewQueues - creates the queues of the config. Their calls are offered to agents through the b2bua, and overflow to voicemail unless
+// it is nil
+func NewQueues(cfg *Config, registrar *Registrar, b2bua *B2bua, voicemail *Voicemail) *Queues {
+	q := &Queues{
+		cfg:       cfg,
+		registrar: registrar,
+		b2bua:     b2bua,
+		voicemail: voicemail,
+		queues:    map[string]*queue{},
+		agents:    map[string]*agent{},
+	}
+
+	for _, cq := range cfg.Queues {
+		// the first queue with a number wins, like the other rules
+		if _, ok := q.queues[cq.Number]; !ok {
+			q.queues[cq.Number] = &queue{CallQueue: cq, changed: make(chan struct{})}
+		}
+	}
+
+	return q
+}
+
+// Route - the handler for a call to one of the queues, or to the agents' feature codes. nil when it is for neither. errNotAgentsPhone
+// means it is a feature code, but it didn't come from where the agent registered and should get a 403
+func (q *Queues) Route(fsm *SipFsm, invite ports.SipMessage, send ports.SendResponseCallback) (CallHandler, error) {
+	dialed := invite.GetRequest().User
+	if dialed == "" {
+		return nil, nil
+	}
+
+	if qu, ok := q.queues[dialed]; ok {
+		return q.wait(qu, fsm, invite, send), nil
+	}
+
+	user := aorUser(invite.GetFrom())
+	var action func() error
+	switch {
+	case q.cfg.AgentPauseCode != "" && dialed == q.cfg.AgentPauseCode:
+		action = func() error { return q.pause(user, true) }
+	case q.cfg.AgentUnpauseCode != "" && dialed == q.cfg.AgentUnpauseCode:
+		action = func() error { return q.pause(user, false) }
+	case q.cfg.AgentLoginCode != "" && strings.HasPrefix(dialed, q.cfg.AgentLoginCode):
+		action = func() error { return q.login(user, strings.TrimPrefix(dialed, q.cfg.AgentLoginCode)) }
+	case q.cfg.AgentLogoutCode != "" && strings.HasPrefix(dialed, q.cfg.AgentLogoutCode):
+		action = func() error { return q.logout(user, strings.TrimPrefix(dialed, q.cfg.AgentLogoutCode)) }
+	default:
+		return nil, nil
+	}
+
+	// the agent is whoever is in the From, so only trust it from one of their registered phones
+	if !q.registrar.IsRegisteredFrom(user, invite.GetSource()) {
+		return nil, fmt.Errorf("%w: %q from %v", errNotAgentsPhone, user, invite.GetSource())
+	}
+
+	return q.feature(action), nil
+}
+
+// feature - does what the feature code is for, and lets the agent know it worked with a double beep, or it didn't with a burst of
+// congestion tone, before hanging up
+func (q *Queues) feature(action func() error) CallHandler {
+	return func(call *Call, sipMsg ports.SipMessage) error {
+		var reader ports.MediaReader
+		err := action()
+		if err != nil {
+			fmt.Printf("queues: %v\n", err)
+			reader, err = call.PlanTone(ToneCongestion, 1000)
+		} else {
+			reader, err = q.beeps(call, 2)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := call.Play(reader); err != nil {
+			return err
+		}
+
+		return call.Hangup()
+	}
+}
+
+// beeps - a short beep for each of count, ie for a caller's place in the queue
+func (q *Queues) beeps(call *Call, count int) (ports.MediaReader, error) {
+	sources := []MediaSource{call.SilenceSource(300)}
+	for i := 0; i < count; i++ {
+		sources = append(sources, func() (ports.MediaReader, error) {
+			return call.Tone(beepHz, 150)
+		}, call.SilenceSource(150))
+	}
+
+	return call.NewPlaylist(1, sources...), nil
+}
+
+// queuesFor - the queue with the number, or every queue when it is empty
+func (q *Queues) queuesFor(number string) ([]*queue, error) {
+	if number == "" {
+		var all []*queue
+		for _, qu := range q.queues {
+			all = append(all, qu)
+		}
+		return all, nil
+	}
+
+	qu, ok := q.queues[number]
+	if !ok {
+		return nil, fmt.Errorf("there is no queue %s", number)
+	}
+
+	return []*queue{qu}, nil
+}
+
+// login - makes the user an agent of the queue, or of every queue they can be when the number is empty. They have to be registered
+// for us to ring them
+func (q *Queues) login(user string, number string) error {
+	if _, ok := q.registrar.Lookup(user); user == "" || !ok {
+		return fmt.Errorf("%q can't log in to the queues without registering", user)
+	}
+
+	queues, err := q.queuesFor(number)
+	if err != nil {
+		return err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	a, ok := q.agents[user]
+	if !ok {
+		a = &agent{user: user, idleSince: time.Now()}
+		q.agents[user] = a
+	}
+
+	var joined []string
+	for _, qu := range queues {
+		if !qu.allows(user) {
+			continue
+		}
+		if !qu.has(a) {
+			qu.members = append(qu.members, a)
+			qu.notify()
+		}
+		joined = append(joined, qu.Number)
+	}
+	if len(joined) == 0 {
+		return fmt.Errorf("%s isn't an agent of queue %s", user, number)
+	}
+
+	fmt.Printf("queues: %s logged in to %s\n", user, strings.Join(joined, ", "))
+
+	return nil
+}
+
+// logout - takes the agent out of the queue, or out of every queue when the number is empty. A call they are on carries on
+func (q *Queues) logout(user string, number string) error {
+	queues, err := q.queuesFor(number)
+	if err != nil {
+		return err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	a, ok := q.agents[user]
+	if !ok {
+		return fmt.Errorf("%q isn't logged in to any queue", user)
+	}
+
+	var left []string
+	for _, qu := range queues {
+		for i, member := range qu.members {
+			if member == a {
+				qu.members = append(qu.members[:i], qu.members[i+1:]...)
+				left = append(left, qu.Number)
+				break
+			}
+		}
+	}
+	if len(left) == 0 {
+		return fmt.Errorf("%s isn't logged in to queue %s", user, number)
+	}
+
+	fmt.Printf("queues: %s logged out of %s\n", user, strings.Join(left, ", "))
+
+	return nil
+}
+
+// pause - stops or starts offering the agent calls from every queue they are logged in to, ie while they are on a break
+func (q *Queues) pause(user string, paused bool) error {
+	q.Lock()
+	defer q.Unlock()
+
+	a, ok := q.agents[user]
+	if !ok || !q.loggedIn(a) {
+		return fmt.Errorf("%q isn't logged in to any queue", user)
+	}
+	a.paused = paused
+	if !paused {
+		q.notifyAll()
+	}
+
+	fmt.Printf("queues: %s paused: %t\n", user, paused)
+
+	return nil
+}
+
+// loggedIn - whether the agent is logged in to any of the queues, with the lock held
+func (q *Queues) loggedIn(a *agent) bool {
+	for _, qu := range q.queues {
+		if qu.has(a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notifyAll - wakes the callers of every queue to see whether an agent is free for them, with the lock held
+func (q *Queues) notifyAll() {
+	for _, qu := range q.queues {
+		qu.notify()
+	}
+}
+
+// release - an agent is done with an offer: it was withdrawn, they missed it, or they took it and have hung up
+func (q *Queues) release(a *agent, missed bool, talked bool) {
+	if a == nil {
+		// the number the caller overflowed to
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	a.busy = false
+	if missed {
+		a.restUntil = time.Now().Add(agentRestTime)
+		time.AfterFunc(agentRestTime, func() {
+			q.Lock()
+			defer q.Unlock()
+			q.notifyAll()
+		})
+	}
+	if talked {
+		a.idleSince = time.Now()
+	}
+	q.notifyAll()
+}
+
+// wait - answers the caller and holds them in the queue until an agent takes the call, they hang up, or they overflow
+func (q *Queues) wait(qu *queue, fsm *SipFsm, invite ports.SipMessage, send ports.SendResponseCallback) CallHandler {
+	return func(call *Call, sipMsg ports.SipMessage) error {
+		qc := &queuedCall{
+			queues: q,
+			queue:  qu,
+			call:   call,
+			legs:   map[*bridgeLeg]bool{},
+			offers: map[*bridgeLeg]*agent{},
+			wake:   make(chan struct{}, 1),
+		}
+		qc.br = q.b2bua.queue(fsm, invite, send, call, qc)
+
+		hold, err := q.hold(call, qu)
+		if err != nil {
+			qc.br.finish()
+			return err
+		}
+
+		q.Lock()
+		qu.waiting = append(qu.waiting, qc)
+		position := len(qu.waiting)
+		q.Unlock()
+		fmt.Printf("queue %s: %s is waiting, %d in the queue\n", qu.Number, addrString(sipMsg.GetFrom()), position)
+
+		outcome := make(chan string, 1)
+		go func() {
+			outcome <- q.run(qc, hold)
+			hold.stop()
+		}()
+
+		err = call.Play(hold)
+		switch <-outcome {
+		case queueAnswered:
+			return qc.connect(sipMsg)
+		case queueTimedOut:
+			return q.overflow(qu, fsm, invite, send)(call, sipMsg)
+		case queueFailed:
+			return call.Hangup()
+		}
+
+		return err
+	}
+}
+
+// hold - what the caller hears while they wait, the queue's music or failing that ringback
+func (q *Queues) hold(call *Call, qu *queue) (*holdReader, error) {
+	if qu.Music != "" {
+		filename := filepath.Join(q.cfg.MediaDir, qu.Music)
+		if reader, err := call.OpenWav(filename); err != nil {
+			fmt.Printf("queue %s: can't play %s, playing ringback: %v\n", qu.Number, filename, err)
+		} else {
+			reader.Close()
+			return &holdReader{music: call.NewPlaylist(LoopForever, call.FileSource(filename))}, nil
+		}
+	}
+
+	ringback, err := call.PlanTone(ToneRingback, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &holdReader{music: ringback}, nil
+}
+
+// run - offers the call to agents as they come free, tells the caller their place now and then, and gives up on the queue at the
+// timeout, when the caller overflows. Returns how the wait ended
+func (q *Queues) run(qc *queuedCall, hold *holdReader) string {
+	qu := qc.queue
+
+	var timeout <-chan time.Time
+	if qu.TimeoutSeconds > 0 {
+		timer := time.NewTimer(time.Duration(qu.TimeoutSeconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var announce <-chan time.Time
+	if qu.AnnounceSeconds > 0 {
+		ticker := time.NewTicker(time.Duration(qu.AnnounceSeconds) * time.Second)
+		defer ticker.Stop()
+		announce = ticker.C
+		q.announce(qc, hold)
+	}
+
+	overflowing := false
+	for {
+		var changed <-chan struct{}
+		if !overflowing {
+			changed = q.dispatch(qc)
+		}
+
+		select {
+		case <-qc.call.Done():
+			if qc.answered() {
+				// the caller hung up just as an agent answered, the bridge hangs up on the agent
+				q.leave(qc)
+				return queueAnswered
+			}
+			q.giveUp(qc)
+			fmt.Printf("queue %s: caller hung up\n", qu.Number)
+			return queueHungUp
+
+		case <-qc.wake:
+			if qc.answered() {
+				q.leave(qc)
+				return queueAnswered
+			}
+			if overflowing && !qc.offering() {
+				fmt.Printf("queue %s: %s didn't answer the overflow either\n", qu.Number, qu.OverflowNumber)
+				q.giveUp(qc)
+				return queueFailed
+			}
+
+		case <-changed:
+
+		case <-announce:
+			q.announce(qc, hold)
+
+		case <-timeout:
+			fmt.Printf("queue %s: caller waited too long\n", qu.Number)
+			q.leave(qc)
+			qc.withdraw()
+
+			// a number that isn't another queue is offered the call like an agent, with the caller still on hold
+			_, isQueue := q.queues[qu.OverflowNumber]
+			if qu.OverflowNumber == "" || isQueue {
+				q.giveUp(qc)
+				return queueTimedOut
+			}
+
+			target, ok := q.b2bua.route(qu.OverflowNumber)
+			if !ok {
+				fmt.Printf("queue %s: can't reach overflow %s\n", qu.Number, qu.OverflowNumber)
+				q.giveUp(qc)
+				return queueFailed
+			}
+			fmt.Printf("queue %s: overflowing to %s\n", qu.Number, target.uri)
+			if err := qc.offer(target, nil); err != nil {
+				fmt.Printf("queue %s: error calling overflow %s: %v\n", qu.Number, qu.OverflowNumber, err)
+				q.giveUp(qc)
+				return queueFailed
+			}
+			overflowing = true
+			timeout, announce = nil, nil
+		}
+	}
+}
+
+// dispatch - offers the call to the agents the queue's strategy picks, once everyone ahead of the caller is being offered to someone
+// and nobody is being offered this call yet, or has taken it. Returns what is closed when that could have changed
+func (q *Queues) dispatch(qc *queuedCall) <-chan struct{} {
+	qu := qc.queue
+
+	q.Lock()
+	changed := qu.changed
+	var agents []*agent
+	if qu.nextUp(qc) && qc.unserved() {
+		agents = qu.pick(q.registrar)
+	}
+	q.Unlock()
+
+	for _, a := range agents {
+		target, ok := q.b2bua.route(a.user)
+		if !ok || target.user != a.user {
+			// they unregistered since we picked them
+			q.release(a, false, false)
+			continue
+		}
+
+		fmt.Printf("queue %s: offering a call to %s\n", qu.Number, a.user)
+		if err := qc.offer(target, a); err != nil {
+			fmt.Printf("queue %s: error calling %s: %v\n", qu.Number, a.user, err)
+			q.release(a, true, false)
+		}
+	}
+
+	return changed
+}
+
+// announce - tells the caller their place in the queue, a beep for each place, which pauses the music while it plays
+func (q *Queues) announce(qc *queuedCall, hold *holdReader) {
+	position := q.position(qc)
+	if position == 0 {
+		return
+	}
+	if position > queueMaxAnnouncedPosition {
+		position = queueMaxAnnouncedPosition
+	}
+
+	reader, err := q.beeps(qc.call, position)
+	if err != nil {
+		fmt.Printf("queue %s: error announcing a caller's place: %v\n", qc.queue.Number, err)
+		return
+	}
+	hold.announce(reader)
+}
+
+// position - the caller's place in the queue, from 1, or 0 once they have left it
+func (q *Queues) position(qc *queuedCall) int {
+	q.Lock()
+	defer q.Unlock()
+
+	for i, other := range qc.queue.waiting {
+		if other == qc {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// leave - takes the caller out of the queue, which lets the caller behind them have the next agent
+func (q *Queues) leave(qc *queuedCall) {
+	q.Lock()
+	defer q.Unlock()
+
+	qu := qc.queue
+	for i, other := range qu.waiting {
+		if other == qc {
+			qu.waiting = append(qu.waiting[:i], qu.waiting[i+1:]...)
+			break
+		}
+	}
+	qu.notify()
+}
+
+// giveUp - the caller is done waiting for an agent, they hung up or are moving on. Anyone still ringing stops, and the bridge goes
+func (q *Queues) giveUp(qc *queuedCall) {
+	qc.Lock()
+	qc.over = true
+	qc.Unlock()
+
+	q.leave(qc)
+	qc.withdraw()
+	qc.br.finish()
+}
+
+// overflow - where the caller goes once they have waited too long: the queue's mailbox, or another queue. Without either, or with
+// voicemail disabled, they are hung up on
+func (q *Queues) overflow(qu *queue, fsm *SipFsm, invite ports.SipMessage, send ports.SendResponseCallback) CallHandler {
+	if next, ok := q.queues[qu.OverflowNumber]; ok {
+		fmt.Printf("queue %s: overflowing to queue %s\n", qu.Number, next.Number)
+		return q.wait(next, fsm, invite, send)
+	}
+	if qu.OverflowMailbox != "" && q.voicemail != nil {
+		fmt.Printf("queue %s: overflowing to %s's voicemail\n", qu.Number, qu.OverflowMailbox)
+		return q.voicemail.leaveMessage(qu.OverflowMailbox)
+	}
+
+	return func(call *Call, sipMsg ports.SipMessage) error {
+		return call.Hangup()
+	}
+}
+
+// queue - a queue's agents and waiting callers, guarded by the lock of the queues
+type queue struct {
+	CallQueue
+	// the agents logged in to the queue, in the order they logged in, which round robin goes around
+	members []*agent
+	// the member after the one round robin offered the last call to
+	next int
+	// the callers, longest waiting first
+	waiting []*queuedCall
+	// closed, and replaced, whenever an agent could have come free or a caller has left
+	changed chan struct{}
+}
+
+// notify - wakes the callers waiting in the queue
+func (qu *queue) notify() {
+	close(qu.changed)
+	qu.changed = make(chan struct{})
+}
+
+// has - whether the agent is logged in to the queue
+func (qu *queue) has(a *agent) bool {
+	for _, member := range qu.members {
+		if member == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextUp - whether the caller can be offered to an agent, which they can once everyone ahead of them is being offered to someone
+func (qu *queue) nextUp(qc *queuedCall) bool {
+	for _, other := range qu.waiting {
+		if other == qc {
+			return true
+		}
+		if other.unserved() {
+			return false
+		}
+	}
+
+	return false
+}
+
+// pick - the agents the next call is offered to, by the queue's strategy, who are then busy with it
+func (qu *queue) pick(registrar *Registrar) []*agent {
+	now := time.Now()
+	free := func(a *agent) bool {
+		if !a.available(now) {
+			return false
+		}
+		binding, ok := registrar.Lookup(a.user)
+		return ok && binding.Contact != nil && binding.Send != nil
+	}
+
+	var picked []*agent
+	switch qu.Strategy {
+	case QueueRoundRobin:
+		for i := range qu.members {
+			index := (qu.next + i) % len(qu.members)
+			if a := qu.members[index]; free(a) {
+				picked = []*agent{a}
+				qu.next = index + 1
+				break
+			}
+		}
+	case QueueLongestIdle:
+		for _, a := range qu.members {
+			if free(a) && (len(picked) == 0 || a.idleSince.Before(picked[0].idleSince)) {
+				picked = []*agent{a}
+			}
+		}
+	default:
+		for _, a := range qu.members {
+			if free(a) {
+				picked = append(picked, a)
+			}
+		}
+	}
+
+	for _, a := range picked {
+		a.busy = true
+	}
+
+	return picked
+}
+
+// agent - a user logged in to one or more queues, guarded by the lock of the queues
+type agent struct {
+	user   string
+	paused bool
+	// being offered a call from one of the queues, or on one
+	busy bool
+	// when they last hung up on a queue call, or logged in, for longest idle
+	idleSince time.Time
+	// they turned down the last call they were offered, or didn't answer it, so they are left alone until then
+	restUntil time.Time
+}
+
+// available - whether the agent can be offered a call
+func (a *agent) available(now time.Time) bool {
+	return !a.paused && !a.busy && !now.Before(a.restUntil)
+}
+
+// queuedCall - a caller waiting in a queue, and the calls to the agents they are being offered to
+type queuedCall struct {
+	sync.Mutex
+	queues *Queues
+	queue  *queue
+	br     *bridge
+	call   *Call
+	// every leg we offered the call on, and the agent each is ringing while it still is, nil for the number they overflowed to
+	legs   map[*bridgeLeg]bool
+	offers map[*bridgeLeg]*agent
+	// who took the call
+	winner *bridgeLeg
+	// set once the caller is done waiting, after which an answer is too late
+	over bool
+	// woken when an offer is answered, or fails
+	wake chan struct{}
+}
+
+// offer - rings the target with the call, an agent or the number the caller overflowed to
+func (qc *queuedCall) offer(target *bridgeTarget, a *agent) error {
+	b := qc.br.b2bua
+	leg, err := b.call(qc.br.invite, target)
+	if err != nil {
+		return err
+	}
+
+	qc.Lock()
+	qc.legs[leg] = true
+	qc.offers[leg] = a
+	qc.Unlock()
+	b.addLeg(qc.br, leg)
+
+	if err := leg.sendMsg(leg.out); err != nil {
+		qc.Lock()
+		delete(qc.offers, leg)
+		qc.Unlock()
+		leg.close()
+		return err
+	}
+
+	ringTime := b.ringTime()
+	if qc.queue.RingSeconds > 0 {
+		ringTime = time.Duration(qc.queue.RingSeconds) * time.Second
+	}
+	go leg.ring(target.transport == ports.TransportUDP, ringTime, func() bool { return qc.ringing(leg) }, func() {
+		fmt.Printf("queue %s: %s didn't answer\n", qc.queue.Number, target.uri)
+		qc.end(leg, true)
+		if err := leg.cancel(); err != nil {
+			fmt.Printf("queue %s: error cancelling call %s: %v\n", qc.queue.Number, leg.out.GetCallID(), err)
+		}
+	})
+
+	return nil
+}
+
+// offered - whether the leg is one of the offers of the call
+func (qc *queuedCall) offered(leg *bridgeLeg) bool {
+	qc.Lock()
+	defer qc.Unlock()
+
+	return qc.legs[leg]
+}
+
+// ringing - whether the offer on the leg is still waiting for an answer
+func (qc *queuedCall) ringing(leg *bridgeLeg) bool {
+	qc.Lock()
+	defer qc.Unlock()
+
+	_, ok := qc.offers[leg]
+	return ok
+}
+
+// offering - whether the call is ringing anyone
+func (qc *queuedCall) offering() bool {
+	qc.Lock()
+	defer qc.Unlock()
+
+	return len(qc.offers) > 0
+}
+
+// unserved - whether the call is waiting for an offer: nobody is being offered it, nobody has taken it and the caller hasn't gone
+func (qc *queuedCall) unserved() bool {
+	qc.Lock()
+	defer qc.Unlock()
+
+	return len(qc.offers) == 0 && qc.winner == nil && !qc.over
+}
+
+// answered - whether someone took the call
+func (qc *queuedCall) answered() bool {
+	qc.Lock()
+	defer qc.Unlock()
+
+	return qc.winner != nil
+}
+
+// end - the offer on the leg is over without being taken. The agent is left alone for a while if it was theirs to take
+func (qc *queuedCall) end(leg *bridgeLeg, missed bool) {
+	qc.Lock()
+	a, ok := qc.offers[leg]
+	delete(qc.offers, leg)
+	missed = missed && qc.winner == nil && !qc.over
+	qc.Unlock()
+	if !ok {
+		return
+	}
+
+	qc.queues.release(a, missed, false)
+	qc.wakeUp()
+}
+
+// withdraw - stops every offer that is still ringing
+func (qc *queuedCall) withdraw() {
+	qc.Lock()
+	var legs []*bridgeLeg
+	for leg := range qc.offers {
+		legs = append(legs, leg)
+	}
+	qc.Unlock()
+
+	for _, leg := range legs {
+		qc.end(leg, false)
+		if err := leg.cancel(); err != nil {
+			fmt.Printf("queue %s: error cancelling call %s: %v\n", qc.queue.Number, leg.out.GetCallID(), err)
+		}
+	}
+}
+
+func (qc *queuedCall) wakeUp() {
+	select {
+	case qc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// handleResponse - a response to one of the offers. The first to answer takes the call, everyone else still ringing is cancelled, and
+// anyone answering too late is hung up on
+func (qc *queuedCall) handleResponse(leg *bridgeLeg, response ports.SipMessage) {
+	status := response.GetStatus()
+	if status < 200 {
+		// the caller is on hold, they don't hear it ringing
+		return
+	}
+	// every final response is acknowledged, a 2xx is sent again until it is
+	leg.acknowledge(response)
+
+	qc.Lock()
+	a, ringing := qc.offers[leg]
+	won := ringing && status < 300 && qc.winner == nil && !qc.over
+	if won {
+		qc.winner = leg
+		delete(qc.offers, leg)
+	}
+	winner := qc.winner
+	var others []*bridgeLeg
+	if won {
+		for other := range qc.offers {
+			others = append(others, other)
+		}
+	}
+	qc.Unlock()
+
+	switch {
+	case leg == winner && !won:
+		// they sent their answer again
+		return
+	case status >= 300:
+		if ringing {
+			fmt.Printf("queue %s: %s turned down the call with %d\n", qc.queue.Number, leg.target.uri, status)
+		}
+		qc.end(leg, true)
+		return
+	case !won:
+		// someone else took it, or the caller has gone
+		leg.hangupWith(response)
+		leg.close()
+		qc.end(leg, false)
+		return
+	}
+
+	fmt.Printf("queue %s: %s answered\n", qc.queue.Number, leg.target.uri)
+	leg.setAnswer(response)
+
+	// the call is theirs now, so the bridge takes it from here, their BYE included
+	qc.br.Lock()
+	qc.br.callee = leg
+	qc.br.state = bridgeAnswered
+	qc.br.Unlock()
+
+	// they are free for the next call once they are done with this one, however it ends, ie transferred on
+	go func() {
+		<-leg.call.Done()
+		qc.queues.release(a, false, true)
+	}()
+
+	for _, other := range others {
+		qc.end(other, false)
+		if err := other.cancel(); err != nil {
+			fmt.Printf("queue %s: error cancelling call %s: %v\n", qc.queue.Number, other.out.GetCallID(), err)
+		}
+	}
+	qc.wakeUp()
+}
+
+// connect - relays the media between the caller and whoever took the call, until one of them hangs up
+func (qc *queuedCall) connect(sipMsg ports.SipMessage) error {
+	qc.Lock()
+	leg := qc.winner
+	qc.Unlock()
+
+	leg.Lock()
+	answer := leg.answer
+	leg.Unlock()
+
+	if err := leg.call.Connect(answer); err != nil {
+		qc.br.hangupCallee()
+		return err
+	}
+
+	return qc.br.relay(qc.call, sipMsg)
+}
+
+// holdReader - what a caller waiting in a queue hears: the music, paused for the announcements of their place, until they are taken
+// off hold
+type holdReader struct {
+	sync.Mutex
+	music        ports.MediaReader
+	announcement ports.MediaReader
+	stopped      bool
+}
+
+// NextRtpFrame - the next frame of the announcement, or of the music when there isn't one
+func (h *holdReader) NextRtpFrame() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.stopped {
+		return nil, io.EOF
+	}
+
+	if h.announcement != nil {
+		frame, err := h.announcement.NextRtpFrame()
+		if err == nil {
+			return frame, nil
+		}
+		h.announcement = nil
+	}
+
+	return h.music.NextRtpFrame()
+}
+
+// announce - plays the reader instead of the music until it runs out
+func (h *holdReader) announce(reader ports.MediaReader) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.announcement = reader
+}
+
+// stop - ends the hold, which ends the Play it is in
+func (h *holdReader) stop() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.stopped = true
+	if closer, ok := h.music.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,159 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"sip_and_rip/ports"
+)
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// RecordingMetadata - the sidecar json written next to every recording
+type RecordingMetadata struct {
+	CallID       string    `json:"callId"`
+	Caller       string    `json:"caller"`
+	Callee       string    `json:"callee"`
+	Codec        string    `json:"codec"`
+	SampleRateHz int       `json:"sampleRateHz"`
+	WavFile      string    `json:"wavFile"`
+	StartedAt    time.Time `json:"startedAt"`
+	EndedAt      time.Time `json:"endedAt"`
+	Packets      uint32    `json:"packets"`
+	LostPackets  uint32    `json:"lostPackets"`
+	// frames the jitter buffer made up, in whole or part, to cover for packets that were lost or late
+	ConcealedFrames uint32 `json:"concealedFrames"`
+	// how the audio held up in each direction, from rtcp
+	Quality *CallQuality `json:"quality,omitempty"`
+}
+
+// CallRecorder - records the caller's inbound audio to a .wav file
+type CallRecorder struct {
+	sync.Mutex
+	id           string
+	receiver     ports.RtpReceiver
+	writer       ports.MediaWriter
+	metadata     RecordingMetadata
+	metadataPath string
+	stopped      bool
+}
+
+// NewCallRecorder - creates a recording in the directory. Feed it the caller's audio with HandleFrame
+func NewCallRecorder(dir string, sipMsg ports.SipMessage, receiver ports.RtpReceiver, factories *ports.Factories) (*CallRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating recording dir %s: %v", dir, err)
+	}
+
+	startedAt := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s", startedAt.Format("20060102T150405Z"), unsafeFilenameChars.ReplaceAllString(sipMsg.GetCallID(), "_"))
+	wavPath := filepath.Join(dir, name+".wav")
+
+	// g711 is the only thing we negotiate, and it is always 8000hz mono
+	sampleRateHz := 8000
+	writer, err := factories.NewWavWriter(wavPath, sampleRateHz, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error creating wav file %s: %v", wavPath, err)
+	}
+
+	r := &CallRecorder{
+		id:           name,
+		receiver:     receiver,
+		writer:       writer,
+		metadataPath: filepath.Join(dir, name+".json"),
+		metadata: RecordingMetadata{
+			CallID:       sipMsg.GetCallID(),
+			Caller:       addrString(sipMsg.GetFrom()),
+			Callee:       addrString(sipMsg.GetTo()),
+			SampleRateHz: sampleRateHz,
+			WavFile:      filepath.Base(wavPath),
+			StartedAt:    startedAt,
+		},
+	}
+
+	fmt.Printf("recording call %s to %s\n", sipMsg.GetCallID(), wavPath)
+
+	return r, nil
+}
+
+// ID - the name of the recording, without an extension
+func (r *CallRecorder) ID() string {
+	return r.id
+}
+
+// Packets - the number of packets recorded so far
+func (r *CallRecorder) Packets() uint32 {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.metadata.Packets
+}
+
+// Stop - stops recording, finishes the .wav file and writes the sidecar json, along with the call's quality if we know it
+func (r *CallRecorder) Stop(quality *CallQuality) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.stopped {
+		return nil
+	}
+	r.stopped = true
+
+	r.metadata.EndedAt = time.Now().UTC()
+	r.metadata.LostPackets = r.receiver.Lost()
+	r.metadata.Quality = quality
+
+	if err := r.writer.Close(); err != nil {
+		return fmt.Errorf("error closing wav file: %v", err)
+	}
+
+	b, err := json.MarshalIndent(r.metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(r.metadataPath, b, 0o644); err != nil {
+		return fmt.Errorf("error writing recording metadata %s: %v", r.metadataPath, err)
+	}
+
+	fmt.Printf("finished recording call %s: %d packets, %d lost\n", r.metadata.CallID, r.metadata.Packets, r.metadata.LostPackets)
+
+	return nil
+}
+
+// HandleFrame - writes a frame of the caller's audio. The jitter buffer has already put it in order and covered any gaps, so the recording keeps its timing
+func (r *CallRecorder) HandleFrame(frame *AudioFrame) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.stopped {
+		return
+	}
+
+	if err := r.writer.WriteSamples(frame.Samples); err != nil {
+		fmt.Println("CallRecorder: error writing samples: ", err)
+		return
+	}
+
+	if frame.Concealed {
+		r.metadata.ConcealedFrames++
+	} else {
+		r.metadata.Packets++
+	}
+	r.metadata.Codec = frame.Codec
+}
+
+// addrString - the uri of a sip address without its display name or params
+func addrString(addr *sip.Addr) string {
+	if addr == nil || addr.Uri == nil {
+		return ""
+	}
+
+	return addr.Uri.String()
+}
@@ -0,0 +1,231 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"sip_and_rip/ports"
+)
+
+// Binding - where a registered address of record (AoR) can currently be reached
+type Binding struct {
+	// the address of record, ie sip:alice@example.com
+	Aor     string
+	Contact *sip.Addr
+	// the address the REGISTER actually came from, what it came in on, and how to send to it there. Over tls and websockets that is
+	// the connection the phone registered on, since it is the only way back to it
+	Source    *net.UDPAddr
+	Transport string
+	Send      ports.SendResponseCallback
+	ExpiresAt time.Time
+	// the contact's preference among the AoR's contacts, from 0 to 1 (rfc 3261 10.2.1.2), and when it registered
+	Q            float64
+	RegisteredAt time.Time
+}
+
+// Registrar - keeps track of the registered users by the user part of their AoR. A user can have a contact for each of their phones
+type Registrar struct {
+	sync.RWMutex
+	bindings map[string][]*Binding
+}
+
+// NewRegistrar - creates an empty registrar
+func NewRegistrar() *Registrar {
+	return &Registrar{
+		bindings: make(map[string][]*Binding),
+	}
+}
+
+// Register - adds or refreshes the binding for a REGISTER request, which came from the source and is answered with send
+func (r *Registrar) Register(sipMsg ports.SipMessage, source *net.UDPAddr, send ports.SendResponseCallback) error {
+	user := aorUser(sipMsg.GetTo())
+	if user == "" {
+		return fmt.Errorf("REGISTER has no user in its To header")
+	}
+
+	now := time.Now()
+	binding := &Binding{
+		Aor:          addrString(sipMsg.GetTo()),
+		Contact:      natContact(sipMsg.GetContact(), source),
+		Source:       source,
+		Transport:    sipMsg.GetTransport(),
+		Send:         send,
+		ExpiresAt:    now.Add(time.Duration(sipMsg.GetExpires()) * time.Second),
+		Q:            contactQ(sipMsg.GetContact()),
+		RegisteredAt: now,
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	// a refresh replaces the phone's binding, anything else is another phone
+	bindings := r.without(user, binding.Contact)
+	r.bindings[user] = append(bindings, binding)
+
+	return nil
+}
+
+// Unregister - removes the binding for a REGISTER request with a 0 expiration, or all of the user's bindings for a Contact of *
+func (r *Registrar) Unregister(sipMsg ports.SipMessage) {
+	user := aorUser(sipMsg.GetTo())
+	contact := sipMsg.GetContact()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if contact == nil || contact.Uri == nil || contact.Uri.Host == "*" {
+		delete(r.bindings, user)
+		return
+	}
+
+	bindings := r.without(user, natContact(contact, sipMsg.GetSource()))
+	if len(bindings) == 0 {
+		delete(r.bindings, user)
+		return
+	}
+	r.bindings[user] = bindings
+}
+
+// Lookup - finds the binding for a user, if they are registered and it hasn't expired. With more than one, it is the one they prefer
+func (r *Registrar) Lookup(user string) (*Binding, bool) {
+	bindings := r.LookupAll(user)
+	if len(bindings) == 0 {
+		return nil, false
+	}
+
+	return bindings[0], true
+}
+
+// LookupAll - the user's bindings that haven't expired, the one they prefer most first and the most recent first between equals
+func (r *Registrar) LookupAll(user string) []*Binding {
+	r.RLock()
+	defer r.RUnlock()
+
+	now := time.Now()
+	var bindings []*Binding
+	for _, binding := range r.bindings[user] {
+		if now.Before(binding.ExpiresAt) {
+			bindings = append(bindings, binding)
+		}
+	}
+
+	sort.SliceStable(bindings, func(i, j int) bool {
+		if bindings[i].Q != bindings[j].Q {
+			return bindings[i].Q > bindings[j].Q
+		}
+		return bindings[i].RegisteredAt.After(bindings[j].RegisteredAt)
+	})
+
+	return bindings
+}
+
+// LookupSource - the binding of the phone that registered from the address, if there is one that hasn't expired
+func (r *Registrar) LookupSource(addr *net.UDPAddr) (*Binding, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	now := time.Now()
+	for _, bindings := range r.bindings {
+		for _, binding := range bindings {
+			if binding.Source != nil && binding.Source.IP.Equal(addr.IP) && binding.Source.Port == addr.Port && now.Before(binding.ExpiresAt) {
+				return binding, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// IsRegisteredFrom - whether the address is where one of the user's phones registered from, ie to trust the request came from them
+// rather than from anyone who put their name in a From header
+func (r *Registrar) IsRegisteredFrom(user string, addr *net.UDPAddr) bool {
+	if user == "" || addr == nil {
+		return false
+	}
+
+	for _, binding := range r.LookupAll(user) {
+		if binding.Source != nil && binding.Source.IP.Equal(addr.IP) && binding.Source.Port == addr.Port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// without - the user's bindings other than the contact's, dropping any that have expired. The lock must be held
+func (r *Registrar) without(user string, contact *sip.Addr) []*Binding {
+	now := time.Now()
+	var bindings []*Binding
+	for _, binding := range r.bindings[user] {
+		if now.After(binding.ExpiresAt) || sameContact(binding.Contact, contact) {
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+
+	return bindings
+}
+
+// sameContact - whether two contacts are the same phone, by their uris without params
+func sameContact(a *sip.Addr, b *sip.Addr) bool {
+	if a == nil || b == nil || a.Uri == nil || b.Uri == nil {
+		return a == b
+	}
+
+	return a.Uri.User == b.Uri.User && a.Uri.CompareHostPort(b.Uri)
+}
+
+// contactQ - the q param of a contact, 1 when it doesn't have one or it isn't a number between 0 and 1
+func contactQ(contact *sip.Addr) float64 {
+	if contact == nil {
+		return 1
+	}
+	param := contact.Param.Get("q")
+	if param == nil {
+		return 1
+	}
+
+	q, err := strconv.ParseFloat(param.Value, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 1
+	}
+
+	return q
+}
+
+// natContact - a phone behind NAT registers its private address, which we can't reach. When the REGISTER came from somewhere else we
+// point the binding at the address it came from instead, since that is the hole in the NAT its keep alives hold open
+func natContact(contact *sip.Addr, source *net.UDPAddr) *sip.Addr {
+	if contact == nil || contact.Uri == nil || source == nil {
+		return contact
+	}
+
+	port := int(contact.Uri.Port)
+	if port == 0 {
+		port = 5060
+	}
+	if contact.Uri.Host == source.IP.String() && port == source.Port {
+		return contact
+	}
+
+	fixed := contact.Copy()
+	fixed.Uri.Host = source.IP.String()
+	fixed.Uri.Port = uint16(source.Port)
+
+	return fixed
+}
+
+// aorUser - the user part of an address, which is what we key registrations and mailboxes by
+func aorUser(addr *sip.Addr) string {
+	if addr == nil || addr.Uri == nil {
+		return ""
+	}
+
+	return addr.Uri.User
+}
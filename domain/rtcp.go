@@ -1,130 +1,532 @@
 package domain
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	mrand "math/rand"
 	"net"
+	"sync"
 	"time"
 
-	"github.com/beevik/ntp"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"sip_and_rip/ports"
 )
 
-func buildRtcpPacket(ssrc uint32, timestampOffset uint32, packetsSinceLastRtcp uint32, payloadOctectCount uint32) ([]byte, error) {
-	t, err := ntp.Time("0.beevik-ntp.pool.ntp.org")
-	if err != nil {
-		fmt.Println(err)
-		return nil, err
+// the seconds between the ntp epoch (1900) and the unix one (1970)
+const ntpEpochOffset = 2208988800
+
+// rtcp gets 5% of the session bandwidth (rfc 3550 6.2)
+const rtcpBandwidthFraction = 0.05
+
+// the shortest time between reports. The first report only waits half of it, so the other side hears from us quickly (rfc 3550 6.2)
+const rtcpMinInterval = 5 * time.Second
+
+// every rtcp packet also carries a udp and ip header, which count towards its size (rfc 3550 6.3.1)
+const rtcpHeaderOverhead = 28
+
+// RtcpSession - the rtcp for one of our calls. Sends an SR+SDES compound at the rfc 3550 interval and a BYE when it ends, and reads the
+// caller's reports to keep track of the call's quality
+type RtcpSession struct {
+	sync.Mutex
+	conn       ports.MediaConn
+	remoteAddr *net.UDPAddr
+	// protects the reports when the call negotiated srtp, nil for plain rtcp
+	srtp   ports.SrtpSession
+	client ports.RtpClient
+	cname  string
+	// the rtp bandwidth of the session in octets per second, which the report interval is a share of
+	sessionBandwidth float64
+	frameMs          int
+	// the extended reports the answer agreed we send, and the jitter buffer the caller's audio goes through for them
+	xr           rtcpXrConfig
+	jitterBuffer *JitterBuffer
+	// the running average size of the compound packets we send, including their udp and ip headers
+	avgPacketSize float64
+	// our measurements of the caller's rtp, and what their reports said about ours
+	reception receptionStats
+	quality   CallQuality
+	// the ssrc the caller's rtcp comes from once we have latched on to it
+	remoteSsrc uint32
+	latched    bool
+	listening  bool
+	started    bool
+	done       chan struct{}
+	readDone   chan struct{}
+	closed     bool
+}
+
+// NewRtcpSession - creates the rtcp session for a call. The conn is our rtcp socket, the port above the rtp one, or the rtcp half of
+// the rtp one when they are multiplexed
+func NewRtcpSession(conn ports.MediaConn, cname string) *RtcpSession {
+	return &RtcpSession{
+		conn:  conn,
+		cname: cname,
+		// a guess until we have sent something, roughly an SR and SDES
+		avgPacketSize: 80 + rtcpHeaderOverhead,
+		// g711 and telephone-event both count 8000 a second, until the answer tells us otherwise
+		reception: receptionStats{clockRateHz: 8000},
+		done:      make(chan struct{}),
+		readDone:  make(chan struct{}),
 	}
-	ntpTime := uint64(t.Unix())
+}
 
-	sr := &rtcp.SenderReport{
-		SSRC:    ssrc,
-		NTPTime: ntpTime,
-		// TODO unclear if this is the right way to calculate the RTP timestamp
-		RTPTime:           timestampOffset + uint32(ntpTime),
-		PacketCount:       packetsSinceLastRtcp,
-		OctetCount:        payloadOctectCount,
-		Reports:           []rtcp.ReceptionReport{},
-		ProfileExtensions: []byte{},
+// SetSrtp - sends and reads the reports as srtcp. Must be called before Listen
+func (s *RtcpSession) SetSrtp(session ports.SrtpSession) {
+	s.srtp = session
+}
+
+// Listen - reads the caller's rtcp until the session is closed
+func (s *RtcpSession) Listen() {
+	s.Lock()
+	s.listening = true
+	s.Unlock()
+
+	go s.read()
+}
+
+// Start - sends reports about the client's stream to the address until the session is closed
+func (s *RtcpSession) Start(remoteAddr *net.UDPAddr, client ports.RtpClient, opts *ports.MediaOptions) {
+	s.Lock()
+	// their rtcp may have beaten our answer, in which case we already know where it really comes from
+	if !s.latched {
+		s.remoteAddr = remoteAddr
 	}
+	s.client = client
+	// every packet also carries ip, udp and rtp headers
+	s.sessionBandwidth = float64(opts.GetFramesPerSecond() * (opts.GetBufferSize() + 40))
+	s.frameMs = 1000 / opts.GetFramesPerSecond()
+	s.reception.clockRateHz = client.Stats().ClockRateHz
+	s.started = true
+	s.Unlock()
+
+	go func() {
+		initial := true
+		for {
+			timer := time.NewTimer(s.interval(initial))
+			initial = false
 
-	return sr.Marshal()
+			select {
+			case <-s.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if err := s.send(s.report()); err != nil {
+				fmt.Printf("RtcpSession: error sending report to %s: %v\n", s.RemoteAddr(), err)
+			}
+		}
+	}()
 }
 
-// should send an RTCP report to be 5% of the session bandwidth, so every 20~ packets
-func startRtcp(remoteAddr *net.UDPAddr) error {
-	// TODO grab this info from the rtp
-	ssrc := uint32(0)
-	timestampOffset := uint32(0)
-	packetsSinceLastRtcp := uint32(0)
-	payloadOctectCount := uint32(0)
+// SetRemoteAddr - sends the rest of the reports somewhere new, ie after a re-INVITE. Ignored once we know where their rtcp really comes from
+func (s *RtcpSession) SetRemoteAddr(addr *net.UDPAddr) {
+	s.Lock()
+	defer s.Unlock()
 
-	// Set up UDP listener for incoming SIP messages
-	fmt.Println("listening for RTCP on:", remoteAddr.Port)
-	localAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("0.0.0.0:%d", remoteAddr.Port))
-	if err != nil {
-		return err
+	if !s.latched {
+		s.remoteAddr = addr
 	}
+}
 
-	conn, err := net.ListenUDP("udp", localAddr)
-	if err != nil {
-		return err
+// SetLocalSdp - picks up which extended reports our answer agreed to send
+func (s *RtcpSession) SetLocalSdp(localSdp ports.SdpMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.xr = newRtcpXrConfig(localSdp)
+}
+
+// SetJitterBuffer - the jitter buffer the caller's audio goes through, which the extended reports describe
+func (s *RtcpSession) SetJitterBuffer(jitterBuffer *JitterBuffer) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.jitterBuffer = jitterBuffer
+}
+
+// RemoteAddr - where the reports are sent
+func (s *RtcpSession) RemoteAddr() *net.UDPAddr {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.remoteAddr
+}
+
+// HandleRtp - measures the caller's rtp for our reception reports. It wants packets as they arrive, before they are put in order
+func (s *RtcpSession) HandleRtp(pkt *rtp.Packet) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.reception.handlePacket(pkt, time.Now())
+}
+
+// Quality - how the call's audio is holding up so far
+func (s *RtcpSession) Quality() CallQuality {
+	s.Lock()
+	defer s.Unlock()
+
+	quality := s.quality
+	quality.FractionLost = s.reception.fractionLost()
+	quality.CumulativeLost = s.reception.cumulativeLost()
+	quality.JitterMs = s.reception.jitterMs()
+
+	// our guess at how each side heard the other
+	if s.reception.started {
+		delay := oneWayDelayMs(quality.RoundTripMs, s.frameMs, quality.JitterMs)
+		bursts := s.reception.bursts.snapshot()
+		quality.RFactor = eModel(quality.FractionLost, bursts.burstRatio(), delay)
+		quality.MOS = mosFromR(quality.RFactor)
+	}
+	if s.client != nil && quality.ReportsReceived > 0 {
+		lossFraction := 0.0
+		if sent := s.client.Stats().PacketCount; sent > 0 && quality.RemoteCumulativeLost > 0 {
+			lossFraction = math.Min(float64(quality.RemoteCumulativeLost)/float64(sent), 1)
+		}
+		delay := oneWayDelayMs(quality.RoundTripMs, s.frameMs, quality.RemoteJitterMs)
+		quality.RemoteRFactor = eModel(lossFraction, 1, delay)
+		quality.RemoteMOS = mosFromR(quality.RemoteRFactor)
 	}
-	defer conn.Close()
 
-	// TODO remove
-	time.Sleep(5 * time.Second)
+	return quality
+}
 
-	go func() {
-		buf := make([]byte, 10*1024*1024)
-		for {
-			n, addr, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				fmt.Println("RTCP addr: ", addr, "Error reading RTCP packet:", err)
-				time.Sleep(2 * time.Second)
+// Close - stops the reports and says goodbye. The socket belongs to the call, so it is left open
+func (s *RtcpSession) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	listening, started := s.listening, s.started
+	s.Unlock()
+
+	if listening {
+		// wake the reader up so it sees it is closed
+		s.conn.SetReadDeadline(time.Now())
+		<-s.readDone
+	}
+
+	if !started {
+		return nil
+	}
+
+	bye := &rtcp.Goodbye{Sources: []uint32{s.client.Stats().SSRC}}
+
+	return s.send(append(s.report(), bye))
+}
+
+// report - an SR, or an RR if we haven't sent any media, with a reception report for the caller's stream and our cname
+func (s *RtcpSession) report() []rtcp.Packet {
+	stats := s.client.Stats()
+	now := time.Now()
+
+	s.Lock()
+	var receptionReports []rtcp.ReceptionReport
+	var xrBlocks []rtcp.ReportBlock
+	if rr, ok := s.reception.report(now); ok {
+		receptionReports = append(receptionReports, rr)
+
+		if s.xr.statSummary {
+			xrBlocks = append(xrBlocks, statSummaryBlock(&s.reception))
+		}
+		if s.xr.voipMetrics {
+			var jitterBuffer *JitterBufferStats
+			if s.jitterBuffer != nil {
+				stats := s.jitterBuffer.Stats()
+				jitterBuffer = &stats
+			}
+			xrBlocks = append(xrBlocks, voipMetricsBlock(&s.reception, jitterBuffer, s.quality.RoundTripMs, s.frameMs))
+		}
+	}
+	s.Unlock()
+
+	var report rtcp.Packet
+	if stats.PacketCount > 0 {
+		// the rtp timestamp that would go with a frame sent right now, from the stream's clock
+		elapsed := int64(now.Sub(stats.TimestampAt))
+		rtpTime := stats.Timestamp + uint32(elapsed*int64(stats.ClockRateHz)/int64(time.Second))
+
+		report = &rtcp.SenderReport{
+			SSRC:        stats.SSRC,
+			NTPTime:     toNtpTime(now),
+			RTPTime:     rtpTime,
+			PacketCount: stats.PacketCount,
+			OctetCount:  stats.OctetCount,
+			Reports:     receptionReports,
+		}
+	} else {
+		report = &rtcp.ReceiverReport{SSRC: stats.SSRC, Reports: receptionReports}
+	}
+
+	sdes := &rtcp.SourceDescription{
+		Chunks: []rtcp.SourceDescriptionChunk{{
+			Source: stats.SSRC,
+			Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: s.cname}},
+		}},
+	}
+
+	packets := []rtcp.Packet{report, sdes}
+	if len(xrBlocks) > 0 {
+		packets = append(packets, &rtcp.ExtendedReport{SenderSSRC: stats.SSRC, Reports: xrBlocks})
+	}
+
+	return packets
+}
+
+func (s *RtcpSession) read() {
+	defer close(s.readDone)
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			fmt.Println("RtcpSession: error reading packet: ", err)
+			continue
+		}
+
+		data := buf[:n]
+		if s.srtp != nil {
+			if data, err = s.srtp.DecryptRtcp(data); err != nil {
+				fmt.Printf("RtcpSession: dropping srtcp packet from %s: %v\n", addr, err)
+				rtcpMetrics.Add("srtcpAuthFailures", 1)
 				continue
 			}
+		}
 
-			fmt.Println("Received RTCP packet from", addr.String(), "of length", n, "bytes")
-			fmt.Println("RTCP packet:", buf[:n])
+		packets, err := rtcp.Unmarshal(data)
+		if err != nil {
+			fmt.Printf("RtcpSession: bad rtcp packet from %s: %v\n", addr, err)
+			rtcpMetrics.Add("invalidPackets", 1)
+			continue
 		}
-	}()
 
-	data, err := buildRtcpPacket(ssrc, timestampOffset, packetsSinceLastRtcp, payloadOctectCount)
-	if err != nil {
-		fmt.Println("error building rtcp packet: ", err.Error())
-		return err
+		s.handle(packets, addr, time.Now())
 	}
+}
 
-	fmt.Println("sending RTCP packet to", remoteAddr.String(), "of length", len(data), "bytes")
+// handle - takes in a compound packet from the caller
+func (s *RtcpSession) handle(packets []rtcp.Packet, addr *net.UDPAddr, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
 
-	// Create a UDP connection to the client
-	rtcpClientConn, err := net.DialUDP("udp", &net.UDPAddr{Port: remoteAddr.Port}, remoteAddr)
-	if err != nil {
-		fmt.Println(err)
-		return err
+	var ourSsrc uint32
+	if s.client != nil {
+		ourSsrc = s.client.Stats().SSRC
 	}
-	defer rtcpClientConn.Close()
 
-	// TODO remove
-	time.Sleep(5 * time.Second)
+	// every compound packet starts with the SR or RR of whoever sent it. Their destination ssrcs are the streams they report on, ie
+	// ours, so the sender's own is the one in the header
+	var senderSsrc uint32
+	var hasSender bool
+	if len(packets) > 0 {
+		switch p := packets[0].(type) {
+		case *rtcp.SenderReport:
+			senderSsrc, hasSender = p.SSRC, true
+		case *rtcp.ReceiverReport:
+			senderSsrc, hasSender = p.SSRC, true
+		}
+	}
+	if !hasSender {
+		rtcpMetrics.Add("invalidPackets", 1)
+		return
+	}
+	if !s.latch(addr, senderSsrc) {
+		rtcpMetrics.Add("ignoredPackets", 1)
+		return
+	}
 
-	fmt.Println("gonna try and send rtcp now")
+	s.quality.ReportsReceived++
+	rtcpMetrics.Add("packetsReceived", 1)
 
-	if _, err := rtcpClientConn.WriteToUDP(data, remoteAddr); err != nil {
-		fmt.Printf("RTCP: Error writing UDP packet to %s: %v\n:", remoteAddr.String(), err)
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.SenderReport:
+			rtcpMetrics.Add("senderReports", 1)
+			s.reception.lastSr = ntpMiddle(p.NTPTime)
+			s.reception.lastSrAt = now
+			s.handleReceptionReports(p.Reports, ourSsrc, now)
+		case *rtcp.ReceiverReport:
+			rtcpMetrics.Add("receiverReports", 1)
+			s.handleReceptionReports(p.Reports, ourSsrc, now)
+		case *rtcp.SourceDescription:
+			for _, chunk := range p.Chunks {
+				for _, item := range chunk.Items {
+					if item.Type == rtcp.SDESCNAME {
+						s.quality.RemoteCname = item.Text
+					}
+				}
+			}
+		case *rtcp.Goodbye:
+			rtcpMetrics.Add("byes", 1)
+			s.quality.ByeReceived = true
+			s.quality.ByeReason = p.Reason
+			fmt.Printf("RtcpSession: %s said goodbye: %s\n", addr, p.Reason)
+		case *rtcp.ExtendedReport:
+			rtcpMetrics.Add("extendedReports", 1)
+			s.handleExtendedReport(p, ourSsrc)
+		}
 	}
+}
+
+// handleReceptionReports - picks out what the caller has to say about our stream. The lock must be held
+func (s *RtcpSession) handleReceptionReports(reports []rtcp.ReceptionReport, ourSsrc uint32, now time.Time) {
+	for _, report := range reports {
+		if report.SSRC != ourSsrc {
+			continue
+		}
+
+		// the cumulative loss is a signed 24 bit number
+		lost := int32(report.TotalLost<<8) >> 8
+		rtcpMetrics.Add("remotePacketsLost", int64(lost-s.quality.RemoteCumulativeLost))
 
-	return nil
+		s.quality.RemoteFractionLost = float64(report.FractionLost) / 256
+		s.quality.RemoteCumulativeLost = lost
+		s.quality.RemoteJitterMs = float64(report.Jitter) * 1000 / float64(s.reception.clockRateHz)
+		if rtt, ok := roundTripMs(report, now); ok {
+			s.quality.RoundTripMs = rtt
+		}
+	}
 }
 
-func oldStartRtcp(addr string, cname string, ssrc uint32, seq uint16, timestampOffset uint32, packetsSinceLastRtcp uint32, payloadOctectCount uint32) error {
-	remoteAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		fmt.Println("error resolving remote addr: ", err.Error())
-		// TODO probably need to update fsm and either retry over a certain interval or send a BYE request (include callId and the tag parameter in the To header field). you would get back a 200 ok from the client.
-		return err
+// handleExtendedReport - picks out what the caller's rtcp-xr has to say about our stream. The lock must be held
+func (s *RtcpSession) handleExtendedReport(xr *rtcp.ExtendedReport, ourSsrc uint32) {
+	for _, block := range xr.Reports {
+		switch b := block.(type) {
+		case *rtcp.VoIPMetricsReportBlock:
+			if b.SSRC != ourSsrc {
+				continue
+			}
+			if b.MOSLQ != xrUnavailable {
+				s.quality.XrMOS = float64(b.MOSLQ) / 10
+			}
+			if b.RFactor != xrUnavailable {
+				s.quality.XrRFactor = float64(b.RFactor)
+			}
+		case *rtcp.StatisticsSummaryReportBlock:
+			if b.SSRC != ourSsrc {
+				continue
+			}
+			if b.DuplicateReports {
+				s.quality.RemoteDuplicates = b.DupPackets
+			}
+			if b.JitterReports {
+				s.quality.RemoteMaxJitterMs = float64(b.MaxJitter) * 1000 / float64(s.reception.clockRateHz)
+			}
+		}
 	}
+}
 
-	data, err := buildRtcpPacket(ssrc, timestampOffset, packetsSinceLastRtcp, payloadOctectCount)
-	if err != nil {
-		fmt.Println("error building rtcp packet: ", err.Error())
-		return err
+// latch - sends our reports back to wherever the caller's come from, which gets through their NAT when their sdp address doesn't. Like rtp,
+// the reports only move to a new address when they come from the same ssrc. The lock must be held
+func (s *RtcpSession) latch(addr *net.UDPAddr, ssrc uint32) bool {
+	if s.latched && s.remoteAddr.IP.Equal(addr.IP) && s.remoteAddr.Port == addr.Port {
+		return true
 	}
+	if s.latched && ssrc != s.remoteSsrc {
+		return false
+	}
+
+	s.remoteAddr = addr
+	s.remoteSsrc = ssrc
+	s.latched = true
+	fmt.Printf("RtcpSession: latched on to rtcp from %s\n", addr)
+
+	return true
+}
 
-	// Create a UDP connection to the client
-	conn, err := net.DialUDP("udp", nil, remoteAddr)
+// send - marshals the packets into one compound packet and sends it
+func (s *RtcpSession) send(packets []rtcp.Packet) error {
+	data, err := rtcp.Marshal(packets)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		return fmt.Errorf("error building rtcp packet: %v", err)
+	}
+	if s.srtp != nil {
+		if data, err = s.srtp.EncryptRtcp(data); err != nil {
+			return fmt.Errorf("error encrypting rtcp packet: %v", err)
+		}
 	}
-	defer conn.Close()
 
-	_, err = conn.WriteToUDP(data, remoteAddr)
-	if err != nil {
-		fmt.Println(err)
-		return err
+	s.Lock()
+	remoteAddr := s.remoteAddr
+	s.avgPacketSize = float64(len(data)+rtcpHeaderOverhead)/16 + s.avgPacketSize*15/16
+	s.Unlock()
+
+	_, err = s.conn.WriteToUDP(data, remoteAddr)
+
+	return err
+}
+
+// interval - how long to wait before the next report (rfc 3550 6.3.1 and A.7). There are two of us in the session and we both send
+func (s *RtcpSession) interval(initial bool) time.Duration {
+	members, senders := 2.0, 2.0
+
+	s.Lock()
+	avgPacketSize := s.avgPacketSize
+	s.Unlock()
+
+	rtcpBandwidth := s.sessionBandwidth * rtcpBandwidthFraction
+	minInterval := rtcpMinInterval.Seconds()
+	if initial {
+		minInterval /= 2
+	}
+
+	// senders get a quarter of the bandwidth when they are a small share of the session, otherwise everyone shares it
+	n := members
+	if senders <= members/4 {
+		rtcpBandwidth /= 4
+		n = senders
+	}
+
+	t := minInterval
+	if rtcpBandwidth > 0 {
+		t = math.Max(avgPacketSize*n/rtcpBandwidth, minInterval)
+	}
+
+	// randomize it so reports from everyone in the session don't line up, then compensate for the randomization skewing it short
+	t = t * (mrand.Float64() + 0.5) / (math.E - 1.5)
+
+	return time.Duration(t * float64(time.Second))
+}
+
+// toNtpTime - the 64 bit ntp format rtcp uses: seconds since 1900 in the top half, and the fraction of a second in the bottom
+func toNtpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+
+	return seconds<<32 | fraction
+}
+
+// newSsrc - a random ssrc for our stream (rfc 3550 8.1). 0 is left out, since it means pick one for us
+func newSsrc() uint32 {
+	for {
+		var b [4]byte
+		rand.Read(b[:])
+		if ssrc := binary.BigEndian.Uint32(b[:]); ssrc != 0 {
+			return ssrc
+		}
 	}
+}
+
+// newCname - a random cname for a call's rtcp, so it can't be used to track who we are across calls (rfc 7022)
+func newCname() string {
+	b := make([]byte, 12)
+	rand.Read(b)
 
-	return nil
+	return base64.StdEncoding.EncodeToString(b)
 }
@@ -0,0 +1,273 @@
+package domain
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// the rtcp counters across every call, served at /debug/vars when the metrics listener is on
+var rtcpMetrics = expvar.NewMap("rtcp")
+
+// a sequence number further ahead than this is a new stream, and one further behind than this is too (rfc 3550 A.1)
+const (
+	maxDropout  = 3000
+	maxMisorder = 100
+)
+
+// CallQuality - how the audio of a call held up in each direction, from the caller's rtcp reports and our own measurements of their stream
+type CallQuality struct {
+	// what the caller reported about the audio we sent them
+	RemoteFractionLost   float64 `json:"remoteFractionLost"`
+	RemoteCumulativeLost int32   `json:"remoteCumulativeLost"`
+	RemoteJitterMs       float64 `json:"remoteJitterMs"`
+	// what we measured of the audio they sent us. The fraction lost is over the whole call, where the remote one is from their latest report
+	FractionLost   float64 `json:"fractionLost"`
+	CumulativeLost int32   `json:"cumulativeLost"`
+	JitterMs       float64 `json:"jitterMs"`
+	// from the last report that echoed one of our sender reports back, 0 until one does
+	RoundTripMs float64 `json:"roundTripMs"`
+	// our e-model estimate (itu-t g.107) of how the caller heard us, from their reports, and how we heard them, from our measurements
+	RemoteRFactor float64 `json:"remoteRFactor"`
+	RemoteMOS     float64 `json:"remoteMos"`
+	RFactor       float64 `json:"rFactor"`
+	MOS           float64 `json:"mos"`
+	// what the caller's own rtcp-xr says about how they heard us, 0 when they don't send it
+	XrRFactor         float64 `json:"xrRFactor,omitempty"`
+	XrMOS             float64 `json:"xrMos,omitempty"`
+	RemoteDuplicates  uint32  `json:"remoteDuplicates,omitempty"`
+	RemoteMaxJitterMs float64 `json:"remoteMaxJitterMs,omitempty"`
+	// the number of rtcp packets the caller sent us
+	ReportsReceived int    `json:"reportsReceived"`
+	RemoteCname     string `json:"remoteCname,omitempty"`
+	// set once the caller sends a BYE for their stream
+	ByeReceived bool   `json:"byeReceived,omitempty"`
+	ByeReason   string `json:"byeReason,omitempty"`
+}
+
+// String - a one line summary for the logs
+func (q CallQuality) String() string {
+	return fmt.Sprintf("sent: %.1f%% lost (%d total), %.1fms jitter, mos %.2f. received: %.1f%% lost (%d total), %.1fms jitter, mos %.2f. rtt %.1fms, %d rtcp reports",
+		q.RemoteFractionLost*100, q.RemoteCumulativeLost, q.RemoteJitterMs, q.RemoteMOS,
+		q.FractionLost*100, q.CumulativeLost, q.JitterMs, q.MOS,
+		q.RoundTripMs, q.ReportsReceived)
+}
+
+// receptionStats - tracks the caller's rtp stream for the reception reports we send them (rfc 3550 6.4.1 and appendix A)
+type receptionStats struct {
+	started bool
+	ssrc    uint32
+	// sequence numbers extended with the number of times they have wrapped, so they keep counting past 65535
+	baseSeq uint32
+	maxSeq  uint32
+	// the packets received in total, and the counts at the last report, so each report covers the packets since the one before
+	received         uint32
+	expectedPrior    uint32
+	receivedPrior    uint32
+	lastFractionLost uint8
+	// the interarrival jitter in rtp timestamp units, and the relative transit time of the last packet
+	jitter      float64
+	lastTransit int64
+	clockRateHz int
+	// used as the start of the arrival clock
+	startedAt time.Time
+	// a packet from a new ssrc, or too far from the sequence numbers to be the same stream, could be a stray. The counts only start over
+	// once the packet after it shows up too (rfc 3550 A.1), so this is the ssrc and sequence number that one has to have
+	onProbation   bool
+	probationSsrc uint32
+	probationSeq  uint16
+	// the middle 32 bits of the ntp time in the caller's last sender report, and when it arrived
+	lastSr   uint32
+	lastSrAt time.Time
+	// which of the last 1024 sequence numbers have arrived, by sequence number mod 1024, to spot duplicates
+	seen       [1024 / 64]uint64
+	duplicates uint32
+	// the differences in transit time between packets, for the extended reports
+	transits       uint32
+	transitMin     float64
+	transitMax     float64
+	transitSum     float64
+	transitSquares float64
+	bursts         burstTracker
+}
+
+// handlePacket - updates the stats with a packet of the caller's stream as it arrives, which may be out of order, a duplicate or a stray
+// (rfc 3550 A.1)
+func (r *receptionStats) handlePacket(pkt *rtp.Packet, arrival time.Time) {
+	seq := uint32(pkt.SequenceNumber)
+
+	// how far the sequence number is ahead of the highest one, wrapping around
+	delta := pkt.SequenceNumber - uint16(r.maxSeq)
+
+	switch {
+	case !r.started || pkt.SSRC != r.ssrc || (delta >= maxDropout && delta < 0xffff-maxMisorder):
+		if !r.onProbation || pkt.SSRC != r.probationSsrc || pkt.SequenceNumber != r.probationSeq {
+			// the first packet of a new stream, or a stray one, which is left out of the counts until the next packet says which
+			r.onProbation, r.probationSsrc, r.probationSeq = true, pkt.SSRC, pkt.SequenceNumber+1
+			return
+		}
+
+		// two packets in a row of a new stream, or one that jumped too far to be the same one, so start counting over
+		*r = receptionStats{
+			started:     true,
+			ssrc:        pkt.SSRC,
+			baseSeq:     seq,
+			maxSeq:      seq,
+			clockRateHz: r.clockRateHz,
+			startedAt:   arrival,
+			lastSr:      r.lastSr,
+			lastSrAt:    r.lastSrAt,
+		}
+		r.markSeen(pkt.SequenceNumber)
+		r.bursts.packetReceived()
+	case delta == 0 || (delta >= maxDropout && r.isSeen(pkt.SequenceNumber)):
+		r.duplicates++
+	case delta < maxDropout:
+		// in order, perhaps with a gap. A lower sequence number than the highest means it wrapped around
+		cycles := r.maxSeq &^ 0xffff
+		if pkt.SequenceNumber < uint16(r.maxSeq) {
+			cycles += 1 << 16
+		}
+		for missing := uint16(r.maxSeq) + 1; missing != pkt.SequenceNumber; missing++ {
+			r.clearSeen(missing)
+			r.bursts.packetLost()
+		}
+		r.maxSeq = cycles | seq
+		r.markSeen(pkt.SequenceNumber)
+		r.bursts.packetReceived()
+	default:
+		// showed up late, after we counted it as lost. It still counts as received, which takes it back off the cumulative loss
+		r.markSeen(pkt.SequenceNumber)
+	}
+	r.received++
+
+	// how far the packet's arrival drifted from when its timestamp says it should have arrived, both in timestamp units (rfc 3550 A.8)
+	arrivalTs := int64(arrival.Sub(r.startedAt)) * int64(r.clockRateHz) / int64(time.Second)
+	transit := arrivalTs - int64(pkt.Timestamp)
+	if r.received > 1 {
+		d := transit - r.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+
+		if r.transits == 0 || float64(d) < r.transitMin {
+			r.transitMin = float64(d)
+		}
+		if float64(d) > r.transitMax {
+			r.transitMax = float64(d)
+		}
+		r.transits++
+		r.transitSum += float64(d)
+		r.transitSquares += float64(d) * float64(d)
+	}
+	r.lastTransit = transit
+}
+
+func (r *receptionStats) markSeen(seq uint16) {
+	n := seq % 1024
+	r.seen[n/64] |= 1 << (n % 64)
+}
+
+func (r *receptionStats) clearSeen(seq uint16) {
+	n := seq % 1024
+	r.seen[n/64] &^= 1 << (n % 64)
+}
+
+func (r *receptionStats) isSeen(seq uint16) bool {
+	n := seq % 1024
+	return r.seen[n/64]&(1<<(n%64)) != 0
+}
+
+// expected - the packets the caller has sent since we started receiving, whether they showed up or not
+func (r *receptionStats) expected() uint32 {
+	return r.maxSeq - r.baseSeq + 1
+}
+
+// fractionLost - the share of the packets the caller sent that never showed up, over the whole call
+func (r *receptionStats) fractionLost() float64 {
+	if !r.started || r.cumulativeLost() <= 0 {
+		return 0
+	}
+
+	return float64(r.cumulativeLost()) / float64(r.expected())
+}
+
+// cumulativeLost - can go negative when packets are duplicated
+func (r *receptionStats) cumulativeLost() int32 {
+	return int32(r.expected() - r.received)
+}
+
+// report - the reception report for the caller's stream, which starts a new reporting interval. ok is false until their rtp shows up
+func (r *receptionStats) report(now time.Time) (rtcp.ReceptionReport, bool) {
+	if !r.started {
+		return rtcp.ReceptionReport{}, false
+	}
+
+	expected := r.expected()
+	expectedInterval := expected - r.expectedPrior
+	lostInterval := int64(expectedInterval) - int64(r.received-r.receivedPrior)
+	r.expectedPrior = expected
+	r.receivedPrior = r.received
+
+	r.lastFractionLost = 0
+	if expectedInterval > 0 && lostInterval > 0 {
+		r.lastFractionLost = uint8(lostInterval << 8 / int64(expectedInterval))
+	}
+
+	// the cumulative loss is a signed 24 bit number on the wire
+	lost := r.cumulativeLost()
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+
+	report := rtcp.ReceptionReport{
+		SSRC:               r.ssrc,
+		FractionLost:       r.lastFractionLost,
+		TotalLost:          uint32(lost) & 0xffffff,
+		LastSequenceNumber: r.maxSeq,
+		Jitter:             uint32(r.jitter),
+	}
+
+	// echo their last sender report, and how long we held on to it, so they can work out the round trip time
+	if !r.lastSrAt.IsZero() {
+		report.LastSenderReport = r.lastSr
+		report.Delay = uint32(now.Sub(r.lastSrAt) * 65536 / time.Second)
+	}
+
+	return report, true
+}
+
+// jitterMs - the interarrival jitter in milliseconds
+func (r *receptionStats) jitterMs() float64 {
+	if r.clockRateHz == 0 {
+		return 0
+	}
+
+	return r.jitter * 1000 / float64(r.clockRateHz)
+}
+
+// ntpMiddle - the middle 32 bits of an ntp time, which is what reports use to refer back to a sender report
+func ntpMiddle(ntpTime uint64) uint32 {
+	return uint32(ntpTime >> 16)
+}
+
+// roundTripMs - the round trip time from a report that echoes one of our sender reports (rfc 3550 6.4.1). ok is false when it doesn't
+func roundTripMs(report rtcp.ReceptionReport, now time.Time) (float64, bool) {
+	if report.LastSenderReport == 0 {
+		return 0, false
+	}
+
+	// all in units of 1/65536 of a second, and wrapping around every 18 hours or so
+	rtt := int32(ntpMiddle(toNtpTime(now)) - report.LastSenderReport - report.Delay)
+	if rtt < 0 {
+		return 0, false
+	}
+
+	return float64(rtt) * 1000 / 65536, true
+}
@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// testRtp - a packet's ssrc and sequence number. They arrive 20ms apart, with timestamps to match
+type testRtp struct {
+	ssrc uint32
+	seq  uint16
+}
+
+// testRun - n packets of the ssrc in a row, from seq on
+func testRun(ssrc uint32, seq uint16, n int) []testRtp {
+	var packets []testRtp
+	for i := 0; i < n; i++ {
+		packets = append(packets, testRtp{ssrc, seq + uint16(i)})
+	}
+
+	return packets
+}
+
+func TestReceptionStatsProbation(t *testing.T) {
+	tests := []struct {
+		name         string
+		packets      [][]testRtp
+		wantSsrc     uint32
+		wantReceived uint32
+		wantLost     int32
+	}{
+		{name: "first packet on probation", packets: [][]testRtp{testRun(1, 100, 10)}, wantSsrc: 1, wantReceived: 9},
+		{name: "one packet is not a stream", packets: [][]testRtp{testRun(1, 100, 1)}, wantReceived: 0},
+		{
+			name:     "stray packet from another ssrc",
+			packets:  [][]testRtp{testRun(1, 100, 10), testRun(2, 5000, 1), testRun(1, 110, 10)},
+			wantSsrc: 1, wantReceived: 19,
+		},
+		{
+			name:     "stray packet too far ahead",
+			packets:  [][]testRtp{testRun(1, 100, 10), testRun(1, 20000, 1), testRun(1, 110, 10)},
+			wantSsrc: 1, wantReceived: 19,
+		},
+		{
+			name:     "stray packet too far behind",
+			packets:  [][]testRtp{testRun(1, 5000, 10), testRun(1, 100, 1), testRun(1, 5010, 10)},
+			wantSsrc: 1, wantReceived: 19,
+		},
+		{
+			name:     "new ssrc",
+			packets:  [][]testRtp{testRun(1, 100, 10), testRun(2, 5000, 5)},
+			wantSsrc: 2, wantReceived: 4,
+		},
+		{
+			name:     "restarted sequence numbers",
+			packets:  [][]testRtp{testRun(1, 100, 10), testRun(1, 20000, 5)},
+			wantSsrc: 1, wantReceived: 4,
+		},
+		{
+			name:     "stray between losses",
+			packets:  [][]testRtp{testRun(1, 100, 10), testRun(1, 112, 1), testRun(2, 5000, 1), testRun(1, 115, 5)},
+			wantSsrc: 1, wantReceived: 15, wantLost: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &receptionStats{clockRateHz: 8000}
+			arrival := time.Unix(1000, 0)
+			n := 0
+			for _, stream := range tt.packets {
+				for _, p := range stream {
+					pkt := &rtp.Packet{Header: rtp.Header{SSRC: p.ssrc, SequenceNumber: p.seq, Timestamp: uint32(n) * 160}}
+					r.handlePacket(pkt, arrival.Add(time.Duration(n)*20*time.Millisecond))
+					n++
+				}
+			}
+
+			if r.received != tt.wantReceived {
+				t.Errorf("received %d, want %d", r.received, tt.wantReceived)
+			}
+			if !r.started {
+				return
+			}
+			if r.ssrc != tt.wantSsrc {
+				t.Errorf("ssrc %d, want %d", r.ssrc, tt.wantSsrc)
+			}
+			if lost := r.cumulativeLost(); lost != tt.wantLost {
+				t.Errorf("lost %d, want %d", lost, tt.wantLost)
+			}
+			if r.jitter != 0 {
+				t.Errorf("jitter %.1f, want 0", r.jitter)
+			}
+		})
+	}
+}
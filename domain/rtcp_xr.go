@@ -0,0 +1,256 @@
+package domain
+
+import (
+	"math"
+
+	"github.com/pion/rtcp"
+
+	"sip_and_rip/ports"
+)
+
+// a burst ends once this many packets in a row arrive (rfc 3611 4.7.2)
+const gmin = 16
+
+// the value rtcp-xr uses for a metric we don't have
+const xrUnavailable = 127
+
+// the receiver configuration bits of a voip metrics block: the kind of loss concealment and jitter buffer we have (rfc 3611 4.7.6)
+const (
+	xrPlcStandard          = 0xc0
+	xrJitterBufferAdaptive = 0x30
+)
+
+// g.113 appendix I: g711 is not impaired by the codec itself, and with loss concealment it copes with this much loss robustness
+const (
+	g711Ie  = 0
+	g711Bpl = 25.1
+)
+
+// rtcpXrConfig - the extended reports the answer agreed we send
+type rtcpXrConfig struct {
+	statSummary bool
+	voipMetrics bool
+}
+
+// newRtcpXrConfig - reads the a=rtcp-xr out of our answer
+func newRtcpXrConfig(localSdp ports.SdpMessage) rtcpXrConfig {
+	var config rtcpXrConfig
+
+	params := localSdp.GetSessionAttributes().RtcpXr
+	if audio := localSdp.GetMediaAttributes("audio"); audio != nil {
+		params = append(params, audio.RtcpXr...)
+	}
+
+	for _, param := range params {
+		switch param.Name {
+		case "stat-summary":
+			config.statSummary = true
+		case "voip-metrics":
+			config.voipMetrics = true
+		}
+	}
+
+	return config
+}
+
+// burstTracker - splits a stream's losses into bursts, where packets are lost close together, and the gaps between them (rfc 3611 4.7.2)
+type burstTracker struct {
+	// the packets received in a row since the last loss
+	run uint32
+	// the burst we are in, which may still turn out to be an isolated loss that belongs to a gap
+	burstOpen    bool
+	burstLen     uint32
+	burstLost    uint32
+	bursts       uint32
+	burstPackets uint32
+	burstLosses  uint32
+	gapPackets   uint32
+	gapLosses    uint32
+	// how often the stream went from receiving to losing and back, for the burst ratio
+	lastLost       bool
+	received, lost uint32
+	toLost, toRecv uint32
+}
+
+func (b *burstTracker) packetReceived() {
+	b.run++
+	b.received++
+	if b.lastLost {
+		b.toRecv++
+	}
+	b.lastLost = false
+}
+
+func (b *burstTracker) packetLost() {
+	b.lost++
+	if !b.lastLost {
+		b.toLost++
+	}
+	b.lastLost = true
+
+	if b.burstOpen && b.run < gmin {
+		// too few packets since the last loss, so they are all part of the burst
+		b.burstLen += b.run + 1
+		b.burstLost++
+	} else {
+		b.closeBurst()
+		b.gapPackets += b.run
+		b.burstOpen = true
+		b.burstLen = 1
+		b.burstLost = 1
+	}
+	b.run = 0
+}
+
+// closeBurst - a burst of a single loss is just an isolated loss in a gap
+func (b *burstTracker) closeBurst() {
+	if !b.burstOpen {
+		return
+	}
+	b.burstOpen = false
+
+	if b.burstLost == 1 {
+		b.gapPackets++
+		b.gapLosses++
+		return
+	}
+
+	b.bursts++
+	b.burstPackets += b.burstLen
+	b.burstLosses += b.burstLost
+}
+
+// snapshot - the totals so far, as if the stream ended now
+func (b *burstTracker) snapshot() burstTracker {
+	snapshot := *b
+	snapshot.closeBurst()
+	snapshot.gapPackets += snapshot.run
+
+	return snapshot
+}
+
+// burstRatio - how much more bunched up the losses are than if they were random, 1 for random loss (itu-t g.107)
+func (b *burstTracker) burstRatio() float64 {
+	if b.received == 0 || b.lost == 0 || b.toLost == 0 {
+		return 1
+	}
+
+	p := float64(b.toLost) / float64(b.received)
+	q := float64(b.toRecv) / float64(b.lost)
+	if p+q == 0 {
+		return 1
+	}
+
+	return math.Max(1/(p+q), 1)
+}
+
+// eModel - the r-factor of g711 audio with the share of packets lost and the one way delay (itu-t g.107, simplified as in g.113)
+func eModel(lossFraction float64, burstRatio float64, delayMs float64) float64 {
+	// the delay impairment
+	id := 0.024 * delayMs
+	if delayMs > 177.3 {
+		id += 0.11 * (delayMs - 177.3)
+	}
+
+	// the codec and loss impairment
+	ppl := lossFraction * 100
+	ieEff := g711Ie + (95-g711Ie)*ppl/(ppl/burstRatio+g711Bpl)
+
+	return math.Max(93.2-id-ieEff, 0)
+}
+
+// mosFromR - the mean opinion score, 1 (bad) to 4.5 (the best a phone call gets), that goes with an r-factor (itu-t g.107 annex b)
+func mosFromR(r float64) float64 {
+	if r <= 0 {
+		return 1
+	}
+	if r >= 100 {
+		return 4.5
+	}
+
+	return 1 + 0.035*r + r*(r-60)*(100-r)*7e-6
+}
+
+// voipMetricsBlock - our view of the caller's stream as an rtcp-xr voip metrics block (rfc 3611 4.7). The jitter buffer is nil when we don't have one
+func voipMetricsBlock(r *receptionStats, jitterBuffer *JitterBufferStats, roundTripMs float64, frameMs int) *rtcp.VoIPMetricsReportBlock {
+	bursts := r.bursts.snapshot()
+
+	block := &rtcp.VoIPMetricsReportBlock{
+		SSRC:           r.ssrc,
+		LossRate:       uint8(math.Min(r.fractionLost()*256, 255)),
+		BurstDensity:   density(bursts.burstLosses, bursts.burstPackets),
+		GapDensity:     density(bursts.gapLosses, bursts.gapPackets),
+		RoundTripDelay: uint16(roundTripMs),
+		SignalLevel:    xrUnavailable,
+		NoiseLevel:     xrUnavailable,
+		RERL:           xrUnavailable,
+		Gmin:           gmin,
+		ExtRFactor:     xrUnavailable,
+	}
+	if bursts.bursts > 0 {
+		block.BurstDuration = uint16(bursts.burstPackets / bursts.bursts * uint32(frameMs))
+	}
+	block.GapDuration = uint16(math.Min(float64(bursts.gapPackets/(bursts.bursts+1)*uint32(frameMs)), math.MaxUint16))
+
+	if jitterBuffer != nil {
+		block.DiscardRate = density(jitterBuffer.Discarded, r.expected())
+		// our concealment follows g.711 appendix I, and the buffer adapts
+		block.RXConfig = xrPlcStandard | xrJitterBufferAdaptive
+		block.JBNominal = uint16(jitterBuffer.NominalDelayMs)
+		block.JBMaximum = uint16(jitterBuffer.MaxDelayMs)
+		block.JBAbsMax = uint16(jitterBuffer.MaxDelayMs)
+	}
+
+	// listening quality leaves out the delay, conversational quality counts it
+	lq := eModel(r.fractionLost(), bursts.burstRatio(), 0)
+	cq := eModel(r.fractionLost(), bursts.burstRatio(), oneWayDelayMs(roundTripMs, frameMs, r.jitterMs()))
+	block.RFactor = uint8(cq)
+	block.MOSLQ = uint8(mosFromR(lq) * 10)
+	block.MOSCQ = uint8(mosFromR(cq) * 10)
+
+	return block
+}
+
+// statSummaryBlock - the loss, duplicates and jitter of the caller's stream as an rtcp-xr statistics summary block (rfc 3611 4.6)
+func statSummaryBlock(r *receptionStats) *rtcp.StatisticsSummaryReportBlock {
+	lost := r.cumulativeLost()
+	if lost < 0 {
+		lost = 0
+	}
+
+	block := &rtcp.StatisticsSummaryReportBlock{
+		LossReports:      true,
+		DuplicateReports: true,
+		JitterReports:    true,
+		SSRC:             r.ssrc,
+		BeginSeq:         uint16(r.baseSeq),
+		// the end is one past the last packet
+		EndSeq:      uint16(r.maxSeq + 1),
+		LostPackets: uint32(lost),
+		DupPackets:  r.duplicates,
+	}
+
+	if r.transits > 0 {
+		mean := r.transitSum / float64(r.transits)
+		block.MinJitter = uint32(r.transitMin)
+		block.MaxJitter = uint32(r.transitMax)
+		block.MeanJitter = uint32(mean)
+		block.DevJitter = uint32(math.Sqrt(math.Max(r.transitSquares/float64(r.transits)-mean*mean, 0)))
+	}
+
+	return block
+}
+
+// density - the share of packets lost, out of 256
+func density(lost uint32, packets uint32) uint8 {
+	if packets == 0 {
+		return 0
+	}
+
+	return uint8(math.Min(float64(lost)*256/float64(packets), 255))
+}
+
+// oneWayDelayMs - a guess at the mouth to ear delay: half the round trip, a frame to fill a packet, and a jitter buffer of twice the jitter
+func oneWayDelayMs(roundTripMs float64, frameMs int, jitterMs float64) float64 {
+	return roundTripMs/2 + float64(frameMs) + 2*jitterMs
+}
@@ -0,0 +1,213 @@
+package domain
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the most frames a late stream sends back to back to catch up. Anything later than this is dropped, since a burst of old audio
+// is worse than a short gap and the caller's jitter buffer can only absorb so much
+const maxCatchUpFrames = 3
+
+// MediaStream - something sent to the caller one frame at a time, ie a prompt being played
+type MediaStream interface {
+	// sends the next frame. Returns true once there is nothing left to send
+	SendFrame() (done bool)
+	// throws away the next frame because we are too late to send it, keeping the stream's clock moving. Returns true once there is nothing left to send
+	SkipFrame() (done bool)
+}
+
+// MediaScheduler - paces every call's outbound media against a monotonic clock. A handful of timer goroutines drive all the streams,
+// rather than a sleeping goroutine per call whose processing time and gc pauses add up into drift
+type MediaScheduler struct {
+	shards []*schedulerShard
+	next   uint32
+}
+
+// NewMediaScheduler - creates a scheduler with a timer goroutine per cpu. It runs until the process exits
+func NewMediaScheduler() *MediaScheduler {
+	s := &MediaScheduler{}
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		shard := &schedulerShard{wake: make(chan struct{}, 1)}
+		s.shards = append(s.shards, shard)
+		go shard.run()
+	}
+
+	return s
+}
+
+// Schedule - starts sending the stream a frame every interval from now. Stop the returned job to cancel it early
+func (s *MediaScheduler) Schedule(stream MediaStream, interval time.Duration) *ScheduledStream {
+	job := &ScheduledStream{
+		stream:   stream,
+		start:    time.Now(),
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	job.due = job.start
+
+	// spread the streams over the shards round robin
+	shard := s.shards[atomic.AddUint32(&s.next, 1)%uint32(len(s.shards))]
+	shard.add(job)
+
+	return job
+}
+
+// ScheduledStream - a stream the scheduler is sending
+type ScheduledStream struct {
+	// held while a frame is being sent, so once Stop returns nothing more goes out
+	sync.Mutex
+	stream MediaStream
+	// time.Now carries a monotonic reading, so wall clock jumps don't affect the pacing
+	start    time.Time
+	interval time.Duration
+	// the number of frames sent or skipped so far, the next one is due at start + frames * interval
+	frames  int64
+	due     time.Time
+	stopped bool
+	done    chan struct{}
+}
+
+// Done - closed once the stream has run out or been stopped
+func (j *ScheduledStream) Done() <-chan struct{} {
+	return j.done
+}
+
+// Stop - cancels the stream. No frames are sent after it returns
+func (j *ScheduledStream) Stop() {
+	j.Lock()
+	defer j.Unlock()
+
+	j.finish()
+}
+
+// finish - the lock must be held
+func (j *ScheduledStream) finish() {
+	if !j.stopped {
+		j.stopped = true
+		close(j.done)
+	}
+}
+
+// sendDue - sends every frame that is due by now, dropping the ones we are too late for. Returns false once the stream is finished
+func (j *ScheduledStream) sendDue(now time.Time) bool {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.stopped {
+		return false
+	}
+
+	due := int64(now.Sub(j.start)/j.interval) + 1 - j.frames
+	for ; due > 0; due-- {
+		var done bool
+		if due > maxCatchUpFrames {
+			done = j.stream.SkipFrame()
+		} else {
+			done = j.stream.SendFrame()
+		}
+		j.frames++
+
+		if done {
+			j.finish()
+			return false
+		}
+	}
+
+	j.due = j.start.Add(time.Duration(j.frames) * j.interval)
+
+	return true
+}
+
+// schedulerShard - a timer goroutine and the streams it drives, ordered by when their next frame is due
+type schedulerShard struct {
+	sync.Mutex
+	jobs streamHeap
+	wake chan struct{}
+}
+
+func (s *schedulerShard) add(job *ScheduledStream) {
+	s.Lock()
+	heap.Push(&s.jobs, job)
+	s.Unlock()
+
+	// the new stream may be due before whatever the goroutine is waiting on
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *schedulerShard) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.Lock()
+		wait := time.Hour
+		if len(s.jobs) > 0 {
+			wait = time.Until(s.jobs[0].due)
+		}
+		s.Unlock()
+
+		if wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				continue
+			}
+		}
+
+		s.sendDue(time.Now())
+	}
+}
+
+// sendDue - sends every stream whose next frame is due
+func (s *schedulerShard) sendDue(now time.Time) {
+	var due []*ScheduledStream
+
+	s.Lock()
+	for len(s.jobs) > 0 && !s.jobs[0].due.After(now) {
+		due = append(due, heap.Pop(&s.jobs).(*ScheduledStream))
+	}
+	s.Unlock()
+
+	// streams are sent without the shard locked, so scheduling new ones never waits on a slow reader
+	var again []*ScheduledStream
+	for _, job := range due {
+		if job.sendDue(now) {
+			again = append(again, job)
+		}
+	}
+
+	s.Lock()
+	for _, job := range again {
+		heap.Push(&s.jobs, job)
+	}
+	s.Unlock()
+}
+
+// streamHeap - a min heap of streams by when their next frame is due
+type streamHeap []*ScheduledStream
+
+func (h streamHeap) Len() int           { return len(h) }
+func (h streamHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h streamHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *streamHeap) Push(x interface{}) {
+	*h = append(*h, x.(*ScheduledStream))
+}
+
+func (h *streamHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return job
+}
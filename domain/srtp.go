@@ -0,0 +1,146 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+
+	"sip_and_rip/ports"
+)
+
+// how much we want a call's media to be srtp. The sdes keys are in the sdp, so we only trust them to calls that came in over tls or
+// secure websockets. Dtls keeps its keys off the wire, but the fingerprint that says whose they are is still in the sdp
+const (
+	// every call has to come in over tls or secure websockets and offer srtp, the rest are turned down
+	SrtpRequire = "require"
+	// calls that come in over tls and offer srtp get it, as do browsers over either websocket, and the rest get plain rtp
+	SrtpPrefer = "prefer"
+	// every call gets plain rtp, and offers of only srtp are turned down
+	SrtpDisable = "disable"
+)
+
+var errSrtpNotAcceptable = fmt.Errorf("srtp not acceptable")
+
+// mediaSecurity - how a call's media is protected. Both are nil for plain rtp
+type mediaSecurity struct {
+	// the caller's sdes key, for srtp keyed in the sdp
+	crypto *ports.SdpCrypto
+	// the caller's ice and dtls parameters, for a browser's srtp keyed by a dtls handshake on the media port
+	webRtc *ports.WebRtcParams
+}
+
+// selectMediaSecurity - how we will protect the caller's media. errSrtpNotAcceptable means the policy and the offer can't agree, and
+// the INVITE should get a 488
+func selectMediaSecurity(policy string, sipMsg ports.SipMessage, newKey func(suite string) ([]byte, error)) (mediaSecurity, error) {
+	offer, err := sipMsg.GetRemoteSdp()
+	if err != nil {
+		return mediaSecurity{}, err
+	}
+
+	audio := offer.GetMediaAttributes("audio")
+	if audio == nil {
+		return mediaSecurity{}, fmt.Errorf("no audio in sdp")
+	}
+
+	secure := isSecureTransport(sipMsg.GetTransport())
+
+	// UDP/TLS/RTP/SAVP and UDP/TLS/RTP/SAVPF are dtls-srtp, which is what browsers offer
+	if strings.HasPrefix(audio.Proto, "UDP/TLS/") {
+		webRtc, err := selectWebRtc(policy, secure, offer, audio)
+		return mediaSecurity{webRtc: webRtc}, err
+	}
+
+	crypto, err := selectSrtpCrypto(policy, secure, sipMsg.GetTransport(), audio, newKey)
+	return mediaSecurity{crypto: crypto}, err
+}
+
+// selectSrtpCrypto - the caller's sdes key we will use for their media, or nil for plain rtp
+func selectSrtpCrypto(policy string, secure bool, transport string, audio *ports.SdpMediaAttributes, newKey func(suite string) ([]byte, error)) (*ports.SdpCrypto, error) {
+	// RTP/SAVP and RTP/SAVPF can only be answered with srtp. Keys offered with RTP/AVP are best effort, we can use them or not
+	savp := strings.Contains(audio.Proto, "SAVP")
+
+	var crypto *ports.SdpCrypto
+	if policy != SrtpDisable && secure {
+		crypto = supportedCrypto(audio.Crypto, newKey)
+	}
+
+	switch {
+	case crypto != nil:
+		return crypto, nil
+	case policy == SrtpRequire && !secure:
+		return nil, fmt.Errorf("%w: srtp is required, and its keys need a call over tls", errSrtpNotAcceptable)
+	case policy == SrtpRequire:
+		return nil, fmt.Errorf("%w: srtp is required, and none of the offered keys are supported", errSrtpNotAcceptable)
+	case savp && !secure:
+		return nil, fmt.Errorf("%w: srtp offered over %s, which would give its keys away", errSrtpNotAcceptable, transport)
+	case savp:
+		return nil, fmt.Errorf("%w: srtp offered, and it is disabled or none of the offered keys are supported", errSrtpNotAcceptable)
+	}
+
+	return nil, nil
+}
+
+// selectWebRtc - the caller's ice and dtls parameters. A browser's media can only be dtls-srtp, with rtcp on the rtp port, so there is
+// nothing to fall back to when we can't do that
+func selectWebRtc(policy string, secure bool, offer ports.SdpMessage, audio *ports.SdpMediaAttributes) (*ports.WebRtcParams, error) {
+	switch {
+	case policy == SrtpDisable:
+		return nil, fmt.Errorf("%w: dtls-srtp offered, and srtp is disabled", errSrtpNotAcceptable)
+	case policy == SrtpRequire && !secure:
+		return nil, fmt.Errorf("%w: srtp is required, and its fingerprint needs a call over tls", errSrtpNotAcceptable)
+	}
+
+	if _, ok := audio.Get("rtcp-mux"); !ok {
+		return nil, fmt.Errorf("%w: dtls-srtp offered without rtcp-mux", errSrtpNotAcceptable)
+	}
+
+	// each of them can be on the media or for the whole session
+	session := offer.GetSessionAttributes()
+	get := func(name string) string {
+		if value, ok := audio.Get(name); ok {
+			return value
+		}
+		value, _ := session.Get(name)
+		return value
+	}
+
+	params := &ports.WebRtcParams{
+		IceUfrag: get("ice-ufrag"),
+		IcePwd:   get("ice-pwd"),
+		Setup:    get("setup"),
+	}
+	if params.IceUfrag == "" || params.IcePwd == "" {
+		return nil, fmt.Errorf("%w: dtls-srtp offered without ice", errSrtpNotAcceptable)
+	}
+
+	// a=fingerprint:sha-256 4A:AD:B9:...
+	fingerprint := strings.Fields(get("fingerprint"))
+	if len(fingerprint) != 2 {
+		return nil, fmt.Errorf("%w: dtls-srtp offered without a fingerprint", errSrtpNotAcceptable)
+	}
+	params.FingerprintHash, params.Fingerprint = strings.ToLower(fingerprint[0]), fingerprint[1]
+
+	return params, nil
+}
+
+// isSecureTransport - whether the transport keeps the sdp to ourselves
+func isSecureTransport(transport string) bool {
+	return transport == ports.TransportTLS || transport == ports.TransportWSS
+}
+
+// supportedCrypto - the first of the offered keys we can use. Session params change how srtp works and mkis change the packets, and
+// we don't do either, so keys with them are skipped (rfc 4568 6.3)
+func supportedCrypto(offered []ports.SdpCrypto, newKey func(suite string) ([]byte, error)) *ports.SdpCrypto {
+	for i := range offered {
+		crypto := &offered[i]
+		if len(crypto.SessionParams) > 0 || crypto.Mki != "" {
+			continue
+		}
+
+		// a key of our own tells us both that we support the suite and how long its keys are
+		if ours, err := newKey(crypto.Suite); err == nil && len(ours) == len(crypto.Key) {
+			return crypto
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+const (
+	// the frequency of the test tone, just off 1khz so its samples don't repeat every cycle at 8khz, which hides faults in the codec
+	milliwattHz = 1004
+	// the peak of a 0dBm0 sine in 16 bit linear, 3.17dB under the 32124 u-law maximum (itu-t g.711 table 5)
+	milliwattAmplitude = 22120
+)
+
+// milliwattTone - a continuous 1004hz tone at 0dBm0, the reference level for line tests
+var milliwattTone = ports.Tone{
+	Segments:  []ports.ToneSegment{{FreqsHz: []int{milliwattHz}, DurationMs: 1000}},
+	Repeat:    true,
+	Amplitude: milliwattAmplitude,
+}
+
+// testLine - the handler for calls to one of the test numbers, nil when the call isn't to one
+func testLine(cfg *Config, sipMsg ports.SipMessage) CallHandler {
+	dialed := sipMsg.GetRequest().User
+	if dialed == "" {
+		return nil
+	}
+
+	switch dialed {
+	case cfg.EchoNumber:
+		return echo(time.Duration(cfg.EchoDelayMs) * time.Millisecond)
+	case cfg.MilliwattNumber:
+		return milliwatt
+	case cfg.ReflectorNumber:
+		return reflector
+	}
+
+	return nil
+}
+
+// echo - plays the caller's own audio back to them, delay late, to check both directions of the media at once
+func echo(delay time.Duration) CallHandler {
+	return func(call *Call, sipMsg ports.SipMessage) error {
+		codec, err := call.sendCodec()
+		if err != nil {
+			return err
+		}
+
+		relay := newAudioRelay(codec, call.mediaOpts, delay)
+		call.OnAudio(relay.push)
+
+		return call.Play(relay)
+	}
+}
+
+// milliwatt - plays the test tone until the caller hangs up, for measuring the loss of a line
+func milliwatt(call *Call, sipMsg ports.SipMessage) error {
+	tone, err := call.newTone(milliwattTone, 0)
+	if err != nil {
+		return err
+	}
+
+	return call.Play(tone)
+}
+
+// reflector - sends the caller's packets straight back as they arrive, so they can measure loss, reordering and round trip time from
+// the sequence numbers and timestamps of their own stream
+func reflector(call *Call, sipMsg ports.SipMessage) error {
+	return call.Reflect()
+}
@@ -0,0 +1,94 @@
+package domain
+
+import (
+	"fmt"
+
+	"sip_and_rip/ports"
+)
+
+// the tones every plan has
+const (
+	ToneDial        = "dial"
+	ToneRingback    = "ringback"
+	ToneBusy        = "busy"
+	ToneCongestion  = "congestion"
+	ToneCallWaiting = "call-waiting"
+	// the beep before leaving a voicemail
+	ToneBeep = "beep"
+)
+
+// the countries' tone plans we know, from itu-t e.180's list of the tones in use around the world
+const (
+	TonePlanUS = "us"
+	TonePlanUK = "uk"
+	// the cept plan most of europe shares (etsi tr 101 041)
+	TonePlanEU = "eu"
+)
+
+// continuous - a tone that plays until it is stopped, ie dial tone
+func continuous(freqsHz ...int) ports.Tone {
+	return ports.Tone{Segments: []ports.ToneSegment{{FreqsHz: freqsHz, DurationMs: 1000}}, Repeat: true}
+}
+
+// cadence - a tone that goes on and off in the pattern, which alternates between on and off durations in ms
+func cadence(freqsHz []int, onOffMs ...int) ports.Tone {
+	tone := ports.Tone{Repeat: true}
+	for i, ms := range onOffMs {
+		seg := ports.ToneSegment{DurationMs: ms}
+		if i%2 == 0 {
+			seg.FreqsHz = freqsHz
+		}
+		tone.Segments = append(tone.Segments, seg)
+	}
+
+	return tone
+}
+
+// voicemail beeps aren't national, everyone gets the same one
+var beepTone = ports.Tone{Segments: []ports.ToneSegment{{FreqsHz: []int{beepHz}, DurationMs: 500}}}
+
+var tonePlans = map[string]map[string]ports.Tone{
+	TonePlanUS: {
+		ToneDial:        continuous(350, 440),
+		ToneRingback:    cadence([]int{440, 480}, 2000, 4000),
+		ToneBusy:        cadence([]int{480, 620}, 500, 500),
+		ToneCongestion:  cadence([]int{480, 620}, 250, 250),
+		ToneCallWaiting: cadence([]int{440}, 300, 9700),
+		ToneBeep:        beepTone,
+	},
+	TonePlanUK: {
+		ToneDial:        continuous(350, 440),
+		ToneRingback:    cadence([]int{400, 450}, 400, 200, 400, 2000),
+		ToneBusy:        cadence([]int{400}, 375, 375),
+		ToneCongestion:  cadence([]int{400}, 400, 350, 225, 525),
+		ToneCallWaiting: cadence([]int{400}, 100, 3000),
+		ToneBeep:        beepTone,
+	},
+	TonePlanEU: {
+		ToneDial:        continuous(425),
+		ToneRingback:    cadence([]int{425}, 1000, 4000),
+		ToneBusy:        cadence([]int{425}, 500, 500),
+		ToneCongestion:  cadence([]int{425}, 250, 250),
+		ToneCallWaiting: cadence([]int{425}, 150, 150, 150, 8000),
+		ToneBeep:        beepTone,
+	},
+}
+
+// LookupTone - the named tone in the plan, the us one when the plan is empty
+func LookupTone(plan string, name string) (ports.Tone, error) {
+	if plan == "" {
+		plan = TonePlanUS
+	}
+
+	tones, ok := tonePlans[plan]
+	if !ok {
+		return ports.Tone{}, fmt.Errorf("unknown tone plan: %s", plan)
+	}
+
+	tone, ok := tones[name]
+	if !ok {
+		return ports.Tone{}, fmt.Errorf("tone plan %s has no %s tone", plan, name)
+	}
+
+	return tone, nil
+}
@@ -0,0 +1,475 @@
+package domain
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jart/gosip/sip"
+
+	"sip_and_rip/ports"
+)
+
+// how long the implicit subscription a REFER creates lasts, which is plenty for a transfer to be answered or not (rfc 3515 2.4.4)
+const referExpiresSeconds = 60
+
+// transfer - a REFER from one side of a bridged call, the transferor, asking us to put the other side through to someone else
+// (rfc 3515). We call them, tell the transferor how it goes with NOTIFYs of the responses as sipfrags (rfc 3420), and once they answer
+// they take the transferor's place in the bridge and the transferor is hung up. A blind transfer calls the Refer-To uri, and an
+// attended one replaces a call the transferor already has with them (rfc 3891)
+type transfer struct {
+	sync.Mutex
+	br *bridge
+	// the transferor's leg, nil when it is the caller's own dialog, and whether it is on the caller's side of the bridge
+	transferor *bridgeLeg
+	fromCaller bool
+	// our call to the transfer target
+	leg *bridgeLeg
+	// set once the transferor has hung up, which a transfer doesn't need them for, guarded by the bridge's lock
+	transferorGone bool
+	// set once the transferor has heard the target ringing, and once the transfer has been answered or has failed
+	rang     bool
+	outcome  string
+	notified bool
+}
+
+// the outcomes of a transfer
+const (
+	transferAnswered = "answered"
+	transferFailed   = "failed"
+)
+
+// refer - a REFER in one of the bridge's dialogs, from leg, or the caller when leg is nil. We take it when the call is up and isn't
+// being transferred already
+func (br *bridge) refer(leg *bridgeLeg, refer ports.SipMessage, send ports.SendResponseCallback) {
+	br.Lock()
+	fromCaller := leg == nil || leg == br.callerLeg
+	busy := br.state != bridgeConnected || br.transfer != nil
+	br.Unlock()
+
+	if busy {
+		// 491 Request Pending, it is still ringing or already being transferred
+		if err := sendResponse(refer, 491, send); err != nil {
+			fmt.Printf("b2bua: error turning down REFER for call %s: %v\n", refer.GetCallID(), err)
+		}
+		return
+	}
+
+	uri, replaces, err := parseReferTo(refer)
+	if err != nil {
+		fmt.Printf("b2bua: can't transfer call %s: %v\n", br.invite.GetCallID(), err)
+		// 400 Bad Request
+		sendResponse(refer, 400, send)
+		return
+	}
+	target, replaces, err := br.b2bua.referTarget(uri, replaces)
+	if err != nil {
+		fmt.Printf("b2bua: can't transfer call %s: %v\n", br.invite.GetCallID(), err)
+		// 404 Not Found
+		sendResponse(refer, 404, send)
+		return
+	}
+
+	out, err := br.b2bua.call(br.invite, target)
+	if err != nil {
+		fmt.Printf("b2bua: error calling %s to transfer call %s: %v\n", target.uri, br.invite.GetCallID(), err)
+		sendResponse(refer, 500, send)
+		return
+	}
+	if replaces != "" {
+		out.out.SetHeader("Replaces", replaces)
+	}
+	out.out.SetHeader("Referred-By", referredBy(refer))
+
+	t := &transfer{
+		br:         br,
+		transferor: leg,
+		fromCaller: fromCaller,
+		leg:        out,
+	}
+
+	br.Lock()
+	if br.transfer != nil {
+		br.Unlock()
+		out.close()
+		sendResponse(refer, 491, send)
+		return
+	}
+	br.transfer = t
+	br.Unlock()
+	br.b2bua.addLeg(br, out)
+
+	kind := "blind"
+	if replaces != "" {
+		kind = "attended"
+	}
+	fmt.Printf("b2bua: %s transfer of call %s to %s as %s\n", kind, br.invite.GetCallID(), target.uri, out.out.GetCallID())
+
+	// 202 Accepted, and the first NOTIFY straight after it (rfc 3515 2.4.5)
+	if err := sendResponse(refer, 202, send); err != nil {
+		fmt.Printf("b2bua: error accepting REFER for call %s: %v\n", refer.GetCallID(), err)
+	}
+	t.notify(100)
+
+	if err := out.sendMsg(out.out); err != nil {
+		fmt.Printf("b2bua: error calling %s: %v\n", target.uri, err)
+		// 503 Service Unavailable
+		t.fail(503)
+		return
+	}
+
+	go out.ring(target.transport == ports.TransportUDP, br.b2bua.ringTime(), t.pending, func() {
+		fmt.Printf("b2bua: %s didn't answer the transfer of call %s\n", target.uri, br.invite.GetCallID())
+		if t.settle(transferFailed) {
+			if err := out.cancel(); err != nil {
+				fmt.Printf("b2bua: error cancelling call %s: %v\n", out.out.GetCallID(), err)
+			}
+			// 408 Request Timeout
+			t.failed(408)
+		}
+	})
+}
+
+// parseReferTo - who a REFER transfers to, and the Replaces of the INVITE that calls them, empty for a blind transfer
+func parseReferTo(refer ports.SipMessage) (*sip.URI, string, error) {
+	referTo := strings.TrimSpace(refer.GetHeader("Refer-To"))
+	if referTo == "" {
+		return nil, "", fmt.Errorf("REFER has no Refer-To")
+	}
+	if start, end := strings.Index(referTo, "<"), strings.LastIndex(referTo, ">"); start >= 0 && end > start {
+		referTo = referTo[start+1 : end]
+	}
+
+	uri, err := sip.ParseURI([]byte(referTo))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid Refer-To %q: %v", referTo, err)
+	}
+	if uri.Scheme != "sip" {
+		return nil, "", fmt.Errorf("Refer-To %q isn't a sip uri, which is all we can reach", referTo)
+	}
+
+	replaces := ""
+	if header := uri.Header.Get("Replaces"); header != nil {
+		replaces = header.Value
+	}
+	uri.Header = nil
+
+	return uri, replaces, nil
+}
+
+// referTarget - how to reach who a REFER transfers to, and the Replaces to send them. A Replaces naming one of our own dialogs is the
+// transferor's call to the target through us, and the target's dialog is with us, not the transferor, so it is our dialog with them
+// that the INVITE replaces, and it goes to them the way that dialog does
+func (b *B2bua) referTarget(uri *sip.URI, replaces string) (*bridgeTarget, string, error) {
+	if replaces != "" {
+		callID := strings.TrimSpace(strings.SplitN(replaces, ";", 2)[0])
+		b.Lock()
+		other, ok := b.bridges[callID]
+		b.Unlock()
+		if ok {
+			if target, ourReplaces, ok := other.otherDialog(callID); ok {
+				return target, ourReplaces, nil
+			}
+		}
+	}
+
+	if target, ok := b.route(uri.User); ok {
+		return target, replaces, nil
+	}
+
+	// anywhere else is sent to as it is. That includes ourselves, so a call can be transferred to a test line or to voicemail
+	b.Lock()
+	sender := b.sender
+	b.Unlock()
+	if sender == nil {
+		return nil, replaces, fmt.Errorf("can't reach %s", uri)
+	}
+	send, err := sendToUri(sender, uri)
+	if err != nil {
+		return nil, replaces, fmt.Errorf("can't reach %s: %v", uri, err)
+	}
+
+	return &bridgeTarget{uri: uri, transport: ports.TransportUDP, send: send}, replaces, nil
+}
+
+// otherDialog - for the bridge dialog with the call id, the dialog on the other side of the bridge: how to reach that end of it, and
+// the Replaces that names it to them, whose to-tag is theirs and from-tag ours (rfc 3891 3)
+func (br *bridge) otherDialog(callID string) (*bridgeTarget, string, bool) {
+	br.Lock()
+	defer br.Unlock()
+
+	if br.state != bridgeConnected {
+		return nil, "", false
+	}
+
+	var other *bridgeLeg
+	switch {
+	case callID == br.invite.GetCallID() || (br.callerLeg != nil && callID == br.callerLeg.out.GetCallID()):
+		other = br.callee
+	case callID == br.callee.out.GetCallID():
+		other = br.callerLeg
+		if other == nil {
+			// the caller's own dialog, which they started
+			contact := br.invite.GetContact()
+			if contact == nil || contact.Uri == nil {
+				return nil, "", false
+			}
+			target := &bridgeTarget{uri: contact.Uri.Copy(), transport: br.invite.GetTransport(), send: br.sendCaller}
+			return target, replacesDialog(callID, br.invite.GetFrom(), br.invite.GetTo()), true
+		}
+	default:
+		return nil, "", false
+	}
+
+	other.Lock()
+	answer := other.answer
+	other.Unlock()
+	if answer == nil || answer.GetContact() == nil || answer.GetContact().Uri == nil {
+		return nil, "", false
+	}
+
+	target := &bridgeTarget{uri: answer.GetContact().Uri.Copy(), transport: other.target.transport, send: other.send}
+	return target, replacesDialog(other.out.GetCallID(), answer.GetTo(), other.out.GetFrom()), true
+}
+
+// replacesDialog - a Replaces header value naming a dialog by its call id, the recipient's tag and ours
+func replacesDialog(callID string, theirs *sip.Addr, ours *sip.Addr) string {
+	return fmt.Sprintf("%s;to-tag=%s;from-tag=%s", callID, addrTag(theirs), addrTag(ours))
+}
+
+// addrTag - the tag param of a From or To, empty if it has none
+func addrTag(addr *sip.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tag := addr.Param.Get("tag"); tag != nil {
+		return tag.Value
+	}
+
+	return ""
+}
+
+// referredBy - who asked for the transfer, for the target to see (rfc 3892)
+func referredBy(refer ports.SipMessage) string {
+	if by := refer.GetHeader("Referred-By"); by != "" {
+		return by
+	}
+
+	return fmt.Sprintf("<%s>", addrString(refer.GetFrom()))
+}
+
+// pending - whether the target hasn't answered or failed yet
+func (t *transfer) pending() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.outcome == ""
+}
+
+// settle - records how the transfer went, once. Returns false if it already had
+func (t *transfer) settle(outcome string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.outcome != "" {
+		return false
+	}
+	t.outcome = outcome
+
+	return true
+}
+
+// handleResponse - a response from the target to our INVITE
+func (t *transfer) handleResponse(response ports.SipMessage) {
+	status := response.GetStatus()
+	switch {
+	case status < 200:
+		t.Lock()
+		ring := status >= 180 && !t.rang && t.outcome == ""
+		t.rang = t.rang || ring
+		t.Unlock()
+
+		if ring {
+			t.notify(status)
+		}
+
+	case status < 300:
+		// every 2xx is acknowledged, the target sends it again until it is
+		t.leg.acknowledge(response)
+
+		t.Lock()
+		outcome := t.outcome
+		t.Unlock()
+		if outcome == transferFailed {
+			// they answered just as we gave up on them
+			t.leg.hangupWith(response)
+			t.leg.close()
+			return
+		}
+		if !t.settle(transferAnswered) {
+			return
+		}
+
+		t.leg.setAnswer(response)
+		if err := t.leg.call.Connect(response); err != nil {
+			fmt.Printf("b2bua: error connecting call %s: %v\n", t.leg.out.GetCallID(), err)
+			t.leg.hangup()
+			// 500 Server Internal Error
+			t.failed(500)
+			return
+		}
+		t.br.splice(t)
+
+	default:
+		t.leg.acknowledge(response)
+		if t.settle(transferFailed) {
+			fmt.Printf("b2bua: %s turned down the transfer of call %s with %d\n", t.leg.target.uri, t.br.invite.GetCallID(), status)
+			t.failed(status)
+		}
+	}
+}
+
+// fail - gives up on the transfer before the target has heard of it
+func (t *transfer) fail(status int) {
+	if t.settle(transferFailed) {
+		t.failed(status)
+	}
+}
+
+// failed - the target isn't taking the call, which stays as it was. The transferor can take it back, unless they have hung up, when
+// there is nobody left for the other side to talk to
+func (t *transfer) failed(status int) {
+	t.leg.close()
+	t.notify(status)
+
+	br := t.br
+	br.Lock()
+	if br.transfer == t {
+		br.transfer = nil
+	}
+	gone := t.transferorGone
+	callerLeg, caller, callee := br.callerLeg, br.caller, br.callee
+	br.Unlock()
+
+	if !gone {
+		return
+	}
+
+	fmt.Printf("b2bua: transfer of call %s failed with nobody left to take it back\n", br.invite.GetCallID())
+	if t.fromCaller {
+		callee.hangup()
+	} else if callerLeg != nil {
+		callerLeg.hangup()
+	} else if caller != nil {
+		if err := caller.Hangup(); err != nil {
+			fmt.Printf("b2bua: error hanging up call %s: %v\n", br.invite.GetCallID(), err)
+		}
+	}
+	br.finish()
+}
+
+// abandon - the bridge is over before the transfer is, so the target is called off
+func (t *transfer) abandon() {
+	if !t.settle(transferFailed) {
+		return
+	}
+
+	if err := t.leg.cancel(); err != nil {
+		fmt.Printf("b2bua: error cancelling call %s: %v\n", t.leg.out.GetCallID(), err)
+	}
+	t.leg.close()
+}
+
+// splice - the target answered, so they take the transferor's side of the bridge, and the transferor is hung up
+func (br *bridge) splice(t *transfer) {
+	codec, err := t.leg.call.sendCodec()
+	if err != nil {
+		fmt.Printf("b2bua: error connecting call %s: %v\n", t.leg.out.GetCallID(), err)
+		t.leg.hangup()
+		t.failed(500)
+		return
+	}
+	relay := newAudioRelay(codec, t.leg.call.mediaOpts, 0)
+
+	br.Lock()
+	replaced, replacedCaller := br.callee, (*Call)(nil)
+	if t.fromCaller {
+		replaced, replacedCaller = br.callerLeg, br.caller
+		br.callerLeg = t.leg
+		br.toCaller = relay
+	} else {
+		br.callee = t.leg
+		br.toCallee = relay
+	}
+	br.transfer = nil
+	gone := t.transferorGone
+	br.Unlock()
+
+	if t.fromCaller {
+		t.leg.call.OnAudio(br.fromCaller)
+	} else {
+		t.leg.call.OnAudio(br.fromCallee)
+	}
+	go br.play(t.leg, relay)
+
+	fmt.Printf("b2bua: transferred call %s to %s\n", br.invite.GetCallID(), t.leg.target.uri)
+	t.notify(200)
+
+	if gone {
+		return
+	}
+	if replaced != nil {
+		replaced.hangup()
+	} else if replacedCaller != nil {
+		if err := replacedCaller.Hangup(); err != nil {
+			fmt.Printf("b2bua: error hanging up call %s: %v\n", br.invite.GetCallID(), err)
+		}
+	}
+}
+
+// notify - tells the transferor how the transfer is going, with the status line of the target's response. A final one ends the
+// subscription the REFER started
+func (t *transfer) notify(status int) {
+	t.br.Lock()
+	gone := t.transferorGone
+	t.br.Unlock()
+
+	t.Lock()
+	if gone || t.notified {
+		t.Unlock()
+		return
+	}
+	final := status >= 200
+	t.notified = final
+	t.Unlock()
+
+	var notify ports.SipMessage
+	var send ports.SendResponseCallback
+	var err error
+	if t.transferor != nil {
+		notify, err = t.transferor.request(ports.MethodNotify)
+		send = t.transferor.send
+	} else {
+		notify, err = t.br.fsm.NewRequest(t.br.invite, ports.MethodNotify)
+		send = t.br.sendCaller
+	}
+	if err != nil {
+		fmt.Printf("b2bua: error notifying the transferor of call %s: %v\n", t.br.invite.GetCallID(), err)
+		return
+	}
+
+	notify.SetHeader("Event", "refer")
+	if final {
+		notify.SetHeader("Subscription-State", "terminated;reason=noresource")
+	} else {
+		notify.SetHeader("Subscription-State", fmt.Sprintf("active;expires=%d", referExpiresSeconds))
+	}
+	notify.SetPayload("message/sipfrag;version=2.0", []byte(fmt.Sprintf("SIP/2.0 %d %s\r\n", status, sip.Phrase(status))))
+
+	var b bytes.Buffer
+	notify.Append(&b)
+	if err := send(b.Bytes()); err != nil {
+		fmt.Printf("b2bua: error notifying the transferor of call %s: %v\n", t.br.invite.GetCallID(), err)
+	}
+}
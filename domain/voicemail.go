@@ -0,0 +1,340 @@
+package domain
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"sip_and_rip/ports"
+)
+
+const (
+	// the longest we will let a subscription go without a refresh
+	maxSubscriptionSeconds = 3600
+	// how long we wait for the owner to pick what to do with a message before moving on
+	voicemailMenuTimeout = 5 * time.Second
+	// the frequency of the beeps we play
+	beepHz = 1000
+)
+
+var errNotMailboxOwner = fmt.Errorf("not the mailbox's owner")
+
+// mwiSubscription - a phone that wants to know when its mailbox changes (rfc 3842)
+type mwiSubscription struct {
+	mailbox   string
+	subscribe ports.SipMessage
+	send      ports.SendResponseCallback
+	cseq      int
+	expiresAt time.Time
+}
+
+// Voicemail - takes messages for registered users who don't answer, lets them listen to them, and tells their phones when they have new ones
+type Voicemail struct {
+	sync.Mutex
+	cfg       *Config
+	store     ports.MailboxStore
+	registrar *Registrar
+	// message-summary subscriptions by call id
+	subscriptions map[string]*mwiSubscription
+}
+
+// NewVoicemail - creates the voicemail application
+func NewVoicemail(cfg *Config, store ports.MailboxStore, registrar *Registrar) *Voicemail {
+	return &Voicemail{
+		cfg:           cfg,
+		store:         store,
+		registrar:     registrar,
+		subscriptions: make(map[string]*mwiSubscription),
+	}
+}
+
+// Route - returns the handler for an INVITE if it is meant for voicemail, or nil if it isn't. errNotMailboxOwner means it is, but it
+// didn't come from the phone of the mailbox's owner and should get a 403
+func (v *Voicemail) Route(sipMsg ports.SipMessage) (CallHandler, error) {
+	dialed := sipMsg.GetRequest().User
+	if dialed != v.cfg.VoicemailNumber {
+		return nil, nil
+	}
+
+	// owners dial in to their own mailbox, which we know by who is calling, from one of their registered phones
+	mailbox := aorUser(sipMsg.GetFrom())
+	if !v.registrar.IsRegisteredFrom(mailbox, sipMsg.GetSource()) {
+		return nil, fmt.Errorf("%w: %q from %v", errNotMailboxOwner, mailbox, sipMsg.GetSource())
+	}
+
+	return v.checkMessages(mailbox), nil
+}
+
+// Subscribe - handles a SUBSCRIBE for the message-summary event, sending the current counts right away
+func (v *Voicemail) Subscribe(sipMsg ports.SipMessage, send ports.SendResponseCallback) error {
+	if sipMsg.GetHeader("Event") != "message-summary" {
+		// 489 Bad Event
+		return sendResponse(sipMsg, 489, send)
+	}
+
+	// phones subscribe to either their mailbox or their own AoR, and only from where they registered
+	mailbox := sipMsg.GetRequest().User
+	if mailbox == "" || mailbox == v.cfg.VoicemailNumber {
+		mailbox = aorUser(sipMsg.GetFrom())
+	}
+	if !v.registrar.IsRegisteredFrom(mailbox, sipMsg.GetSource()) {
+		fmt.Printf("voicemail: turning down a subscription to %q from %v, it isn't one of their phones\n", mailbox, sipMsg.GetSource())
+		// 403 Forbidden
+		return sendResponse(sipMsg, 403, send)
+	}
+
+	expires := sipMsg.GetExpires()
+	if expires > maxSubscriptionSeconds {
+		expires = maxSubscriptionSeconds
+	}
+
+	v.Lock()
+	sub, ok := v.subscriptions[sipMsg.GetCallID()]
+	if !ok {
+		sub = &mwiSubscription{
+			mailbox:   mailbox,
+			subscribe: sipMsg,
+			send:      send,
+		}
+	}
+	sub.expiresAt = time.Now().Add(time.Duration(expires) * time.Second)
+	if expires > 0 {
+		v.subscriptions[sipMsg.GetCallID()] = sub
+	} else {
+		delete(v.subscriptions, sipMsg.GetCallID())
+	}
+	v.Unlock()
+
+	if err := sendResponse(sipMsg, 200, send); err != nil {
+		return err
+	}
+
+	// the first NOTIFY always follows a SUBSCRIBE, even an unsubscribe
+	return v.sendNotify(sub)
+}
+
+// leaveMessage - plays the greeting and a beep, then records until the caller hangs up
+func (v *Voicemail) leaveMessage(mailbox string) CallHandler {
+	return func(call *Call, sipMsg ports.SipMessage) error {
+		fmt.Printf("voicemail: %s is leaving a message for %s\n", addrString(sipMsg.GetFrom()), mailbox)
+
+		greeting := v.store.Greeting(mailbox)
+		if greeting == "" {
+			greeting = v.cfg.VoicemailGreeting
+		}
+		if greeting != "" {
+			if err := v.playFile(call, greeting); err != nil {
+				return err
+			}
+		}
+
+		beep, err := call.PlanTone(ToneBeep, 0)
+		if err != nil {
+			return err
+		}
+		if err := call.Play(beep); err != nil {
+			return err
+		}
+
+		dir, err := v.store.RecordingDir(mailbox)
+		if err != nil {
+			return err
+		}
+
+		recorder, err := call.Record(dir, sipMsg)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-call.Done():
+		case <-time.After(time.Duration(v.cfg.VoicemailMaxSeconds) * time.Second):
+			if err := call.Hangup(); err != nil {
+				fmt.Println("voicemail: error hanging up: ", err)
+			}
+		}
+
+		quality := call.Quality()
+		if err := recorder.Stop(&quality); err != nil {
+			return err
+		}
+
+		// they hung up before saying anything
+		if recorder.Packets() == 0 {
+			return v.store.Delete(mailbox, recorder.ID())
+		}
+
+		v.notifyMailbox(mailbox)
+
+		return nil
+	}
+}
+
+// checkMessages - lets the owner listen to their messages. After each message 7 deletes it, 1 replays it, and anything else (or nothing) saves it
+func (v *Voicemail) checkMessages(mailbox string) CallHandler {
+	return func(call *Call, sipMsg ports.SipMessage) error {
+		messages, err := v.store.List(mailbox)
+		if err != nil {
+			return err
+		}
+
+		// without prompts, announce the number of new messages with a beep for each
+		for _, msg := range messages {
+			if msg.Heard {
+				break
+			}
+			if err := v.playBeep(call, 150); err != nil {
+				return err
+			}
+		}
+
+		defer v.notifyMailbox(mailbox)
+
+		for i := 0; i < len(messages); {
+			msg := messages[i]
+
+			reader, err := call.OpenWav(msg.WavFile)
+			if err != nil {
+				fmt.Printf("voicemail: skipping message %s: %v\n", msg.ID, err)
+				i++
+				continue
+			}
+
+			digit, err := call.PlayUntilDigit(reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+
+			if digit == 0 {
+				if digit, err = call.WaitForDigit(voicemailMenuTimeout); err != nil {
+					return err
+				}
+			}
+
+			switch digit {
+			case '1':
+				continue
+			case '7':
+				if err := v.store.Delete(mailbox, msg.ID); err != nil {
+					return err
+				}
+			default:
+				if err := v.store.MarkHeard(mailbox, msg.ID); err != nil {
+					return err
+				}
+			}
+			i++
+		}
+
+		// a low tone to say goodbye
+		if err := v.playTone(call, beepHz/2, 700); err != nil {
+			return err
+		}
+
+		return call.Hangup()
+	}
+}
+
+// notifyMailbox - sends the current message counts to every phone subscribed to the mailbox
+func (v *Voicemail) notifyMailbox(mailbox string) {
+	v.Lock()
+	var subs []*mwiSubscription
+	for callID, sub := range v.subscriptions {
+		if time.Now().After(sub.expiresAt) {
+			delete(v.subscriptions, callID)
+			continue
+		}
+		if sub.mailbox == mailbox {
+			subs = append(subs, sub)
+		}
+	}
+	v.Unlock()
+
+	for _, sub := range subs {
+		if err := v.sendNotify(sub); err != nil {
+			fmt.Printf("voicemail: error notifying %s: %v\n", mailbox, err)
+		}
+	}
+}
+
+func (v *Voicemail) sendNotify(sub *mwiSubscription) error {
+	messages, err := v.store.List(sub.mailbox)
+	if err != nil {
+		return err
+	}
+
+	newCount, oldCount := 0, 0
+	for _, msg := range messages {
+		if msg.Heard {
+			oldCount++
+		} else {
+			newCount++
+		}
+	}
+
+	v.Lock()
+	sub.cseq++
+	cseq := sub.cseq
+	remaining := int(time.Until(sub.expiresAt).Seconds())
+	v.Unlock()
+
+	notify, err := sub.subscribe.NewInDialogRequest(ports.MethodNotify, cseq)
+	if err != nil {
+		return err
+	}
+
+	notify.SetHeader("Event", "message-summary")
+	if remaining > 0 {
+		notify.SetHeader("Subscription-State", fmt.Sprintf("active;expires=%d", remaining))
+	} else {
+		notify.SetHeader("Subscription-State", "terminated;reason=timeout")
+	}
+
+	account := fmt.Sprintf("sip:%s@%s", sub.mailbox, sub.subscribe.GetRequest().Host)
+	notify.SetPayload("application/simple-message-summary", messageSummary(account, newCount, oldCount))
+
+	var b bytes.Buffer
+	notify.Append(&b)
+
+	return sub.send(b.Bytes())
+}
+
+// messageSummary - the body of a message-summary NOTIFY
+func messageSummary(account string, newCount int, oldCount int) []byte {
+	waiting := "no"
+	if newCount > 0 {
+		waiting = "yes"
+	}
+
+	return []byte(fmt.Sprintf("Messages-Waiting: %s\r\nMessage-Account: %s\r\nVoice-Message: %d/%d\r\n", waiting, account, newCount, oldCount))
+}
+
+func (v *Voicemail) playTone(call *Call, freqHz int, durationMs int) error {
+	tone, err := call.Tone(freqHz, durationMs)
+	if err != nil {
+		return err
+	}
+
+	return call.Play(tone)
+}
+
+// playBeep - plays a beep followed by a short silence, so back to back beeps can be counted
+func (v *Voicemail) playBeep(call *Call, durationMs int) error {
+	if err := v.playTone(call, beepHz, durationMs); err != nil {
+		return err
+	}
+
+	return v.playTone(call, 0, 150)
+}
+
+func (v *Voicemail) playFile(call *Call, filename string) error {
+	reader, err := call.OpenWav(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return call.Play(reader)
+}
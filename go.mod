@@ -3,13 +3,22 @@ module sip_and_rip
 go 1.20
 
 require (
-	github.com/beevik/ntp v0.3.0 // indirect
-	github.com/jart/gosip v0.0.0-20220818224804-29801cedf805 // indirect
-	github.com/looplab/fsm v1.0.1 // indirect
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/jart/gosip v0.0.0-20220818224804-29801cedf805
+	github.com/looplab/fsm v1.0.1
+	github.com/pion/dtls/v2 v2.2.7
+	github.com/pion/rtcp v1.2.12
+	github.com/pion/rtp v1.8.3
+	github.com/pion/srtp/v2 v2.0.18
+	github.com/pion/stun v0.6.1
+	golang.org/x/net v0.17.0
+	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32
+)
+
+require (
+	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.10 // indirect
-	github.com/pion/rtp v1.7.13 // indirect
-	github.com/pixelbender/go-sdp v1.1.0 // indirect
-	golang.org/x/net v0.7.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	github.com/pion/transport/v2 v2.2.3 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
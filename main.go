@@ -1,32 +1,408 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
 	"sip_and_rip/adapters"
 	"sip_and_rip/domain"
 	"sip_and_rip/ports"
 )
 
 func main() {
-	api := domain.NewApi()
+	addr := flag.String("addr", "0.0.0.0:5061", "the address to listen for sip messages on")
+	tlsAddr := flag.String("tls-addr", "", "the address to listen for sip messages over tls on, disabled when empty")
+	tlsCert := flag.String("tls-cert", "", "the certificate for sip over tls, in pem")
+	tlsKey := flag.String("tls-key", "", "the certificate's private key, in pem")
+	wsAddr := flag.String("ws-addr", "", "the address to listen for sip messages over websockets on, for browsers. disabled when empty")
+	wssAddr := flag.String("wss-addr", "", "the address to listen for sip messages over secure websockets on, with -tls-cert and -tls-key. disabled when empty")
+	srtpPolicy := flag.String("srtp", domain.SrtpPrefer, "require, prefer or disable srtp for calls' media. srtp keys are only exchanged over tls")
+	silenceMode := flag.String("silence", domain.SilenceComfortNoise, "cn, silence or off. cn sends comfort noise in place of silence to callers that support it, and silence frames between prompts to the rest. silence always sends silence frames between prompts")
+	tonePlan := flag.String("tone-plan", domain.TonePlanUS, "us, uk or eu, whose ringback, busy and other tones to play")
+	mediaIP := flag.String("media-ip", "", "the ip to bind rtp to and advertise in sdp, defaults to every interface")
+	rtpPortMin := flag.Int("rtp-port-min", 10000, "the lowest port rtp and rtcp can use")
+	rtpPortMax := flag.Int("rtp-port-max", 20000, "the highest port rtp and rtcp can use")
+	mediaDir := flag.String("media-dir", ".", "the directory the files calls hear are in")
+	playFile := flag.String("play-file", "ulaw-test.wav", "the wav file calls hear when no play rule matches, in -media-dir")
+	playRules := flag.String("play-rules", "", "a json file of rules that pick the wav file each call hears by dialed number, caller or time of day")
+	playHeader := flag.Bool("play-header", false, "let callers pick the wav file they hear from -media-dir with an X-Play-File header")
+	promptCacheMB := flag.Int("prompt-cache-mb", 64, "keep up to this many megabytes of wav files in memory, ready to send, for every call to share. disabled when 0")
+	recordingDir := flag.String("recording-dir", "", "record the caller's audio to .wav files in this directory, disabled when empty")
+	voicemailDir := flag.String("voicemail-dir", "", "keep voicemail boxes in this directory, disabled when empty")
+	voicemailNumber := flag.String("voicemail-number", "*97", "the number to dial to listen to your voicemail")
+	voicemailGreeting := flag.String("voicemail-greeting", "", "the greeting for mailboxes without their own greeting.wav")
+	voicemailMaxSeconds := flag.Int("voicemail-max-seconds", 120, "the longest voicemail a caller can leave")
+	echoNumber := flag.String("echo-number", "9196", "the number that echoes callers back to themselves, disabled when empty")
+	echoDelayMs := flag.Int("echo-delay-ms", 0, "how late the echo is, in milliseconds")
+	milliwattNumber := flag.String("milliwatt-number", "9197", "the number that plays a 1004hz test tone at 0dBm0, disabled when empty")
+	reflectorNumber := flag.String("reflector-number", "9198", "the number that sends callers' rtp packets straight back, sequence numbers and all. disabled when empty")
+	bridgeRoutes := flag.String("bridge-routes", "", "a json file of routes that send calls to numbers on to sip uris, ie other phones or a pbx. calls to registered users always ring them")
+	conferenceRooms := flag.String("conference-rooms", "", "a json file of the numbers callers dial to talk to each other, and their pins")
+	queues := flag.String("queues", "", "a json file of the numbers callers dial to wait on hold for the next free agent")
+	agentLoginCode := flag.String("agent-login-code", "*71", "the feature code agents dial, then a queue's number or nothing for every queue, to log in. disabled when empty")
+	agentLogoutCode := flag.String("agent-logout-code", "*72", "the feature code agents dial, then a queue's number or nothing for every queue, to log out. disabled when empty")
+	agentPauseCode := flag.String("agent-pause-code", "*73", "the feature code agents dial to stop being offered calls for a while. disabled when empty")
+	agentUnpauseCode := flag.String("agent-unpause-code", "*74", "the feature code agents dial to be offered calls again. disabled when empty")
+	proxyMode := flag.String("proxy", domain.ProxyOff, "off, stateless or stateful. off bridges calls to registered users and -bridge-routes as a back to back user agent, the others proxy them. only a stateful proxy forks to every phone a user has")
+	ringSeconds := flag.Int("ring-seconds", 30, "how long bridged calls ring before going to voicemail, or being turned away")
+	metricsAddr := flag.String("metrics-addr", "", "serve call quality metrics at /debug/vars on this address, disabled when empty")
+	controlAddr := flag.String("control-addr", "", "serve the control api, which mutes and kicks conference participants, on this address. it has no authentication, so keep it to localhost. disabled when empty")
+	flag.Parse()
 
-	addr := "0.0.0.0:5061"
-	server := getServer(addr, api)
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	api := domain.NewApi(&domain.Config{
+		MediaDir:            *mediaDir,
+		DefaultPlayFile:     *playFile,
+		PlayRules:           getPlayRules(*playRules),
+		PlayFileHeader:      *playHeader,
+		RecordingDir:        *recordingDir,
+		VoicemailNumber:     *voicemailNumber,
+		VoicemailGreeting:   *voicemailGreeting,
+		VoicemailMaxSeconds: *voicemailMaxSeconds,
+		EchoNumber:          *echoNumber,
+		EchoDelayMs:         getEchoDelayMs(*echoDelayMs),
+		MilliwattNumber:     *milliwattNumber,
+		ReflectorNumber:     *reflectorNumber,
+		BridgeRoutes:        getBridgeRoutes(*bridgeRoutes),
+		ConferenceRooms:     getConferenceRooms(*conferenceRooms),
+		Queues:              getQueues(*queues),
+		AgentLoginCode:      *agentLoginCode,
+		AgentLogoutCode:     *agentLogoutCode,
+		AgentPauseCode:      *agentPauseCode,
+		AgentUnpauseCode:    *agentUnpauseCode,
+		RingSeconds:         getRingSeconds(*ringSeconds),
+		ProxyMode:           getProxyMode(*proxyMode),
+		SrtpPolicy:          getSrtpPolicy(*srtpPolicy),
+		SilenceMode:         getSilenceMode(*silenceMode),
+		TonePlan:            getTonePlan(*tonePlan),
+	}, getFactories(*promptCacheMB), getPortAllocator(*mediaIP, *rtpPortMin, *rtpPortMax), getMailboxStore(*voicemailDir))
+
+	server := getServer(*addr, api)
+	api.SetSipSender(server)
+
+	if *tlsAddr != "" {
+		tlsServer := getTLSServer(*tlsAddr, *tlsCert, *tlsKey, api)
+
+		fmt.Println("Listening for tls on: ", *tlsAddr)
+		go func() {
+			if err := tlsServer.Serve(); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if *wsAddr != "" {
+		wsServer := adapters.NewWSServer(*wsAddr, "", "", api)
+
+		fmt.Println("Listening for websockets on: ", *wsAddr)
+		go func() {
+			if err := wsServer.Serve(); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if *wssAddr != "" {
+		wssServer := getWSSServer(*wssAddr, *tlsCert, *tlsKey, api)
+
+		fmt.Println("Listening for secure websockets on: ", *wssAddr)
+		go func() {
+			if err := wssServer.Serve(); err != nil {
+				panic(err)
+			}
+		}()
+	}
 
-	fmt.Println("Listening on: ", addr)
+	if *controlAddr != "" {
+		controlServer := adapters.NewControlServer(*controlAddr, api)
+
+		fmt.Println("Serving the control api on: ", *controlAddr)
+		go func() {
+			if err := controlServer.Serve(); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	fmt.Println("Listening on: ", *addr)
 	if err := server.Serve(); err != nil {
 		panic(err)
 	}
 }
 
-func getServer(addr string, api ports.Api) ports.PublicServer {
-	var server ports.PublicServer
-	var err error
+func getServer(addr string, api ports.Api) *adapters.UDPServer {
+	server, err := adapters.NewUDPServer(addr, api)
+	if err != nil {
+		panic(err)
+	}
+
+	return server
+}
+
+// getTLSServer - sip over tls, which calls need for srtp
+func getTLSServer(addr string, certFile string, keyFile string, api ports.Api) ports.PublicServer {
+	if certFile == "" || keyFile == "" {
+		panic("sip over tls needs -tls-cert and -tls-key")
+	}
 
-	server, err = adapters.NewUDPServer(addr, api)
+	server, err := adapters.NewTLSServer(addr, certFile, keyFile, api)
 	if err != nil {
 		panic(err)
 	}
 
 	return server
 }
+
+// getWSSServer - sip over secure websockets, which browsers on https pages need
+func getWSSServer(addr string, certFile string, keyFile string, api ports.Api) ports.PublicServer {
+	if certFile == "" || keyFile == "" {
+		panic("sip over secure websockets needs -tls-cert and -tls-key")
+	}
+
+	return adapters.NewWSServer(addr, certFile, keyFile, api)
+}
+
+// getEchoDelayMs - checks the delay is one we can hold, the echo keeps that much of the caller's audio
+func getEchoDelayMs(delayMs int) int {
+	if delayMs < 0 || delayMs > 10000 {
+		panic(fmt.Sprintf("-echo-delay-ms must be between 0 and 10000, not %d", delayMs))
+	}
+
+	return delayMs
+}
+
+// getSrtpPolicy - checks the policy is one we know
+func getSrtpPolicy(policy string) string {
+	switch policy {
+	case domain.SrtpRequire, domain.SrtpPrefer, domain.SrtpDisable:
+		return policy
+	}
+
+	panic(fmt.Sprintf("invalid srtp policy: %s", policy))
+}
+
+// getPlayRules - reads the rules from the json file, none when there isn't one
+func getPlayRules(filename string) []domain.PlayRule {
+	if filename == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	var rules []domain.PlayRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		panic(fmt.Sprintf("invalid play rules in %s: %v", filename, err))
+	}
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			panic(fmt.Sprintf("invalid play rule %d in %s: %v", i, filename, err))
+		}
+	}
+
+	return rules
+}
+
+// getBridgeRoutes - reads the routes from the json file, none when there isn't one
+func getBridgeRoutes(filename string) []domain.BridgeRoute {
+	if filename == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	var routes []domain.BridgeRoute
+	if err := json.Unmarshal(b, &routes); err != nil {
+		panic(fmt.Sprintf("invalid bridge routes in %s: %v", filename, err))
+	}
+	for i, route := range routes {
+		if err := route.Validate(); err != nil {
+			panic(fmt.Sprintf("invalid bridge route %d in %s: %v", i, filename, err))
+		}
+	}
+
+	return routes
+}
+
+// getConferenceRooms - reads the rooms from the json file, none when there isn't one
+func getConferenceRooms(filename string) []domain.ConferenceRoom {
+	if filename == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	var rooms []domain.ConferenceRoom
+	if err := json.Unmarshal(b, &rooms); err != nil {
+		panic(fmt.Sprintf("invalid conference rooms in %s: %v", filename, err))
+	}
+	for i, room := range rooms {
+		if err := room.Validate(); err != nil {
+			panic(fmt.Sprintf("invalid conference room %d in %s: %v", i, filename, err))
+		}
+	}
+
+	return rooms
+}
+
+// getQueues - reads the queues from the json file, none when there isn't one
+func getQueues(filename string) []domain.CallQueue {
+	if filename == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	var queues []domain.CallQueue
+	if err := json.Unmarshal(b, &queues); err != nil {
+		panic(fmt.Sprintf("invalid queues in %s: %v", filename, err))
+	}
+	for i, queue := range queues {
+		if err := queue.Validate(); err != nil {
+			panic(fmt.Sprintf("invalid queue %d in %s: %v", i, filename, err))
+		}
+	}
+
+	return queues
+}
+
+// getProxyMode - checks the mode is one we know
+func getProxyMode(mode string) string {
+	switch mode {
+	case domain.ProxyOff, domain.ProxyStateless, domain.ProxyStateful:
+		return mode
+	}
+
+	panic(fmt.Sprintf("invalid proxy mode: %s", mode))
+}
+
+// getRingSeconds - checks bridged calls ring for a while, but not forever
+func getRingSeconds(seconds int) int {
+	if seconds < 1 || seconds > 300 {
+		panic(fmt.Sprintf("-ring-seconds must be between 1 and 300, not %d", seconds))
+	}
+
+	return seconds
+}
+
+// getSilenceMode - checks the mode is one we know
+func getSilenceMode(mode string) string {
+	switch mode {
+	case domain.SilenceComfortNoise, domain.SilenceFrames, domain.SilenceOff:
+		return mode
+	}
+
+	panic(fmt.Sprintf("invalid silence mode: %s", mode))
+}
+
+// getTonePlan - checks the plan is one we know
+func getTonePlan(plan string) string {
+	switch plan {
+	case domain.TonePlanUS, domain.TonePlanUK, domain.TonePlanEU:
+		return plan
+	}
+
+	panic(fmt.Sprintf("invalid tone plan: %s", plan))
+}
+
+// serveMetrics - expvar registers its handler on the default mux
+func serveMetrics(addr string) {
+	fmt.Println("Serving metrics on: ", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		fmt.Println("error serving metrics: ", err)
+	}
+}
+
+// getFactories - wires the domain up with our adapters. Wav files are read through the prompt cache, unless it has no room
+func getFactories(promptCacheMB int) *ports.Factories {
+	// every browser call shakes hands with the same certificate, its fingerprint goes in our sdp
+	webRtcCert, err := adapters.NewWebRtcCertificate()
+	if err != nil {
+		panic(err)
+	}
+
+	newWavReader := func(filename string, codec ports.Codec, opts *ports.MediaOptions) (ports.MediaReadCloser, error) {
+		return adapters.NewWavReaderForCodec(filename, codec, opts)
+	}
+	if promptCacheMB > 0 {
+		cache := adapters.NewPromptCache(int64(promptCacheMB) << 20)
+		newWavReader = cache.Open
+	}
+
+	return &ports.Factories{
+		ParseSipMessage: func(b []byte) (ports.SipMessage, error) {
+			return adapters.ParseSipMsg(b)
+		},
+		NewRtpClient: func(conn ports.MediaConn, rtpAddr *net.UDPAddr, ssrc uint32, opts *ports.MediaOptions) (ports.RtpClient, error) {
+			return adapters.NewRtpClient(conn, rtpAddr, ssrc, opts)
+		},
+		NewRtpReceiver: func(conn ports.MediaConn) ports.RtpReceiver {
+			return adapters.NewRtpReceiver(conn)
+		},
+		NewWavReader: newWavReader,
+		NewToneReader: func(tone ports.Tone, durationMs int, codec ports.Codec, opts *ports.MediaOptions) ports.MediaReader {
+			return adapters.NewToneReader(tone, durationMs, codec, opts)
+		},
+		NewWavWriter: func(filename string, sampleRateHz int, channelSize int) (ports.MediaWriter, error) {
+			return adapters.NewWavWriter(filename, sampleRateHz, channelSize)
+		},
+		NewCodec:     adapters.NewCodec,
+		NewOpusCodec: adapters.NewOpusCodec,
+		NewSrtpKey:   adapters.NewSrtpKey,
+		NewSrtpSession: func(suite string, localKey []byte, remoteKey []byte) (ports.SrtpSession, error) {
+			return adapters.NewSrtpSession(suite, localKey, remoteKey)
+		},
+		NewWebRtcTransport: func(conn *net.UDPConn, remote *ports.WebRtcParams) (ports.WebRtcTransport, error) {
+			return adapters.NewWebRtcTransport(conn, remote, webRtcCert)
+		},
+	}
+}
+
+// getPortAllocator - hands out rtp ports from the range. When the ip is empty we bind to every interface and advertise the address the caller dialed
+func getPortAllocator(mediaIP string, min int, max int) ports.PortAllocator {
+	ip := net.IPv4zero
+	if mediaIP != "" {
+		if ip = net.ParseIP(mediaIP); ip == nil {
+			panic(fmt.Sprintf("invalid media ip: %s", mediaIP))
+		}
+	}
+
+	allocator, err := adapters.NewPortAllocator(ip, min, max)
+	if err != nil {
+		panic(err)
+	}
+
+	return allocator
+}
+
+// getMailboxStore - the voicemail boxes, or nil to disable voicemail
+func getMailboxStore(dir string) ports.MailboxStore {
+	if dir == "" {
+		return nil
+	}
+
+	store, err := adapters.NewFileMailboxStore(dir)
+	if err != nil {
+		fmt.Println("error creating mailbox store, voicemail is disabled: ", err)
+		return nil
+	}
+
+	return store
+}
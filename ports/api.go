@@ -9,5 +9,14 @@ type SendResponseCallback func(b []byte) error
 
 // Api - is the interface for the sip/rtp servers api
 type Api interface {
-	HandleSipMessage(remoteAddr *net.UDPAddr, msg []byte, sendFunc SendResponseCallback) error
+	// the transport is one of the Transport constants. Messages over tls and websockets come from a tcp address, which is passed as its ip and port
+	HandleSipMessage(remoteAddr *net.UDPAddr, transport string, msg []byte, sendFunc SendResponseCallback) error
+}
+
+// SipSender - sends sip messages to an address of our choosing, for the requests we start ourselves, ie the INVITE to the far end of
+// a bridged call. What comes back is handled like any other message
+type SipSender interface {
+	SendTo(addr *net.UDPAddr, b []byte) error
+	// the address we send from, which goes in our Via and Contact
+	LocalAddr() *net.UDPAddr
 }
@@ -0,0 +1,26 @@
+package ports
+
+const (
+	// PcmuPayloadType - g711 u-law, the static payload type every sip client supports
+	PcmuPayloadType = uint8(0)
+	// PcmaPayloadType - g711 a-law
+	PcmaPayloadType = uint8(8)
+	// OpusClockRateHz - opus timestamps always count at 48000hz, whatever rate it is encoded at (rfc 7587 4.1)
+	OpusClockRateHz = 48000
+)
+
+// Codec - converts audio between 16 bit linear pcm samples and an rtp payload
+type Codec interface {
+	// the encoding name as it appears in an sdp rtpmap, ie PCMU
+	Name() string
+	// the static (or negotiated) rtp payload type
+	PayloadType() uint8
+	// the rate of the pcm samples it encodes and decodes, 8000hz for g711
+	SampleRateHz() int
+	// the rate of the rtp timestamps, which is the sample rate for g711 but 48000hz for opus
+	ClockRateHz() int
+	// encodes pcm samples into an rtp payload
+	Encode(pcm []int16) []byte
+	// decodes an rtp payload into pcm samples
+	Decode(payload []byte) []int16
+}
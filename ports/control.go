@@ -0,0 +1,35 @@
+package ports
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrNotFound - what the control api gets back for a room or participant that doesn't exist, ie one who has already hung up
+var ErrNotFound = fmt.Errorf("not found")
+
+// ConferenceParticipant - someone in a conference room
+type ConferenceParticipant struct {
+	// unique within the room, for muting and kicking them
+	ID       string    `json:"id"`
+	Caller   string    `json:"caller"`
+	JoinedAt time.Time `json:"joined_at"`
+	// the rest of the room can't hear them
+	Muted bool `json:"muted"`
+}
+
+// Conference - a conference room with someone in it
+type Conference struct {
+	Room         string                  `json:"room"`
+	Participants []ConferenceParticipant `json:"participants"`
+}
+
+// Control - what the control api can do to the calls in progress
+type Control interface {
+	// the rooms that have someone in them
+	Conferences() []Conference
+	// stops or starts the rest of the room hearing the participant
+	MuteParticipant(room string, id string, muted bool) error
+	// hangs up on the participant
+	KickParticipant(room string, id string) error
+}
@@ -0,0 +1,31 @@
+package ports
+
+import (
+	"net"
+)
+
+// Factories - the constructors for everything the domain needs from the outside world. main wires in the adapters, tests can wire in fakes
+type Factories struct {
+	// parses a packet into a sip message
+	ParseSipMessage func(b []byte) (SipMessage, error)
+	// sends rtp to a client from our local socket
+	NewRtpClient func(conn MediaConn, rtpAddr *net.UDPAddr, ssrc uint32, opts *MediaOptions) (RtpClient, error)
+	// reads a client's rtp from our local socket
+	NewRtpReceiver func(conn MediaConn) RtpReceiver
+	// reads a wav file as rtp frames encoded with the codec
+	NewWavReader func(filename string, codec Codec, opts *MediaOptions) (MediaReadCloser, error)
+	// synthesizes a tone as rtp frames. The duration cuts it short, without one it plays its cadence once, or forever if it repeats
+	NewToneReader func(tone Tone, durationMs int, codec Codec, opts *MediaOptions) MediaReader
+	// writes pcm samples to a wav file
+	NewWavWriter func(filename string, sampleRateHz int, channelSize int) (MediaWriter, error)
+	// the codec for an rtp payload type
+	NewCodec func(payloadType uint8) (Codec, error)
+	// the opus codec, at the dynamic payload type the call negotiated for it
+	NewOpusCodec func(payloadType uint8) (Codec, error)
+	// a random master key and salt for an srtp crypto suite, to offer in our a=crypto
+	NewSrtpKey func(suite string) ([]byte, error)
+	// protects a call's media with our key and the caller's
+	NewSrtpSession func(suite string, localKey []byte, remoteKey []byte) (SrtpSession, error)
+	// carries a call's media to a browser over its rtp socket, with the caller's ice and dtls parameters from their offer
+	NewWebRtcTransport func(conn *net.UDPConn, remote *WebRtcParams) (WebRtcTransport, error)
+}
@@ -5,6 +5,27 @@ type MediaReader interface {
 	NextRtpFrame() ([]byte, error)
 }
 
+// MediaReadCloser - a media stream backed by something that has to be closed, ie a file
+type MediaReadCloser interface {
+	MediaReader
+	Close() error
+}
+
+// ToneSegment - a stretch of a tone's cadence. Its frequencies are mixed together, and it is silence without any
+type ToneSegment struct {
+	FreqsHz    []int
+	DurationMs int
+}
+
+// Tone - a pattern of tones and silences, ie ringback's two seconds on and four off
+type Tone struct {
+	Segments []ToneSegment
+	// plays the cadence over and over, rather than once
+	Repeat bool
+	// the peak of the tone as a 16 bit sample, the reader's own when 0
+	Amplitude int
+}
+
 // MediaOptions - the type of media that will be sent
 type MediaOptions struct {
 	// an arbitrary number, but a practical one. balances packet size, network delay, and codec efficiency. commonly used for ulaw/g711.
@@ -14,6 +35,8 @@ type MediaOptions struct {
 	// the number of analog samples taken per second to convert to digital form. So 8000 analog samples are taken per second to convert to digital form. Higher the sampling rate, better is the quality
 	// a typical g711 sample rate. 8000hz.
 	SampleRateHz int
+	// the rate our rtp timestamps count at. Left at 0 they count samples, opus has them at 48000hz whatever its sample rate
+	ClockRateHz int
 	// Lets us know how many bytes are in a sample size
 	// g711 typically uses 16bit PCM samples, so 2 bytes.
 	SampleFormatPcmBytes int
@@ -50,6 +73,15 @@ func (m *MediaOptions) GetSampleSize() int {
 	return m.SampleRateHz / m.GetFramesPerSecond()
 }
 
+// GetClockTicks - how far the rtp timestamp moves in a frame
+func (m *MediaOptions) GetClockTicks() int {
+	if m == nil || m.ClockRateHz == 0 {
+		return m.GetSampleSize()
+	}
+
+	return m.ClockRateHz / m.GetFramesPerSecond()
+}
+
 // GetBufferSize - the size of the buffer needed to hold a frame
 func (m *MediaOptions) GetBufferSize() int {
 	if m == nil {
@@ -68,3 +100,9 @@ func (m *MediaOptions) GetBufferSize() int {
 
 	return m.GetSampleSize() * m.SampleFormatPcmBytes * m.ChannelSize
 }
+
+// MediaWriter - writes a decoded media stream to a sink
+type MediaWriter interface {
+	WriteSamples(pcm []int16) error
+	Close() error
+}
@@ -1,10 +1,80 @@
 package ports
 
+import (
+	"net"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
 // RtpClient - represents an rtp client
 type RtpClient interface {
 	Close() error
 	Write(payload []byte) (int, error)
+	// moves the stream's clock on by a frame without sending anything, so the client plays out a gap where a frame was dropped
+	Skip()
+	// sends a comfort noise packet (rfc 3389) in the place of a frame, with the level of the background noise in -dBov. The next
+	// frame written after it starts a talkspurt
+	WriteComfortNoise(payloadType uint8, level uint8) (int, error)
+	// sends a packet as it is, but with our ssrc, ie reflecting the caller's own packets back to them
+	WritePacket(pkt *rtp.Packet) (int, error)
+	// the payload type Write sends the audio as, PCMU until it is set
+	SetPayloadType(payloadType uint8)
 	// TODO not sure this is how we want to do this. can just use the mediaOptions to get the buffer size
 	// returns a buffer of the proper size for an rtp packet
-	GetBuffer() ([]byte, error)
+	GetBuffer() []byte
+	// retargets the stream, for when the client's media turns out to come from somewhere other than its sdp said
+	SetRemoteAddr(addr *net.UDPAddr)
+	// what has been sent so far, for rtcp sender reports
+	Stats() RtpSenderStats
+	// encrypts the rest of the stream, for calls that negotiated srtp
+	SetSrtp(session SrtpSession)
+}
+
+// RtpSenderStats - the state of an outbound rtp stream
+type RtpSenderStats struct {
+	SSRC uint32
+	// the number of packets and payload octets sent since the stream started
+	PacketCount uint32
+	OctetCount  uint32
+	// the rtp timestamp of the latest frame and the moment it was due, which ties the stream's clock to the wall clock
+	Timestamp   uint32
+	TimestampAt time.Time
+	// the units of the rtp timestamp per second, ie 8000 for g711
+	ClockRateHz int
+}
+
+// RtpLatchHandler - is called with the address an rtp stream actually comes from
+type RtpLatchHandler func(addr *net.UDPAddr)
+
+// RtpPacketHandler - is called with every inbound rtp packet, in sequence number order
+type RtpPacketHandler func(pkt *rtp.Packet)
+
+// RtpReceiver - listens on a local port for an inbound rtp stream
+type RtpReceiver interface {
+	// the local address the receiver is bound to, this is what we advertise in our sdp
+	LocalAddr() *net.UDPAddr
+	// starts reading packets, handing them to the handler in order
+	Start(handler RtpPacketHandler)
+	// calls the handler when the stream's first packet arrives and whenever it moves to a new address. Must be called before Start
+	OnLatch(handler RtpLatchHandler)
+	// calls the handler with every packet of the stream the moment it arrives, before it is put in order, ie for measuring jitter. Must be called before Start
+	OnArrival(handler RtpPacketHandler)
+	// only takes packets that decrypt with the session, for calls that negotiated srtp. Must be called before Start
+	SetSrtp(session SrtpSession)
+	// where the stream is coming from, nil until the first packet arrives
+	RemoteAddr() *net.UDPAddr
+	// the number of packets that never arrived in time to be played out
+	Lost() uint32
+	Close() error
+}
+
+// PortAllocator - hands out rtp/rtcp socket pairs from a range of ports
+type PortAllocator interface {
+	// binds an rtp socket on an even port and an rtcp socket on the port above it
+	Allocate() (rtp *net.UDPConn, rtcp *net.UDPConn, err error)
+	// returns a pair to the pool once both sockets are closed
+	Release(port int)
+	// the address the sockets are bound to, unspecified when bound to every interface
+	IP() net.IP
 }
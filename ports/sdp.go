@@ -1,27 +1,157 @@
 package ports
 
 import (
+	"net"
+
 	"github.com/jart/gosip/sdp"
 )
 
+// SdpMessage - a session description (rfc 4566), either a client's or one we built
 type SdpMessage interface {
+	// turns the sdp into its body
+	String() string
+
 	// gets the uri where the server should send media to as indicated in the sdp message
-	getMediaAddress() string
+	GetMediaAddress() string
 
 	// determines if the provided codec is supported as indicated in the sdp message
-	isCodecSupported(sdp.Codec) bool
+	IsCodecSupported(sdp.Codec) bool
 
-	// create a sdp response based on the sdp message
-	newSdpResponse(acceptedCodecs ...sdp.Codec) SdpMessage
+	// create a sdp response based on the sdp message, with the address we receive media on and the codecs we accept
+	NewSdpResponse(localAddr *net.UDPAddr, acceptedCodecs ...sdp.Codec) (SdpMessage, error)
 
 	// gets the uri where the server should send rtcp info to as indicated in the sdp message
-	getRtcpAddress() string
+	GetRtcpAddress() string
 
 	// gets the ssrc (helps identify the source of the rtp stream) as indicated in the sdp message
-	getSsrc() uint32
+	GetSsrc() uint32
 	// gets the cname (used to associate a ssrc with a particual user or device) as indicated in the sdp message
-	getCname() string
+	GetCname() string
 
 	// determines if the sdp message is a request (sent from a client) or a response (sent from our server)
-	isRequest() bool
+	IsRequest() bool
+
+	// the direction of the audio: sendrecv, sendonly, recvonly or inactive
+	GetDirection() string
+
+	// the attributes that apply to the whole session, ie the a= lines before the first m= line
+	GetSessionAttributes() *SdpAttributes
+	// the attributes of the first m= line of the media type (audio, video, etc), or nil if there isn't one
+	GetMediaAttributes(media string) *SdpMediaAttributes
+}
+
+// SdpAttribute - a single a= line. Flags like `a=sendrecv` have an empty value
+type SdpAttribute struct {
+	Name  string
+	Value string
+}
+
+// SdpRtcp - where to send rtcp, from `a=rtcp:<port> [<nettype> <addrtype> <addr>]` (rfc 3605)
+type SdpRtcp struct {
+	Port int
+	// IN
+	NetType string
+	// IP4 or IP6
+	AddrType string
+	// when the attribute leaves the address out, it is the connection address of the media
+	Addr string
+}
+
+// SdpSsrc - a source in the stream, from `a=ssrc:<ssrc> <name>[:<value>]` (rfc 5576). Each source can have many lines, ie cname, msid, label
+type SdpSsrc struct {
+	ID         uint32
+	Attributes []SdpAttribute
+}
+
+// Cname - the canonical name of the source, used to tie its rtp to rtcp reports
+func (s *SdpSsrc) Cname() string {
+	for _, a := range s.Attributes {
+		if a.Name == "cname" {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// SdpRtcpFeedback - an rtcp feedback message the sender supports, from `a=rtcp-fb:<pt> <type> [<param>]` (rfc 4585). The payload type is `*` when it applies to all of them
+type SdpRtcpFeedback struct {
+	PayloadType string
+	Type        string
+	Param       string
+}
+
+// SdpCrypto - an sdes key for srtp, from `a=crypto:<tag> <suite> inline:<key and salt>[|<lifetime>][|<mki>:<length>] [<session params>]` (rfc 4568)
+type SdpCrypto struct {
+	// identifies the line, the answer uses the tag of the offer's line it picked
+	Tag   int
+	Suite string
+	// the master key followed by the master salt, decoded from base64
+	Key []byte
+	// how many packets the key may protect, ie 2^20. Empty when not given
+	Lifetime string
+	// the master key identifier and its length in the packets, ie 1:4. Empty when the key doesn't have one
+	Mki string
+	// ie UNENCRYPTED_SRTP or KDR=1
+	SessionParams []string
+}
+
+// SdpAttributes - every a= line at one level of the sdp, with the ones we care about parsed out
+type SdpAttributes struct {
+	// every attribute in the order it appeared, including the ones that are parsed below and ones we don't know
+	All []SdpAttribute
+	// nil when there is no a=rtcp
+	Rtcp   *SdpRtcp
+	Ssrcs  []SdpSsrc
+	RtcpFb []SdpRtcpFeedback
+	// the sdes keys offered for srtp, in the order the sender prefers them
+	Crypto []SdpCrypto
+	// the rtcp extended reports the sender wants (rfc 3611), ie `a=rtcp-xr:rcvr-rtt=all:10000 voip-metrics` is {rcvr-rtt all:10000} {voip-metrics ""}
+	RtcpXr []SdpAttribute
+	// whether the session is being recorded: on, off or paused (rfc 7866). Empty when not given
+	Record string
+	// sendrecv, sendonly, recvonly or inactive. Empty when not given
+	Direction string
+}
+
+// Get - the value of the first attribute with the name
+func (a *SdpAttributes) Get(name string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+
+	for _, attr := range a.All {
+		if attr.Name == name {
+			return attr.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// GetAll - the values of every attribute with the name, ie all the a=rtpmap lines
+func (a *SdpAttributes) GetAll(name string) []string {
+	if a == nil {
+		return nil
+	}
+
+	var values []string
+	for _, attr := range a.All {
+		if attr.Name == name {
+			values = append(values, attr.Value)
+		}
+	}
+
+	return values
+}
+
+// SdpMediaAttributes - the attributes of a single m= line
+type SdpMediaAttributes struct {
+	// audio, video, application, etc
+	Media string
+	// the transport from the m= line, ie RTP/AVP for plain rtp or RTP/SAVP for srtp
+	Proto string
+	// the connection address for this media, from its own c= line or else the session's
+	Addr string
+	SdpAttributes
 }
@@ -1,5 +1,14 @@
 package ports
 
+// the transports sip messages come in on
+const (
+	TransportUDP = "udp"
+	TransportTLS = "tls"
+	// sip over websocket, plain and over tls (rfc 7118)
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+)
+
 type PublicServer interface {
 	Serve() error
 }
@@ -28,6 +28,10 @@ type SipMessage interface {
 	GetCallID() string
 	// where to send response packets to (or nil)
 	GetContact() *sip.Addr
+	// the logical sender of the message
+	GetFrom() *sip.Addr
+	// the logical destination of the message
+	GetTo() *sip.Addr
 	// seconds registration should expire
 	GetExpires() int
 	// the media options chosen from the sdp
@@ -38,8 +42,87 @@ type SipMessage interface {
 	GetRtcpAddress() (*net.UDPAddr, error)
 	// Get the ssrc info which includes the cname if available
 	GetSsrc() (uint32, string, error)
+	// records the address the message actually came from, filling in the Via's received and rport params for clients behind NAT
+	SetSource(addr *net.UDPAddr)
+	// the address the message came from, or nil if it didn't come off the network
+	GetSource() *net.UDPAddr
+	// the last sdp we sent in the session, so an answer to a re-INVITE keeps its session id and version
+	SetPreviousSdp(previous SdpMessage)
+	// the sdp we answered an INVITE with, nil until the response has been made
+	GetLocalSdp() SdpMessage
+	// sets the address we receive media on, advertised in the sdp of our response
+	SetLocalRtpAddr(addr *net.UDPAddr)
+	// sets our sdes key for the media, which makes the sdp of our response srtp. nil keeps it plain rtp
+	SetLocalCrypto(crypto *SdpCrypto)
+	// sets the ssrc and cname of the stream we send, announced in the sdp of our response
+	SetLocalSsrc(ssrc uint32, cname string)
+	// sets our ice and dtls parameters, which makes the sdp of our response webrtc. nil leaves them out
+	SetLocalWebRtc(params *WebRtcParams)
+	// the sdp in the body of the message
+	GetRemoteSdp() (SdpMessage, error)
+	// records what the message came in on, one of the Transport constants
+	SetTransport(transport string)
+	// what the message came in on, one of the Transport constants
+	GetTransport() string
 	// determines if the sip message is a register message with 0 expiration, indicating its meant to unregister a client
 	IsUnregister() bool
+	// determines if the sip message is a response rather than a request
+	IsResponse() bool
+	// the status code of a response
+	GetStatus() int
+	// the payload type of rfc 2833 dtmf events, if offered in the sdp message at the audio's clock rate
+	GetDtmfPayloadType() (uint8, bool)
+	// the payload type of rfc 3389 comfort noise, if offered in the sdp message at the audio's clock rate
+	GetComfortNoisePayloadType() (uint8, bool)
+	// create a request to send inside the dialog started by this message, or by our INVITE when this is the 2xx that answered it
+	NewInDialogRequest(method string, cseq int) (SipMessage, error)
+	// create the INVITE for the other leg of a call we bridge to the target, with our address on the transport in its Via and Contact
+	NewOutboundInvite(target *sip.URI, local *net.UDPAddr, transport string) (SipMessage, error)
+	// put our sdp offer, with the address and ssrc set on the INVITE, in its body
+	AddOffer() error
+	// create the ACK for a final response to our INVITE
+	NewAck(response SipMessage) (SipMessage, error)
+	// create a CANCEL for our INVITE
+	NewCancel() (SipMessage, error)
+	// the payload type of the opus or g711 audio in the sdp, which in an answer is what we send
+	GetAudioPayloadType() (uint8, bool)
+	// the payload type of opus, when it is the audio in the sdp
+	GetOpusPayloadType() (uint8, bool)
+	// how many more hops a request can take
+	GetMaxForwards() int
+	// whether the request is in a dialog already, rather than starting one
+	IsInDialog() bool
+	// the branch of the top Via, which names the transaction
+	GetBranch() string
+	// the uris of the Route headers, the next hop first
+	GetRoutes() []*sip.URI
+	// where the top Via says a response goes, and the transport it goes over
+	GetViaAddr() (*net.UDPAddr, string, error)
+	// create the request a proxy passes on to the next hop
+	NewForwardedRequest(hop ForwardHop) (SipMessage, error)
+	// create the response a proxy passes back, without its own Via
+	NewForwardedResponse() (SipMessage, error)
+	// gets a header's value, empty if it isn't set
+	GetHeader(name string) string
+	// sets a header's value
+	SetHeader(name string, value string)
+	// sets the body of the message
+	SetPayload(contentType string, body []byte)
+}
+
+// ForwardHop - where and how a proxy passes a request on
+type ForwardHop struct {
+	// the new request uri, nil to leave it as it is, ie for a request in a dialog
+	Target *sip.URI
+	// our address and the transport, for our Via and Record-Route
+	Local     *net.UDPAddr
+	Transport string
+	// the branch of our Via, which the responses come back on
+	Branch string
+	// take the top Route off, when it is us
+	PopRoute bool
+	// add our Record-Route, so the rest of the dialog comes through us too
+	RecordRoute bool
 }
 
 const (
@@ -0,0 +1,22 @@
+package ports
+
+// the sdes crypto suites for srtp (rfc 4568 and rfc 7714)
+const (
+	SrtpAesCm128HmacSha1_80 = "AES_CM_128_HMAC_SHA1_80"
+	SrtpAesCm128HmacSha1_32 = "AES_CM_128_HMAC_SHA1_32"
+	SrtpAeadAes128Gcm       = "AEAD_AES_128_GCM"
+)
+
+// SrtpSession - protects a call's media (rfc 3711). What we send is encrypted and authenticated with our key, and what the caller sends is
+// checked and decrypted with theirs. Each direction keeps its own rollover counters and replay window, so it is safe to use from the
+// goroutines that send and receive at the same time
+type SrtpSession interface {
+	// turns an rtp packet into an srtp one
+	EncryptRtp(pkt []byte) ([]byte, error)
+	// turns an srtp packet back into rtp, failing when it doesn't authenticate or has been replayed
+	DecryptRtp(pkt []byte) ([]byte, error)
+	// turns a compound rtcp packet into an srtcp one
+	EncryptRtcp(pkt []byte) ([]byte, error)
+	// turns an srtcp packet back into rtcp, failing when it doesn't authenticate or has been replayed
+	DecryptRtcp(pkt []byte) ([]byte, error)
+}
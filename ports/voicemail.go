@@ -0,0 +1,29 @@
+package ports
+
+import (
+	"time"
+)
+
+// VoicemailMessage - a message left in a mailbox
+type VoicemailMessage struct {
+	ID         string
+	Caller     string
+	ReceivedAt time.Time
+	// heard messages are kept until the owner deletes them
+	Heard bool
+	// the path to the recording
+	WavFile string
+}
+
+// MailboxStore - stores voicemail messages by mailbox
+type MailboxStore interface {
+	// the directory new messages for the mailbox should be recorded to
+	RecordingDir(mailbox string) (string, error)
+	// all messages in the mailbox, new messages first and oldest first within each group
+	List(mailbox string) ([]VoicemailMessage, error)
+	// moves a message out of the new messages
+	MarkHeard(mailbox string, id string) error
+	Delete(mailbox string, id string) error
+	// the path to the mailbox owner's greeting, or empty if they haven't recorded one
+	Greeting(mailbox string) string
+}
@@ -0,0 +1,42 @@
+package ports
+
+import (
+	"net"
+	"time"
+)
+
+// WebRtcParams - one side's ice and dtls parameters, from `a=ice-ufrag`, `a=ice-pwd`, `a=fingerprint` and `a=setup` (rfc 8839 and
+// rfc 8842)
+type WebRtcParams struct {
+	IceUfrag string
+	IcePwd   string
+	// the hash function and the certificate's hash in hex, ie sha-256 and 4A:AD:B9:...
+	FingerprintHash string
+	Fingerprint     string
+	// active, passive or actpass, which decides who starts the dtls handshake
+	Setup string
+}
+
+// MediaConn - a socket a call's media is read from and written to. A *net.UDPConn is one, and so is each half of a WebRtcTransport
+type MediaConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	// a deadline that has already passed wakes up a blocked read, which is how readers are stopped
+	SetReadDeadline(t time.Time) error
+	LocalAddr() net.Addr
+}
+
+// WebRtcTransport - carries a call's media over its rtp socket the way a browser expects (rfc 8834): ice-lite connectivity checks
+// find the caller, a dtls handshake with their certificate keys srtp, and rtp and rtcp share the one port
+type WebRtcTransport interface {
+	// our side's parameters, for the answer
+	LocalParams() *WebRtcParams
+	// starts answering the caller's checks and shaking hands with them
+	Start() error
+	// the rtp and rtcp halves of the socket. What is written to them is encrypted and goes to the address the caller nominated,
+	// whatever address it was written to, and what is read from them has been decrypted. Nothing goes out until the handshake is done
+	RtpConn() MediaConn
+	RtcpConn() MediaConn
+	// tells the caller we are done and stops reading the socket, which is left for whoever allocated it to close
+	Close() error
+}